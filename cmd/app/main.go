@@ -2,16 +2,19 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 
+	"github.com/benpsk/go-starter/internal/auth"
 	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/jobs"
+	"github.com/benpsk/go-starter/internal/mail"
 	"github.com/benpsk/go-starter/internal/postgres"
-	"github.com/benpsk/go-starter/internal/r2"
+	"github.com/benpsk/go-starter/internal/scheduler"
 	"github.com/benpsk/go-starter/internal/server"
 	"github.com/benpsk/go-starter/internal/storage"
 )
@@ -33,32 +36,71 @@ func main() {
 	}
 	defer db.Close()
 
-	store, err := newStorage(ctx, cfg)
+	reads, err := postgres.ConnectReplicas(ctx, cfg.Database, db)
+	if err != nil {
+		log.Fatalf("database replicas: %v", err)
+	}
+	defer reads.Close()
+	go reads.Run(ctx)
+
+	store, err := storage.FromConfig(ctx, cfg)
 	if err != nil {
 		log.Fatalf("storage: %v", err)
 	}
+	if cfg.Storage.Dedupe {
+		dedupe := storage.NewDedupe(store, postgres.NewBlobStore(db))
+		go dedupe.RunGC(ctx, cfg.Storage.GCInterval, cfg.Storage.GCGrace)
+		store = dedupe
+	}
 
-	r := server.NewRouter(cfg, db, store)
+	// background holds goroutines that finish their work after ctx is done
+	// and must stop before the pool closes.
+	var background sync.WaitGroup
+	jobStore := postgres.NewJobStore(db)
+	if cfg.Jobs.Workers > 0 {
+		registry := jobs.NewRegistry()
+		auth.RegisterJobs(registry, postgres.NewUserAuthStore(db), postgres.NewRateLimitStore(db), postgres.NewAbuseStore(db))
+		mailer, err := mail.FromConfig(cfg.Mail)
+		if err != nil {
+			log.Fatalf("mail: %v", err)
+		}
+		mail.RegisterJobs(registry, postgres.NewMailOutboxStore(db), mailer)
+		worker := jobs.NewWorker(jobStore, registry, jobs.WorkerOptions{
+			Concurrency:  cfg.Jobs.Workers,
+			PollInterval: cfg.Jobs.PollInterval,
+			DrainTimeout: cfg.ShutdownTimeout,
+		})
+		background.Go(func() { worker.Run(ctx) })
+	}
+	if cfg.Scheduler.Enabled {
+		sched := scheduler.New(postgres.NewSchedulerStore(db), postgres.NewAdvisoryElector(db, "scheduler"), scheduler.Options{
+			DrainTimeout: cfg.ShutdownTimeout,
+		})
+		registerScheduledTasks(sched, jobs.NewClient(jobStore))
+		background.Go(func() { sched.Run(ctx) })
+	}
+
+	r := server.NewRouter(cfg, db, reads, store)
 	srv := server.New(cfg, r)
 
 	log.Printf("Listening on %s", listenURL(cfg.HTTPAddr))
 	if err := srv.Start(ctx); err != nil {
 		log.Fatalf("server: %v", err)
 	}
+	background.Wait()
 }
 
-func newStorage(ctx context.Context, cfg config.Config) (storage.Store, error) {
-	switch cfg.Storage.Driver {
-	case "local":
-		return storage.NewLocal(cfg.Storage.LocalDir, cfg.AppURL, cfg.Storage.LocalPublicPath)
-	case "r2":
-		client, err := r2.New(ctx, cfg.R2.Endpoint, cfg.R2.Region, cfg.R2.AccessKeyID, cfg.R2.SecretAccessKey, cfg.R2.Bucket, cfg.R2.PublicBaseURL)
-		if err != nil {
-			return nil, err
+// registerScheduledTasks sets up the recurring tasks. Keep tasks short:
+// anything slow or retryable should enqueue a job instead of running inline.
+func registerScheduledTasks(sched *scheduler.Scheduler, jobClient *jobs.Client) {
+	enqueue := func(args jobs.Args) func(context.Context) error {
+		return func(ctx context.Context) error {
+			_, err := jobClient.Enqueue(ctx, args, jobs.Unique(args.Kind()))
+			return err
 		}
-		return storage.NewR2(client), nil
-	default:
-		return nil, fmt.Errorf("unsupported storage driver %q", cfg.Storage.Driver)
+	}
+	if err := sched.Register("auth.prune_expired", "@hourly", enqueue(auth.PruneExpiredArgs{})); err != nil {
+		log.Fatalf("scheduler: %v", err)
 	}
 }
 
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/abuse"
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/postgres"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const abuseUsage = "usage: %s abuse [list|allow|deny|remove|unban] [options]"
+
+func runAbuse(args []string) {
+	if len(args) < 1 {
+		log.Fatalf(abuseUsage, os.Args[0])
+	}
+	switch args[0] {
+	case "list":
+		runAbuseList(args[1:])
+	case "allow":
+		runAbuseRule(abuse.Allow, args[1:])
+	case "deny":
+		runAbuseRule(abuse.Deny, args[1:])
+	case "remove":
+		runAbuseRemove(args[1:])
+	case "unban":
+		runAbuseUnban(args[1:])
+	default:
+		log.Fatalf(abuseUsage, os.Args[0])
+	}
+}
+
+func connectAbuse(ctx context.Context) (*pgxpool.Pool, *postgres.AbuseStore) {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	pool, err := postgres.Connect(ctx, cfg.Database)
+	if err != nil {
+		log.Fatalf("database: %v", err)
+	}
+	return pool, postgres.NewAbuseStore(pool)
+}
+
+func runAbuseList(args []string) {
+	flags := flag.NewFlagSet("abuse list", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	pool, store := connectAbuse(ctx)
+	defer pool.Close()
+
+	rules, err := store.Rules(ctx)
+	if err != nil {
+		log.Fatalf("abuse list: %v", err)
+	}
+	bans, err := store.ActiveBans(ctx, time.Now())
+	if err != nil {
+		log.Fatalf("abuse list: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tNETWORK\tACTION\tCREATED\tNOTE")
+	for _, rule := range rules {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", rule.ID, rule.Network, rule.Action, rule.CreatedAt.Local().Format(time.DateTime), rule.Note)
+	}
+	fmt.Fprintln(w, "\nBANNED\tREASON\tOFFENCE\tUNTIL\t")
+	for _, ban := range bans {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t\n", ban.Key, ban.Reason, ban.Offences, ban.Until.Local().Format(time.DateTime))
+	}
+	_ = w.Flush()
+}
+
+// runAbuseRule adds or replaces an allow or deny rule. Running apps pick it
+// up within 30 seconds.
+func runAbuseRule(action abuse.Action, args []string) {
+	name := "abuse " + string(action)
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	note := flags.String("note", "", "why the rule exists")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalf("usage: %s %s [-note text] <ip|cidr>", os.Args[0], name)
+	}
+	network, err := parseNetwork(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	pool, store := connectAbuse(ctx)
+	defer pool.Close()
+
+	rule, err := store.PutRule(ctx, network, action, strings.TrimSpace(*note))
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	log.Printf("%s: rule %d %ss %s", name, rule.ID, action, rule.Network)
+}
+
+func runAbuseRemove(args []string) {
+	flags := flag.NewFlagSet("abuse remove", flag.ExitOnError)
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalf("usage: %s abuse remove <rule id>", os.Args[0])
+	}
+	id, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+	if err != nil {
+		log.Fatalf("abuse remove: invalid rule id %q", flags.Arg(0))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	pool, store := connectAbuse(ctx)
+	defer pool.Close()
+
+	if err := store.DeleteRule(ctx, id); err != nil {
+		if errors.Is(err, abuse.ErrNotFound) {
+			log.Fatalf("abuse remove: rule %d does not exist", id)
+		}
+		log.Fatalf("abuse remove: %v", err)
+	}
+	log.Printf("abuse remove: removed rule %d", id)
+}
+
+// runAbuseUnban lifts a ban and resets the client's offences. Running apps
+// stop blocking it within 30 seconds.
+func runAbuseUnban(args []string) {
+	flags := flag.NewFlagSet("abuse unban", flag.ExitOnError)
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalf("usage: %s abuse unban <ip|ipv6 /64 as listed>", os.Args[0])
+	}
+	key := strings.TrimSpace(flags.Arg(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	pool, store := connectAbuse(ctx)
+	defer pool.Close()
+
+	if err := store.Unban(ctx, key); err != nil {
+		if errors.Is(err, abuse.ErrNotFound) {
+			log.Fatalf("abuse unban: %s is not banned", key)
+		}
+		log.Fatalf("abuse unban: %v", err)
+	}
+	log.Printf("abuse unban: unbanned %s", key)
+}
+
+func parseNetwork(v string) (netip.Prefix, error) {
+	if strings.Contains(v, "/") {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%q is not an IP address or CIDR", v)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(v)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an IP address or CIDR", v)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
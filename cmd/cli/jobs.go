@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/jobs"
+	"github.com/benpsk/go-starter/internal/postgres"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func runJobs(args []string) {
+	if len(args) < 1 {
+		log.Fatalf("usage: %s jobs [list|retry|cancel] [options]", os.Args[0])
+	}
+	switch args[0] {
+	case "list":
+		runJobsList(args[1:])
+	case "retry":
+		runJobsUpdate(jobsUpdate{name: "retry", done: "requeued", notFound: "is not dead or cancelled", apply: (*postgres.JobStore).Requeue}, args[1:])
+	case "cancel":
+		runJobsUpdate(jobsUpdate{name: "cancel", done: "cancelled", notFound: "is not queued", apply: (*postgres.JobStore).Cancel}, args[1:])
+	default:
+		log.Fatalf("usage: %s jobs [list|retry|cancel] [options]", os.Args[0])
+	}
+}
+
+func connectJobs(ctx context.Context) (*pgxpool.Pool, *postgres.JobStore) {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	pool, err := postgres.Connect(ctx, cfg.Database)
+	if err != nil {
+		log.Fatalf("database: %v", err)
+	}
+	return pool, postgres.NewJobStore(pool)
+}
+
+func runJobsList(args []string) {
+	flags := flag.NewFlagSet("jobs list", flag.ExitOnError)
+	state := flags.String("state", "", "only list jobs in this state (queued, running, done, dead, cancelled)")
+	kind := flags.String("kind", "", "only list jobs of this kind")
+	limit := flags.Int("limit", 50, "maximum jobs to list")
+	_ = flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	pool, store := connectJobs(ctx)
+	defer pool.Close()
+
+	list, err := store.List(ctx, jobs.ListFilter{State: jobs.State(*state), Kind: *kind, Limit: *limit})
+	if err != nil {
+		log.Fatalf("jobs list: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tSTATE\tATTEMPTS\tRUN AT\tLAST ERROR")
+	for _, job := range list {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d/%d\t%s\t%s\n", job.ID, job.Kind, job.State, job.Attempts, job.MaxAttempts, job.RunAt.Local().Format(time.DateTime), firstLine(job.LastError))
+	}
+	_ = w.Flush()
+}
+
+type jobsUpdate struct {
+	name     string
+	done     string
+	notFound string
+	apply    func(*postgres.JobStore, context.Context, int64) error
+}
+
+// runJobsUpdate applies u to each job ID given as an argument.
+func runJobsUpdate(u jobsUpdate, args []string) {
+	name := u.name
+	flags := flag.NewFlagSet("jobs "+name, flag.ExitOnError)
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		log.Fatalf("usage: %s jobs %s <id>...", os.Args[0], name)
+	}
+	ids := make([]int64, 0, flags.NArg())
+	for _, arg := range flags.Args() {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			log.Fatalf("jobs %s: invalid job id %q", name, arg)
+		}
+		ids = append(ids, id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	pool, store := connectJobs(ctx)
+	defer pool.Close()
+
+	for _, id := range ids {
+		if err := u.apply(store, ctx, id); err != nil {
+			if errors.Is(err, jobs.ErrNotFound) {
+				log.Fatalf("jobs %s: job %d does not exist or %s", name, id, u.notFound)
+			}
+			log.Fatalf("jobs %s: %v", name, err)
+		}
+		log.Printf("jobs %s: %s job %d", name, u.done, id)
+	}
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -26,7 +26,7 @@ func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
 	if len(os.Args) < 2 {
-		log.Fatalf("usage: %s [migrate|seed|fresh|dump] [options]", os.Args[0])
+		log.Fatalf("usage: %s [migrate|seed|fresh|dump|uploads|storage|jobs|abuse] [options]", os.Args[0])
 	}
 
 	switch os.Args[1] {
@@ -38,8 +38,16 @@ func main() {
 		runFresh(os.Args[2:])
 	case "dump":
 		runDump(os.Args[2:])
+	case "uploads":
+		runUploads(os.Args[2:])
+	case "storage":
+		runStorage(os.Args[2:])
+	case "jobs":
+		runJobs(os.Args[2:])
+	case "abuse":
+		runAbuse(os.Args[2:])
 	default:
-		log.Fatalf("usage: %s [migrate|seed|fresh|dump] [options]", os.Args[0])
+		log.Fatalf("usage: %s [migrate|seed|fresh|dump|uploads|storage|jobs|abuse] [options]", os.Args[0])
 	}
 }
 
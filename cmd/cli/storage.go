@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/postgres"
+	"github.com/benpsk/go-starter/internal/storage"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// openStore builds the configured store, wrapped for deduplication when
+// STORAGE_DEDUPE is on, the same way the app does.
+func openStore(ctx context.Context, cfg config.Config, pool *pgxpool.Pool) (storage.Store, error) {
+	store, err := storage.FromConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Storage.Dedupe {
+		return storage.NewDedupe(store, postgres.NewBlobStore(pool)), nil
+	}
+	return store, nil
+}
+
+func runStorage(args []string) {
+	if len(args) < 1 {
+		log.Fatalf("usage: %s storage [gc|sync] [options]", os.Args[0])
+	}
+	switch args[0] {
+	case "gc":
+		runStorageGC(args[1:])
+	case "sync":
+		runStorageSync(args[1:])
+	default:
+		log.Fatalf("usage: %s storage [gc|sync] [options]", os.Args[0])
+	}
+}
+
+// runStorageGC deletes deduplicated blobs nothing has referenced for longer
+// than the grace period. It runs even with STORAGE_DEDUPE off so blobs left
+// from when it was on still get collected.
+func runStorageGC(args []string) {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	flags := flag.NewFlagSet("storage gc", flag.ExitOnError)
+	grace := flags.Duration("grace", cfg.Storage.GCGrace, "only delete blobs unreferenced for longer than this")
+	_ = flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	pool, err := postgres.Connect(ctx, cfg.Database)
+	if err != nil {
+		log.Fatalf("database: %v", err)
+	}
+	defer pool.Close()
+	store, err := storage.FromConfig(ctx, cfg)
+	if err != nil {
+		log.Fatalf("storage: %v", err)
+	}
+
+	removed, err := storage.NewDedupe(store, postgres.NewBlobStore(pool)).CollectGarbage(ctx, *grace)
+	if err != nil {
+		log.Fatalf("storage gc: %v", err)
+	}
+	log.Printf("storage gc: removed %d unreferenced blobs", removed)
+}
+
+// runStorageSync copies every object from one backend to another. Verified
+// copies are appended to the -state file, and a rerun with the same file
+// skips them, so an interrupted sync picks up where it stopped.
+func runStorageSync(args []string) {
+	flags := flag.NewFlagSet("storage sync", flag.ExitOnError)
+	from := flags.String("from", "", "source driver (local or r2)")
+	to := flags.String("to", "", "destination driver (local or r2)")
+	prefix := flags.String("prefix", "", "only sync keys with this prefix")
+	workers := flags.Int("workers", 8, "concurrent copies")
+	dryRun := flags.Bool("dry-run", false, "list what would be copied without writing anything")
+	statePath := flags.String("state", "", "resume state file (default storage-sync-<from>-<to>.jsonl)")
+	rewriteURLs := flags.Bool("rewrite-urls", false, "rewrite stored public URLs in known tables to the destination")
+	_ = flags.Parse(args)
+
+	if *from == "" || *to == "" || *from == *to {
+		log.Fatalf("usage: %s storage sync -from local -to r2 [options]", os.Args[0])
+	}
+	if *statePath == "" {
+		*statePath = fmt.Sprintf("storage-sync-%s-%s.jsonl", *from, *to)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	src, err := storage.FromDriver(ctx, *from, cfg)
+	if err != nil {
+		log.Fatalf("storage sync: source: %v", err)
+	}
+	dst, err := storage.FromDriver(ctx, *to, cfg)
+	if err != nil {
+		log.Fatalf("storage sync: destination: %v", err)
+	}
+
+	done, err := loadSyncState(*statePath)
+	if err != nil {
+		log.Fatalf("storage sync: %v", err)
+	}
+	opts := storage.SyncOptions{Prefix: *prefix, Workers: *workers, DryRun: *dryRun, Done: done}
+	if !*dryRun {
+		state, err := os.OpenFile(*statePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Fatalf("storage sync: open state: %v", err)
+		}
+		defer state.Close()
+		enc := json.NewEncoder(state)
+		opts.OnCopied = func(rec storage.SyncRecord) {
+			if err := enc.Encode(rec); err != nil {
+				log.Printf("storage sync: write state: %v", err)
+			}
+		}
+	}
+
+	started := time.Now()
+	report, err := storage.Sync(ctx, src, dst, opts)
+	for _, objErr := range report.Errors {
+		log.Printf("storage sync: %v", objErr)
+	}
+	verb := "copied"
+	if *dryRun {
+		verb = "would copy"
+	}
+	log.Printf("storage sync: listed %d, %s %d (%d bytes), skipped %d, failed %d in %s",
+		report.Listed, verb, report.Copied, report.Bytes, report.Skipped, report.Failed, time.Since(started).Round(time.Millisecond))
+	if err != nil {
+		log.Fatalf("storage sync: %v", err)
+	}
+	if report.Failed > 0 {
+		log.Fatalf("storage sync: %d objects failed; rerun to retry them", report.Failed)
+	}
+
+	if *rewriteURLs {
+		pool, err := postgres.Connect(ctx, cfg.Database)
+		if err != nil {
+			log.Fatalf("database: %v", err)
+		}
+		defer pool.Close()
+		oldBase, newBase := publicBaseURL(src), publicBaseURL(dst)
+		changed, err := postgres.RewriteStorageURLs(ctx, pool, oldBase, newBase, *dryRun)
+		if err != nil {
+			log.Fatalf("storage sync: rewrite urls: %v", err)
+		}
+		columns := make([]string, 0, len(changed))
+		for column := range changed {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		for _, column := range columns {
+			log.Printf("storage sync: %s: %d urls %s -> %s", column, changed[column], oldBase, newBase)
+		}
+	}
+}
+
+func loadSyncState(path string) (map[string]storage.SyncRecord, error) {
+	done := map[string]storage.SyncRecord{}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open state: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var rec storage.SyncRecord
+		// A line cut short by a crash is ignored; that object is copied again.
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			continue
+		}
+		done[storage.SyncDoneKey(rec.Visibility, rec.Key)] = rec
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	return done, nil
+}
+
+// publicBaseURL is the prefix every public URL from store starts with.
+func publicBaseURL(store storage.Store) string {
+	const probe = "storage-sync-probe"
+	return strings.TrimSuffix(store.PublicURL(probe), probe)
+}
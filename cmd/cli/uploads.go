@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/postgres"
+	"github.com/benpsk/go-starter/internal/storage"
+)
+
+func runUploads(args []string) {
+	if len(args) < 1 || args[0] != "cleanup" {
+		log.Fatalf("usage: %s uploads cleanup [options]", os.Args[0])
+	}
+	runUploadsCleanup(args[1:])
+}
+
+// runUploadsCleanup aborts resumable uploads that expired before finishing
+// and, for local storage, removes multipart directories nothing refers to.
+func runUploadsCleanup(args []string) {
+	flags := flag.NewFlagSet("uploads cleanup", flag.ExitOnError)
+	batch := flags.Int("batch", 100, "expired uploads to process per query")
+	_ = flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	pool, err := postgres.Connect(ctx, cfg.Database)
+	if err != nil {
+		log.Fatalf("database: %v", err)
+	}
+	defer pool.Close()
+	store, err := openStore(ctx, cfg, pool)
+	if err != nil {
+		log.Fatalf("storage: %v", err)
+	}
+
+	uploads := postgres.NewUploadStore(pool)
+	now := time.Now()
+	removed := 0
+	for {
+		expired, err := uploads.ListExpiredResumable(ctx, now, *batch)
+		if err != nil {
+			log.Fatalf("uploads cleanup: %v", err)
+		}
+		if len(expired) == 0 {
+			break
+		}
+		for _, res := range expired {
+			if err := store.AbortMultipart(ctx, res.StorageKey, res.StorageUploadID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Fatalf("uploads cleanup: abort upload %d: %v", res.ID, err)
+			}
+			if err := uploads.DeleteResumable(ctx, res.ID); err != nil {
+				log.Fatalf("uploads cleanup: delete upload %d: %v", res.ID, err)
+			}
+			removed++
+		}
+	}
+	log.Printf("uploads cleanup: removed %d expired uploads", removed)
+
+	if local, ok := storage.AsLocal(store); ok {
+		pruned, err := local.PruneMultipart(now.Add(-cfg.Uploads.ResumableTTL))
+		if err != nil {
+			log.Fatalf("uploads cleanup: %v", err)
+		}
+		log.Printf("uploads cleanup: pruned %d orphaned multipart directories", pruned)
+	}
+}
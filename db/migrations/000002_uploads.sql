@@ -0,0 +1,14 @@
+create table if not exists uploads (
+    id bigint generated always as identity primary key,
+    user_id bigint not null references users(id) on delete cascade,
+    storage_key text not null unique,
+    filename text not null,
+    content_type text not null,
+    size_bytes bigint not null check (size_bytes > 0),
+    status text not null default 'pending' check (status in ('pending', 'completed')),
+    created_at timestamptz not null default now(),
+    completed_at timestamptz
+);
+
+create index if not exists idx_uploads_user_id on uploads(user_id);
+create index if not exists idx_uploads_pending_created_at on uploads(created_at) where status = 'pending';
@@ -0,0 +1,4 @@
+alter table users
+    add column if not exists avatar_source text not null default 'provider'
+        check (avatar_source in ('provider', 'custom')),
+    add column if not exists avatar_keys text[] not null default '{}';
@@ -0,0 +1,11 @@
+create table if not exists resumable_uploads (
+    upload_id bigint primary key references uploads(id) on delete cascade,
+    storage_upload_id text not null,
+    part_size bigint not null check (part_size > 0),
+    offset_bytes bigint not null default 0 check (offset_bytes >= 0),
+    parts jsonb not null default '[]',
+    expires_at timestamptz not null,
+    updated_at timestamptz not null default now()
+);
+
+create index if not exists idx_resumable_uploads_expires_at on resumable_uploads(expires_at);
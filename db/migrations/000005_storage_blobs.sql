@@ -0,0 +1,23 @@
+create table if not exists storage_blobs (
+    id bigint generated always as identity primary key,
+    sha256 text not null,
+    visibility text not null check (visibility in ('public', 'private')),
+    size_bytes bigint not null check (size_bytes >= 0),
+    content_type text not null,
+    ref_count integer not null default 0 check (ref_count >= 0),
+    unreferenced_at timestamptz,
+    created_at timestamptz not null default now(),
+    unique (sha256, visibility)
+);
+
+create index if not exists idx_storage_blobs_unreferenced_at on storage_blobs(unreferenced_at) where ref_count = 0;
+
+create table if not exists storage_blob_refs (
+    visibility text not null check (visibility in ('public', 'private')),
+    key text not null,
+    blob_id bigint not null references storage_blobs(id),
+    linked_at timestamptz not null default now(),
+    primary key (visibility, key)
+);
+
+create index if not exists idx_storage_blob_refs_blob_id on storage_blob_refs(blob_id);
@@ -0,0 +1,20 @@
+create table if not exists jobs (
+    id bigint generated always as identity primary key,
+    kind text not null,
+    payload jsonb not null default '{}',
+    state text not null default 'queued' check (state in ('queued', 'running', 'done', 'dead', 'cancelled')),
+    attempts integer not null default 0 check (attempts >= 0),
+    max_attempts integer not null check (max_attempts > 0),
+    run_at timestamptz not null default now(),
+    unique_key text,
+    last_error text,
+    locked_at timestamptz,
+    created_at timestamptz not null default now(),
+    updated_at timestamptz not null default now(),
+    finished_at timestamptz
+);
+
+create index if not exists idx_jobs_queued_run_at on jobs(run_at) where state = 'queued';
+create index if not exists idx_jobs_running_locked_at on jobs(locked_at) where state = 'running';
+create index if not exists idx_jobs_state_created_at on jobs(state, created_at desc);
+create unique index if not exists idx_jobs_unique_key on jobs(unique_key) where unique_key is not null and state in ('queued', 'running');
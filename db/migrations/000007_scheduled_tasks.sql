@@ -0,0 +1,19 @@
+create table if not exists scheduled_tasks (
+    name text primary key,
+    spec text not null,
+    next_run_at timestamptz not null,
+    updated_at timestamptz not null default now()
+);
+
+create table if not exists scheduled_task_runs (
+    id bigint generated always as identity primary key,
+    task text not null references scheduled_tasks(name) on delete cascade,
+    instance text not null,
+    status text not null default 'running' check (status in ('running', 'succeeded', 'failed')),
+    error text,
+    started_at timestamptz not null default now(),
+    finished_at timestamptz,
+    duration_ms bigint
+);
+
+create index if not exists idx_scheduled_task_runs_task_started_at on scheduled_task_runs(task, started_at desc);
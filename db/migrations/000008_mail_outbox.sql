@@ -0,0 +1,15 @@
+create table if not exists mail_outbox (
+    id bigint generated always as identity primary key,
+    from_address text not null,
+    to_addresses text[] not null check (cardinality(to_addresses) > 0),
+    subject text not null,
+    html_body text not null,
+    text_body text not null,
+    state text not null default 'pending' check (state in ('pending', 'sent', 'failed')),
+    attempts integer not null default 0 check (attempts >= 0),
+    last_error text,
+    created_at timestamptz not null default now(),
+    sent_at timestamptz
+);
+
+create index if not exists idx_mail_outbox_state_created_at on mail_outbox(state, created_at desc);
@@ -0,0 +1,23 @@
+create table if not exists user_devices (
+    id bigint generated always as identity primary key,
+    user_id bigint not null references users(id) on delete cascade,
+    fingerprint text not null,
+    first_seen_at timestamptz not null default now(),
+    last_seen_at timestamptz not null default now(),
+    unique (user_id, fingerprint)
+);
+
+create table if not exists security_events (
+    id bigint generated always as identity primary key,
+    user_id bigint not null references users(id) on delete cascade,
+    kind text not null check (kind in ('new_device_sign_in')),
+    client text not null check (client in ('web', 'api')),
+    fingerprint text not null,
+    device text not null,
+    ip text,
+    user_agent text,
+    created_at timestamptz not null default now(),
+    reported_at timestamptz
+);
+
+create index if not exists idx_security_events_user_id_created_at on security_events(user_id, created_at desc);
@@ -0,0 +1,8 @@
+create table if not exists rate_limit_buckets (
+    key text primary key,
+    window_start timestamptz not null,
+    hits integer not null check (hits >= 0),
+    expires_at timestamptz not null
+);
+
+create index if not exists idx_rate_limit_buckets_expires_at on rate_limit_buckets(expires_at);
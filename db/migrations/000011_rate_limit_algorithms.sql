@@ -0,0 +1,7 @@
+-- State for the sliding window, sliding log and token bucket algorithms.
+-- window_start doubles as the last refill time of a token bucket.
+alter table rate_limit_buckets
+    add column if not exists previous_hits integer not null default 0 check (previous_hits >= 0),
+    add column if not exists hit_log timestamptz[] not null default '{}',
+    add column if not exists tokens double precision not null default 0,
+    add column if not exists allowed boolean not null default true;
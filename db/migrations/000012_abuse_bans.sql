@@ -0,0 +1,17 @@
+create table if not exists ip_bans (
+    key text primary key,
+    reason text not null,
+    offences integer not null default 1 check (offences > 0),
+    banned_at timestamptz not null,
+    banned_until timestamptz not null
+);
+
+create index if not exists idx_ip_bans_banned_until on ip_bans(banned_until);
+
+create table if not exists ip_rules (
+    id bigint generated always as identity primary key,
+    network cidr not null unique,
+    action text not null check (action in ('allow', 'deny')),
+    note text not null default '',
+    created_at timestamptz not null default now()
+);
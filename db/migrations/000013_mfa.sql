@@ -0,0 +1,18 @@
+create table if not exists user_mfa (
+    user_id bigint primary key references users(id) on delete cascade,
+    secret_ciphertext bytea not null,
+    confirmed_at timestamptz,
+    last_used_step bigint not null default 0,
+    created_at timestamptz not null default now()
+);
+
+create table if not exists user_recovery_codes (
+    id bigint generated always as identity primary key,
+    user_id bigint not null references users(id) on delete cascade,
+    code_hash text not null,
+    used_at timestamptz,
+    created_at timestamptz not null default now(),
+    unique (user_id, code_hash)
+);
+
+alter table user_sessions add column if not exists mfa_pending boolean not null default false;
@@ -0,0 +1,15 @@
+create table if not exists webauthn_credentials (
+    id bigint generated always as identity primary key,
+    user_id bigint not null references users(id) on delete cascade,
+    credential_id bytea not null unique,
+    public_key bytea not null,
+    sign_count bigint not null default 0,
+    transports text[] not null default '{}',
+    backup_eligible boolean not null default false,
+    backed_up boolean not null default false,
+    name text not null default '',
+    created_at timestamptz not null default now(),
+    last_used_at timestamptz
+);
+
+create index if not exists idx_webauthn_credentials_user_id on webauthn_credentials(user_id);
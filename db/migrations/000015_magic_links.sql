@@ -0,0 +1,16 @@
+-- Set when the address was proven by a provider or a magic link. Existing
+-- emails are not backfilled: some were stored while the provider reported
+-- them unverified, so they are verified on the next sign-in that says so.
+alter table users add column if not exists email_verified_at timestamptz;
+
+create table if not exists magic_links (
+    id bigint generated always as identity primary key,
+    email text not null,
+    token_hash text not null unique,
+    redirect_to text not null default '',
+    expires_at timestamptz not null,
+    created_at timestamptz not null default now(),
+    used_at timestamptz
+);
+
+create index if not exists idx_magic_links_expires_at on magic_links(expires_at);
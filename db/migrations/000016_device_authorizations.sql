@@ -0,0 +1,17 @@
+-- RFC 8628 device authorization grants. The CLI polls with device_code
+-- (stored hashed) while the user approves user_code on /device.
+create table if not exists device_authorizations (
+    id bigint generated always as identity primary key,
+    device_code_hash text not null unique,
+    user_code text not null unique,
+    client_id text not null,
+    user_id bigint references users(id) on delete cascade,
+    status text not null default 'pending' check (status in ('pending', 'approved', 'denied', 'consumed')),
+    interval_seconds integer not null,
+    last_polled_at timestamptz,
+    expires_at timestamptz not null,
+    created_at timestamptz not null default now(),
+    decided_at timestamptz
+);
+
+create index if not exists idx_device_authorizations_expires_at on device_authorizations(expires_at);
@@ -0,0 +1,5 @@
+-- Bytes received past the last whole part of a resumable upload. They are
+-- held here until a PATCH completes the part, since storage rejects short
+-- parts anywhere but at the end.
+alter table resumable_uploads
+    add column if not exists tail bytea not null default ''::bytea;
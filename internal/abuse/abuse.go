@@ -0,0 +1,256 @@
+// Package abuse bans client IPs that keep failing authentication checks.
+package abuse
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/forwarded"
+)
+
+var ErrNotFound = errors.New("abuse rule or ban not found")
+
+// DefaultForgetAfter is how long a client must stay clean after a ban for
+// its next ban to start short again.
+const DefaultForgetAfter = 7 * 24 * time.Hour
+
+// Kind is a failure that counts towards a ban.
+type Kind string
+
+const (
+	OAuthFailure        Kind = "oauth_failure"
+	InvalidRefreshToken Kind = "invalid_refresh_token"
+	CSRFFailure         Kind = "csrf_failure"
+	MFAFailure          Kind = "mfa_failure"
+	PasskeyFailure      Kind = "passkey_failure"
+	MagicLinkFailure    Kind = "magic_link_failure"
+	DeviceCodeFailure   Kind = "device_code_failure"
+)
+
+type Action string
+
+const (
+	// Allow exempts a network from bans and failure counting.
+	Allow Action = "allow"
+	// Deny blocks a network until the rule is removed.
+	Deny Action = "deny"
+)
+
+// Rule is a manual allow or deny list entry.
+type Rule struct {
+	ID        int64
+	Network   netip.Prefix
+	Action    Action
+	Note      string
+	CreatedAt time.Time
+}
+
+// Ban blocks one client key, as returned by forwarded.ClientKey, until
+// Until. Offences counts the bans in a row that escalated to this one.
+type Ban struct {
+	Key       string
+	Reason    string
+	Offences  int
+	Until     time.Time
+	CreatedAt time.Time
+}
+
+// Store keeps failure counts, bans and rules where every replica sees them.
+// The Postgres implementation is postgres.AbuseStore.
+type Store interface {
+	// AddFailure counts a failure for key and returns the failures within
+	// the last window, including this one.
+	AddFailure(ctx context.Context, key string, now time.Time, window time.Duration) (int, error)
+	// Ban bans key from now. The first ban lasts base; each ban that starts
+	// within forgetAfter of the previous one ending lasts four times as
+	// long, up to max. A ban that is still active is returned unchanged.
+	Ban(ctx context.Context, key, reason string, now time.Time, base, max, forgetAfter time.Duration) (Ban, error)
+	ActiveBans(ctx context.Context, now time.Time) ([]Ban, error)
+	Rules(ctx context.Context) ([]Rule, error)
+}
+
+type Options struct {
+	// Threshold failures within Window ban a client. Zero disables
+	// automatic bans; rules still apply.
+	Threshold int
+	Window    time.Duration
+	// BanDuration is the first ban; repeat offences escalate up to
+	// MaxBanDuration.
+	BanDuration    time.Duration
+	MaxBanDuration time.Duration
+	// ForgetAfter is how long a client must stay clean after a ban for the
+	// next one to start again at BanDuration.
+	ForgetAfter time.Duration
+	// Refresh is how often bans and rules made elsewhere are reloaded.
+	Refresh time.Duration
+}
+
+// Detector counts failures reported by handlers and blocks banned clients.
+// Bans and rules are cached in memory and reloaded every Options.Refresh,
+// so checking a request costs no database round-trip.
+type Detector struct {
+	store Store
+	opts  Options
+	now   func() time.Time
+
+	mu       sync.Mutex
+	bans     map[string]time.Time
+	rules    []Rule
+	loadedAt time.Time
+	loading  bool
+}
+
+func NewDetector(store Store, opts Options) *Detector {
+	if opts.Window <= 0 {
+		opts.Window = 10 * time.Minute
+	}
+	if opts.BanDuration <= 0 {
+		opts.BanDuration = 15 * time.Minute
+	}
+	if opts.MaxBanDuration < opts.BanDuration {
+		opts.MaxBanDuration = opts.BanDuration
+	}
+	if opts.ForgetAfter <= 0 {
+		opts.ForgetAfter = DefaultForgetAfter
+	}
+	if opts.Refresh <= 0 {
+		opts.Refresh = 30 * time.Second
+	}
+	return &Detector{store: store, opts: opts, now: time.Now, bans: make(map[string]time.Time)}
+}
+
+func (d *Detector) SetNowForTest(now func() time.Time) {
+	if now != nil {
+		d.now = now
+	}
+}
+
+// Report counts a failure of kind from r's client and bans the client once
+// it reaches the threshold. Store errors are logged, not returned, so
+// callers can report on their error paths without more error handling.
+func (d *Detector) Report(r *http.Request, kind Kind) {
+	if d == nil || d.opts.Threshold <= 0 {
+		return
+	}
+	ip := clientIP(r)
+	ctx := r.Context()
+	now := d.now()
+	d.refresh(ctx, now)
+	if action, _ := d.rule(ip); action == Allow {
+		return
+	}
+	key := forwarded.ClientKey(ip.String())
+	count, err := d.store.AddFailure(ctx, key, now, d.opts.Window)
+	if err != nil {
+		log.Printf("abuse: count %s for %s: %v", kind, key, err)
+		return
+	}
+	if count < d.opts.Threshold {
+		return
+	}
+	ban, err := d.store.Ban(ctx, key, string(kind), now, d.opts.BanDuration, d.opts.MaxBanDuration, d.opts.ForgetAfter)
+	if err != nil {
+		log.Printf("abuse: ban %s: %v", key, err)
+		return
+	}
+	log.Printf("abuse: banned %s until %s after %d failures (%s, offence %d)", key, ban.Until.Format(time.RFC3339), count, kind, ban.Offences)
+	d.mu.Lock()
+	d.bans[key] = ban.Until
+	d.mu.Unlock()
+}
+
+// Blocked reports whether r's client is denied or banned. until is zero
+// for deny rules, which do not expire.
+func (d *Detector) Blocked(r *http.Request) (blocked bool, until time.Time) {
+	if d == nil {
+		return false, time.Time{}
+	}
+	ip := clientIP(r)
+	now := d.now()
+	d.refresh(r.Context(), now)
+	switch action, _ := d.rule(ip); action {
+	case Allow:
+		return false, time.Time{}
+	case Deny:
+		return true, time.Time{}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	until, ok := d.bans[forwarded.ClientKey(ip.String())]
+	if !ok || !now.Before(until) {
+		return false, time.Time{}
+	}
+	return true, until
+}
+
+// Middleware hands blocked requests to onBlocked instead of next.
+func (d *Detector) Middleware(onBlocked func(w http.ResponseWriter, r *http.Request, until time.Time)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if blocked, until := d.Blocked(r); blocked {
+				onBlocked(w, r, until)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rule returns the action of the most specific rule matching ip.
+func (d *Detector) rule(ip netip.Addr) (Action, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var (
+		match Rule
+		found bool
+	)
+	for _, rule := range d.rules {
+		if rule.Network.Contains(ip) && (!found || rule.Network.Bits() > match.Network.Bits()) {
+			match, found = rule, true
+		}
+	}
+	return match.Action, found
+}
+
+// refresh reloads bans and rules when they are older than Options.Refresh.
+// Only one caller reloads; the others keep using the cached copy.
+func (d *Detector) refresh(ctx context.Context, now time.Time) {
+	d.mu.Lock()
+	if d.loading || now.Sub(d.loadedAt) < d.opts.Refresh {
+		d.mu.Unlock()
+		return
+	}
+	d.loading = true
+	d.mu.Unlock()
+
+	bans, banErr := d.store.ActiveBans(ctx, now)
+	rules, ruleErr := d.store.Rules(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.loading = false
+	d.loadedAt = now
+	if banErr != nil || ruleErr != nil {
+		// Keep the cached copy until the next refresh.
+		log.Printf("abuse: reload bans and rules: %v", errors.Join(banErr, ruleErr))
+		return
+	}
+	d.bans = make(map[string]time.Time, len(bans))
+	for _, ban := range bans {
+		d.bans[ban.Key] = ban.Until
+	}
+	d.rules = rules
+}
+
+func clientIP(r *http.Request) netip.Addr {
+	if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return addr.Addr().Unmap()
+	}
+	addr, _ := netip.ParseAddr(r.RemoteAddr)
+	return addr.Unmap()
+}
@@ -0,0 +1,182 @@
+package abuse
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type fakeStore struct {
+	failures map[string]int
+	bans     map[string]Ban
+	rules    []Rule
+	loads    int
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{failures: make(map[string]int), bans: make(map[string]Ban)}
+}
+
+func (s *fakeStore) AddFailure(_ context.Context, key string, _ time.Time, _ time.Duration) (int, error) {
+	s.failures[key]++
+	return s.failures[key], nil
+}
+
+func (s *fakeStore) Ban(_ context.Context, key, reason string, now time.Time, base, _, _ time.Duration) (Ban, error) {
+	ban := Ban{Key: key, Reason: reason, Offences: s.bans[key].Offences + 1, Until: now.Add(base), CreatedAt: now}
+	s.bans[key] = ban
+	return ban, nil
+}
+
+func (s *fakeStore) ActiveBans(_ context.Context, now time.Time) ([]Ban, error) {
+	s.loads++
+	var bans []Ban
+	for _, ban := range s.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	return bans, nil
+}
+
+func (s *fakeStore) Rules(context.Context) ([]Rule, error) {
+	return s.rules, nil
+}
+
+func request(remoteAddr string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = remoteAddr
+	return r
+}
+
+func TestDetectorBansAfterThreshold(t *testing.T) {
+	t.Parallel()
+
+	store := newFakeStore()
+	d := NewDetector(store, Options{Threshold: 3, BanDuration: 15 * time.Minute})
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	d.SetNowForTest(func() time.Time { return now })
+
+	r := request("198.51.100.7:4000")
+	for range 2 {
+		d.Report(r, OAuthFailure)
+	}
+	if blocked, _ := d.Blocked(r); blocked {
+		t.Fatal("client should not be banned below the threshold")
+	}
+	d.Report(r, CSRFFailure)
+	blocked, until := d.Blocked(r)
+	if !blocked || !until.Equal(now.Add(15*time.Minute)) {
+		t.Fatalf("expected a ban until %s: blocked=%v until=%s", now.Add(15*time.Minute), blocked, until)
+	}
+	if ban := store.bans["198.51.100.7"]; ban.Reason != string(CSRFFailure) {
+		t.Fatalf("ban reason = %q, want %q", ban.Reason, CSRFFailure)
+	}
+	if blocked, _ := d.Blocked(request("198.51.100.8:4000")); blocked {
+		t.Fatal("other clients should not be banned")
+	}
+
+	now = now.Add(16 * time.Minute)
+	if blocked, _ := d.Blocked(r); blocked {
+		t.Fatal("ban should expire")
+	}
+}
+
+func TestDetectorBansIPv6ClientsBySlash64(t *testing.T) {
+	t.Parallel()
+
+	store := newFakeStore()
+	d := NewDetector(store, Options{Threshold: 2})
+	d.Report(request("[2001:db8:1:2::1]:4000"), InvalidRefreshToken)
+	d.Report(request("[2001:db8:1:2::ff]:4000"), InvalidRefreshToken)
+
+	if blocked, _ := d.Blocked(request("[2001:db8:1:2::abcd]:4000")); !blocked {
+		t.Fatal("addresses in a banned /64 should be blocked")
+	}
+	if blocked, _ := d.Blocked(request("[2001:db8:1:3::1]:4000")); blocked {
+		t.Fatal("other /64 networks should not be blocked")
+	}
+}
+
+func TestDetectorRules(t *testing.T) {
+	t.Parallel()
+
+	store := newFakeStore()
+	store.rules = []Rule{
+		{Network: netip.MustParsePrefix("203.0.113.0/24"), Action: Deny},
+		{Network: netip.MustParsePrefix("203.0.113.5/32"), Action: Allow},
+		{Network: netip.MustParsePrefix("192.0.2.0/24"), Action: Allow},
+	}
+	d := NewDetector(store, Options{Threshold: 1})
+
+	if blocked, until := d.Blocked(request("203.0.113.9:4000")); !blocked || !until.IsZero() {
+		t.Fatalf("denied network should be blocked without expiry: blocked=%v until=%s", blocked, until)
+	}
+	if blocked, _ := d.Blocked(request("203.0.113.5:4000")); blocked {
+		t.Fatal("the most specific rule should win")
+	}
+
+	allowed := request("192.0.2.10:4000")
+	d.Report(allowed, OAuthFailure)
+	if len(store.failures) != 0 {
+		t.Fatalf("allowed clients should not be counted: %v", store.failures)
+	}
+	if blocked, _ := d.Blocked(allowed); blocked {
+		t.Fatal("allowed clients should not be banned")
+	}
+}
+
+func TestDetectorReloadsAfterRefresh(t *testing.T) {
+	t.Parallel()
+
+	store := newFakeStore()
+	d := NewDetector(store, Options{Threshold: 5, Refresh: 30 * time.Second})
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	d.SetNowForTest(func() time.Time { return now })
+
+	r := request("198.51.100.7:4000")
+	if blocked, _ := d.Blocked(r); blocked {
+		t.Fatal("client should not start banned")
+	}
+	// Another replica bans the client.
+	store.bans["198.51.100.7"] = Ban{Key: "198.51.100.7", Until: now.Add(time.Hour)}
+
+	now = now.Add(10 * time.Second)
+	if blocked, _ := d.Blocked(r); blocked {
+		t.Fatal("cached bans should be used until the refresh interval passes")
+	}
+	now = now.Add(30 * time.Second)
+	if blocked, _ := d.Blocked(r); !blocked {
+		t.Fatal("bans made elsewhere should be picked up after a refresh")
+	}
+	if store.loads != 2 {
+		t.Fatalf("loads = %d, want 2", store.loads)
+	}
+}
+
+func TestDetectorMiddleware(t *testing.T) {
+	t.Parallel()
+
+	store := newFakeStore()
+	store.rules = []Rule{{Network: netip.MustParsePrefix("203.0.113.0/24"), Action: Deny}}
+	d := NewDetector(store, Options{})
+	handler := d.Middleware(func(w http.ResponseWriter, r *http.Request, until time.Time) {
+		w.WriteHeader(http.StatusForbidden)
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, request("203.0.113.9:4000"))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("denied client: status = %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, request("198.51.100.1:4000"))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("other client: status = %d", rec.Code)
+	}
+}
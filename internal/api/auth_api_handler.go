@@ -8,7 +8,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/benpsk/go-starter/internal/abuse"
 	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/postgres"
 	"github.com/benpsk/go-starter/internal/user"
 	"github.com/go-chi/chi/v5"
 )
@@ -17,12 +19,19 @@ type apiAuthContextKey string
 
 const apiAuthClaimsKey apiAuthContextKey = "api_auth_claims"
 
+var errIssueAPITokens = errors.New("issue api tokens")
+
 type loginRequest struct {
 	Code         string `json:"code"`
 	CodeVerifier string `json:"code_verifier"`
 	RedirectURI  string `json:"redirect_uri"`
 }
 
+type mfaRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
 type refreshRequest struct {
 	RefreshToken string `json:"refresh_token"`
 }
@@ -62,25 +71,115 @@ func (h Handler) login(w http.ResponseWriter, r *http.Request) {
 
 	profile, err := h.auth.ExchangeAndVerify(r.Context(), provider, req.Code, req.CodeVerifier, strings.TrimSpace(req.RedirectURI), cfg)
 	if err != nil {
+		h.reportAbuse(r, abuse.OAuthFailure)
 		writeErrorJSON(w, http.StatusUnauthorized, "oauth login failed")
 		return
 	}
-	currentUser, err := h.auth.FindOrCreateSocialUser(r.Context(), profile)
+	var currentUser user.User
+	var resp auth.APITokenResponse
+	var mfaRequired bool
+	err = h.auth.InTx(r.Context(), func(ctx context.Context) error {
+		var err error
+		currentUser, err = h.auth.FindOrCreateSocialUser(ctx, profile)
+		if err != nil {
+			return err
+		}
+		if err := h.auth.RecordSignIn(ctx, currentUser, auth.RequestMetaFromRequest(r), auth.ClientAPI); err != nil {
+			return err
+		}
+		mfaRequired, err = h.auth.MFARequired(ctx, currentUser.ID)
+		if err != nil || mfaRequired {
+			return err
+		}
+		resp, err = h.auth.IssueAPITokenPair(ctx, currentUser.ID, time.Now())
+		if err != nil {
+			return errors.Join(errIssueAPITokens, err)
+		}
+		return nil
+	})
 	if err != nil {
 		if errors.Is(err, user.ErrEmailConflict) {
 			writeErrorJSON(w, http.StatusConflict, "account email is already used by another provider")
 			return
 		}
+		if errors.Is(err, errIssueAPITokens) {
+			writeErrorJSON(w, http.StatusInternalServerError, "failed to issue tokens")
+			return
+		}
 		writeErrorJSON(w, http.StatusInternalServerError, "failed to sign in user")
 		return
 	}
+	if mfaRequired {
+		token, expiresAt, err := h.auth.IssueMFAChallenge(currentUser.ID, time.Now())
+		if err != nil {
+			writeErrorJSON(w, http.StatusInternalServerError, "failed to issue tokens")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"mfa_required":         true,
+			"mfa_token":            token,
+			"mfa_token_expires_at": expiresAt,
+		})
+		return
+	}
+	h.writeLoginTokens(w, r, currentUser, resp)
+}
 
-	resp, err := h.auth.IssueAPITokenPair(r.Context(), currentUser.ID, time.Now())
+// verifyMFA exchanges the mfa_token from login and a TOTP or recovery code
+// for the API tokens login would otherwise have returned.
+func (h Handler) verifyMFA(w http.ResponseWriter, r *http.Request) {
+	if !h.auth.APIAuthConfigured() {
+		writeErrorJSON(w, http.StatusServiceUnavailable, "api auth is not configured")
+		return
+	}
+	var req mfaRequest
+	if err := decodeJSONWithLimit(w, r, &req, defaultRequestBodyLimitBytes); err != nil {
+		if isRequestBodyTooLarge(err) {
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		writeErrorJSON(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if strings.TrimSpace(req.MFAToken) == "" || strings.TrimSpace(req.Code) == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "mfa_token and code are required")
+		return
+	}
+	userID, err := h.auth.ParseMFAChallenge(req.MFAToken)
+	if err != nil {
+		h.reportAbuse(r, abuse.MFAFailure)
+		writeErrorJSON(w, http.StatusUnauthorized, "invalid mfa token")
+		return
+	}
+	now := time.Now()
+	if err := h.auth.VerifyMFA(r.Context(), userID, req.Code, now); err != nil {
+		if errors.Is(err, auth.ErrInvalidMFACode) {
+			h.reportAbuse(r, abuse.MFAFailure)
+			writeErrorJSON(w, http.StatusUnauthorized, "invalid code")
+			return
+		}
+		writeErrorJSON(w, http.StatusInternalServerError, "failed to verify code")
+		return
+	}
+	// The user may have been created by the login that issued mfa_token.
+	currentUser, err := h.auth.Users().FindByID(postgres.WithPrimaryReads(r.Context()), userID)
+	if err != nil {
+		writeErrorJSON(w, http.StatusUnauthorized, "user not found")
+		return
+	}
+	resp, err := h.auth.IssueAPITokenPair(r.Context(), currentUser.ID, now)
 	if err != nil {
 		writeErrorJSON(w, http.StatusInternalServerError, "failed to issue tokens")
 		return
 	}
+	h.writeLoginTokens(w, r, currentUser, resp)
+}
+
+func (h Handler) writeLoginTokens(w http.ResponseWriter, r *http.Request, currentUser user.User, resp auth.APITokenResponse) {
 	h.auth.SetAPIRefreshCookie(w, r, resp.RefreshToken, resp.RefreshTokenExpiresAt)
+	// Browser clients echo this cookie in X-CSRF-Token when refreshing or
+	// logging out with the refresh cookie.
+	h.auth.RotateCSRFCookie(w, r, h.auth.SessionTokenFromRequest(r))
 	writeJSON(w, http.StatusOK, map[string]any{
 		"token_type":               resp.TokenType,
 		"access_token":             resp.AccessToken,
@@ -120,6 +219,9 @@ func (h Handler) refresh(w http.ResponseWriter, r *http.Request) {
 	}
 	resp, err := h.auth.RotateAPIRefreshToken(r.Context(), refreshToken, time.Now())
 	if err != nil {
+		if errors.Is(err, auth.ErrInvalidRefreshToken) {
+			h.reportAbuse(r, abuse.InvalidRefreshToken)
+		}
 		writeErrorJSON(w, http.StatusUnauthorized, "invalid refresh token")
 		return
 	}
@@ -145,6 +247,7 @@ func (h Handler) logout(w http.ResponseWriter, r *http.Request) {
 		_ = h.auth.Users().RevokeAPIRefreshTokenByHash(r.Context(), auth.HashToken(refreshToken), time.Now())
 	}
 	h.auth.ClearAPIRefreshCookie(w, r)
+	h.auth.RotateCSRFCookie(w, r, h.auth.SessionTokenFromRequest(r))
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -154,7 +257,8 @@ func (h Handler) me(w http.ResponseWriter, r *http.Request) {
 		writeErrorJSON(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	currentUser, err := h.auth.Users().FindByID(r.Context(), claims.UserID)
+	// Clients call this right after login, which may have created the user.
+	currentUser, err := h.auth.Users().FindByID(postgres.WithPrimaryReads(r.Context()), claims.UserID)
 	if err != nil {
 		writeErrorJSON(w, http.StatusUnauthorized, "user not found")
 		return
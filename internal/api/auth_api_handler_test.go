@@ -7,7 +7,9 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -35,6 +37,8 @@ func (f fakeSocialVerifier) ExchangeAndVerify(ctx context.Context, provider stri
 }
 
 func TestAPILoginIssuesTokensAndSetsRefreshCookie(t *testing.T) {
+	t.Parallel()
+
 	ctx, cleanup := withTx(t)
 	defer cleanup()
 
@@ -85,7 +89,61 @@ func TestAPILoginIssuesTokensAndSetsRefreshCookie(t *testing.T) {
 	assertRefreshCookieSet(t, rec, authService.APIRefreshCookieName())
 }
 
+func TestAPILoginRecordsNewDevices(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	authService := testAuthService()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	authService.SetVerifier(fakeSocialVerifier{
+		profile: user.SocialProfile{
+			Provider:       "github",
+			ProviderUserID: "api-device-" + suffix,
+			Email:          "api-device+" + suffix + "@example.com",
+			EmailVerified:  true,
+			Name:           "API Device User",
+		},
+	})
+	h := NewHandler(integrationPool, authService)
+
+	login := func(userAgent, remoteAddr string) {
+		t.Helper()
+		req := jsonRequest(t, http.MethodPost, "/api/auth/login/github", map[string]any{
+			"code":          "code",
+			"code_verifier": "verifier",
+			"redirect_uri":  "http://127.0.0.1:8080/callback",
+		})
+		req.Header.Set("User-Agent", userAgent)
+		req.RemoteAddr = remoteAddr
+		req = withURLParam(req.WithContext(ctx), "provider", "github")
+		rec := httptest.NewRecorder()
+		h.login(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("login: %d body=%s", rec.Code, rec.Body.String())
+		}
+	}
+	login("starter-ios/2.3.1 (iPhone; iOS 17.5)", "203.0.113.7:5000")
+	login("starter-ios/2.4.0 (iPhone; iOS 17.6)", "203.0.113.99:5000")
+	login("starter-android/2.4.0 (Linux; Android 14; Mobile)", "198.51.100.7:5000")
+
+	u, err := authService.Users().FindByIdentity(ctx, "github", "api-device-"+suffix)
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+	events, err := authService.SecurityEvents(ctx, u.ID)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("expected one new-device event: %+v err=%v", events, err)
+	}
+	if events[0].Client != auth.ClientAPI || events[0].Device != "starter-android on Android" || events[0].IP != "198.51.100.7" {
+		t.Fatalf("unexpected event %+v", events[0])
+	}
+}
+
 func TestAPIRefreshRotatesAndDetectsReuse(t *testing.T) {
+	t.Parallel()
+
 	ctx := context.Background()
 
 	authService := testAuthService()
@@ -132,6 +190,8 @@ func TestAPIRefreshRotatesAndDetectsReuse(t *testing.T) {
 }
 
 func TestAPILogoutRevokesRefreshToken(t *testing.T) {
+	t.Parallel()
+
 	ctx := context.Background()
 
 	authService := testAuthService()
@@ -162,6 +222,8 @@ func TestAPILogoutRevokesRefreshToken(t *testing.T) {
 }
 
 func TestAPIMeRequiresValidJWT(t *testing.T) {
+	t.Parallel()
+
 	ctx, cleanup := withTx(t)
 	defer cleanup()
 
@@ -193,6 +255,8 @@ func TestAPIMeRequiresValidJWT(t *testing.T) {
 }
 
 func TestAPILoginHandlesVerifierFailure(t *testing.T) {
+	t.Parallel()
+
 	ctx, cleanup := withTx(t)
 	defer cleanup()
 
@@ -214,8 +278,68 @@ func TestAPILoginHandlesVerifierFailure(t *testing.T) {
 	}
 }
 
+func TestAPIFailuresFromOtherSitesDoNotCountTowardsBans(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	cfg := testConfig()
+	cfg.Abuse.Threshold = 1
+	authService := auth.NewService(integrationPool, cfg)
+	h := NewHandler(integrationPool, authService)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		request func() *http.Request
+	}{
+		{
+			name:    "refresh",
+			handler: h.refresh,
+			request: func() *http.Request {
+				return jsonRequest(t, http.MethodPost, "/api/auth/refresh", map[string]any{"refresh_token": "not-a-token"})
+			},
+		},
+		{
+			name:    "mfa",
+			handler: h.verifyMFA,
+			request: func() *http.Request {
+				return jsonRequest(t, http.MethodPost, "/api/auth/mfa", map[string]any{"mfa_token": "not-a-token", "code": "123456"})
+			},
+		},
+		{
+			name:    "device token",
+			handler: h.deviceToken,
+			request: func() *http.Request {
+				form := url.Values{"grant_type": {deviceCodeGrantType}, "device_code": {"not-a-code"}, "client_id": {"starter-cli"}}
+				req := httptest.NewRequest(http.MethodPost, "/api/auth/device/token", strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return req
+			},
+		},
+	}
+	for i, tt := range tests {
+		for j, site := range []string{"cross-site", "same-origin"} {
+			req := tt.request()
+			req.Header.Set("Sec-Fetch-Site", site)
+			req.RemoteAddr = "192.0.2." + strconv.Itoa(10*i+j+1) + ":5000"
+			req = req.WithContext(ctx)
+			tt.handler(httptest.NewRecorder(), req)
+			blocked, _ := authService.Abuse().Blocked(req)
+			if want := site == "same-origin"; blocked != want {
+				t.Errorf("%s from %s: banned = %v, want %v", tt.name, site, blocked, want)
+			}
+		}
+	}
+}
+
 func testAuthService() *auth.Service {
-	cfg := config.Config{
+	return auth.NewService(integrationPool, testConfig())
+}
+
+func testConfig() config.Config {
+	return config.Config{
 		AppName: "Go Starter",
 		AppEnv:  "test",
 		AppURL:  "http://127.0.0.1:8080",
@@ -231,10 +355,11 @@ func testAuthService() *auth.Service {
 				AccessTokenTTL:    10 * time.Minute,
 				RefreshTokenTTL:   24 * time.Hour,
 				RefreshCookieName: "test_api_refresh",
+				DeviceClientIDs:   []string{"starter-cli"},
 			},
 		},
+		Mail: config.MailConfig{From: "Go Starter <no-reply@example.com>"},
 	}
-	return auth.NewService(integrationPool, cfg)
 }
 
 func jsonRequest(t *testing.T, method, path string, body any) *http.Request {
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/abuse"
+	"github.com/benpsk/go-starter/internal/auth"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// deviceCode starts an RFC 8628 device authorization for a CLI client. The
+// client shows user_code and verification_uri, then polls deviceToken.
+func (h Handler) deviceCode(w http.ResponseWriter, r *http.Request) {
+	if !h.auth.DeviceFlowEnabled() {
+		writeErrorJSON(w, http.StatusServiceUnavailable, "device flow is not configured")
+		return
+	}
+	if !parseDeviceForm(w, r) {
+		return
+	}
+	resp, err := h.auth.StartDeviceAuthorization(r.Context(), strings.TrimSpace(r.PostFormValue("client_id")), time.Now())
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidDeviceClient) {
+			writeErrorJSON(w, http.StatusUnauthorized, "invalid_client")
+			return
+		}
+		writeErrorJSON(w, http.StatusInternalServerError, "failed to start device authorization")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// deviceToken is polled by the client until the user approves or denies
+// it on /device. Errors use the RFC 8628 codes; slow_down stands in for a
+// rate limit since clients are expected to poll.
+func (h Handler) deviceToken(w http.ResponseWriter, r *http.Request) {
+	if !h.auth.DeviceFlowEnabled() {
+		writeErrorJSON(w, http.StatusServiceUnavailable, "device flow is not configured")
+		return
+	}
+	if !parseDeviceForm(w, r) {
+		return
+	}
+	if r.PostFormValue("grant_type") != deviceCodeGrantType {
+		writeErrorJSON(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	deviceCode := strings.TrimSpace(r.PostFormValue("device_code"))
+	clientID := strings.TrimSpace(r.PostFormValue("client_id"))
+	if deviceCode == "" || clientID == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	_, resp, err := h.auth.ExchangeDeviceCode(r.Context(), deviceCode, clientID, auth.RequestMetaFromRequest(r), time.Now())
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, resp)
+	case errors.Is(err, auth.ErrInvalidDeviceClient):
+		writeErrorJSON(w, http.StatusUnauthorized, "invalid_client")
+	case errors.Is(err, auth.ErrDeviceAuthorizationPending):
+		writeErrorJSON(w, http.StatusBadRequest, "authorization_pending")
+	case errors.Is(err, auth.ErrDeviceSlowDown):
+		writeErrorJSON(w, http.StatusBadRequest, "slow_down")
+	case errors.Is(err, auth.ErrDeviceAccessDenied):
+		writeErrorJSON(w, http.StatusBadRequest, "access_denied")
+	case errors.Is(err, auth.ErrDeviceCodeExpired):
+		writeErrorJSON(w, http.StatusBadRequest, "expired_token")
+	case errors.Is(err, auth.ErrInvalidDeviceCode):
+		h.reportAbuse(r, abuse.DeviceCodeFailure)
+		writeErrorJSON(w, http.StatusBadRequest, "invalid_grant")
+	default:
+		writeErrorJSON(w, http.StatusInternalServerError, "failed to issue tokens")
+	}
+}
+
+// parseDeviceForm reads the form-encoded body RFC 8628 clients send and
+// answers the request itself when that fails.
+func parseDeviceForm(w http.ResponseWriter, r *http.Request) bool {
+	limitRequestBody(w, r, defaultRequestBodyLimitBytes)
+	if err := r.ParseForm(); err != nil {
+		if isRequestBodyTooLarge(err) {
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return false
+		}
+		writeErrorJSON(w, http.StatusBadRequest, "invalid_request")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/postgres"
+)
+
+func TestDeviceFlowIssuesTokensOnceApproved(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	authService := testAuthService()
+	h := NewHandler(integrationPool, authService)
+	u, _, _ := insertUserAndSession(t, ctx, postgres.NewUserAuthStore(integrationPool))
+
+	rec := deviceRequest(ctx, h.deviceCode, url.Values{"client_id": {"starter-cli"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("device code status: %d body=%s", rec.Code, rec.Body.String())
+	}
+	var started auth.DeviceAuthorizationResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil {
+		t.Fatalf("decode device code: %v", err)
+	}
+	if started.DeviceCode == "" || len(started.UserCode) != 9 || started.Interval != 5 || started.ExpiresIn != 600 {
+		t.Fatalf("unexpected device code response: %+v", started)
+	}
+	if started.VerificationURI != "http://127.0.0.1:8080/device" || !strings.HasSuffix(started.VerificationURIComplete, "?user_code="+started.UserCode) {
+		t.Fatalf("unexpected verification uris: %+v", started)
+	}
+
+	poll := url.Values{"grant_type": {deviceCodeGrantType}, "device_code": {started.DeviceCode}, "client_id": {"starter-cli"}}
+	assertDeviceError(t, deviceRequest(ctx, h.deviceToken, poll), http.StatusBadRequest, "authorization_pending")
+	assertDeviceError(t, deviceRequest(ctx, h.deviceToken, poll), http.StatusBadRequest, "slow_down")
+
+	if err := authService.DecideDeviceAuthorization(ctx, strings.ToLower(started.UserCode), u.ID, true, time.Now()); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	rec = deviceRequest(ctx, h.deviceToken, poll)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("device token status: %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("token response should not be cached")
+	}
+	var tokens auth.APITokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &tokens); err != nil {
+		t.Fatalf("decode tokens: %v", err)
+	}
+	claims, err := authService.ParseAPIAccessToken(tokens.AccessToken)
+	if err != nil || claims.UserID != u.ID || tokens.RefreshToken == "" {
+		t.Fatalf("unexpected tokens: %+v claims=%+v err=%v", tokens, claims, err)
+	}
+
+	assertDeviceError(t, deviceRequest(ctx, h.deviceToken, poll), http.StatusBadRequest, "invalid_grant")
+}
+
+func TestDeviceFlowRejectsBadRequests(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	authService := testAuthService()
+	h := NewHandler(integrationPool, authService)
+	u, _, _ := insertUserAndSession(t, ctx, postgres.NewUserAuthStore(integrationPool))
+
+	assertDeviceError(t, deviceRequest(ctx, h.deviceCode, url.Values{"client_id": {"unknown-cli"}}), http.StatusUnauthorized, "invalid_client")
+
+	started, err := authService.StartDeviceAuthorization(ctx, "starter-cli", time.Now())
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	poll := url.Values{"grant_type": {deviceCodeGrantType}, "device_code": {started.DeviceCode}, "client_id": {"starter-cli"}}
+
+	wrongGrant := url.Values{"grant_type": {"authorization_code"}, "device_code": {started.DeviceCode}, "client_id": {"starter-cli"}}
+	assertDeviceError(t, deviceRequest(ctx, h.deviceToken, wrongGrant), http.StatusBadRequest, "unsupported_grant_type")
+	wrongCode := url.Values{"grant_type": {deviceCodeGrantType}, "device_code": {"not-a-device-code"}, "client_id": {"starter-cli"}}
+	assertDeviceError(t, deviceRequest(ctx, h.deviceToken, wrongCode), http.StatusBadRequest, "invalid_grant")
+
+	if err := authService.DecideDeviceAuthorization(ctx, started.UserCode, u.ID, false, time.Now()); err != nil {
+		t.Fatalf("deny: %v", err)
+	}
+	assertDeviceError(t, deviceRequest(ctx, h.deviceToken, poll), http.StatusBadRequest, "access_denied")
+}
+
+func deviceRequest(ctx context.Context, handler http.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/device", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler(rec, req.WithContext(ctx))
+	return rec
+}
+
+func assertDeviceError(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	var payload struct {
+		Error string `json:"error"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &payload)
+	if rec.Code != status || payload.Error != code {
+		t.Fatalf("got %d %q, want %d %q (body=%s)", rec.Code, payload.Error, status, code, rec.Body.String())
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+
+	"github.com/benpsk/go-starter/internal/abuse"
+	"github.com/benpsk/go-starter/internal/auth"
 )
 
 const defaultRequestBodyLimitBytes = 1 << 20 // 1 MiB
@@ -32,6 +35,17 @@ func decodeJSONWithLimit(w http.ResponseWriter, r *http.Request, dst any, maxByt
 	return nil
 }
 
+// reportAbuse counts a failure of kind towards an abuse ban. Requests the
+// browser marks as cross-site are not counted: API bodies are not checked
+// for a JSON content type and can carry their own token, so any page can
+// post junk from its visitors' browsers to get them banned.
+func (h Handler) reportAbuse(r *http.Request, kind abuse.Kind) {
+	if auth.IsCrossSite(r) {
+		return
+	}
+	h.auth.Abuse().Report(r, kind)
+}
+
 func isRequestBodyTooLarge(err error) bool {
 	var maxErr *http.MaxBytesError
 	return errors.As(err, &maxErr)
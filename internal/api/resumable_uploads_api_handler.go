@@ -0,0 +1,361 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/storage"
+	"github.com/benpsk/go-starter/internal/upload"
+	"github.com/go-chi/chi/v5"
+)
+
+// Resumable uploads speak the tus 1.0.0 protocol (core plus the creation,
+// termination, checksum and expiration extensions), so off-the-shelf tus
+// clients work against /api/uploads/resumable.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,checksum,expiration"
+	tusBasePath   = "/api/uploads/resumable"
+
+	// statusChecksumMismatch is the tus checksum extension's 460 status.
+	statusChecksumMismatch = 460
+)
+
+func (h Handler) tusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.resumablePolicy.MaxBytes, 10))
+	w.Header().Set("Tus-Checksum-Algorithm", strings.Join(upload.ChecksumAlgorithms, ","))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h Handler) createResumableUpload(w http.ResponseWriter, r *http.Request) {
+	claims := apiAuthFromContext(r)
+	if claims == nil {
+		writeTusError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if !checkTusVersion(w, r) {
+		return
+	}
+	if h.store == nil {
+		writeTusError(w, http.StatusServiceUnavailable, "uploads are not configured")
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeTusError(w, http.StatusBadRequest, "deferred upload length is not supported")
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		writeTusError(w, http.StatusBadRequest, "Upload-Length is required")
+		return
+	}
+	meta, err := upload.ParseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeTusError(w, http.StatusBadRequest, "invalid Upload-Metadata")
+		return
+	}
+	filename := firstNonEmpty(meta["filename"], meta["name"])
+	contentType, err := h.resumablePolicy.Validate(firstNonEmpty(meta["filetype"], meta["type"]), size)
+	if err != nil {
+		switch {
+		case errors.Is(err, upload.ErrTooLarge):
+			writeTusError(w, http.StatusRequestEntityTooLarge, "file exceeds the upload size limit")
+		case errors.Is(err, upload.ErrContentTypeNotAllowed):
+			writeTusError(w, http.StatusUnsupportedMediaType, "content type is not allowed")
+		default:
+			writeTusError(w, http.StatusBadRequest, "Upload-Length must be positive")
+		}
+		return
+	}
+
+	key, err := upload.NewStorageKey(claims.UserID, filename)
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+	storageUploadID, err := h.store.CreateMultipart(r.Context(), key, contentType)
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+	created, err := h.uploads.CreateResumable(r.Context(), upload.Resumable{
+		Upload: upload.Upload{
+			UserID:      claims.UserID,
+			StorageKey:  key,
+			Filename:    upload.SafeFilename(filename),
+			ContentType: contentType,
+			SizeBytes:   size,
+		},
+		StorageUploadID: storageUploadID,
+		PartSize:        h.uploadPartSize,
+		ExpiresAt:       time.Now().Add(h.resumableTTL),
+	})
+	if err != nil {
+		h.abortMultipart(key, storageUploadID)
+		writeTusError(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Location", tusBasePath+"/"+strconv.FormatInt(created.ID, 10))
+	w.Header().Set("Upload-Expires", created.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h Handler) headResumableUpload(w http.ResponseWriter, r *http.Request) {
+	res, ok := h.loadResumable(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(res.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(res.SizeBytes, 10))
+	w.Header().Set("Upload-Expires", res.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// patchResumableUpload streams the body to storage one part at a time.
+// Storage only takes whole parts (or the final, shorter part), so bytes
+// short of a part are held with the upload and sent ahead of the next
+// PATCH; Upload-Offset always covers everything received.
+func (h Handler) patchResumableUpload(w http.ResponseWriter, r *http.Request) {
+	res, ok := h.loadResumable(w, r)
+	if !ok {
+		return
+	}
+	if ct, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.TrimSpace(ct) != "application/offset+octet-stream" {
+		writeTusError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeTusError(w, http.StatusBadRequest, "Upload-Offset is required")
+		return
+	}
+	if offset != res.Offset {
+		writeTusError(w, http.StatusConflict, "Upload-Offset does not match the current offset")
+		return
+	}
+	var checksum hash.Hash
+	var wantSum []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		checksum, wantSum, err = upload.ParseChecksum(header)
+		if err != nil {
+			writeTusError(w, http.StatusBadRequest, "unsupported Upload-Checksum")
+			return
+		}
+	}
+
+	// Storage calls and bookkeeping must not be cut short if the client goes
+	// away mid-body; whatever was received should still be recorded.
+	ctx := context.WithoutCancel(r.Context())
+	var body io.Reader = io.LimitReader(r.Body, res.SizeBytes-res.Offset+1)
+	if checksum != nil {
+		// The checksum covers the whole body, so none of it is stored until
+		// the body has been read to the end and matched.
+		spool, err := os.CreateTemp("", "tus-patch-*")
+		if err != nil {
+			writeTusError(w, http.StatusInternalServerError, "failed to buffer upload")
+			return
+		}
+		defer removeSpool(spool)
+		if _, err := io.Copy(io.MultiWriter(spool, checksum), body); err != nil {
+			writeTusError(w, http.StatusBadRequest, "request body was interrupted")
+			return
+		}
+		if !bytes.Equal(checksum.Sum(nil), wantSum) {
+			writeTusError(w, statusChecksumMismatch, "checksum mismatch")
+			return
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			writeTusError(w, http.StatusInternalServerError, "failed to buffer upload")
+			return
+		}
+		body = spool
+	}
+
+	data := io.MultiReader(bytes.NewReader(res.Tail), body)
+	stored := res.Offset - int64(len(res.Tail))
+	var parts []upload.Part
+	var tail []byte
+	var storeErr error
+	buf := make([]byte, res.PartSize)
+	for {
+		n, readErr := io.ReadFull(data, buf)
+		if stored+int64(n) > res.SizeBytes {
+			writeTusError(w, http.StatusRequestEntityTooLarge, "body exceeds Upload-Length")
+			return
+		}
+		if n == 0 {
+			break
+		}
+		final := stored+int64(n) == res.SizeBytes
+		if n < len(buf) && !final {
+			tail = bytes.Clone(buf[:n])
+			break
+		}
+		number := len(res.Parts) + len(parts) + 1
+		part, err := h.store.UploadPart(ctx, res.StorageKey, res.StorageUploadID, number, bytes.NewReader(buf[:n]), int64(n))
+		if err != nil {
+			// Keep the part's bytes so a retry does not have to resend them.
+			log.Printf("upload %d: store part %d: %v", res.ID, number, err)
+			storeErr = err
+			tail = bytes.Clone(buf[:n])
+			break
+		}
+		parts = append(parts, upload.Part{Number: part.Number, ETag: part.ETag, Size: part.Size})
+		stored += int64(n)
+		if final || readErr != nil {
+			break
+		}
+	}
+
+	if newOffset := stored + int64(len(tail)); newOffset != res.Offset || len(parts) > 0 {
+		if err := h.uploads.AdvanceResumable(ctx, res.ID, res.Offset, newOffset, parts, tail); err != nil {
+			if errors.Is(err, upload.ErrOffsetMismatch) {
+				writeTusError(w, http.StatusConflict, "upload was modified concurrently")
+				return
+			}
+			writeTusError(w, http.StatusInternalServerError, "failed to record upload progress")
+			return
+		}
+		res.Offset = newOffset
+		res.Parts = append(res.Parts, parts...)
+		res.Tail = tail
+	}
+	if storeErr != nil {
+		writeTusError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+
+	if res.Complete() {
+		if err := h.completeResumable(ctx, res); err != nil {
+			log.Printf("upload %d: complete: %v", res.ID, err)
+			writeTusError(w, http.StatusInternalServerError, "failed to complete upload")
+			return
+		}
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(res.Offset, 10))
+	w.Header().Set("Upload-Expires", res.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h Handler) deleteResumableUpload(w http.ResponseWriter, r *http.Request) {
+	res, ok := h.loadResumable(w, r)
+	if !ok {
+		return
+	}
+	if err := h.store.AbortMultipart(r.Context(), res.StorageKey, res.StorageUploadID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		writeTusError(w, http.StatusInternalServerError, "failed to abort upload")
+		return
+	}
+	if err := h.uploads.DeleteResumable(r.Context(), res.ID); err != nil {
+		writeTusError(w, http.StatusInternalServerError, "failed to delete upload")
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeResumable is safe to retry: a PATCH at the final offset with an
+// empty body finishes an upload whose completion failed earlier.
+func (h Handler) completeResumable(ctx context.Context, res upload.Resumable) error {
+	parts := make([]storage.Part, 0, len(res.Parts))
+	for _, p := range res.Parts {
+		parts = append(parts, storage.Part{Number: p.Number, ETag: p.ETag, Size: p.Size})
+	}
+	if err := h.store.CompleteMultipart(ctx, res.StorageKey, res.StorageUploadID, parts); err != nil {
+		if _, statErr := h.store.Stat(ctx, res.StorageKey); statErr != nil {
+			return err
+		}
+	}
+	_, err := h.uploads.CompleteResumable(ctx, res.ID, res.UserID, time.Now())
+	return err
+}
+
+func (h Handler) loadResumable(w http.ResponseWriter, r *http.Request) (upload.Resumable, bool) {
+	claims := apiAuthFromContext(r)
+	if claims == nil {
+		writeTusError(w, http.StatusUnauthorized, "unauthorized")
+		return upload.Resumable{}, false
+	}
+	if !checkTusVersion(w, r) {
+		return upload.Resumable{}, false
+	}
+	if h.store == nil {
+		writeTusError(w, http.StatusServiceUnavailable, "uploads are not configured")
+		return upload.Resumable{}, false
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeTusError(w, http.StatusNotFound, "upload not found")
+		return upload.Resumable{}, false
+	}
+	res, err := h.uploads.FindResumableForUser(r.Context(), id, claims.UserID)
+	if err != nil {
+		if errors.Is(err, upload.ErrNotFound) {
+			writeTusError(w, http.StatusNotFound, "upload not found")
+			return upload.Resumable{}, false
+		}
+		writeTusError(w, http.StatusInternalServerError, "failed to load upload")
+		return upload.Resumable{}, false
+	}
+	if time.Now().After(res.ExpiresAt) {
+		writeTusError(w, http.StatusGone, "upload expired")
+		return upload.Resumable{}, false
+	}
+	return res, true
+}
+
+func (h Handler) abortMultipart(key, uploadID string) {
+	if err := h.store.AbortMultipart(context.Background(), key, uploadID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("abort multipart upload %s: %v", key, err)
+	}
+}
+
+// removeSpool closes and deletes a temporary copy of a PATCH body.
+func removeSpool(f *os.File) {
+	_ = f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		log.Printf("remove %s: %v", f.Name(), err)
+	}
+}
+
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") == tusVersion {
+		return true
+	}
+	w.Header().Set("Tus-Version", tusVersion)
+	writeTusError(w, http.StatusPreconditionFailed, "unsupported Tus-Resumable version")
+	return false
+}
+
+// writeTusError answers in plain text, which is what tus clients surface.
+func writeTusError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	http.Error(w, message, status)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/storage"
+	"github.com/benpsk/go-starter/internal/upload"
+)
+
+func TestAPIResumableUploadInParts(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store, err := storage.NewLocal(t.TempDir(), "http://127.0.0.1:8080", "/media")
+	if err != nil {
+		t.Fatalf("new local store: %v", err)
+	}
+	authService := testAuthService()
+	h := NewHandler(integrationPool, authService).WithUploads(store, config.UploadConfig{
+		AllowedContentTypes: []string{"video/mp4"},
+		ResumableMaxBytes:   1024,
+		PartSize:            4,
+		ResumableTTL:        time.Hour,
+	})
+	u, _, _ := insertUserAndSession(t, ctx, authService.Users())
+	accessToken, _, err := authService.IssueAPIAccessToken(u.ID, "resumable-family-1", time.Now())
+	if err != nil {
+		t.Fatalf("issue access token: %v", err)
+	}
+	tusRequest := func(method, path string, body io.Reader, id string) *http.Request {
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req = req.WithContext(ctx)
+		if id != "" {
+			req = withURLParam(req, "id", id)
+		}
+		return req
+	}
+	serve := func(handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.requireAPIAuth(handler).ServeHTTP(rec, req)
+		return rec
+	}
+
+	create := tusRequest(http.MethodPost, tusBasePath, nil, "")
+	create.Header.Set("Upload-Length", "10")
+	create.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("clip.mp4"))+",filetype "+base64.StdEncoding.EncodeToString([]byte("video/mp4")))
+	rec := serve(h.createResumableUpload, create)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected create status: %d body=%s", rec.Code, rec.Body.String())
+	}
+	location := rec.Header().Get("Location")
+	id := strings.TrimPrefix(location, tusBasePath+"/")
+	if id == location || id == "" {
+		t.Fatalf("unexpected location %q", location)
+	}
+
+	patch := func(offset, body, checksum string) *httptest.ResponseRecorder {
+		req := tusRequest(http.MethodPatch, location, strings.NewReader(body), id)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", offset)
+		if checksum != "" {
+			req.Header.Set("Upload-Checksum", checksum)
+		}
+		return serve(h.patchResumableUpload, req)
+	}
+
+	// The whole first part is stored; the trailing "ef" is held until the
+	// rest of the second part arrives.
+	rec = patch("0", "abcdef", "")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("unexpected first patch: %d offset=%q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	if rec = patch("0", "abcd", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for stale offset, got %d", rec.Code)
+	}
+	if rec = patch("6", "ghij", "sha1 "+base64.StdEncoding.EncodeToString(make([]byte, sha1.Size))); rec.Code != statusChecksumMismatch {
+		t.Fatalf("expected 460 for checksum mismatch, got %d", rec.Code)
+	}
+
+	head := serve(h.headResumableUpload, tusRequest(http.MethodHead, location, nil, id))
+	if head.Code != http.StatusOK || head.Header().Get("Upload-Offset") != "6" || head.Header().Get("Upload-Length") != "10" {
+		t.Fatalf("unexpected head: %d offset=%q length=%q", head.Code, head.Header().Get("Upload-Offset"), head.Header().Get("Upload-Length"))
+	}
+
+	// Chunks smaller than a part still move the offset forward.
+	rec = patch("6", "g", "")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "7" {
+		t.Fatalf("unexpected short patch: %d offset=%q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	sum := sha1.Sum([]byte("hij"))
+	rec = patch("7", "hij", "sha1 "+base64.StdEncoding.EncodeToString(sum[:]))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "10" {
+		t.Fatalf("unexpected final patch: %d offset=%q body=%s", rec.Code, rec.Header().Get("Upload-Offset"), rec.Body.String())
+	}
+
+	uploadID, _ := strconv.ParseInt(id, 10, 64)
+	completed, err := h.uploads.FindByIDForUser(ctx, uploadID, u.ID)
+	if err != nil {
+		t.Fatalf("find upload: %v", err)
+	}
+	if completed.Status != upload.StatusCompleted {
+		t.Fatalf("expected completed upload, got %s", completed.Status)
+	}
+	obj, err := store.Open(ctx, completed.StorageKey)
+	if err != nil {
+		t.Fatalf("open assembled object: %v", err)
+	}
+	defer obj.Close()
+	data, _ := io.ReadAll(obj)
+	if string(data) != "abcdefghij" || obj.ContentType != "video/mp4" {
+		t.Fatalf("unexpected assembled object %q (%s)", data, obj.ContentType)
+	}
+}
@@ -2,35 +2,94 @@ package api
 
 import (
 	"context"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/postgres"
+	"github.com/benpsk/go-starter/internal/storage"
+	"github.com/benpsk/go-starter/internal/upload"
 	"github.com/go-chi/chi/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Handler struct {
-	db   *pgxpool.Pool
-	auth *auth.Service
+	db           *pgxpool.Pool
+	reads        *postgres.ReadRouter
+	auth         *auth.Service
+	store        storage.Store
+	uploads      *postgres.UploadStore
+	uploadPolicy upload.Policy
+	uploadURLTTL time.Duration
+
+	resumablePolicy upload.Policy
+	uploadPartSize  int64
+	resumableTTL    time.Duration
 }
 
 func NewHandler(db *pgxpool.Pool, authService *auth.Service) Handler {
-	return Handler{db: db, auth: authService}
+	return Handler{db: db, auth: authService, uploads: postgres.NewUploadStore(db)}
+}
+
+// WithUploads enables the /uploads endpoints backed by store.
+func (h Handler) WithUploads(store storage.Store, cfg config.UploadConfig) Handler {
+	h.store = store
+	h.uploadPolicy = upload.Policy{MaxBytes: cfg.MaxBytes, AllowedContentTypes: cfg.AllowedContentTypes}
+	h.uploadURLTTL = cfg.URLTTL
+	h.resumablePolicy = upload.Policy{MaxBytes: cfg.ResumableMaxBytes, AllowedContentTypes: cfg.AllowedContentTypes}
+	h.uploadPartSize = cfg.PartSize
+	h.resumableTTL = cfg.ResumableTTL
+	return h
+}
+
+// WithReadRouter adds replica health to the readiness payload.
+func (h Handler) WithReadRouter(reads *postgres.ReadRouter) Handler {
+	h.reads = reads
+	return h
 }
 
 func Routes(h Handler, limiter *auth.RateLimiter) chi.Router {
 	r := chi.NewRouter()
 	r.Route("/auth", func(r chi.Router) {
-		r.With(limiter.LimitByIP("api_auth_login")).Post("/login/{provider}", h.login)
-		r.With(limiter.LimitByIP("api_auth_refresh")).Post("/refresh", h.refresh)
+		r.With(limiter.Limit("api_auth_login")).Post("/login/{provider}", h.login)
+		r.With(limiter.Limit("api_auth_mfa")).Post("/mfa", h.verifyMFA)
+		r.With(limiter.Limit("api_auth_refresh")).Post("/refresh", h.refresh)
+		r.With(limiter.Limit("api_auth_device")).Post("/device/code", h.deviceCode)
+		r.Post("/device/token", h.deviceToken)
 		r.Post("/logout", h.logout)
 		r.With(h.requireAPIAuth).Get("/me", h.me)
 	})
+	r.Route("/uploads", func(r chi.Router) {
+		r.With(h.requireAPIAuth).Post("/", h.createUpload)
+		r.With(h.requireAPIAuth).Post("/{id}/complete", h.completeUpload)
+		r.Put("/local/*", h.receiveLocalUpload)
+		r.Route("/resumable", func(r chi.Router) {
+			r.Options("/", h.tusOptions)
+			r.With(h.requireAPIAuth).Post("/", h.createResumableUpload)
+			r.With(h.requireAPIAuth).Head("/{id}", h.headResumableUpload)
+			r.With(h.requireAPIAuth).Patch("/{id}", h.patchResumableUpload)
+			r.With(h.requireAPIAuth).Delete("/{id}", h.deleteResumableUpload)
+		})
+	})
 	r.Get("/health", h.Health)
 	return r
 }
 
+// Banned answers requests from clients blocked by the abuse detector. until
+// is zero for deny rules.
+func Banned(w http.ResponseWriter, r *http.Request, until time.Time) {
+	payload := map[string]any{"error": "ip banned"}
+	if !until.IsZero() {
+		seconds := int(math.Ceil(time.Until(until).Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		payload["banned_until"] = until.UTC()
+	}
+	writeJSON(w, http.StatusForbidden, payload)
+}
+
 func (h Handler) Health(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
 	defer cancel()
@@ -46,5 +105,27 @@ func (h Handler) Health(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if replicas := h.reads.ReplicaStatuses(); len(replicas) > 0 {
+		// Reads fall back to the primary, so unhealthy replicas degrade the
+		// report without failing readiness.
+		items := make([]map[string]any, 0, len(replicas))
+		for _, replica := range replicas {
+			item := map[string]any{
+				"name":       replica.Name,
+				"status":     "up",
+				"lag_ms":     replica.Lag.Milliseconds(),
+				"checked_at": replica.CheckedAt,
+			}
+			if !replica.Healthy {
+				item["status"] = replica.Error
+				if payload["status"] == "ok" {
+					payload["status"] = "degraded"
+				}
+			}
+			items = append(items, item)
+		}
+		payload["replicas"] = items
+	}
+
 	writeJSON(w, status, payload)
 }
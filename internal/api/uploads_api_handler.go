@@ -0,0 +1,213 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/storage"
+	"github.com/benpsk/go-starter/internal/upload"
+	"github.com/go-chi/chi/v5"
+)
+
+type createUploadRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int64  `json:"size_bytes"`
+}
+
+type uploadResponse struct {
+	ID          int64      `json:"id"`
+	Key         string     `json:"key"`
+	Filename    string     `json:"filename"`
+	ContentType string     `json:"content_type"`
+	SizeBytes   int64      `json:"size_bytes"`
+	Status      string     `json:"status"`
+	URL         string     `json:"url,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type presignedUploadResponse struct {
+	URL       string            `json:"url"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+func (h Handler) createUpload(w http.ResponseWriter, r *http.Request) {
+	claims := apiAuthFromContext(r)
+	if claims == nil {
+		writeErrorJSON(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if h.store == nil {
+		writeErrorJSON(w, http.StatusServiceUnavailable, "uploads are not configured")
+		return
+	}
+
+	var req createUploadRequest
+	if err := decodeJSONWithLimit(w, r, &req, defaultRequestBodyLimitBytes); err != nil {
+		if isRequestBodyTooLarge(err) {
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		writeErrorJSON(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	contentType, err := h.uploadPolicy.Validate(req.ContentType, req.SizeBytes)
+	if err != nil {
+		switch {
+		case errors.Is(err, upload.ErrTooLarge):
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge, "file exceeds the upload size limit")
+		case errors.Is(err, upload.ErrContentTypeNotAllowed):
+			writeErrorJSON(w, http.StatusUnsupportedMediaType, "content type is not allowed")
+		default:
+			writeErrorJSON(w, http.StatusBadRequest, "size_bytes must be positive")
+		}
+		return
+	}
+
+	key, err := upload.NewStorageKey(claims.UserID, req.Filename)
+	if err != nil {
+		writeErrorJSON(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+	presigned, err := h.store.PresignUpload(r.Context(), key, contentType, req.SizeBytes, h.uploadURLTTL)
+	if err != nil {
+		if errors.Is(err, storage.ErrSigningNotConfigured) {
+			writeErrorJSON(w, http.StatusServiceUnavailable, "uploads are not configured")
+			return
+		}
+		writeErrorJSON(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+	created, err := h.uploads.Create(r.Context(), upload.Upload{
+		UserID:      claims.UserID,
+		StorageKey:  key,
+		Filename:    upload.SafeFilename(req.Filename),
+		ContentType: contentType,
+		SizeBytes:   req.SizeBytes,
+	})
+	if err != nil {
+		writeErrorJSON(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"upload": h.uploadResponse(created),
+		"upload_request": presignedUploadResponse{
+			URL:       presigned.URL,
+			Method:    presigned.Method,
+			Headers:   presigned.Headers,
+			ExpiresAt: presigned.ExpiresAt,
+		},
+	})
+}
+
+func (h Handler) completeUpload(w http.ResponseWriter, r *http.Request) {
+	claims := apiAuthFromContext(r)
+	if claims == nil {
+		writeErrorJSON(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeErrorJSON(w, http.StatusNotFound, "upload not found")
+		return
+	}
+	pending, err := h.uploads.FindByIDForUser(r.Context(), id, claims.UserID)
+	if err != nil {
+		if errors.Is(err, upload.ErrNotFound) {
+			writeErrorJSON(w, http.StatusNotFound, "upload not found")
+			return
+		}
+		writeErrorJSON(w, http.StatusInternalServerError, "failed to complete upload")
+		return
+	}
+	if pending.Status == upload.StatusCompleted {
+		writeErrorJSON(w, http.StatusConflict, "upload already completed")
+		return
+	}
+	if h.store == nil {
+		writeErrorJSON(w, http.StatusServiceUnavailable, "uploads are not configured")
+		return
+	}
+	// The client did the PUT, so check that storage holds what was
+	// presigned before trusting it.
+	info, err := h.store.Stat(r.Context(), pending.StorageKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			writeErrorJSON(w, http.StatusConflict, "file has not been uploaded")
+			return
+		}
+		writeErrorJSON(w, http.StatusInternalServerError, "failed to complete upload")
+		return
+	}
+	if contentType, err := h.uploadPolicy.Validate(info.ContentType, info.Size); err != nil || contentType != pending.ContentType || info.Size != pending.SizeBytes {
+		writeErrorJSON(w, http.StatusUnprocessableEntity, "uploaded file does not match the upload")
+		return
+	}
+	completed, err := h.uploads.MarkCompleted(r.Context(), id, claims.UserID, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, upload.ErrNotFound):
+			writeErrorJSON(w, http.StatusNotFound, "upload not found")
+		case errors.Is(err, upload.ErrAlreadyCompleted):
+			writeErrorJSON(w, http.StatusConflict, "upload already completed")
+		default:
+			writeErrorJSON(w, http.StatusInternalServerError, "failed to complete upload")
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, h.uploadResponse(completed))
+}
+
+// receiveLocalUpload stands in for a presigned object storage PUT when the
+// local storage driver is used. The signature in the query is the only auth.
+func (h Handler) receiveLocalUpload(w http.ResponseWriter, r *http.Request) {
+	local, ok := storage.AsLocal(h.store)
+	if !ok {
+		writeErrorJSON(w, http.StatusNotFound, "not found")
+		return
+	}
+	key := strings.TrimPrefix(chi.URLParam(r, "*"), "/")
+	err := local.ReceiveSignedUpload(r.Context(), key, r.URL.Query(), r.Header.Get("Content-Type"), r.Body)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrInvalidSignature), errors.Is(err, storage.ErrSignatureExpired):
+			writeErrorJSON(w, http.StatusForbidden, "invalid or expired upload url")
+		case errors.Is(err, storage.ErrContentTypeMismatch):
+			writeErrorJSON(w, http.StatusUnsupportedMediaType, "content type does not match upload url")
+		case errors.Is(err, storage.ErrTooLarge):
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge, "file exceeds the signed size")
+		case errors.Is(err, storage.ErrTooSmall):
+			writeErrorJSON(w, http.StatusBadRequest, "file is shorter than the signed size")
+		case errors.Is(err, storage.ErrSigningNotConfigured):
+			writeErrorJSON(w, http.StatusServiceUnavailable, "uploads are not configured")
+		default:
+			writeErrorJSON(w, http.StatusInternalServerError, "failed to store upload")
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h Handler) uploadResponse(u upload.Upload) uploadResponse {
+	resp := uploadResponse{
+		ID:          u.ID,
+		Key:         u.StorageKey,
+		Filename:    u.Filename,
+		ContentType: u.ContentType,
+		SizeBytes:   u.SizeBytes,
+		Status:      u.Status,
+		CreatedAt:   u.CreatedAt,
+		CompletedAt: u.CompletedAt,
+	}
+	if u.Status == upload.StatusCompleted && h.store != nil {
+		resp.URL = h.store.PublicURL(u.StorageKey)
+	}
+	return resp
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/storage"
+	"github.com/benpsk/go-starter/internal/upload"
+)
+
+func TestAPIUploadPresignReceiveAndComplete(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store, err := storage.NewLocal(t.TempDir(), "http://127.0.0.1:8080", "/media")
+	if err != nil {
+		t.Fatalf("new local store: %v", err)
+	}
+	store.EnableSigning("test-signing-secret")
+
+	authService := testAuthService()
+	h := NewHandler(integrationPool, authService).WithUploads(store, config.UploadConfig{
+		MaxBytes:            1024,
+		AllowedContentTypes: []string{"image/png"},
+		URLTTL:              time.Minute,
+	})
+	u, _, _ := insertUserAndSession(t, ctx, authService.Users())
+	accessToken, _, err := authService.IssueAPIAccessToken(u.ID, "upload-family-1", time.Now())
+	if err != nil {
+		t.Fatalf("issue access token: %v", err)
+	}
+
+	rejected := jsonRequest(t, http.MethodPost, "/api/uploads", map[string]any{
+		"filename":     "notes.txt",
+		"content_type": "text/plain",
+		"size_bytes":   5,
+	})
+	rejected.Header.Set("Authorization", "Bearer "+accessToken)
+	rec := httptest.NewRecorder()
+	h.requireAPIAuth(http.HandlerFunc(h.createUpload)).ServeHTTP(rec, rejected.WithContext(ctx))
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 for disallowed type, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	req := jsonRequest(t, http.MethodPost, "/api/uploads", map[string]any{
+		"filename":     "Avatar.png",
+		"content_type": "image/png",
+		"size_bytes":   5,
+	})
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	rec = httptest.NewRecorder()
+	h.requireAPIAuth(http.HandlerFunc(h.createUpload)).ServeHTTP(rec, req.WithContext(ctx))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status: %d body=%s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		Upload        uploadResponse          `json:"upload"`
+		UploadRequest presignedUploadResponse `json:"upload_request"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+	if created.Upload.Status != upload.StatusPending || created.UploadRequest.Method != http.MethodPut {
+		t.Fatalf("unexpected create response: %+v", created)
+	}
+
+	completeUpload := func() *httptest.ResponseRecorder {
+		complete := httptest.NewRequest(http.MethodPost, "/api/uploads/"+strconv.FormatInt(created.Upload.ID, 10)+"/complete", nil)
+		complete.Header.Set("Authorization", "Bearer "+accessToken)
+		complete = withURLParam(complete.WithContext(ctx), "id", strconv.FormatInt(created.Upload.ID, 10))
+		rec := httptest.NewRecorder()
+		h.requireAPIAuth(http.HandlerFunc(h.completeUpload)).ServeHTTP(rec, complete)
+		return rec
+	}
+	if rec = completeUpload(); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 before the file is uploaded, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if _, err := store.Upload(ctx, created.Upload.Key, strings.NewReader("hi"), "image/png"); err != nil {
+		t.Fatalf("store short object: %v", err)
+	}
+	if rec = completeUpload(); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a size mismatch, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	uploadURL, err := url.Parse(created.UploadRequest.URL)
+	if err != nil {
+		t.Fatalf("parse upload url: %v", err)
+	}
+	put := httptest.NewRequest(http.MethodPut, uploadURL.RequestURI(), strings.NewReader("hello"))
+	put.Header.Set("Content-Type", "image/png")
+	put = withURLParam(put, "*", strings.TrimPrefix(uploadURL.Path, storage.LocalSignedUploadPath+"/"))
+	rec = httptest.NewRecorder()
+	h.receiveLocalUpload(rec, put)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected put status: %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	rec = completeUpload()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected complete status: %d body=%s", rec.Code, rec.Body.String())
+	}
+	var completed uploadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &completed); err != nil {
+		t.Fatalf("decode complete response: %v", err)
+	}
+	if completed.Status != upload.StatusCompleted || completed.URL != store.PublicURL(created.Upload.Key) {
+		t.Fatalf("unexpected completed upload: %+v", completed)
+	}
+}
@@ -62,6 +62,10 @@ func (s *Service) IssueAPITokenPair(ctx context.Context, userID int64, now time.
 	}, nil
 }
 
+// ErrInvalidRefreshToken is returned for refresh tokens that are unknown,
+// expired, revoked or reused.
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
 func (s *Service) RotateAPIRefreshToken(ctx context.Context, currentRefreshToken string, now time.Time) (APITokenResponse, error) {
 	currentHash := HashToken(currentRefreshToken)
 	newRefreshToken, err := randomToken(32)
@@ -79,7 +83,7 @@ func (s *Service) RotateAPIRefreshToken(ctx context.Context, currentRefreshToken
 		if result.ReuseDetected && result.FamilyID != "" {
 			_ = s.users.RevokeAPIRefreshTokenFamily(ctx, result.FamilyID, now)
 		}
-		return APITokenResponse{}, errors.New("unauthorized")
+		return APITokenResponse{}, ErrInvalidRefreshToken
 	}
 
 	accessToken, accessExpiresAt, err := s.IssueAPIAccessToken(result.UserID, result.FamilyID, now)
@@ -136,7 +140,7 @@ func (s *Service) ParseAPIAccessToken(tokenString string) (ParsedAPIAccessToken,
 			return nil, errors.New("unexpected signing method")
 		}
 		return []byte(s.apiAccessTokenSecret), nil
-	})
+	}, jwt.WithAudience("go-starter-api"))
 	if err != nil {
 		return ParsedAPIAccessToken{}, err
 	}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	CSRFCookieName = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+	CSRFFormField  = "csrf_token"
+)
+
+// newCSRFKey returns the key that signs CSRF tokens. Without a configured
+// secret a random key is used, which is fine for a single development
+// process but invalidates tokens on restart and between replicas.
+func newCSRFKey(secret string) []byte {
+	if secret = strings.TrimSpace(secret); secret != "" {
+		return []byte(secret)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	log.Print("auth: CSRF_SECRET is not set; using a random key for this process")
+	return key
+}
+
+// NewCSRFToken returns a token bound to sessionToken, the raw session cookie
+// value or "" for visitors who are not signed in. Tokens are
+// "<random>.<signature>", so a token taken from one session is useless in
+// another and a planted cookie cannot be forged without the key.
+func (s *Service) NewCSRFToken(sessionToken string) (string, error) {
+	nonce, err := randomToken(24)
+	if err != nil {
+		return "", err
+	}
+	return nonce + "." + s.csrfSignature(nonce, sessionToken), nil
+}
+
+// ValidCSRFToken reports whether token was issued for sessionToken.
+func (s *Service) ValidCSRFToken(token, sessionToken string) bool {
+	nonce, signature, ok := strings.Cut(strings.TrimSpace(token), ".")
+	if !ok || nonce == "" {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(s.csrfSignature(nonce, sessionToken)))
+}
+
+func (s *Service) csrfSignature(nonce, sessionToken string) string {
+	binding := "anonymous"
+	if sessionToken = strings.TrimSpace(sessionToken); sessionToken != "" {
+		binding = "session:" + HashToken(sessionToken)
+	}
+	mac := hmac.New(sha256.New, s.csrfKey)
+	mac.Write([]byte("csrf\x00" + binding + "\x00" + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// EnsureCSRFCookie returns the request's CSRF token, issuing a new cookie
+// when it is missing or belongs to another session.
+func (s *Service) EnsureCSRFCookie(w http.ResponseWriter, r *http.Request) string {
+	sessionToken := s.SessionTokenFromRequest(r)
+	if token := CSRFCookieFromRequest(r); token != "" && s.ValidCSRFToken(token, sessionToken) {
+		return token
+	}
+	return s.RotateCSRFCookie(w, r, sessionToken)
+}
+
+// RotateCSRFCookie issues a fresh token bound to sessionToken. Setting and
+// clearing the session cookie call it, so tokens change on login and
+// logout.
+func (s *Service) RotateCSRFCookie(w http.ResponseWriter, r *http.Request, sessionToken string) string {
+	token, err := s.NewCSRFToken(sessionToken)
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: false, // JS reads this to set htmx header and hidden form fields.
+		SameSite: http.SameSiteLaxMode,
+		Secure:   s.SessionCookieSecure(r),
+	})
+	return token
+}
+
+// CheckCSRF reports whether r carries the CSRF cookie, the same token in the
+// X-CSRF-Token header or csrf_token form field, and a signature matching
+// the request's session.
+func (s *Service) CheckCSRF(r *http.Request) bool {
+	cookieToken := CSRFCookieFromRequest(r)
+	candidate := strings.TrimSpace(r.Header.Get(CSRFHeaderName))
+	if candidate == "" {
+		candidate = strings.TrimSpace(r.FormValue(CSRFFormField))
+	}
+	if cookieToken == "" || !hmac.Equal([]byte(cookieToken), []byte(candidate)) {
+		return false
+	}
+	return s.ValidCSRFToken(candidate, s.SessionTokenFromRequest(r))
+}
+
+func CSRFCookieFromRequest(r *http.Request) string {
+	c, err := r.Cookie(CSRFCookieName)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(c.Value)
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCSRFService() *Service {
+	return &Service{csrfKey: []byte("test-csrf-key"), sessionCookieName: "test_session", appEnv: "test"}
+}
+
+func TestCSRFTokensAreBoundToTheSession(t *testing.T) {
+	t.Parallel()
+
+	s := testCSRFService()
+	token, err := s.NewCSRFToken("session-a")
+	if err != nil {
+		t.Fatalf("new token: %v", err)
+	}
+	if !s.ValidCSRFToken(token, "session-a") {
+		t.Fatal("token should be valid for its own session")
+	}
+	if s.ValidCSRFToken(token, "session-b") || s.ValidCSRFToken(token, "") {
+		t.Fatal("token should not be valid for another session")
+	}
+	nonce, _, _ := strings.Cut(token, ".")
+	if s.ValidCSRFToken(nonce+".forged", "session-a") || s.ValidCSRFToken(nonce, "session-a") {
+		t.Fatal("forged or unsigned tokens should be rejected")
+	}
+	other := &Service{csrfKey: []byte("another-key")}
+	if other.ValidCSRFToken(token, "session-a") {
+		t.Fatal("tokens signed with another key should be rejected")
+	}
+}
+
+func TestCheckCSRF(t *testing.T) {
+	t.Parallel()
+
+	s := testCSRFService()
+	token, _ := s.NewCSRFToken("session-a")
+
+	post := func(cookie, header, form, session string) *http.Request {
+		body := url.Values{}
+		if form != "" {
+			body.Set(CSRFFormField, form)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/account/avatar/delete", strings.NewReader(body.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: cookie})
+		}
+		if header != "" {
+			r.Header.Set(CSRFHeaderName, header)
+		}
+		if session != "" {
+			r.AddCookie(&http.Cookie{Name: "test_session", Value: session})
+		}
+		return r
+	}
+
+	if !s.CheckCSRF(post(token, token, "", "session-a")) {
+		t.Error("matching header token should pass")
+	}
+	if !s.CheckCSRF(post(token, "", token, "session-a")) {
+		t.Error("matching form token should pass")
+	}
+	if s.CheckCSRF(post(token, "", "", "session-a")) {
+		t.Error("a cookie alone should fail")
+	}
+	if s.CheckCSRF(post(token, token, "", "session-b")) {
+		t.Error("a token from another session should fail")
+	}
+	planted, _ := s.NewCSRFToken("")
+	if s.CheckCSRF(post(planted, planted, "", "session-a")) {
+		t.Error("an anonymous token should fail for a signed-in session")
+	}
+}
+
+func TestSessionCookieRotatesCSRFCookie(t *testing.T) {
+	t.Parallel()
+
+	s := testCSRFService()
+	r := httptest.NewRequest(http.MethodGet, "/auth/google/callback", nil)
+
+	rec := httptest.NewRecorder()
+	anonymous := s.EnsureCSRFCookie(rec, r)
+	if !s.ValidCSRFToken(anonymous, "") {
+		t.Fatal("visitors should get an anonymous token")
+	}
+
+	rec = httptest.NewRecorder()
+	s.SetSessionCookie(rec, r, "session-a", time.Now().Add(time.Hour))
+	signedIn := csrfCookieFrom(t, rec)
+	if !s.ValidCSRFToken(signedIn, "session-a") {
+		t.Fatal("signing in should issue a token bound to the new session")
+	}
+
+	r.AddCookie(&http.Cookie{Name: "test_session", Value: "session-a"})
+	r.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: signedIn})
+	rec = httptest.NewRecorder()
+	if got := s.EnsureCSRFCookie(rec, r); got != signedIn || len(rec.Result().Cookies()) != 0 {
+		t.Fatal("a valid token should be kept")
+	}
+
+	rec = httptest.NewRecorder()
+	s.ClearSessionCookie(rec, r)
+	if signedOut := csrfCookieFrom(t, rec); !s.ValidCSRFToken(signedOut, "") {
+		t.Fatal("signing out should issue an anonymous token")
+	}
+}
+
+func csrfCookieFrom(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == CSRFCookieName {
+			return c.Value
+		}
+	}
+	t.Fatal("no csrf cookie set")
+	return ""
+}
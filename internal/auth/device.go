@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/mail"
+	"github.com/benpsk/go-starter/internal/user"
+)
+
+// Sign-in clients recorded on security events.
+const (
+	ClientWeb = "web"
+	ClientAPI = "api"
+)
+
+// ParseDevice describes the device behind a request from its user agent and
+// the network it came from (the /24 of an IPv4 address, the /48 of IPv6).
+func ParseDevice(meta RequestMeta) user.Device {
+	ua := meta.UserAgent
+	d := user.Device{
+		Browser:  uaBrowser(ua),
+		OS:       uaOS(ua),
+		Type:     uaDeviceType(ua),
+		IPPrefix: ipPrefix(meta.IP),
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{d.Browser, d.OS, d.Type, d.IPPrefix}, "|")))
+	d.Fingerprint = hex.EncodeToString(sum[:16])
+	return d
+}
+
+func uaBrowser(ua string) string {
+	switch {
+	case ua == "":
+		return "Unknown browser"
+	case strings.Contains(ua, "Edg/") || strings.Contains(ua, "Edge/") || strings.Contains(ua, "EdgiOS/"):
+		return "Edge"
+	case strings.Contains(ua, "OPR/") || strings.Contains(ua, "Opera"):
+		return "Opera"
+	case strings.Contains(ua, "SamsungBrowser/"):
+		return "Samsung Internet"
+	case strings.Contains(ua, "Firefox/") || strings.Contains(ua, "FxiOS/"):
+		return "Firefox"
+	case strings.Contains(ua, "Chrome/") || strings.Contains(ua, "CriOS/") || strings.Contains(ua, "Chromium/"):
+		return "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		return "Safari"
+	}
+	// API clients usually send "name/version"; the name is what matters.
+	product, _, _ := strings.Cut(strings.Fields(ua)[0], "/")
+	return product
+}
+
+func uaOS(ua string) string {
+	switch {
+	case strings.Contains(ua, "Windows"):
+		return "Windows"
+	case strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad") || strings.Contains(ua, "iPod"):
+		return "iOS"
+	case strings.Contains(ua, "Mac OS X") || strings.Contains(ua, "Macintosh"):
+		return "macOS"
+	case strings.Contains(ua, "CrOS"):
+		return "ChromeOS"
+	case strings.Contains(ua, "Android"):
+		return "Android"
+	case strings.Contains(ua, "Linux"):
+		return "Linux"
+	default:
+		return "an unknown OS"
+	}
+}
+
+func uaDeviceType(ua string) string {
+	switch {
+	case ua == "":
+		return "unknown"
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet") || (strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile")):
+		return "tablet"
+	case strings.Contains(ua, "Mobi") || strings.Contains(ua, "iPhone"):
+		return "mobile"
+	default:
+		return "desktop"
+	}
+}
+
+func ipPrefix(ip string) string {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+// RecordSignIn remembers the device behind a sign-in. When the user has not
+// signed in from it before, it adds a security event to their feed on
+// /account and emails them. Call it in the sign-in transaction.
+func (s *Service) RecordSignIn(ctx context.Context, u user.User, meta RequestMeta, client string) error {
+	device := ParseDevice(meta)
+	now := time.Now()
+	isNew, err := s.users.RememberDevice(ctx, u.ID, device.Fingerprint, now)
+	if err != nil || !isNew {
+		return err
+	}
+	ev, err := s.users.CreateSecurityEvent(ctx, user.SecurityEvent{
+		UserID:      u.ID,
+		Kind:        user.SecurityEventNewDevice,
+		Client:      client,
+		Fingerprint: device.Fingerprint,
+		Device:      device.Description(),
+		IP:          meta.IP,
+		UserAgent:   meta.UserAgent,
+	})
+	if err != nil {
+		return err
+	}
+	if u.Email == "" {
+		return nil
+	}
+	return s.outbox.Queue(ctx, u.Email, mail.NewDeviceSignIn{
+		AppName:     s.appName,
+		AppURL:      s.appURL,
+		DisplayName: u.DisplayName,
+		Device:      ev.Device,
+		IP:          ev.IP,
+		At:          ev.CreatedAt,
+	})
+}
+
+// SecurityEvents returns the user's most recent security events.
+func (s *Service) SecurityEvents(ctx context.Context, userID int64) ([]user.SecurityEvent, error) {
+	return s.users.ListSecurityEvents(ctx, userID, 20)
+}
+
+// ReportSignIn handles "this wasn't me" on a security event: it flags the
+// event, forgets its device and revokes every session and API refresh
+// token of the user. Access tokens already issued stay valid until they
+// expire.
+func (s *Service) ReportSignIn(ctx context.Context, userID, eventID int64) error {
+	now := time.Now()
+	return s.InTx(ctx, func(ctx context.Context) error {
+		if err := s.users.ReportSecurityEvent(ctx, userID, eventID, now); err != nil {
+			return err
+		}
+		return s.users.RevokeAllSessions(ctx, userID, now)
+	})
+}
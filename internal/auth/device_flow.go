@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/user"
+)
+
+var (
+	ErrInvalidDeviceClient        = errors.New("client may not use the device flow")
+	ErrInvalidDeviceCode          = errors.New("invalid device code")
+	ErrInvalidUserCode            = errors.New("invalid or expired user code")
+	ErrDeviceAuthorizationPending = errors.New("device authorization is pending")
+	ErrDeviceSlowDown             = errors.New("device is polling too fast")
+	ErrDeviceAccessDenied         = errors.New("device authorization was denied")
+	ErrDeviceCodeExpired          = errors.New("device code expired")
+)
+
+const (
+	// deviceCodeTTL is how long a user has to approve a device.
+	deviceCodeTTL = 10 * time.Minute
+	// devicePollInterval is the seconds a device waits between polls; each
+	// poll that comes too early adds deviceSlowDownSeconds to it.
+	devicePollInterval    = 5
+	deviceSlowDownSeconds = 5
+	// userCodeAlphabet has no vowels, so user codes cannot spell words, and
+	// no digits that read like letters.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+// DeviceAuthorizationResponse is the RFC 8628 device authorization response.
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DeviceFlowEnabled reports whether any client may use the device flow.
+func (s *Service) DeviceFlowEnabled() bool {
+	return s.APIAuthConfigured() && len(s.deviceClientIDs) > 0
+}
+
+// DeviceClientAllowed reports whether clientID is listed in
+// API_DEVICE_CLIENT_IDS.
+func (s *Service) DeviceClientAllowed(clientID string) bool {
+	return clientID != "" && slices.Contains(s.deviceClientIDs, clientID)
+}
+
+// StartDeviceAuthorization creates a pending authorization for clientID and
+// returns the codes the device shows its user and polls with.
+func (s *Service) StartDeviceAuthorization(ctx context.Context, clientID string, now time.Time) (DeviceAuthorizationResponse, error) {
+	if !s.DeviceClientAllowed(clientID) {
+		return DeviceAuthorizationResponse{}, ErrInvalidDeviceClient
+	}
+	deviceCode, err := randomToken(32)
+	if err != nil {
+		return DeviceAuthorizationResponse{}, err
+	}
+	// User codes are short, so retry the rare collision with a live one.
+	for range 5 {
+		userCode, err := newUserCode()
+		if err != nil {
+			return DeviceAuthorizationResponse{}, err
+		}
+		created, err := s.users.CreateDeviceAuthorization(ctx, user.DeviceAuthorization{
+			DeviceCodeHash:  HashToken(deviceCode),
+			UserCode:        userCode,
+			ClientID:        clientID,
+			IntervalSeconds: devicePollInterval,
+			ExpiresAt:       now.Add(deviceCodeTTL),
+		})
+		if err != nil {
+			return DeviceAuthorizationResponse{}, err
+		}
+		if !created {
+			continue
+		}
+		verificationURI := strings.TrimRight(strings.TrimSpace(s.appURL), "/") + "/device"
+		return DeviceAuthorizationResponse{
+			DeviceCode:              deviceCode,
+			UserCode:                FormatUserCode(userCode),
+			VerificationURI:         verificationURI,
+			VerificationURIComplete: verificationURI + "?user_code=" + url.QueryEscape(FormatUserCode(userCode)),
+			ExpiresIn:               int(deviceCodeTTL.Seconds()),
+			Interval:                devicePollInterval,
+		}, nil
+	}
+	return DeviceAuthorizationResponse{}, errors.New("could not allocate a unique user code")
+}
+
+// PendingDeviceAuthorization finds the authorization a user is about to
+// approve from the code they typed.
+func (s *Service) PendingDeviceAuthorization(ctx context.Context, userCode string, now time.Time) (user.DeviceAuthorization, error) {
+	code := NormalizeUserCode(userCode)
+	if len(code) != userCodeLength {
+		return user.DeviceAuthorization{}, ErrInvalidUserCode
+	}
+	a, err := s.users.FindPendingDeviceAuthorization(ctx, code, now)
+	if errors.Is(err, user.ErrNotFound) {
+		return user.DeviceAuthorization{}, ErrInvalidUserCode
+	}
+	return a, err
+}
+
+// DecideDeviceAuthorization approves or denies the device waiting on
+// userCode for userID. Only fully signed-in sessions reach it, so the
+// device gets tokens without a second two-factor check.
+func (s *Service) DecideDeviceAuthorization(ctx context.Context, userCode string, userID int64, approve bool, now time.Time) error {
+	code := NormalizeUserCode(userCode)
+	if len(code) != userCodeLength {
+		return ErrInvalidUserCode
+	}
+	_, err := s.users.DecideDeviceAuthorization(ctx, code, userID, approve, now)
+	if errors.Is(err, user.ErrNotFound) {
+		return ErrInvalidUserCode
+	}
+	return err
+}
+
+// ExchangeDeviceCode is one poll of the device token endpoint. Until the
+// user decides it fails with ErrDeviceAuthorizationPending, or
+// ErrDeviceSlowDown when the device polls faster than its interval; once
+// approved it signs the user in and returns their API tokens, exactly once.
+func (s *Service) ExchangeDeviceCode(ctx context.Context, deviceCode, clientID string, meta RequestMeta, now time.Time) (user.User, APITokenResponse, error) {
+	if !s.DeviceClientAllowed(clientID) {
+		return user.User{}, APITokenResponse{}, ErrInvalidDeviceClient
+	}
+	if strings.TrimSpace(deviceCode) == "" {
+		return user.User{}, APITokenResponse{}, ErrInvalidDeviceCode
+	}
+	var out user.User
+	var resp APITokenResponse
+	var pollErr error
+	err := s.InTx(ctx, func(ctx context.Context) error {
+		a, err := s.users.FindDeviceAuthorizationForPoll(ctx, HashToken(deviceCode))
+		if errors.Is(err, user.ErrNotFound) {
+			return ErrInvalidDeviceCode
+		}
+		if err != nil {
+			return err
+		}
+		if a.ClientID != clientID {
+			return ErrInvalidDeviceCode
+		}
+		if !now.Before(a.ExpiresAt) {
+			return ErrDeviceCodeExpired
+		}
+		switch a.Status {
+		case user.DeviceAuthorizationPending:
+			// The poll is recorded even when it is refused, so the commit
+			// below must not be rolled back by the error.
+			interval := a.IntervalSeconds
+			pollErr = ErrDeviceAuthorizationPending
+			if a.LastPolledAt != nil && now.Sub(*a.LastPolledAt) < time.Duration(interval)*time.Second {
+				interval += deviceSlowDownSeconds
+				pollErr = ErrDeviceSlowDown
+			}
+			return s.users.PollDeviceAuthorization(ctx, a.ID, interval, now)
+		case user.DeviceAuthorizationDenied:
+			return ErrDeviceAccessDenied
+		case user.DeviceAuthorizationApproved:
+		default:
+			return ErrInvalidDeviceCode
+		}
+		consumed, err := s.users.ConsumeDeviceAuthorization(ctx, a.ID)
+		if err != nil {
+			return err
+		}
+		if !consumed || a.UserID == nil {
+			return ErrInvalidDeviceCode
+		}
+		out, err = s.users.FindByID(ctx, *a.UserID)
+		if err != nil {
+			return err
+		}
+		if err := s.RecordSignIn(ctx, out, meta, ClientAPI); err != nil {
+			return err
+		}
+		resp, err = s.IssueAPITokenPair(ctx, out.ID, now)
+		return err
+	})
+	if err == nil {
+		err = pollErr
+	}
+	if err != nil {
+		return user.User{}, APITokenResponse{}, err
+	}
+	return out, resp, nil
+}
+
+// NormalizeUserCode uppercases a typed user code and drops the dash and
+// anything else that is not a letter.
+func NormalizeUserCode(code string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(code) {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// FormatUserCode splits a normalized user code for display, as in
+// "BCDF-GHJK".
+func FormatUserCode(code string) string {
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+func newUserCode() (string, error) {
+	out := make([]byte, 0, userCodeLength)
+	buf := make([]byte, userCodeLength*2)
+	for len(out) < userCodeLength {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			// Reject the top of the byte range so every letter is equally
+			// likely.
+			if int(b) >= 256-256%len(userCodeAlphabet) || len(out) == userCodeLength {
+				continue
+			}
+			out = append(out, userCodeAlphabet[int(b)%len(userCodeAlphabet)])
+		}
+	}
+	return string(out), nil
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewUserCode(t *testing.T) {
+	t.Parallel()
+
+	seen := map[string]bool{}
+	for range 50 {
+		code, err := newUserCode()
+		if err != nil {
+			t.Fatalf("newUserCode: %v", err)
+		}
+		if len(code) != userCodeLength || strings.Trim(code, userCodeAlphabet) != "" {
+			t.Fatalf("user code %q has the wrong shape", code)
+		}
+		seen[code] = true
+	}
+	if len(seen) < 45 {
+		t.Fatalf("only %d distinct user codes in 50", len(seen))
+	}
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	t.Parallel()
+
+	for in, want := range map[string]string{
+		"BCDF-GHJK":   "BCDFGHJK",
+		" bcdf ghjk ": "BCDFGHJK",
+		"bcdf-ghjk\n": "BCDFGHJK",
+		"BC12-DF":     "BCDF",
+		"":            "",
+		"ÄBCDF-GHJK":  "BCDFGHJK",
+	} {
+		if got := NormalizeUserCode(in); got != want {
+			t.Errorf("NormalizeUserCode(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if got := FormatUserCode("BCDFGHJK"); got != "BCDF-GHJK" {
+		t.Fatalf("FormatUserCode = %q", got)
+	}
+	if got := FormatUserCode("BCD"); got != "BCD" {
+		t.Fatalf("FormatUserCode of a short code = %q", got)
+	}
+}
@@ -0,0 +1,43 @@
+package auth
+
+import "testing"
+
+func TestParseDevice(t *testing.T) {
+	cases := []struct {
+		ua, browser, os, kind string
+	}{
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36", "Chrome", "macOS", "desktop"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0.0.0", "Edge", "Windows", "desktop"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1", "Safari", "iOS", "mobile"},
+		{"Mozilla/5.0 (Linux; Android 14; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36", "Chrome", "Android", "tablet"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:127.0) Gecko/20100101 Firefox/127.0", "Firefox", "Linux", "desktop"},
+		{"starter-ios/2.3.1 (iPhone; iOS 17.5)", "starter-ios", "iOS", "mobile"},
+		{"", "Unknown browser", "an unknown OS", "unknown"},
+	}
+	for _, tc := range cases {
+		d := ParseDevice(RequestMeta{UserAgent: tc.ua, IP: "203.0.113.7"})
+		if d.Browser != tc.browser || d.OS != tc.os || d.Type != tc.kind {
+			t.Errorf("%q: got %s/%s/%s, want %s/%s/%s", tc.ua, d.Browser, d.OS, d.Type, tc.browser, tc.os, tc.kind)
+		}
+	}
+}
+
+func TestDeviceFingerprint(t *testing.T) {
+	chrome := func(version, ip string) string {
+		ua := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/" + version + " Safari/537.36"
+		return ParseDevice(RequestMeta{UserAgent: ua, IP: ip}).Fingerprint
+	}
+	base := chrome("126.0.0.0", "203.0.113.7")
+	if chrome("127.0.1.2", "203.0.113.200") != base {
+		t.Error("a browser update on the same network should be the same device")
+	}
+	if chrome("126.0.0.0", "198.51.100.7") == base {
+		t.Error("another network should be a new device")
+	}
+	if a, b := ParseDevice(RequestMeta{IP: "2001:db8:1:2::1"}), ParseDevice(RequestMeta{IP: "2001:db8:1:ffff::9"}); a.IPPrefix != "2001:db8:1::/48" || a.Fingerprint != b.Fingerprint {
+		t.Errorf("IPv6 addresses in one /48 should match: %s %s", a.IPPrefix, b.IPPrefix)
+	}
+	if d := ParseDevice(RequestMeta{IP: "::ffff:203.0.113.7"}); d.IPPrefix != "203.0.113.0/24" {
+		t.Errorf("IPv4-mapped addresses should use the IPv4 prefix, got %s", d.IPPrefix)
+	}
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/abuse"
+	"github.com/benpsk/go-starter/internal/jobs"
+	"github.com/benpsk/go-starter/internal/postgres"
+)
+
+// PruneExpiredArgs deletes expired sessions, API refresh tokens, magic
+// links, device authorizations, rate limit windows and bans old enough to
+// be forgotten.
+type PruneExpiredArgs struct{}
+
+func (PruneExpiredArgs) Kind() string { return "auth.prune_expired" }
+
+// RegisterJobs adds the auth job handlers to r.
+func RegisterJobs(r *jobs.Registry, users *postgres.UserAuthStore, limits *postgres.RateLimitStore, bans *postgres.AbuseStore) {
+	jobs.Handle(r, func(ctx context.Context, _ jobs.Job, _ PruneExpiredArgs) error {
+		now := time.Now()
+		sessions, tokens, err := users.PruneExpired(ctx, now)
+		if err != nil {
+			return err
+		}
+		if sessions > 0 || tokens > 0 {
+			log.Printf("auth: pruned %d expired sessions and %d expired refresh tokens", sessions, tokens)
+		}
+		if _, err := users.DeleteExpiredMagicLinks(ctx, now); err != nil {
+			return err
+		}
+		if _, err := users.DeleteExpiredDeviceAuthorizations(ctx, now); err != nil {
+			return err
+		}
+		if _, err := limits.DeleteExpired(ctx, now); err != nil {
+			return err
+		}
+		if _, err := bans.DeleteExpiredBans(ctx, now.Add(-abuse.DefaultForgetAfter)); err != nil {
+			return err
+		}
+		return nil
+	})
+}
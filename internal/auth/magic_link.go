@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/mail"
+	"github.com/benpsk/go-starter/internal/user"
+)
+
+var (
+	ErrInvalidEmail     = errors.New("invalid email address")
+	ErrInvalidMagicLink = errors.New("invalid or expired magic link")
+)
+
+// magicLinkTTL is how long an emailed sign-in link works.
+const magicLinkTTL = 15 * time.Minute
+
+// NormalizeEmail lowercases a bare address like "ada@example.com" and
+// rejects anything else, including display names and angle brackets.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := netmail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > 254 {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+// SendMagicLink emails a one-time sign-in link to email that leads to
+// redirectTo. It works the same whether or not the address has an account,
+// so it does not reveal which ones do.
+func (s *Service) SendMagicLink(ctx context.Context, email, redirectTo string, now time.Time) error {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	rawToken, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	return s.InTx(ctx, func(ctx context.Context) error {
+		err := s.users.CreateMagicLink(ctx, user.MagicLink{
+			Email:      email,
+			TokenHash:  HashToken(rawToken),
+			RedirectTo: redirectTo,
+			ExpiresAt:  now.Add(magicLinkTTL),
+		})
+		if err != nil {
+			return err
+		}
+		return s.outbox.Queue(ctx, email, mail.MagicLink{
+			AppName:   s.appName,
+			AppURL:    s.appURL,
+			Link:      strings.TrimRight(strings.TrimSpace(s.appURL), "/") + "/auth/magic-link?token=" + url.QueryEscape(rawToken),
+			ExpiresIn: magicLinkTTL,
+		})
+	})
+}
+
+// UseMagicLink spends the link for rawToken and returns the user it signs
+// in and where they asked to go.
+func (s *Service) UseMagicLink(ctx context.Context, rawToken string, now time.Time) (user.User, string, error) {
+	if strings.TrimSpace(rawToken) == "" {
+		return user.User{}, "", ErrInvalidMagicLink
+	}
+	var out user.User
+	var redirectTo string
+	err := s.InTx(ctx, func(ctx context.Context) error {
+		link, err := s.users.UseMagicLink(ctx, HashToken(rawToken), now)
+		if errors.Is(err, user.ErrNotFound) {
+			return ErrInvalidMagicLink
+		}
+		if err != nil {
+			return err
+		}
+		redirectTo = link.RedirectTo
+		out, err = s.findOrCreateEmailUser(ctx, link.Email)
+		return err
+	})
+	if err != nil {
+		return user.User{}, "", err
+	}
+	return out, redirectTo, nil
+}
+
+// findOrCreateEmailUser resolves a magic-link sign-in to the user who used
+// email before, then to the user whose verified email it is, who gets an
+// email identity. Otherwise it signs up a new user, which fails with
+// ErrEmailConflict when an account holds the address unverified.
+func (s *Service) findOrCreateEmailUser(ctx context.Context, email string) (user.User, error) {
+	name, _, _ := strings.Cut(email, "@")
+	profile := user.SocialProfile{
+		Provider:       user.ProviderEmail,
+		ProviderUserID: email,
+		Email:          email,
+		EmailVerified:  true,
+		Name:           name,
+	}
+	existing, err := s.users.FindByIdentity(ctx, profile.Provider, profile.ProviderUserID)
+	if err == nil {
+		return existing, nil
+	}
+	if !errors.Is(err, user.ErrNotFound) {
+		return user.User{}, err
+	}
+	existing, err = s.users.FindByVerifiedEmail(ctx, email)
+	if err == nil {
+		if err := s.users.LinkIdentity(ctx, existing.ID, profile); err != nil {
+			return user.User{}, err
+		}
+		return existing, nil
+	}
+	if !errors.Is(err, user.ErrNotFound) {
+		return user.User{}, err
+	}
+	return s.findOrCreateSocialUser(ctx, profile)
+}
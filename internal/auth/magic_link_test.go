@@ -0,0 +1,20 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	t.Parallel()
+
+	got, err := NormalizeEmail("  Ada.Lovelace+test@Example.COM ")
+	if err != nil || got != "ada.lovelace+test@example.com" {
+		t.Fatalf("NormalizeEmail = %q, %v", got, err)
+	}
+	for _, bad := range []string{"", "ada", "ada@", "Ada <ada@example.com>", "<ada@example.com>", "ada@example.com, bob@example.com", "a\r\nb@example.com"} {
+		if _, err := NormalizeEmail(bad); !errors.Is(err, ErrInvalidEmail) {
+			t.Errorf("NormalizeEmail(%q) err = %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/user"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrMFAUnavailable = errors.New("two-factor authentication is not configured")
+	ErrInvalidMFACode = errors.New("invalid two-factor code")
+)
+
+const (
+	// mfaPendingSessionTTL is how long a session may wait for its second
+	// factor; it gets the full session TTL once that is passed.
+	mfaPendingSessionTTL = 10 * time.Minute
+	mfaChallengeTTL      = 5 * time.Minute
+	mfaChallengeAudience = "go-starter-mfa"
+	recoveryCodeCount    = 10
+)
+
+// MFAEnrollment is what the user copies into an authenticator app.
+type MFAEnrollment struct {
+	Secret string
+	URI    string
+}
+
+type MFAStatus struct {
+	Enabled           bool
+	ConfirmedAt       time.Time
+	RecoveryCodesLeft int
+}
+
+func newMFACipher(key []byte) cipher.AEAD {
+	if len(key) == 0 {
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// MFAAvailable reports whether an MFA_ENCRYPTION_KEY is configured.
+func (s *Service) MFAAvailable() bool {
+	return s.mfaCipher != nil
+}
+
+func (s *Service) MFAStatus(ctx context.Context, userID int64) (MFAStatus, error) {
+	m, err := s.users.FindMFA(ctx, userID)
+	if errors.Is(err, user.ErrNotFound) || (err == nil && m.ConfirmedAt == nil) {
+		return MFAStatus{}, nil
+	}
+	if err != nil {
+		return MFAStatus{}, err
+	}
+	left, err := s.users.CountRecoveryCodes(ctx, userID)
+	if err != nil {
+		return MFAStatus{}, err
+	}
+	return MFAStatus{Enabled: true, ConfirmedAt: *m.ConfirmedAt, RecoveryCodesLeft: left}, nil
+}
+
+// MFARequired reports whether signing in as userID needs a second factor.
+func (s *Service) MFARequired(ctx context.Context, userID int64) (bool, error) {
+	status, err := s.MFAStatus(ctx, userID)
+	return status.Enabled, err
+}
+
+// BeginMFAEnrollment stores a new secret for u that stays inactive until
+// ConfirmMFAEnrollment sees a code generated from it.
+func (s *Service) BeginMFAEnrollment(ctx context.Context, u user.User) (MFAEnrollment, error) {
+	if !s.MFAAvailable() {
+		return MFAEnrollment{}, ErrMFAUnavailable
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+	if err := s.users.PutPendingMFA(ctx, u.ID, s.sealMFASecret(u.ID, secret)); err != nil {
+		return MFAEnrollment{}, err
+	}
+	return s.mfaEnrollment(u, secret), nil
+}
+
+// PendingMFAEnrollment returns u's unconfirmed enrollment, for showing the
+// setup page again after a wrong code.
+func (s *Service) PendingMFAEnrollment(ctx context.Context, u user.User) (MFAEnrollment, error) {
+	m, err := s.users.FindMFA(ctx, u.ID)
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+	if m.ConfirmedAt != nil {
+		return MFAEnrollment{}, user.ErrMFAEnabled
+	}
+	secret, err := s.openMFASecret(m)
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+	return s.mfaEnrollment(u, secret), nil
+}
+
+func (s *Service) mfaEnrollment(u user.User, secret []byte) MFAEnrollment {
+	account := u.Email
+	if account == "" {
+		account = u.DisplayName
+	}
+	return MFAEnrollment{
+		Secret: totpEncoding.EncodeToString(secret),
+		URI:    totpURI(s.appName, account, secret),
+	}
+}
+
+// ConfirmMFAEnrollment enables two-factor authentication when code matches
+// the pending secret and returns fresh recovery codes, shown only once.
+func (s *Service) ConfirmMFAEnrollment(ctx context.Context, userID int64, code string, now time.Time) ([]string, error) {
+	m, err := s.users.FindMFA(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if m.ConfirmedAt != nil {
+		return nil, user.ErrMFAEnabled
+	}
+	secret, err := s.openMFASecret(m)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := matchTOTP(secret, code, now)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	var codes []string
+	err = s.InTx(ctx, func(ctx context.Context) error {
+		if err := s.users.ConfirmMFA(ctx, userID, step, now); err != nil {
+			return err
+		}
+		codes, err = s.replaceRecoveryCodes(ctx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// VerifyMFA accepts a current TOTP code or an unused recovery code. Each
+// TOTP code and recovery code works only once.
+func (s *Service) VerifyMFA(ctx context.Context, userID int64, code string, now time.Time) error {
+	m, err := s.users.FindMFA(ctx, userID)
+	if errors.Is(err, user.ErrNotFound) || (err == nil && m.ConfirmedAt == nil) {
+		return ErrInvalidMFACode
+	}
+	if err != nil {
+		return err
+	}
+	secret, err := s.openMFASecret(m)
+	if err != nil {
+		return err
+	}
+	if step, ok := matchTOTP(secret, code, now); ok {
+		used, err := s.users.UseMFAStep(ctx, userID, step)
+		if err != nil {
+			return err
+		}
+		if !used {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+	used, err := s.users.UseRecoveryCode(ctx, userID, hashRecoveryCode(code), now)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces every recovery code after checking code.
+func (s *Service) RegenerateRecoveryCodes(ctx context.Context, userID int64, code string, now time.Time) ([]string, error) {
+	if err := s.VerifyMFA(ctx, userID, code, now); err != nil {
+		return nil, err
+	}
+	return s.replaceRecoveryCodes(ctx, userID)
+}
+
+// DisableMFA turns two-factor authentication off after checking code.
+func (s *Service) DisableMFA(ctx context.Context, userID int64, code string, now time.Time) error {
+	if err := s.VerifyMFA(ctx, userID, code, now); err != nil {
+		return err
+	}
+	return s.users.DeleteMFA(ctx, userID)
+}
+
+func (s *Service) replaceRecoveryCodes(ctx context.Context, userID int64) ([]string, error) {
+	codes, err := newRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	if err := s.users.ReplaceRecoveryCodes(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// CreateMFAPendingSession starts a short session that only lets the user
+// enter their second factor.
+func (s *Service) CreateMFAPendingSession(ctx context.Context, currentUser user.User, meta RequestMeta) (string, time.Time, error) {
+	return s.createSession(ctx, currentUser, meta, true)
+}
+
+// CompleteMFASession upgrades the pending session with token once the
+// second factor is verified and returns its replacement token.
+func (s *Service) CompleteMFASession(ctx context.Context, token string, now time.Time) (string, time.Time, error) {
+	newToken, err := randomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := now.Add(s.sessionTTL)
+	if err := s.users.CompleteMFASession(ctx, HashToken(token), HashToken(newToken), expiresAt, now); err != nil {
+		return "", time.Time{}, err
+	}
+	return newToken, expiresAt, nil
+}
+
+// IssueMFAChallenge returns the token an API client exchanges, together
+// with a second factor, for API tokens after an OAuth login.
+func (s *Service) IssueMFAChallenge(userID int64, now time.Time) (string, time.Time, error) {
+	if strings.TrimSpace(s.apiAccessTokenSecret) == "" {
+		return "", time.Time{}, errors.New("api access token not configured")
+	}
+	jti, err := randomToken(20)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := now.Add(mfaChallengeTTL)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		ID:        jti,
+		Subject:   formatUserID(userID),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+		Issuer:    "go-starter",
+		Audience:  []string{mfaChallengeAudience},
+	})
+	signed, err := token.SignedString([]byte(s.apiAccessTokenSecret))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// ParseMFAChallenge returns the user a challenge token was issued to.
+func (s *Service) ParseMFAChallenge(tokenString string) (int64, error) {
+	tokenString = strings.TrimSpace(tokenString)
+	if tokenString == "" || strings.TrimSpace(s.apiAccessTokenSecret) == "" {
+		return 0, errors.New("unauthorized")
+	}
+	var claims jwt.RegisteredClaims
+	parsed, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (any, error) {
+		return []byte(s.apiAccessTokenSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(mfaChallengeAudience))
+	if err != nil {
+		return 0, err
+	}
+	if !parsed.Valid {
+		return 0, errors.New("invalid token")
+	}
+	return parseUserID(claims.Subject)
+}
+
+func (s *Service) sealMFASecret(userID int64, secret []byte) []byte {
+	nonce := make([]byte, s.mfaCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return s.mfaCipher.Seal(nonce, nonce, secret, mfaAdditionalData(userID))
+}
+
+func (s *Service) openMFASecret(m user.MFA) ([]byte, error) {
+	if !s.MFAAvailable() {
+		return nil, ErrMFAUnavailable
+	}
+	size := s.mfaCipher.NonceSize()
+	if len(m.SecretCiphertext) < size {
+		return nil, errors.New("mfa secret is corrupt")
+	}
+	nonce, sealed := m.SecretCiphertext[:size], m.SecretCiphertext[size:]
+	return s.mfaCipher.Open(nil, nonce, sealed, mfaAdditionalData(m.UserID))
+}
+
+// mfaAdditionalData binds a ciphertext to its user, so copying it to
+// another row does not decrypt.
+func mfaAdditionalData(userID int64) []byte {
+	return []byte("user:" + strconv.FormatInt(userID, 10))
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/user"
+)
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	t.Parallel()
+
+	// RFC 6238 appendix B SHA-1 vectors, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	for _, tc := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		if got := totpCode(secret, totpStep(time.Unix(tc.unix, 0))); got != tc.want {
+			t.Errorf("code at %d = %s, want %s", tc.unix, got, tc.want)
+		}
+	}
+}
+
+func TestMatchTOTPAllowsOneStepOfDrift(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111109, 0)
+	step := totpStep(now)
+	for _, offset := range []int64{-1, 0, 1} {
+		got, ok := matchTOTP(secret, totpCode(secret, step+offset), now)
+		if !ok || got != step+offset {
+			t.Errorf("offset %d: step %d ok %v", offset, got, ok)
+		}
+	}
+	if _, ok := matchTOTP(secret, totpCode(secret, step+2), now); ok {
+		t.Error("code two steps ahead should not match")
+	}
+	code := totpCode(secret, step)
+	if _, ok := matchTOTP(secret, code[:3]+" "+code[3:], now); !ok {
+		t.Error("spaces inside a code should be ignored")
+	}
+	if _, ok := matchTOTP(secret, "", now); ok {
+		t.Error("empty code should not match")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	t.Parallel()
+
+	codes, err := newRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		t.Fatalf("new codes: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' || seen[code] {
+			t.Fatalf("unexpected code %q in %q", code, codes)
+		}
+		seen[code] = true
+	}
+	want := hashRecoveryCode(codes[0])
+	if got := hashRecoveryCode(" " + strings.ToUpper(strings.ReplaceAll(codes[0], "-", "")) + " "); got != want {
+		t.Error("case, spaces and dashes should not change the hash")
+	}
+}
+
+func TestMFASecretIsBoundToItsUser(t *testing.T) {
+	t.Parallel()
+
+	s := &Service{mfaCipher: newMFACipher(bytes.Repeat([]byte{7}, 32))}
+	secret := []byte("12345678901234567890")
+	sealed := s.sealMFASecret(42, secret)
+	if bytes.Contains(sealed, secret) {
+		t.Fatal("secret stored in plain text")
+	}
+	got, err := s.openMFASecret(user.MFA{UserID: 42, SecretCiphertext: sealed})
+	if err != nil || !bytes.Equal(got, secret) {
+		t.Fatalf("open = %q, %v", got, err)
+	}
+	if _, err := s.openMFASecret(user.MFA{UserID: 43, SecretCiphertext: sealed}); err == nil {
+		t.Fatal("a secret copied to another user should not decrypt")
+	}
+	if _, err := (&Service{}).openMFASecret(user.MFA{UserID: 42, SecretCiphertext: sealed}); err != ErrMFAUnavailable {
+		t.Fatalf("without a key: %v", err)
+	}
+}
+
+func TestMFAChallengeIsNotAnAccessToken(t *testing.T) {
+	t.Parallel()
+
+	s := &Service{apiAccessTokenSecret: "test-secret", apiAccessTokenTTL: time.Minute}
+	now := time.Now()
+	challenge, _, err := s.IssueMFAChallenge(42, now)
+	if err != nil {
+		t.Fatalf("issue challenge: %v", err)
+	}
+	if userID, err := s.ParseMFAChallenge(challenge); err != nil || userID != 42 {
+		t.Fatalf("parse challenge = %d, %v", userID, err)
+	}
+	if _, err := s.ParseAPIAccessToken(challenge); err == nil {
+		t.Fatal("challenge token accepted as an access token")
+	}
+	access, _, err := s.IssueAPIAccessToken(42, "session", now)
+	if err != nil {
+		t.Fatalf("issue access token: %v", err)
+	}
+	if _, err := s.ParseMFAChallenge(access); err == nil {
+		t.Fatal("access token accepted as a challenge token")
+	}
+}
@@ -0,0 +1,341 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/postgres"
+	"github.com/benpsk/go-starter/internal/user"
+	"github.com/benpsk/go-starter/internal/webauthn"
+)
+
+var (
+	ErrPasskeyUnavailable = errors.New("passkeys are not configured")
+	// ErrPasskeyFailed wraps every reason a passkey response is rejected.
+	ErrPasskeyFailed    = errors.New("passkey verification failed")
+	ErrLastSignInMethod = errors.New("cannot remove the last way to sign in")
+)
+
+type passkeyCeremonyKind string
+
+const (
+	passkeySignup   passkeyCeremonyKind = "signup"
+	passkeyRegister passkeyCeremonyKind = "register"
+	passkeyLogin    passkeyCeremonyKind = "login"
+)
+
+// passkeyCeremony is the server half of one create() or get() call, kept
+// until the browser answers the challenge.
+type passkeyCeremony struct {
+	kind   passkeyCeremonyKind
+	userID int64
+	handle []byte
+	// linkHandle is set when handle is new for an existing user and becomes
+	// their passkey identity on success.
+	linkHandle  bool
+	displayName string
+	expiresAt   time.Time
+}
+
+// passkeyCeremonyStore keeps ceremonies in memory like oauthFlowStore, keyed
+// by challenge.
+type passkeyCeremonyStore struct {
+	mu         sync.Mutex
+	ceremonies map[string]passkeyCeremony
+}
+
+func newPasskeyCeremonyStore() *passkeyCeremonyStore {
+	return &passkeyCeremonyStore{ceremonies: map[string]passkeyCeremony{}}
+}
+
+func (s *passkeyCeremonyStore) start(c passkeyCeremony, now time.Time) ([]byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, existing := range s.ceremonies {
+		if now.After(existing.expiresAt) {
+			delete(s.ceremonies, key)
+		}
+	}
+	// A little longer than the browser timeout, for the round trip.
+	c.expiresAt = now.Add(webauthn.Timeout + time.Minute)
+	s.ceremonies[string(challenge)] = c
+	return challenge, nil
+}
+
+func (s *passkeyCeremonyStore) consume(challenge []byte, kind passkeyCeremonyKind, now time.Time) (passkeyCeremony, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.ceremonies[string(challenge)]
+	if !ok {
+		return passkeyCeremony{}, false
+	}
+	delete(s.ceremonies, string(challenge))
+	if c.kind != kind || now.After(c.expiresAt) {
+		return passkeyCeremony{}, false
+	}
+	return c, true
+}
+
+// PasskeysAvailable reports whether APP_URL gave a usable relying party.
+func (s *Service) PasskeysAvailable() bool {
+	return s.relyingParty.ID != ""
+}
+
+// BeginPasskeySignup starts creating a new account whose only way to sign
+// in is the passkey being made.
+func (s *Service) BeginPasskeySignup(displayName string, now time.Time) (webauthn.CreationOptions, error) {
+	if !s.PasskeysAvailable() {
+		return webauthn.CreationOptions{}, ErrPasskeyUnavailable
+	}
+	handle, err := newPasskeyHandle()
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+	displayName = strings.TrimSpace(displayName)
+	challenge, err := s.passkeyCeremonies.start(passkeyCeremony{kind: passkeySignup, handle: handle, displayName: displayName}, now)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+	return s.relyingParty.CreationOptions(challenge, webauthn.User{Handle: handle, Name: displayName, DisplayName: displayName}, nil), nil
+}
+
+// BeginPasskeyRegistration starts adding a passkey to u's account. A
+// passkey signs in without the second factor, so when two-factor
+// authentication is on mfaCode must be a current TOTP or recovery code, as
+// for turning it off. Only the ceremony started here can be finished.
+func (s *Service) BeginPasskeyRegistration(ctx context.Context, u user.User, mfaCode string, now time.Time) (webauthn.CreationOptions, error) {
+	if !s.PasskeysAvailable() {
+		return webauthn.CreationOptions{}, ErrPasskeyUnavailable
+	}
+	required, err := s.MFARequired(ctx, u.ID)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+	if required {
+		if err := s.VerifyMFA(ctx, u.ID, mfaCode, now); err != nil {
+			return webauthn.CreationOptions{}, err
+		}
+	}
+	handle, err := s.passkeyHandle(ctx, u.ID)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+	linkHandle := handle == nil
+	if linkHandle {
+		if handle, err = newPasskeyHandle(); err != nil {
+			return webauthn.CreationOptions{}, err
+		}
+	}
+	existing, err := s.users.ListPasskeys(ctx, u.ID)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+	exclude := make([]webauthn.Credential, len(existing))
+	for i, p := range existing {
+		exclude[i] = webauthn.Credential{ID: p.CredentialID, Transports: p.Transports}
+	}
+	challenge, err := s.passkeyCeremonies.start(passkeyCeremony{kind: passkeyRegister, userID: u.ID, handle: handle, linkHandle: linkHandle}, now)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+	name := u.Email
+	if name == "" {
+		name = u.DisplayName
+	}
+	return s.relyingParty.CreationOptions(challenge, webauthn.User{Handle: handle, Name: name, DisplayName: u.DisplayName}, exclude), nil
+}
+
+// FinishPasskeyRegistration verifies a create() response. With a nil
+// currentUser it completes a sign-up and returns the new user; otherwise
+// the passkey is added to currentUser.
+func (s *Service) FinishPasskeyRegistration(ctx context.Context, currentUser *user.User, resp webauthn.RegistrationResponse, meta RequestMeta, now time.Time) (user.User, error) {
+	challenge, err := resp.Challenge()
+	if err != nil {
+		return user.User{}, fmt.Errorf("%w: %w", ErrPasskeyFailed, err)
+	}
+	kind := passkeySignup
+	if currentUser != nil {
+		kind = passkeyRegister
+	}
+	c, ok := s.passkeyCeremonies.consume(challenge, kind, now)
+	if !ok || (currentUser != nil && c.userID != currentUser.ID) {
+		return user.User{}, fmt.Errorf("%w: unknown or expired challenge", ErrPasskeyFailed)
+	}
+	cred, err := s.relyingParty.VerifyRegistration(resp, challenge)
+	if err != nil {
+		return user.User{}, fmt.Errorf("%w: %w", ErrPasskeyFailed, err)
+	}
+
+	var out user.User
+	err = s.InTx(ctx, func(ctx context.Context) error {
+		var err error
+		profile := user.SocialProfile{
+			Provider:       user.ProviderPasskey,
+			ProviderUserID: encodePasskeyHandle(c.handle),
+			Name:           c.displayName,
+		}
+		if currentUser == nil {
+			out, err = s.users.CreateUserWithIdentity(ctx, profile)
+			if err != nil {
+				return err
+			}
+		} else {
+			out = *currentUser
+			if c.linkHandle {
+				if err := s.users.LinkIdentity(ctx, out.ID, profile); err != nil {
+					return err
+				}
+			}
+		}
+		_, err = s.users.CreatePasskey(ctx, user.Passkey{
+			UserID:         out.ID,
+			CredentialID:   cred.ID,
+			PublicKey:      cred.PublicKey,
+			SignCount:      cred.SignCount,
+			Transports:     cred.Transports,
+			BackupEligible: cred.BackupEligible,
+			BackedUp:       cred.BackedUp,
+			Name:           ParseDevice(meta).Description(),
+		})
+		return err
+	})
+	if err != nil {
+		return user.User{}, err
+	}
+	return out, nil
+}
+
+// BeginPasskeyLogin starts a sign-in with any passkey for this site.
+func (s *Service) BeginPasskeyLogin(now time.Time) (webauthn.RequestOptions, error) {
+	if !s.PasskeysAvailable() {
+		return webauthn.RequestOptions{}, ErrPasskeyUnavailable
+	}
+	challenge, err := s.passkeyCeremonies.start(passkeyCeremony{kind: passkeyLogin}, now)
+	if err != nil {
+		return webauthn.RequestOptions{}, err
+	}
+	return s.relyingParty.RequestOptions(challenge), nil
+}
+
+// FinishPasskeyLogin verifies a get() response and returns the user it
+// signs in. The passkey must belong to the user its handle names, and its
+// signature counter must move forward.
+func (s *Service) FinishPasskeyLogin(ctx context.Context, resp webauthn.AssertionResponse, now time.Time) (user.User, error) {
+	challenge, err := resp.Challenge()
+	if err != nil {
+		return user.User{}, fmt.Errorf("%w: %w", ErrPasskeyFailed, err)
+	}
+	if _, ok := s.passkeyCeremonies.consume(challenge, passkeyLogin, now); !ok {
+		return user.User{}, fmt.Errorf("%w: unknown or expired challenge", ErrPasskeyFailed)
+	}
+	passkey, err := s.users.FindPasskeyByCredentialID(ctx, resp.RawID)
+	if errors.Is(err, user.ErrNotFound) {
+		return user.User{}, fmt.Errorf("%w: unknown credential", ErrPasskeyFailed)
+	}
+	if err != nil {
+		return user.User{}, err
+	}
+	if len(resp.Response.UserHandle) == 0 {
+		return user.User{}, fmt.Errorf("%w: no user handle", ErrPasskeyFailed)
+	}
+	owner, err := s.users.FindByIdentity(ctx, user.ProviderPasskey, encodePasskeyHandle(resp.Response.UserHandle))
+	if errors.Is(err, user.ErrNotFound) || (err == nil && owner.ID != passkey.UserID) {
+		return user.User{}, fmt.Errorf("%w: user handle does not match", ErrPasskeyFailed)
+	}
+	if err != nil {
+		return user.User{}, err
+	}
+	cred, err := s.relyingParty.VerifyAssertion(resp, challenge, webauthn.Credential{
+		ID:             passkey.CredentialID,
+		PublicKey:      passkey.PublicKey,
+		SignCount:      passkey.SignCount,
+		BackupEligible: passkey.BackupEligible,
+		BackedUp:       passkey.BackedUp,
+	})
+	if err != nil {
+		if errors.Is(err, webauthn.ErrSignCount) {
+			log.Printf("auth: passkey %d of user %d reused signature counter %d; it may be cloned", passkey.ID, owner.ID, passkey.SignCount)
+		}
+		return user.User{}, fmt.Errorf("%w: %w", ErrPasskeyFailed, err)
+	}
+	ok, err := s.users.UsePasskey(ctx, passkey.ID, passkey.SignCount, cred.SignCount, cred.BackedUp, now)
+	if err != nil {
+		return user.User{}, err
+	}
+	if !ok {
+		return user.User{}, fmt.Errorf("%w: %w", ErrPasskeyFailed, webauthn.ErrSignCount)
+	}
+	return owner, nil
+}
+
+func (s *Service) Passkeys(ctx context.Context, userID int64) ([]user.Passkey, error) {
+	return s.users.ListPasskeys(ctx, userID)
+}
+
+// DeletePasskey removes one of userID's passkeys, unless it is the only
+// way left to sign in to the account.
+func (s *Service) DeletePasskey(ctx context.Context, userID, passkeyID int64) error {
+	return s.InTx(ctx, func(ctx context.Context) error {
+		passkeys, err := s.users.ListPasskeys(ctx, userID)
+		if err != nil {
+			return err
+		}
+		identities, err := s.users.ListIdentitiesByUserID(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(passkeys, func(p user.Passkey) bool { return p.ID == passkeyID }) {
+			return user.ErrNotFound
+		}
+		otherMethods := len(passkeys) - 1
+		for _, identity := range identities {
+			if identity.Provider != user.ProviderPasskey {
+				otherMethods++
+			}
+		}
+		if otherMethods == 0 {
+			return ErrLastSignInMethod
+		}
+		return s.users.DeletePasskey(ctx, userID, passkeyID)
+	})
+}
+
+// passkeyHandle returns the user handle of userID's existing passkeys, or
+// nil when they have none yet. It reads from the primary: a replica that
+// has not seen the first passkey yet would have a second handle minted.
+func (s *Service) passkeyHandle(ctx context.Context, userID int64) ([]byte, error) {
+	identities, err := s.users.ListIdentitiesByUserID(postgres.WithPrimaryReads(ctx), userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, identity := range identities {
+		if identity.Provider == user.ProviderPasskey {
+			return base64.RawURLEncoding.DecodeString(identity.ProviderUserID)
+		}
+	}
+	return nil, nil
+}
+
+func newPasskeyHandle() ([]byte, error) {
+	handle := make([]byte, 32)
+	if _, err := rand.Read(handle); err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
+
+func encodePasskeyHandle(handle []byte) string {
+	return base64.RawURLEncoding.EncodeToString(handle)
+}
@@ -1,7 +1,11 @@
 package auth
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"log"
 	"math"
 	"net"
 	"net/http"
@@ -10,40 +14,188 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/forwarded"
+	"github.com/benpsk/go-starter/internal/postgres"
 )
 
 const (
 	DefaultRateLimitRequests = 10
 	DefaultRateLimitWindow   = time.Minute
+
+	// rateLimitLeaseShare is how much of a fixed or sliding window limit a
+	// replica reserves in the store at once: a lease of limit/share hits
+	// that later requests use up locally until the window ends, so a busy
+	// key costs one round-trip per lease instead of one per request.
+	// Leased hits count whether or not they are used. Limits under the
+	// share get leases of one hit, which keeps sign-in limits exact.
+	rateLimitLeaseShare = 10
+)
+
+// RateLimitAlgorithm decides how hits within a window are counted.
+type RateLimitAlgorithm string
+
+const (
+	// RateLimitFixedWindow counts hits in windows that start at a key's
+	// first hit. Cheap, but allows up to twice the limit across a window
+	// edge.
+	RateLimitFixedWindow RateLimitAlgorithm = "fixed_window"
+	// RateLimitSlidingLog keeps the time of every allowed hit and allows a
+	// request when fewer than limit happened in the last window. Exact, at
+	// the cost of storing up to limit timestamps per key.
+	RateLimitSlidingLog RateLimitAlgorithm = "sliding_log"
+	// RateLimitSlidingWindow counts hits in aligned windows and weights the
+	// previous window by how much of it still overlaps the last window.
+	RateLimitSlidingWindow RateLimitAlgorithm = "sliding_window"
+	// RateLimitTokenBucket allows bursts of up to limit requests and
+	// refills limit tokens per window.
+	RateLimitTokenBucket RateLimitAlgorithm = "token_bucket"
 )
 
-type RateLimitBucket struct {
-	windowStart time.Time
-	count       int
-	lastSeenAt  time.Time
+// RateLimitKey is what a policy counts requests by.
+type RateLimitKey string
+
+const (
+	RateLimitByIP RateLimitKey = "ip"
+	// RateLimitByUser counts per signed-in user, from the web session or
+	// an API access token, and per IP for anonymous requests.
+	RateLimitByUser RateLimitKey = "user"
+	// RateLimitByToken counts per verified API token family, and per IP for
+	// requests without a valid access or refresh token.
+	RateLimitByToken RateLimitKey = "token"
+	// RateLimitByEmail counts per address in the request's email form
+	// field, and per IP for requests without one.
+	RateLimitByEmail RateLimitKey = "email"
+)
+
+type RateLimitPolicy struct {
+	Algorithm RateLimitAlgorithm
+	Limit     int
+	Window    time.Duration
+	Key       RateLimitKey
+}
+
+// RateLimitStore keeps rate limit state per key, one method per algorithm.
+// Each call must update a key atomically. MemoryRateLimitStore keeps state
+// in this process; postgres.RateLimitStore shares it between replicas.
+type RateLimitStore interface {
+	// Add records n hits on key at now and returns the start of key's fixed
+	// window and its hit count including these. A window that started
+	// window or more before now is replaced by one starting at now.
+	Add(ctx context.Context, key string, n int, now time.Time, window time.Duration) (windowStart time.Time, count int, err error)
+	// AddSlidingWindow counts n hits in the window aligned to window that
+	// contains now, unless the previous window's count weighted by its
+	// remaining overlap plus the current count and n would exceed limit.
+	// It returns both counts after the hits.
+	AddSlidingWindow(ctx context.Context, key string, limit, n int, now time.Time, window time.Duration) (previous, current int, allowed bool, err error)
+	// AddSlidingLog records a hit at now unless limit hits happened in the
+	// window before now, and returns the recorded hits in that window,
+	// oldest first.
+	AddSlidingLog(ctx context.Context, key string, limit int, now time.Time, window time.Duration) (hits []time.Time, allowed bool, err error)
+	// TakeToken refills key's bucket of capacity tokens at capacity per
+	// window and takes one token when a whole one is available. It returns
+	// the tokens left.
+	TakeToken(ctx context.Context, key string, capacity int, now time.Time, window time.Duration) (tokens float64, allowed bool, err error)
 }
 
+var (
+	_ RateLimitStore = (*MemoryRateLimitStore)(nil)
+	_ RateLimitStore = (*postgres.RateLimitStore)(nil)
+)
+
 type RateLimiter struct {
-	mu      sync.Mutex
-	buckets map[string]RateLimitBucket
-	limit   int
-	window  time.Duration
-	now     func() time.Time
+	store         RateLimitStore
+	defaultPolicy RateLimitPolicy
+	policies      map[string]RateLimitPolicy
+	userID        func(*http.Request) int64
+	token         func(*http.Request) string
+	now           func() time.Time
+	// fallback keeps state while store is failing, so limits still apply
+	// per process.
+	fallback *MemoryRateLimitStore
+
+	mu sync.Mutex
+	// blocked caches denials until a request could be allowed again so a
+	// client that is over the limit does not cost a store round-trip per
+	// request.
+	blocked map[string]time.Time
+	// leases holds hits reserved in the store ahead of the requests that
+	// use them, see rateLimitLeaseShare.
+	leases map[string]rateLimitLease
+}
+
+// rateLimitLease is a batch of hits reserved in the store for one key.
+type rateLimitLease struct {
+	hits int
+	// remaining is what the store had left after the reservation.
+	remaining int
+	until     time.Time
 }
 
+// rateLimitDecision is the outcome of one request, reported in the
+// RateLimit-* headers.
+type rateLimitDecision struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// reset is how long until remaining goes up, or until a denied request
+	// could be allowed.
+	reset time.Duration
+	// leased is how many hits were reserved beyond this request for later
+	// requests to use.
+	leased int
+}
+
+// NewRateLimiter returns a limiter that counts every scope in fixed windows
+// by client IP, in process memory. Use WithPolicies to configure scopes
+// and WithStore to share state between replicas.
 func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
-	if limit <= 0 {
-		limit = DefaultRateLimitRequests
+	fallback := NewMemoryRateLimitStore()
+	return &RateLimiter{
+		store: fallback,
+		defaultPolicy: normalizeRateLimitPolicy(RateLimitPolicy{
+			Algorithm: RateLimitFixedWindow,
+			Limit:     limit,
+			Window:    window,
+			Key:       RateLimitByIP,
+		}),
+		policies: make(map[string]RateLimitPolicy),
+		now:      time.Now,
+		fallback: fallback,
+		blocked:  make(map[string]time.Time),
+		leases:   make(map[string]rateLimitLease),
 	}
-	if window <= 0 {
-		window = DefaultRateLimitWindow
+}
+
+func (l *RateLimiter) WithStore(store RateLimitStore) *RateLimiter {
+	if store != nil {
+		l.store = store
 	}
-	return &RateLimiter{
-		buckets: make(map[string]RateLimitBucket),
-		limit:   limit,
-		window:  window,
-		now:     time.Now,
+	return l
+}
+
+// WithPolicy sets the policy for scope; zero fields fall back to the
+// defaults.
+func (l *RateLimiter) WithPolicy(scope string, policy RateLimitPolicy) *RateLimiter {
+	l.policies[strings.TrimSpace(scope)] = normalizeRateLimitPolicy(policy)
+	return l
+}
+
+// WithPolicies applies the configured default and per-scope policies.
+func (l *RateLimiter) WithPolicies(cfg config.RateLimitConfig) *RateLimiter {
+	l.defaultPolicy = normalizeRateLimitPolicy(rateLimitPolicyFromConfig(cfg.Default))
+	for scope, policy := range cfg.Policies {
+		l.WithPolicy(scope, rateLimitPolicyFromConfig(policy))
 	}
+	return l
+}
+
+// WithIdentity sets how the user and token keys are read from a request.
+func (l *RateLimiter) WithIdentity(userID func(*http.Request) int64, token func(*http.Request) string) *RateLimiter {
+	l.userID = userID
+	l.token = token
+	return l
 }
 
 func (l *RateLimiter) SetNowForTest(now func() time.Time) {
@@ -52,22 +204,40 @@ func (l *RateLimiter) SetNowForTest(now func() time.Time) {
 	}
 }
 
+// Limit applies scope's policy.
+func (l *RateLimiter) Limit(scope string) func(http.Handler) http.Handler {
+	return l.middleware(scope, "")
+}
+
+// LimitByIP applies scope's policy but always counts by client IP.
 func (l *RateLimiter) LimitByIP(scope string) func(http.Handler) http.Handler {
+	return l.middleware(scope, RateLimitByIP)
+}
+
+// LimitByEmail applies scope's policy but always counts by the email form
+// field, so one address cannot be flooded from many IPs.
+func (l *RateLimiter) LimitByEmail(scope string) func(http.Handler) http.Handler {
+	return l.middleware(scope, RateLimitByEmail)
+}
+
+func (l *RateLimiter) middleware(scope string, key RateLimitKey) func(http.Handler) http.Handler {
 	scope = strings.TrimSpace(scope)
 	if l == nil || scope == "" {
 		return func(next http.Handler) http.Handler { return next }
 	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			key := scope + ":" + NormalizedClientIP(r)
-			if allowed, retryAfter := l.allow(key); !allowed {
-				if retryAfter > 0 {
-					seconds := int(math.Ceil(retryAfter.Seconds()))
-					if seconds < 1 {
-						seconds = 1
-					}
-					w.Header().Set("Retry-After", strconv.Itoa(seconds))
-				}
+			policy := l.policy(scope)
+			if key != "" {
+				policy.Key = key
+			}
+			decision := l.allow(r.Context(), policy, scope+":"+l.requestKey(r, policy.Key))
+			seconds := int(math.Ceil(decision.reset.Seconds()))
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(max(seconds, 0)))
+			if !decision.allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
 				if r != nil && r.URL != nil && strings.HasPrefix(r.URL.Path, "/api/") {
 					w.Header().Set("Content-Type", "application/json")
 					w.WriteHeader(http.StatusTooManyRequests)
@@ -82,56 +252,247 @@ func (l *RateLimiter) LimitByIP(scope string) func(http.Handler) http.Handler {
 	}
 }
 
-func (l *RateLimiter) allow(key string) (bool, time.Duration) {
+func (l *RateLimiter) policy(scope string) RateLimitPolicy {
+	if policy, ok := l.policies[scope]; ok {
+		return policy
+	}
+	return l.defaultPolicy
+}
+
+// requestKey identifies the client by key, falling back to its IP.
+func (l *RateLimiter) requestKey(r *http.Request, key RateLimitKey) string {
+	switch key {
+	case RateLimitByUser:
+		if l.userID != nil {
+			if id := l.userID(r); id > 0 {
+				return "user:" + strconv.FormatInt(id, 10)
+			}
+		}
+	case RateLimitByToken:
+		if l.token != nil {
+			if token := l.token(r); token != "" {
+				sum := sha256.Sum256([]byte(token))
+				return "token:" + hex.EncodeToString(sum[:16])
+			}
+		}
+	case RateLimitByEmail:
+		if email := strings.ToLower(strings.TrimSpace(r.PostFormValue("email"))); email != "" {
+			sum := sha256.Sum256([]byte(email))
+			return "email:" + hex.EncodeToString(sum[:16])
+		}
+	}
+	return "ip:" + forwarded.ClientKey(NormalizedClientIP(r))
+}
+
+func (l *RateLimiter) allow(ctx context.Context, policy RateLimitPolicy, key string) rateLimitDecision {
 	if l == nil {
-		return true, 0
+		return rateLimitDecision{allowed: true}
 	}
+	// The algorithm is part of the key so state written by one algorithm
+	// is never read by another after a policy change.
+	key = string(policy.Algorithm) + ":" + key
 	now := l.now()
 
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	until, blocked := l.blocked[key]
+	if blocked && now.Before(until) {
+		l.mu.Unlock()
+		return rateLimitDecision{limit: policy.Limit, reset: until.Sub(now)}
+	}
+	delete(l.blocked, key)
+	if lease, ok := l.leases[key]; ok && now.Before(lease.until) {
+		lease.hits--
+		if lease.hits > 0 {
+			l.leases[key] = lease
+		} else {
+			delete(l.leases, key)
+		}
+		l.mu.Unlock()
+		return rateLimitDecision{allowed: true, limit: policy.Limit, remaining: lease.remaining + lease.hits, reset: lease.until.Sub(now)}
+	}
+	delete(l.leases, key)
+	l.mu.Unlock()
 
-	l.cleanupLocked(now)
+	n := 1
+	if policy.Algorithm == RateLimitFixedWindow || policy.Algorithm == RateLimitSlidingWindow {
+		n = max(policy.Limit/rateLimitLeaseShare, 1)
+	}
+	decision, err := l.check(ctx, l.store, policy, key, now, n)
+	if err != nil {
+		log.Printf("rate limit: %v; counting in memory", err)
+		decision, _ = l.check(ctx, l.fallback, policy, key, now, n)
+	}
 
-	bucket := l.buckets[key]
-	if bucket.windowStart.IsZero() || now.Sub(bucket.windowStart) >= l.window {
-		bucket = RateLimitBucket{
-			windowStart: now,
-			count:       1,
-			lastSeenAt:  now,
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if decision.allowed {
+		if decision.leased > 0 {
+			for k, lease := range l.leases {
+				if !now.Before(lease.until) {
+					delete(l.leases, k)
+				}
+			}
+			l.leases[key] = rateLimitLease{hits: decision.leased, remaining: decision.remaining, until: now.Add(decision.reset)}
+			decision.remaining += decision.leased
+		}
+		return decision
+	}
+	for k, t := range l.blocked {
+		if !now.Before(t) {
+			delete(l.blocked, k)
 		}
-		l.buckets[key] = bucket
-		return true, 0
 	}
+	l.blocked[key] = now.Add(decision.reset)
+	return decision
+}
 
-	bucket.lastSeenAt = now
-	if bucket.count >= l.limit {
-		l.buckets[key] = bucket
-		retryAfter := l.window - now.Sub(bucket.windowStart)
-		if retryAfter < 0 {
-			retryAfter = 0
+// check counts one request in store. Fixed and sliding windows reserve n
+// hits when they fit, and report the extra ones in leased.
+func (l *RateLimiter) check(ctx context.Context, store RateLimitStore, policy RateLimitPolicy, key string, now time.Time, n int) (rateLimitDecision, error) {
+	limit, window := policy.Limit, policy.Window
+	decision := rateLimitDecision{limit: limit}
+	switch policy.Algorithm {
+	case RateLimitSlidingLog:
+		hits, allowed, err := store.AddSlidingLog(ctx, key, limit, now, window)
+		if err != nil {
+			return decision, err
+		}
+		decision.allowed = allowed
+		decision.remaining = limit - len(hits)
+		if len(hits) > 0 {
+			decision.reset = hits[0].Add(window).Sub(now)
+		}
+	case RateLimitSlidingWindow:
+		previous, current, allowed, err := store.AddSlidingWindow(ctx, key, limit, n, now, window)
+		if err == nil && !allowed && n > 1 {
+			// Too close to the limit for a lease; count this request alone.
+			n = 1
+			previous, current, allowed, err = store.AddSlidingWindow(ctx, key, limit, n, now, window)
+		}
+		if err != nil {
+			return decision, err
+		}
+		if allowed {
+			decision.leased = n - 1
 		}
-		return false, retryAfter
+		start := now.Truncate(window)
+		weight := 1 - float64(now.Sub(start))/float64(window)
+		decision.allowed = allowed
+		decision.remaining = limit - int(math.Ceil(float64(previous)*weight)) - current
+		if allowed {
+			decision.reset = start.Add(window).Sub(now)
+		} else {
+			decision.reset = slidingWindowRetryAfter(previous, current, limit, now, start, window)
+		}
+	case RateLimitTokenBucket:
+		tokens, allowed, err := store.TakeToken(ctx, key, limit, now, window)
+		if err != nil {
+			return decision, err
+		}
+		perToken := float64(window) / float64(limit)
+		decision.allowed = allowed
+		decision.remaining = int(math.Floor(tokens))
+		if allowed {
+			decision.reset = time.Duration(math.Ceil((float64(limit) - tokens) * perToken))
+		} else {
+			decision.reset = time.Duration(math.Ceil((1 - tokens) * perToken))
+		}
+	default:
+		start, count, err := store.Add(ctx, key, n, now, window)
+		if err != nil {
+			return decision, err
+		}
+		// Near the limit only part of the reservation may fit.
+		granted := min(max(limit-(count-n), 0), n)
+		decision.allowed = granted > 0
+		decision.leased = max(granted-1, 0)
+		decision.remaining = limit - count
+		decision.reset = start.Add(window).Sub(now)
 	}
+	decision.remaining = max(decision.remaining, 0)
+	decision.reset = max(decision.reset, 0)
+	return decision, nil
+}
 
-	bucket.count++
-	l.buckets[key] = bucket
-	return true, 0
+// slidingWindowRetryAfter returns how long until the weighted count leaves
+// room for one more hit: later in the current window when the current
+// count alone is under limit, otherwise in the next window once the
+// current count has decayed enough.
+func slidingWindowRetryAfter(previous, current, limit int, now, start time.Time, window time.Duration) time.Duration {
+	if current < limit && previous > 0 {
+		elapsed := 1 - float64(limit-current-1)/float64(previous)
+		return start.Add(time.Duration(math.Ceil(elapsed * float64(window)))).Sub(now)
+	}
+	if current == 0 {
+		return 0
+	}
+	elapsed := 1 - float64(limit-1)/float64(current)
+	return start.Add(window + time.Duration(math.Ceil(elapsed*float64(window)))).Sub(now)
 }
 
-func (l *RateLimiter) cleanupLocked(now time.Time) {
-	if len(l.buckets) == 0 {
-		return
+func normalizeRateLimitPolicy(policy RateLimitPolicy) RateLimitPolicy {
+	switch policy.Algorithm {
+	case RateLimitFixedWindow, RateLimitSlidingLog, RateLimitSlidingWindow, RateLimitTokenBucket:
+	default:
+		policy.Algorithm = RateLimitFixedWindow
+	}
+	if policy.Limit <= 0 {
+		policy.Limit = DefaultRateLimitRequests
+	}
+	if policy.Window <= 0 {
+		policy.Window = DefaultRateLimitWindow
 	}
-	staleAfter := l.window * 2
-	if staleAfter <= 0 {
-		staleAfter = 2 * time.Minute
+	switch policy.Key {
+	case RateLimitByUser, RateLimitByToken, RateLimitByEmail:
+	default:
+		policy.Key = RateLimitByIP
+	}
+	return policy
+}
+
+func rateLimitPolicyFromConfig(policy config.RateLimitPolicy) RateLimitPolicy {
+	return RateLimitPolicy{
+		Algorithm: RateLimitAlgorithm(policy.Algorithm),
+		Limit:     policy.Limit,
+		Window:    policy.Window,
+		Key:       RateLimitKey(policy.Key),
+	}
+}
+
+// RequestUserID returns the signed-in user from the web session or a valid
+// API access token, or 0.
+func (s *Service) RequestUserID(r *http.Request) int64 {
+	if u := CurrentUserFromRequest(r); u != nil {
+		return u.ID
+	}
+	if token := BearerTokenFromRequest(r); token != "" {
+		if parsed, err := s.ParseAPIAccessToken(token); err == nil {
+			return parsed.UserID
+		}
+	}
+	return 0
+}
+
+// RequestToken returns the token family of the request's API access token
+// or API refresh cookie once the token checks out, and "" otherwise, so
+// made-up tokens are counted by IP instead of getting fresh buckets. The
+// family stays the same as refresh tokens rotate.
+func (s *Service) RequestToken(r *http.Request) string {
+	if token := BearerTokenFromRequest(r); token != "" {
+		if parsed, err := s.ParseAPIAccessToken(token); err == nil && parsed.SessionID != "" {
+			return "family:" + parsed.SessionID
+		}
+		return ""
 	}
-	for key, bucket := range l.buckets {
-		if now.Sub(bucket.lastSeenAt) >= staleAfter {
-			delete(l.buckets, key)
+	if token := s.APIRefreshTokenFromRequest(r); token != "" {
+		// The token may have been issued by the previous refresh, so a
+		// replica would not have it yet.
+		rec, err := s.users.GetAPIRefreshTokenByHash(postgres.WithPrimaryReads(r.Context()), HashToken(token))
+		if err == nil && rec.RevokedAt == nil && time.Now().Before(rec.ExpiresAt) {
+			return "family:" + rec.FamilyID
 		}
 	}
+	return ""
 }
 
 func NormalizedClientIP(r *http.Request) string {
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+type rateLimitBucket struct {
+	// windowStart is the start of the fixed or sliding window, or the last
+	// refill of a token bucket.
+	windowStart time.Time
+	count       int
+	previous    int
+	tokens      float64
+	hits        []time.Time
+	expiresAt   time.Time
+}
+
+// MemoryRateLimitStore keeps rate limit state in a process-local map.
+type MemoryRateLimitStore struct {
+	mu          sync.Mutex
+	buckets     map[string]*rateLimitBucket
+	lastCleanup time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*rateLimitBucket)}
+}
+
+func (s *MemoryRateLimitStore) Add(_ context.Context, key string, n int, now time.Time, window time.Duration) (time.Time, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := s.bucketLocked(key, now)
+	if bucket.windowStart.IsZero() || now.Sub(bucket.windowStart) >= window {
+		*bucket = rateLimitBucket{windowStart: now, expiresAt: now.Add(window)}
+	}
+	bucket.count += n
+	return bucket.windowStart, bucket.count, nil
+}
+
+func (s *MemoryRateLimitStore) AddSlidingWindow(_ context.Context, key string, limit, n int, now time.Time, window time.Duration) (int, int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := now.Truncate(window)
+	bucket := s.bucketLocked(key, now)
+	switch {
+	case bucket.windowStart.Equal(start):
+	case bucket.windowStart.Equal(start.Add(-window)):
+		bucket.previous, bucket.count = bucket.count, 0
+	default:
+		bucket.previous, bucket.count = 0, 0
+	}
+	bucket.windowStart = start
+	bucket.expiresAt = start.Add(2 * window)
+
+	weight := 1 - float64(now.Sub(start))/float64(window)
+	allowed := float64(bucket.previous)*weight+float64(bucket.count+n) <= float64(limit)
+	if allowed {
+		bucket.count += n
+	}
+	return bucket.previous, bucket.count, allowed, nil
+}
+
+func (s *MemoryRateLimitStore) AddSlidingLog(_ context.Context, key string, limit int, now time.Time, window time.Duration) ([]time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := s.bucketLocked(key, now)
+	cutoff := now.Add(-window)
+	kept := bucket.hits[:0]
+	for _, at := range bucket.hits {
+		if at.After(cutoff) {
+			kept = append(kept, at)
+		}
+	}
+	bucket.hits = kept
+	allowed := len(bucket.hits) < limit
+	if allowed {
+		bucket.hits = append(bucket.hits, now)
+		bucket.expiresAt = now.Add(window)
+	}
+	hits := make([]time.Time, len(bucket.hits))
+	copy(hits, bucket.hits)
+	return hits, allowed, nil
+}
+
+func (s *MemoryRateLimitStore) TakeToken(_ context.Context, key string, capacity int, now time.Time, window time.Duration) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := s.bucketLocked(key, now)
+	if bucket.windowStart.IsZero() {
+		bucket.tokens = float64(capacity)
+	} else if elapsed := now.Sub(bucket.windowStart); elapsed > 0 {
+		bucket.tokens += float64(capacity) * float64(elapsed) / float64(window)
+	}
+	bucket.tokens = math.Min(bucket.tokens, float64(capacity))
+	if now.After(bucket.windowStart) {
+		bucket.windowStart = now
+	}
+	bucket.expiresAt = now.Add(window)
+
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	return bucket.tokens, allowed, nil
+}
+
+// bucketLocked returns key's bucket, creating it if needed. Expired buckets
+// are dropped at most once a minute.
+func (s *MemoryRateLimitStore) bucketLocked(key string, now time.Time) *rateLimitBucket {
+	if now.Sub(s.lastCleanup) >= time.Minute {
+		for k, bucket := range s.buckets {
+			if !now.Before(bucket.expiresAt) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastCleanup = now
+	}
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &rateLimitBucket{}
+		s.buckets[key] = bucket
+	}
+	return bucket
+}
@@ -1,10 +1,17 @@
 package auth
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/benpsk/go-starter/internal/config"
 )
 
 func TestRateLimiterMiddlewareBlocksAfterLimitAndResets(t *testing.T) {
@@ -82,6 +89,32 @@ func TestRateLimiterMiddlewareKeysByClientIP(t *testing.T) {
 	}
 }
 
+func TestRateLimiterGroupsIPv6ClientsBySlash64(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewRateLimiter(1, time.Minute)
+	handler := limiter.Limit("web_oauth_start")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	send := func(remoteAddr string) int {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/auth/login/google", nil)
+		r.RemoteAddr = remoteAddr
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if got := send("[2001:db8:1:2::1]:1000"); got != http.StatusNoContent {
+		t.Fatalf("first request status = %d", got)
+	}
+	if got := send("[2001:db8:1:2:ffff::9]:1000"); got != http.StatusTooManyRequests {
+		t.Fatalf("same /64 status = %d, want %d", got, http.StatusTooManyRequests)
+	}
+	if got := send("[2001:db8:1:3::1]:1000"); got != http.StatusNoContent {
+		t.Fatalf("other /64 status = %d, want %d", got, http.StatusNoContent)
+	}
+}
+
 func TestNormalizedClientIP(t *testing.T) {
 	t.Parallel()
 
@@ -106,3 +139,402 @@ func TestNormalizedClientIP(t *testing.T) {
 		})
 	}
 }
+
+type countingRateLimitStore struct {
+	*MemoryRateLimitStore
+	calls int
+	err   error
+}
+
+func (s *countingRateLimitStore) Add(ctx context.Context, key string, n int, now time.Time, window time.Duration) (time.Time, int, error) {
+	s.calls++
+	if s.err != nil {
+		return time.Time{}, 0, s.err
+	}
+	return s.MemoryRateLimitStore.Add(ctx, key, n, now, window)
+}
+
+func TestRateLimiterCachesDenialsUntilWindowEnds(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 2, 24, 12, 0, 0, 0, time.UTC)
+	store := &countingRateLimitStore{MemoryRateLimitStore: NewMemoryRateLimitStore()}
+	limiter := NewRateLimiter(2, time.Minute).WithStore(store)
+	limiter.SetNowForTest(func() time.Time { return now })
+	policy := limiter.policy("scope")
+	ctx := context.Background()
+
+	for i := range 2 {
+		if d := limiter.allow(ctx, policy, "scope:203.0.113.5"); !d.allowed {
+			t.Fatalf("request %d should be allowed", i+1)
+		}
+	}
+	now = now.Add(10 * time.Second)
+	d := limiter.allow(ctx, policy, "scope:203.0.113.5")
+	if d.allowed || d.reset != 50*time.Second {
+		t.Fatalf("expected a denial with 50s left, got allowed=%v reset=%s", d.allowed, d.reset)
+	}
+	for range 5 {
+		if d := limiter.allow(ctx, policy, "scope:203.0.113.5"); d.allowed {
+			t.Fatal("expected the client to stay blocked")
+		}
+	}
+	if store.calls != 3 {
+		t.Fatalf("blocked requests should not reach the store: %d calls, want 3", store.calls)
+	}
+
+	now = now.Add(50 * time.Second)
+	if d := limiter.allow(ctx, policy, "scope:203.0.113.5"); !d.allowed {
+		t.Fatal("expected a new window to allow the client")
+	}
+	if store.calls != 4 {
+		t.Fatalf("expected the new window to be counted in the store, got %d calls", store.calls)
+	}
+}
+
+func TestRateLimiterLeasesHitsForHighLimits(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 2, 24, 12, 0, 0, 0, time.UTC)
+	store := &countingRateLimitStore{MemoryRateLimitStore: NewMemoryRateLimitStore()}
+	limiter := NewRateLimiter(100, time.Minute).WithStore(store)
+	limiter.SetNowForTest(func() time.Time { return now })
+	policy := limiter.policy("scope")
+	ctx := context.Background()
+
+	for i := range 100 {
+		d := limiter.allow(ctx, policy, "scope:203.0.113.5")
+		if !d.allowed || d.remaining != 99-i {
+			t.Fatalf("request %d: allowed=%v remaining=%d, want remaining %d", i+1, d.allowed, d.remaining, 99-i)
+		}
+	}
+	if store.calls != 10 {
+		t.Fatalf("allowed requests should use leases of 10: %d store calls, want 10", store.calls)
+	}
+	if d := limiter.allow(ctx, policy, "scope:203.0.113.5"); d.allowed {
+		t.Fatal("leases must not let more than the limit through")
+	}
+
+	// Another replica used part of the window, so only some of the next
+	// lease fits.
+	now = now.Add(time.Minute)
+	if _, _, err := store.MemoryRateLimitStore.Add(ctx, "fixed_window:scope:203.0.113.5", 95, now, time.Minute); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	allowed := 0
+	for range 10 {
+		if limiter.allow(ctx, policy, "scope:203.0.113.5").allowed {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Fatalf("expected the 5 hits left in the window, got %d", allowed)
+	}
+
+	sliding := RateLimitPolicy{Algorithm: RateLimitSlidingWindow, Limit: 100, Window: time.Minute, Key: RateLimitByIP}
+	allowed = 0
+	for range 150 {
+		if limiter.allow(ctx, sliding, "scope:198.51.100.7").allowed {
+			allowed++
+		}
+	}
+	if allowed != 100 {
+		t.Fatalf("sliding window leases allowed %d requests, want 100", allowed)
+	}
+}
+
+func TestRateLimiterFallsBackToMemoryWhenStoreFails(t *testing.T) {
+	t.Parallel()
+
+	store := &countingRateLimitStore{err: errors.New("connection refused")}
+	limiter := NewRateLimiter(1, time.Minute).WithStore(store)
+	policy := limiter.policy("scope")
+	ctx := context.Background()
+
+	if d := limiter.allow(ctx, policy, "scope:198.51.100.1"); !d.allowed {
+		t.Fatal("first request should be allowed")
+	}
+	if d := limiter.allow(ctx, policy, "scope:198.51.100.1"); d.allowed {
+		t.Fatal("the in-memory fallback should still enforce the limit")
+	}
+}
+
+// hitsAllowed sends one request per step from start until end and returns
+// how many were allowed.
+func hitsAllowed(limiter *RateLimiter, policy RateLimitPolicy, now *time.Time, start, end time.Time, step time.Duration) int {
+	allowed := 0
+	for *now = start; now.Before(end); *now = now.Add(step) {
+		if limiter.allow(context.Background(), policy, "scope:client").allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestRateLimitAlgorithmsSmoothWindowEdges(t *testing.T) {
+	t.Parallel()
+
+	// One request starts the minute, then the client bursts just before
+	// and just after the window edge. A fixed window lets nearly twice the
+	// limit through within two seconds; the other algorithms hold the line.
+	tests := []struct {
+		algorithm RateLimitAlgorithm
+		want      int
+	}{
+		{algorithm: RateLimitFixedWindow, want: 19},
+		{algorithm: RateLimitSlidingLog, want: 10},
+		{algorithm: RateLimitSlidingWindow, want: 9},
+		{algorithm: RateLimitTokenBucket, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.algorithm), func(t *testing.T) {
+			t.Parallel()
+
+			start := time.Date(2026, 2, 24, 12, 0, 0, 0, time.UTC)
+			now := start
+			limiter := NewRateLimiter(10, time.Minute)
+			limiter.SetNowForTest(func() time.Time { return now })
+			policy := RateLimitPolicy{Algorithm: tt.algorithm, Limit: 10, Window: time.Minute}
+			limiter.allow(context.Background(), policy, "scope:client")
+
+			got := 0
+			for _, at := range []time.Time{start.Add(59 * time.Second), start.Add(60500 * time.Millisecond)} {
+				got += hitsAllowed(limiter, policy, &now, at, at.Add(10*time.Millisecond), time.Millisecond)
+			}
+			if got != tt.want {
+				t.Fatalf("%d requests allowed around the window edge, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitAlgorithmsRecoverAtTheConfiguredRate(t *testing.T) {
+	t.Parallel()
+
+	for _, algorithm := range []RateLimitAlgorithm{RateLimitSlidingLog, RateLimitSlidingWindow, RateLimitTokenBucket} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			t.Parallel()
+
+			start := time.Date(2026, 2, 24, 12, 0, 0, 0, time.UTC)
+			now := start
+			limiter := NewRateLimiter(6, time.Minute)
+			limiter.SetNowForTest(func() time.Time { return now })
+			policy := RateLimitPolicy{Algorithm: algorithm, Limit: 6, Window: time.Minute}
+
+			// A client sending every second for ten minutes should get
+			// close to the limit per window without exceeding it. The
+			// sliding window counter rounds in the client's disfavour.
+			got := hitsAllowed(limiter, policy, &now, start, start.Add(10*time.Minute), time.Second)
+			if got < 50 || got > 66 {
+				t.Fatalf("%d requests allowed in ten minutes, want about 60", got)
+			}
+		})
+	}
+}
+
+func TestRateLimiterSetsRateLimitHeaders(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 2, 24, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(10, time.Minute).
+		WithPolicy("api_auth_login", RateLimitPolicy{Algorithm: RateLimitTokenBucket, Limit: 3, Window: 30 * time.Second})
+	limiter.SetNowForTest(func() time.Time { return now })
+	handler := limiter.Limit("api_auth_login")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	req := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/auth/login/google", nil)
+		r.RemoteAddr = "203.0.113.5:54321"
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	var rec *httptest.ResponseRecorder
+	for i, wantRemaining := range []string{"2", "1", "0"} {
+		rec = req()
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("request %d status = %d", i+1, rec.Code)
+		}
+		if got := rec.Header().Get("RateLimit-Limit"); got != "3" {
+			t.Fatalf("RateLimit-Limit = %q, want 3", got)
+		}
+		if got := rec.Header().Get("RateLimit-Remaining"); got != wantRemaining {
+			t.Fatalf("request %d RateLimit-Remaining = %q, want %s", i+1, got, wantRemaining)
+		}
+	}
+	if got := rec.Header().Get("RateLimit-Reset"); got != "30" {
+		t.Fatalf("RateLimit-Reset after the third request = %q, want 30", got)
+	}
+
+	denied := req()
+	if denied.Code != http.StatusTooManyRequests {
+		t.Fatalf("fourth request status = %d, want %d", denied.Code, http.StatusTooManyRequests)
+	}
+	// One token refills every 10s.
+	if denied.Header().Get("RateLimit-Remaining") != "0" || denied.Header().Get("RateLimit-Reset") != "10" || denied.Header().Get("Retry-After") != "10" {
+		t.Fatalf("unexpected throttled headers %v", denied.Header())
+	}
+}
+
+func TestRateLimiterKeysByUserAndToken(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewRateLimiter(1, time.Minute).
+		WithPolicy("per_user", RateLimitPolicy{Algorithm: RateLimitSlidingLog, Limit: 1, Key: RateLimitByUser}).
+		WithPolicy("per_token", RateLimitPolicy{Algorithm: RateLimitSlidingLog, Limit: 1, Key: RateLimitByToken}).
+		WithIdentity(func(r *http.Request) int64 {
+			id, _ := strconv.ParseInt(r.Header.Get("X-Test-User"), 10, 64)
+			return id
+		}, BearerTokenFromRequest)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	send := func(scope, remoteAddr, userID, token string) int {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/auth/login/google", nil)
+		r.RemoteAddr = remoteAddr
+		if userID != "" {
+			r.Header.Set("X-Test-User", userID)
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		limiter.Limit(scope)(ok).ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if got := send("per_user", "198.51.100.1:1000", "7", ""); got != http.StatusNoContent {
+		t.Fatalf("user 7 first request = %d", got)
+	}
+	if got := send("per_user", "198.51.100.2:1000", "7", ""); got != http.StatusTooManyRequests {
+		t.Fatalf("user 7 from another IP = %d, want %d", got, http.StatusTooManyRequests)
+	}
+	if got := send("per_user", "198.51.100.1:1000", "8", ""); got != http.StatusNoContent {
+		t.Fatalf("user 8 from user 7's IP = %d, want %d", got, http.StatusNoContent)
+	}
+	if got := send("per_user", "198.51.100.1:1000", "", ""); got != http.StatusNoContent {
+		t.Fatalf("anonymous request should be counted by IP: %d", got)
+	}
+	if got := send("per_user", "198.51.100.1:1000", "", ""); got != http.StatusTooManyRequests {
+		t.Fatalf("second anonymous request from the same IP = %d, want %d", got, http.StatusTooManyRequests)
+	}
+
+	if got := send("per_token", "198.51.100.1:1000", "", "token-a"); got != http.StatusNoContent {
+		t.Fatalf("token a first request = %d", got)
+	}
+	if got := send("per_token", "198.51.100.3:1000", "", "token-a"); got != http.StatusTooManyRequests {
+		t.Fatalf("token a from another IP = %d, want %d", got, http.StatusTooManyRequests)
+	}
+	if got := send("per_token", "198.51.100.1:1000", "", "token-b"); got != http.StatusNoContent {
+		t.Fatalf("token b = %d, want %d", got, http.StatusNoContent)
+	}
+}
+
+func TestRateLimiterKeysByEmail(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewRateLimiter(1, time.Minute)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("email") == "" && r.URL.Query().Get("anonymous") == "" {
+			t.Error("the form should still be readable after the limiter")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	send := func(remoteAddr, email string) int {
+		rec := httptest.NewRecorder()
+		target := "/auth/magic-link"
+		if email == "" {
+			target += "?anonymous=1"
+		}
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(url.Values{"email": {email}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remoteAddr
+		limiter.LimitByEmail("per_email")(ok).ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if got := send("198.51.100.1:1000", "ada@example.com"); got != http.StatusNoContent {
+		t.Fatalf("first request = %d", got)
+	}
+	if got := send("198.51.100.2:1000", " ADA@example.com"); got != http.StatusTooManyRequests {
+		t.Fatalf("same address from another IP = %d, want %d", got, http.StatusTooManyRequests)
+	}
+	if got := send("198.51.100.1:1000", "grace@example.com"); got != http.StatusNoContent {
+		t.Fatalf("another address = %d, want %d", got, http.StatusNoContent)
+	}
+	if got := send("198.51.100.1:1000", ""); got != http.StatusNoContent {
+		t.Fatalf("request without an address should be counted by IP: %d", got)
+	}
+}
+
+func TestRateLimiterWithPoliciesFromConfig(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewRateLimiter(10, time.Minute).WithPolicies(config.RateLimitConfig{
+		Default: config.RateLimitPolicy{Algorithm: "sliding_window", Limit: 20, Window: time.Minute, Key: "ip"},
+		Policies: map[string]config.RateLimitPolicy{
+			"api_auth_refresh": {Algorithm: "token_bucket", Limit: 5, Window: 10 * time.Second, Key: "token"},
+		},
+	})
+	if got, want := limiter.policy("web_oauth_start"), (RateLimitPolicy{Algorithm: RateLimitSlidingWindow, Limit: 20, Window: time.Minute, Key: RateLimitByIP}); got != want {
+		t.Fatalf("default policy = %+v, want %+v", got, want)
+	}
+	if got, want := limiter.policy("api_auth_refresh"), (RateLimitPolicy{Algorithm: RateLimitTokenBucket, Limit: 5, Window: 10 * time.Second, Key: RateLimitByToken}); got != want {
+		t.Fatalf("api_auth_refresh policy = %+v, want %+v", got, want)
+	}
+}
+
+func TestRateLimiterKeysByEmailFromConfig(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewRateLimiter(10, time.Minute).WithPolicies(config.RateLimitConfig{
+		Policies: map[string]config.RateLimitPolicy{
+			"web_magic_link": {Algorithm: "fixed_window", Limit: 1, Window: time.Minute, Key: "email"},
+		},
+	})
+	handler := limiter.Limit("web_magic_link")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	send := func(remoteAddr, email string) int {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/auth/magic-link", strings.NewReader(url.Values{"email": {email}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remoteAddr
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if got := send("198.51.100.1:1000", "ada@example.com"); got != http.StatusNoContent {
+		t.Fatalf("first request = %d", got)
+	}
+	if got := send("198.51.100.2:1000", "ada@example.com"); got != http.StatusTooManyRequests {
+		t.Fatalf("same address from another IP = %d, want %d", got, http.StatusTooManyRequests)
+	}
+	if got := send("198.51.100.1:1000", "grace@example.com"); got != http.StatusNoContent {
+		t.Fatalf("another address from the same IP = %d, want %d", got, http.StatusNoContent)
+	}
+}
+
+func TestRequestTokenOnlyKeysValidTokens(t *testing.T) {
+	t.Parallel()
+
+	s := NewService(nil, config.Config{Auth: config.AuthConfig{API: config.APIAuthConfig{AccessTokenSecret: "test-api-access-secret"}}})
+	token, _, err := s.IssueAPIAccessToken(7, "family-1", time.Now())
+	if err != nil {
+		t.Fatalf("issue access token: %v", err)
+	}
+	key := func(bearer string) string {
+		r := httptest.NewRequest(http.MethodPost, "/api/auth/refresh", nil)
+		r.Header.Set("Authorization", "Bearer "+bearer)
+		return s.RequestToken(r)
+	}
+	if got := key(token); got != "family:family-1" {
+		t.Fatalf("valid token key = %q", got)
+	}
+	for _, bad := range []string{"made-up", token + "x"} {
+		if got := key(bad); got != "" {
+			t.Fatalf("invalid token %q keyed as %q", bad, got)
+		}
+	}
+}
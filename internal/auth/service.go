@@ -2,19 +2,33 @@ package auth
 
 import (
 	"context"
+	"crypto/cipher"
 	"errors"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/benpsk/go-starter/internal/abuse"
 	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/jobs"
+	"github.com/benpsk/go-starter/internal/mail"
 	"github.com/benpsk/go-starter/internal/postgres"
 	"github.com/benpsk/go-starter/internal/user"
+	"github.com/benpsk/go-starter/internal/webauthn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Service struct {
+	db                       *pgxpool.Pool
 	users                    *postgres.UserAuthStore
+	outbox                   *mail.Outbox
+	abuse                    *abuse.Detector
+	csrfKey                  []byte
+	mfaCipher                cipher.AEAD
+	relyingParty             webauthn.RelyingParty
+	passkeyCeremonies        *passkeyCeremonyStore
+	appName                  string
 	appEnv                   string
 	appURL                   string
 	sessionCookieName        string
@@ -24,15 +38,19 @@ type Service struct {
 	apiAccessTokenTTL        time.Duration
 	apiRefreshTokenTTL       time.Duration
 	apiRefreshCookieName     string
+	deviceClientIDs          []string
 	oauthFlows               *oauthFlowStore
 	verifier                 SocialVerifier
 	googleOAuth              ProviderConfig
 	githubOAuth              ProviderConfig
+	adminEmails              []string
 }
 
 func NewService(db *pgxpool.Pool, cfg config.Config) *Service {
-	return &Service{
+	s := &Service{
+		db:                       db,
 		users:                    postgres.NewUserAuthStore(db),
+		appName:                  cfg.AppName,
 		appEnv:                   cfg.AppEnv,
 		appURL:                   cfg.AppURL,
 		sessionCookieName:        cfg.Auth.SessionCookieName,
@@ -42,6 +60,7 @@ func NewService(db *pgxpool.Pool, cfg config.Config) *Service {
 		apiAccessTokenTTL:        cfg.Auth.API.AccessTokenTTL,
 		apiRefreshTokenTTL:       cfg.Auth.API.RefreshTokenTTL,
 		apiRefreshCookieName:     cfg.Auth.API.RefreshCookieName,
+		deviceClientIDs:          cfg.Auth.API.DeviceClientIDs,
 		oauthFlows:               newOAuthFlowStore(6 * time.Minute),
 		verifier:                 NewSocialVerifier(),
 		googleOAuth: ProviderConfig{
@@ -52,13 +71,47 @@ func NewService(db *pgxpool.Pool, cfg config.Config) *Service {
 			ClientID:     cfg.Auth.Social.GitHub.ClientID,
 			ClientSecret: cfg.Auth.Social.GitHub.ClientSecret,
 		},
+		adminEmails: cfg.Auth.AdminEmails,
+		csrfKey:     newCSRFKey(cfg.Auth.CSRFSecret),
+		mfaCipher:   newMFACipher(cfg.Auth.MFAEncryptionKey),
+
+		passkeyCeremonies: newPasskeyCeremonyStore(),
+	}
+	// Without a usable APP_URL passkeys stay off; PasskeysAvailable says so.
+	if rp, err := webauthn.NewRelyingParty(cfg.AppURL, cfg.AppName); err == nil {
+		s.relyingParty = rp
 	}
+	s.outbox = mail.NewOutbox(postgres.NewMailOutboxStore(db), jobs.NewClient(postgres.NewJobStore(db)), s.InTx, cfg.Mail.From)
+	s.abuse = abuse.NewDetector(postgres.NewAbuseStore(db), abuse.Options{
+		Threshold:      cfg.Abuse.Threshold,
+		Window:         cfg.Abuse.Window,
+		BanDuration:    cfg.Abuse.BanDuration,
+		MaxBanDuration: cfg.Abuse.MaxBanDuration,
+	})
+	return s
 }
 
 func (s *Service) Users() *postgres.UserAuthStore {
 	return s.users
 }
 
+// Outbox queues email; messages queued inside InTx are sent only if the
+// transaction commits.
+func (s *Service) Outbox() *mail.Outbox {
+	return s.outbox
+}
+
+// Abuse counts failed auth attempts per client and bans repeat offenders.
+func (s *Service) Abuse() *abuse.Detector {
+	return s.abuse
+}
+
+// InTx runs fn in a transaction (or a savepoint of the one already in ctx) so
+// several auth writes commit or roll back together.
+func (s *Service) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	return postgres.InTx(ctx, s.db, fn)
+}
+
 func (s *Service) SetVerifier(verifier SocialVerifier) {
 	if verifier != nil {
 		s.verifier = verifier
@@ -73,6 +126,15 @@ func (s *Service) SessionCookieName() string {
 	return s.sessionCookieName
 }
 
+// IsAdmin reports whether u's email is listed in ADMIN_EMAILS and was
+// verified, so claiming an admin's address at a provider is not enough.
+func (s *Service) IsAdmin(u *user.User) bool {
+	if u == nil || u.Email == "" || !u.EmailVerified {
+		return false
+	}
+	return slices.Contains(s.adminEmails, strings.ToLower(u.Email))
+}
+
 func (s *Service) APIAuthConfigured() bool {
 	return strings.TrimSpace(s.apiAccessTokenSecret) != ""
 }
@@ -139,9 +201,24 @@ func (s *Service) ExchangeAndVerify(ctx context.Context, provider string, code s
 }
 
 func (s *Service) FindOrCreateSocialUser(ctx context.Context, profile user.SocialProfile) (user.User, error) {
+	var out user.User
+	err := s.InTx(ctx, func(ctx context.Context) error {
+		var err error
+		out, err = s.findOrCreateSocialUser(ctx, profile)
+		return err
+	})
+	if err != nil {
+		return user.User{}, err
+	}
+	return out, nil
+}
+
+func (s *Service) findOrCreateSocialUser(ctx context.Context, profile user.SocialProfile) (user.User, error) {
 	currentUser, err := s.users.FindByIdentity(ctx, profile.Provider, profile.ProviderUserID)
 	if err == nil {
-		_ = s.users.UpdateUserFromProfile(ctx, currentUser.ID, profile)
+		if err := s.users.UpdateUserFromProfile(ctx, currentUser.ID, profile); err != nil {
+			return user.User{}, err
+		}
 		return s.users.FindByID(ctx, currentUser.ID)
 	}
 	if err != nil && !errors.Is(err, user.ErrNotFound) {
@@ -153,5 +230,15 @@ func (s *Service) FindOrCreateSocialUser(ctx context.Context, profile user.Socia
 			return user.User{}, user.ErrEmailConflict
 		}
 	}
-	return s.users.CreateUserWithIdentity(ctx, profile)
+	created, err := s.users.CreateUserWithIdentity(ctx, profile)
+	if err != nil {
+		return user.User{}, err
+	}
+	if created.Email != "" && profile.EmailVerified {
+		welcome := mail.Welcome{AppName: s.appName, AppURL: s.appURL, DisplayName: created.DisplayName}
+		if err := s.outbox.Queue(ctx, created.Email, welcome); err != nil {
+			return user.User{}, err
+		}
+	}
+	return created, nil
 }
@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/user"
+)
+
+func TestIsAdminRequiresVerifiedEmail(t *testing.T) {
+	t.Parallel()
+
+	s := NewService(nil, config.Config{Auth: config.AuthConfig{AdminEmails: []string{"ops@example.com"}}})
+	for _, tt := range []struct {
+		u    *user.User
+		want bool
+	}{
+		{u: nil},
+		{u: &user.User{Email: "someone@example.com", EmailVerified: true}},
+		{u: &user.User{Email: "ops@example.com"}},
+		{u: &user.User{Email: "Ops@Example.com", EmailVerified: true}, want: true},
+	} {
+		if got := s.IsAdmin(tt.u); got != tt.want {
+			t.Errorf("IsAdmin(%+v) = %v, want %v", tt.u, got, tt.want)
+		}
+	}
+}
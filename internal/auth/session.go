@@ -8,12 +8,16 @@ import (
 	"strings"
 	"time"
 
+	"github.com/benpsk/go-starter/internal/forwarded"
 	"github.com/benpsk/go-starter/internal/user"
 )
 
 type contextKey string
 
-const currentUserContextKey contextKey = "current_user"
+const (
+	currentUserContextKey    contextKey = "current_user"
+	mfaPendingUserContextKey contextKey = "mfa_pending_user"
+)
 
 func (s *Service) LoadSession(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -45,7 +49,11 @@ func (s *Service) LoadSession(next http.Handler) http.Handler {
 			_ = s.users.TouchSession(r.Context(), sess.ID, now)
 		}
 
-		ctx := context.WithValue(r.Context(), currentUserContextKey, &currentUser)
+		key := currentUserContextKey
+		if sess.MFAPending {
+			key = mfaPendingUserContextKey
+		}
+		ctx := context.WithValue(r.Context(), key, &currentUser)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -67,12 +75,32 @@ func skipSessionLoad(r *http.Request) bool {
 func (s *Service) RequireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if CurrentUserFromRequest(r) == nil {
+			target := "/auth/login"
+			if MFAPendingUserFromRequest(r) != nil {
+				target = "/auth/mfa"
+			}
 			if IsHtmx(r) {
-				w.Header().Set("HX-Redirect", "/auth/login")
+				w.Header().Set("HX-Redirect", target)
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
-			http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+			http.Redirect(w, r, target, http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireMFAPending lets through only sessions waiting for their second
+// factor.
+func (s *Service) RequireMFAPending(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if MFAPendingUserFromRequest(r) == nil {
+			target := "/auth/login"
+			if CurrentUserFromRequest(r) != nil {
+				target = "/account"
+			}
+			http.Redirect(w, r, target, http.StatusSeeOther)
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -103,12 +131,36 @@ func ContextWithCurrentUser(ctx context.Context, currentUser *user.User) context
 	return context.WithValue(ctx, currentUserContextKey, currentUser)
 }
 
+// MFAPendingUserFromRequest returns the user of a session that still needs
+// its second factor.
+func MFAPendingUserFromRequest(r *http.Request) *user.User {
+	if r == nil {
+		return nil
+	}
+	if u, ok := r.Context().Value(mfaPendingUserContextKey).(*user.User); ok {
+		return u
+	}
+	return nil
+}
+
+func ContextWithMFAPendingUser(ctx context.Context, pendingUser *user.User) context.Context {
+	return context.WithValue(ctx, mfaPendingUserContextKey, pendingUser)
+}
+
 func (s *Service) CreateSession(ctx context.Context, currentUser user.User, meta RequestMeta) (string, time.Time, error) {
+	return s.createSession(ctx, currentUser, meta, false)
+}
+
+func (s *Service) createSession(ctx context.Context, currentUser user.User, meta RequestMeta, mfaPending bool) (string, time.Time, error) {
 	rawToken, err := randomToken(32)
 	if err != nil {
 		return "", time.Time{}, err
 	}
-	expiresAt := time.Now().Add(s.sessionTTL)
+	ttl := s.sessionTTL
+	if mfaPending {
+		ttl = mfaPendingSessionTTL
+	}
+	expiresAt := time.Now().Add(ttl)
 	err = s.users.CreateSession(ctx, user.Session{
 		UserID:     currentUser.ID,
 		TokenHash:  HashToken(rawToken),
@@ -116,6 +168,7 @@ func (s *Service) CreateSession(ctx context.Context, currentUser user.User, meta
 		LastSeenAt: time.Now(),
 		IP:         meta.IP,
 		UserAgent:  meta.UserAgent,
+		MFAPending: mfaPending,
 	})
 	if err != nil {
 		return "", time.Time{}, err
@@ -151,6 +204,7 @@ func (s *Service) SetSessionCookie(w http.ResponseWriter, r *http.Request, token
 		Expires:  expiresAt,
 		MaxAge:   int(time.Until(expiresAt).Seconds()),
 	})
+	s.RotateCSRFCookie(w, r, token)
 }
 
 func (s *Service) ClearSessionCookie(w http.ResponseWriter, r *http.Request) {
@@ -163,6 +217,7 @@ func (s *Service) ClearSessionCookie(w http.ResponseWriter, r *http.Request) {
 		Secure:   s.SessionCookieSecure(r),
 		MaxAge:   -1,
 	})
+	s.RotateCSRFCookie(w, r, "")
 }
 
 func (s *Service) SessionTokenFromRequest(r *http.Request) string {
@@ -179,12 +234,19 @@ func (s *Service) SessionCookieSecure(r *http.Request) bool {
 	if strings.EqualFold(s.appEnv, "production") {
 		return true
 	}
-	if r != nil && r.TLS != nil {
-		return true
-	}
-	return r != nil && strings.EqualFold(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto")), "https")
+	return forwarded.IsHTTPS(r)
 }
 
 func IsHtmx(r *http.Request) bool {
 	return r.Header.Get("HX-Request") == "true"
 }
+
+// IsCrossSite reports whether the browser marked r as started by another
+// site, such as a link or form on a third-party page.
+func IsCrossSite(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "cross-site", "same-site":
+		return true
+	}
+	return false
+}
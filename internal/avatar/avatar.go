@@ -0,0 +1,162 @@
+package avatar
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // register the gif decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"strconv"
+)
+
+const (
+	// MaxBytes bounds the uploaded file, before decoding.
+	MaxBytes = 5 << 20
+	// MaxPixels bounds the decoded image so a small, highly compressed file
+	// cannot expand into gigabytes of memory.
+	MaxPixels   = 40_000_000
+	jpegQuality = 85
+)
+
+// Sizes are the square edge lengths, in pixels, every avatar is rendered at.
+var Sizes = []int{64, 128, 256}
+
+var (
+	ErrTooLarge          = errors.New("avatar file is too large")
+	ErrTooManyPixels     = errors.New("avatar dimensions are too large")
+	ErrUnsupportedFormat = errors.New("avatar must be a jpeg, png or gif image")
+)
+
+type Variant struct {
+	Size        int
+	ContentType string
+	Ext         string
+	Data        []byte
+}
+
+// Process decodes an uploaded image, applies its EXIF orientation, crops it
+// to a centred square and re-encodes it at each of Sizes. Re-encoding drops
+// all metadata, EXIF included. Images with transparency are kept as PNG,
+// everything else becomes JPEG.
+func Process(r io.Reader) ([]Variant, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, MaxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("read avatar: %w", err)
+	}
+	if len(raw) > MaxBytes {
+		return nil, ErrTooLarge
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, ErrUnsupportedFormat
+	}
+	switch format {
+	case "jpeg", "png", "gif":
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return nil, ErrTooManyPixels
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, ErrUnsupportedFormat
+	}
+	if format == "jpeg" {
+		src = applyOrientation(src, jpegOrientation(raw))
+	}
+	square := cropSquare(src)
+	opaque := isOpaque(square)
+
+	variants := make([]Variant, 0, len(Sizes))
+	for _, size := range Sizes {
+		resized := resize(square, size)
+		var buf bytes.Buffer
+		v := Variant{Size: size}
+		if opaque {
+			v.ContentType, v.Ext = "image/jpeg", "jpg"
+			err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: jpegQuality})
+		} else {
+			v.ContentType, v.Ext = "image/png", "png"
+			err = png.Encode(&buf, resized)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("encode avatar: %w", err)
+		}
+		v.Data = buf.Bytes()
+		variants = append(variants, v)
+	}
+	return variants, nil
+}
+
+// NewKeyPrefix returns a fresh storage prefix for one set of variants, so a
+// replaced avatar never shares URLs (or CDN cache entries) with the new one.
+func NewKeyPrefix(userID int64) (string, error) {
+	var raw [12]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", fmt.Errorf("random avatar key: %w", err)
+	}
+	return path.Join("avatars", strconv.FormatInt(userID, 10), hex.EncodeToString(raw[:])), nil
+}
+
+func (v Variant) Key(prefix string) string {
+	return path.Join(prefix, strconv.Itoa(v.Size)+"."+v.Ext)
+}
+
+func cropSquare(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), src, image.Pt(x0, y0), draw.Src)
+	return dst
+}
+
+// resize scales a square image to size x size by averaging the source pixels
+// under each destination pixel. Upscaling degrades to nearest neighbour.
+func resize(src *image.RGBA, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	srcSize := src.Bounds().Dx()
+	for dy := 0; dy < size; dy++ {
+		sy0 := dy * srcSize / size
+		sy1 := max((dy+1)*srcSize/size, sy0+1)
+		for dx := 0; dx < size; dx++ {
+			sx0 := dx * srcSize / size
+			sx1 := max((dx+1)*srcSize/size, sx0+1)
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				off := src.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += uint64(src.Pix[off])
+					g += uint64(src.Pix[off+1])
+					b += uint64(src.Pix[off+2])
+					a += uint64(src.Pix[off+3])
+					off += 4
+					n++
+				}
+			}
+			dst.SetRGBA(dx, dy, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+func isOpaque(img *image.RGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
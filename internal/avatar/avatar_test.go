@@ -0,0 +1,144 @@
+package avatar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestProcessRendersSquareVariantsWithoutMetadata(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			src.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 80, A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, src, nil); err != nil {
+		t.Fatalf("encode source: %v", err)
+	}
+	raw := withExifOrientation(t, buf.Bytes(), 6)
+
+	variants, err := Process(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("process: %v", err)
+	}
+	if len(variants) != len(Sizes) {
+		t.Fatalf("got %d variants, want %d", len(variants), len(Sizes))
+	}
+	for i, v := range variants {
+		if v.Size != Sizes[i] || v.ContentType != "image/jpeg" || v.Ext != "jpg" {
+			t.Fatalf("unexpected variant %d: size=%d type=%s", i, v.Size, v.ContentType)
+		}
+		if bytes.Contains(v.Data, []byte("Exif")) {
+			t.Fatalf("variant %d still carries exif", v.Size)
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(v.Data))
+		if err != nil {
+			t.Fatalf("decode variant: %v", err)
+		}
+		if cfg.Width != v.Size || cfg.Height != v.Size {
+			t.Fatalf("variant %d is %dx%d", v.Size, cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func TestProcessKeepsTransparencyAsPNG(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("encode source: %v", err)
+	}
+	variants, err := Process(&buf)
+	if err != nil {
+		t.Fatalf("process: %v", err)
+	}
+	if variants[0].ContentType != "image/png" {
+		t.Fatalf("expected png for transparent source, got %s", variants[0].ContentType)
+	}
+}
+
+func TestProcessRejectsBadInput(t *testing.T) {
+	if _, err := Process(strings.NewReader("<svg></svg>")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("expected ErrUnsupportedFormat, got %v", err)
+	}
+	if _, err := Process(bytes.NewReader(make([]byte, MaxBytes+1))); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// 2x1 image: red, blue.
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red := color.RGBA{R: 0xff, A: 0xff}
+	blue := color.RGBA{B: 0xff, A: 0xff}
+	src.SetRGBA(0, 0, red)
+	src.SetRGBA(1, 0, blue)
+
+	cases := []struct {
+		orientation int
+		w, h        int
+		first       color.RGBA
+	}{
+		{orientation: 1, w: 2, h: 1, first: red},
+		{orientation: 2, w: 2, h: 1, first: blue},
+		{orientation: 3, w: 2, h: 1, first: blue},
+		{orientation: 6, w: 1, h: 2, first: red},
+		{orientation: 8, w: 1, h: 2, first: blue},
+	}
+	for _, tc := range cases {
+		out := applyOrientation(src, tc.orientation)
+		b := out.Bounds()
+		if b.Dx() != tc.w || b.Dy() != tc.h {
+			t.Fatalf("orientation %d: got %dx%d, want %dx%d", tc.orientation, b.Dx(), b.Dy(), tc.w, tc.h)
+		}
+		if got := color.RGBAModel.Convert(out.At(b.Min.X, b.Min.Y)); got != tc.first {
+			t.Fatalf("orientation %d: top-left = %v, want %v", tc.orientation, got, tc.first)
+		}
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if got := jpegOrientation(buf.Bytes()); got != 1 {
+		t.Fatalf("plain jpeg orientation = %d, want 1", got)
+	}
+	if got := jpegOrientation(withExifOrientation(t, buf.Bytes(), 8)); got != 8 {
+		t.Fatalf("exif orientation = %d, want 8", got)
+	}
+}
+
+// withExifOrientation inserts a minimal big-endian EXIF APP1 segment holding
+// only the orientation tag right after the JPEG SOI marker.
+func withExifOrientation(t *testing.T, jpg []byte, orientation uint16) []byte {
+	t.Helper()
+	var tiff bytes.Buffer
+	tiff.WriteString("MM")
+	_ = binary.Write(&tiff, binary.BigEndian, uint16(42))
+	_ = binary.Write(&tiff, binary.BigEndian, uint32(8))
+	_ = binary.Write(&tiff, binary.BigEndian, uint16(1))
+	_ = binary.Write(&tiff, binary.BigEndian, uint16(exifOrientationTag))
+	_ = binary.Write(&tiff, binary.BigEndian, uint16(3)) // SHORT
+	_ = binary.Write(&tiff, binary.BigEndian, uint32(1))
+	_ = binary.Write(&tiff, binary.BigEndian, orientation)
+	_ = binary.Write(&tiff, binary.BigEndian, uint16(0))
+	_ = binary.Write(&tiff, binary.BigEndian, uint32(0))
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, segment...)
+	return append(out, jpg[2:]...)
+}
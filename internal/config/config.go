@@ -1,8 +1,10 @@
 package config
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"net/netip"
 	"net/url"
 	"os"
 	"strconv"
@@ -24,12 +26,37 @@ const (
 	defaultDBMaxConns       = int32(4)
 	defaultDBConnLifetime   = 30 * time.Minute
 	defaultDBConnIdleTime   = 5 * time.Minute
+	defaultDBReplicaMaxLag  = 10 * time.Second
 	defaultStorageDriver    = "local"
 	defaultLocalStorageDir  = "media"
 	defaultLocalPublicPath  = "/media"
 	defaultR2Region         = "auto"
+	defaultUploadMaxBytes   = int64(10 << 20)
+	defaultUploadURLTTL     = 15 * time.Minute
+	defaultResumableMax     = int64(5 << 30)
+	defaultUploadPartSize   = int64(8 << 20)
+	minUploadPartSize       = int64(5 << 20)
+	defaultResumableTTL     = 24 * time.Hour
+	defaultStorageGCEvery   = time.Hour
+	defaultStorageGCGrace   = 24 * time.Hour
+	defaultJobWorkers       = 4
+	defaultJobPollInterval  = time.Second
+	defaultMailDriver       = "log"
+	defaultMailFrom         = "Go Starter <no-reply@localhost>"
+	defaultSMTPPort         = 587
+	defaultRateLimitStore   = "postgres"
+	defaultRateLimitAlgo    = "sliding_window"
+	defaultRateLimitLimit   = 10
+	defaultRateLimitWindow  = time.Minute
+	defaultAbuseThreshold   = 20
+	defaultAbuseWindow      = 10 * time.Minute
+	defaultAbuseBan         = 15 * time.Minute
+	defaultAbuseMaxBan      = 24 * time.Hour
+	defaultHSTSMaxAge       = 365 * 24 * time.Hour
 )
 
+var defaultUploadContentTypes = []string{"image/jpeg", "image/png", "image/webp", "image/gif", "application/pdf"}
+
 type Config struct {
 	AppName         string
 	AppEnv          string
@@ -41,12 +68,110 @@ type Config struct {
 	Database        DatabaseConfig
 	Storage         StorageConfig
 	R2              R2Config
+	Uploads         UploadConfig
+	Jobs            JobsConfig
+	Scheduler       SchedulerConfig
+	Mail            MailConfig
+	RateLimit       RateLimitConfig
+	Abuse           AbuseConfig
+	Security        SecurityConfig
+
+	// TrustedProxies are the peers whose Forwarded/X-Forwarded-* headers
+	// are believed. Empty trusts nobody.
+	TrustedProxies []netip.Prefix
+}
+
+type RateLimitConfig struct {
+	// Store is postgres, which shares counts between replicas, or memory.
+	Store string
+	// Default applies to every scope without an entry in Policies.
+	Default  RateLimitPolicy
+	Policies map[string]RateLimitPolicy
+}
+
+// AbuseConfig controls temporary IP bans after repeated auth failures.
+type AbuseConfig struct {
+	// Threshold failures within Window ban a client; 0 disables bans.
+	Threshold int
+	Window    time.Duration
+	// BanDuration is the first ban; repeat offences last four times as
+	// long each, up to MaxBanDuration.
+	BanDuration    time.Duration
+	MaxBanDuration time.Duration
+}
+
+// SecurityConfig controls the Content-Security-Policy and HSTS headers.
+type SecurityConfig struct {
+	// CSP holds directives that replace or extend the default policy, for
+	// example "img-src 'self' https://cdn.example.com; frame-src 'none'".
+	CSP string
+	// CSPReportOnly sends the policy as Content-Security-Policy-Report-Only,
+	// so violations are reported but nothing is blocked.
+	CSPReportOnly bool
+	// HSTSMaxAge is sent in Strict-Transport-Security on HTTPS requests in
+	// production; 0 disables the header.
+	HSTSMaxAge time.Duration
+}
+
+type RateLimitPolicy struct {
+	// Algorithm is fixed_window, sliding_log, sliding_window or token_bucket.
+	Algorithm string
+	Limit     int
+	Window    time.Duration
+	// Key is what requests are counted by: ip, user or token.
+	Key string
+}
+
+type MailConfig struct {
+	// Driver is log (development; messages are logged and written to Dir
+	// when set) or smtp.
+	Driver string
+	From   string
+	Dir    string
+	SMTP   SMTPConfig
+}
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+type SchedulerConfig struct {
+	// Enabled lets this process campaign to be the leader that runs
+	// scheduled tasks.
+	Enabled bool
+}
+
+type JobsConfig struct {
+	// Workers is how many jobs the app runs at once; 0 leaves the queue to
+	// other processes.
+	Workers      int
+	PollInterval time.Duration
 }
 
 type StorageConfig struct {
 	Driver          string
 	LocalDir        string
 	LocalPublicPath string
+	SigningSecret   string
+	// Dedupe stores server-side uploads once per SHA-256 and tracks logical
+	// keys in Postgres; unreferenced blobs are collected after GCGrace.
+	Dedupe     bool
+	GCInterval time.Duration
+	GCGrace    time.Duration
+}
+
+type UploadConfig struct {
+	MaxBytes            int64
+	AllowedContentTypes []string
+	URLTTL              time.Duration
+	// Resumable (tus) uploads are streamed in PartSize chunks and may be
+	// much larger than MaxBytes.
+	ResumableMaxBytes int64
+	PartSize          int64
+	ResumableTTL      time.Duration
 }
 
 type R2Config struct {
@@ -55,6 +180,7 @@ type R2Config struct {
 	AccessKeyID     string
 	SecretAccessKey string
 	Bucket          string
+	PrivateBucket   string
 	PublicBaseURL   string
 }
 
@@ -64,6 +190,14 @@ type AuthConfig struct {
 	CookieSecure      bool
 	Social            SocialAuthConfig
 	API               APIAuthConfig
+	// AdminEmails may open /admin pages; emails are compared lower-cased.
+	AdminEmails []string
+	// CSRFSecret signs CSRF tokens. Required in production; elsewhere a
+	// random key is used, so tokens do not survive restarts.
+	CSRFSecret string
+	// MFAEncryptionKey is the 32-byte AES key that encrypts TOTP secrets.
+	// Without it two-factor enrollment is unavailable.
+	MFAEncryptionKey []byte
 }
 
 type SocialAuthConfig struct {
@@ -81,10 +215,15 @@ type APIAuthConfig struct {
 	AccessTokenTTL    time.Duration
 	RefreshTokenTTL   time.Duration
 	RefreshCookieName string
+	// DeviceClientIDs may sign in with the device authorization grant;
+	// the grant is off when it is empty.
+	DeviceClientIDs []string
 }
 
 type DatabaseConfig struct {
 	URL             string
+	ReplicaURLs     []string
+	ReplicaMaxLag   time.Duration
 	MaxConns        int32
 	MaxConnLifetime time.Duration
 	MaxConnIdleTime time.Duration
@@ -110,15 +249,54 @@ func Load() (Config, error) {
 			MaxConns:        defaultDBMaxConns,
 			MaxConnLifetime: defaultDBConnLifetime,
 			MaxConnIdleTime: defaultDBConnIdleTime,
+			ReplicaMaxLag:   defaultDBReplicaMaxLag,
 		},
 		Storage: StorageConfig{
 			Driver:          defaultStorageDriver,
 			LocalDir:        defaultLocalStorageDir,
 			LocalPublicPath: defaultLocalPublicPath,
+			GCInterval:      defaultStorageGCEvery,
+			GCGrace:         defaultStorageGCGrace,
 		},
 		R2: R2Config{
 			Region: defaultR2Region,
 		},
+		Uploads: UploadConfig{
+			MaxBytes:            defaultUploadMaxBytes,
+			AllowedContentTypes: defaultUploadContentTypes,
+			URLTTL:              defaultUploadURLTTL,
+			ResumableMaxBytes:   defaultResumableMax,
+			PartSize:            defaultUploadPartSize,
+			ResumableTTL:        defaultResumableTTL,
+		},
+		Jobs: JobsConfig{
+			Workers:      defaultJobWorkers,
+			PollInterval: defaultJobPollInterval,
+		},
+		Scheduler: SchedulerConfig{
+			Enabled: true,
+		},
+		Mail: MailConfig{
+			Driver: defaultMailDriver,
+			From:   defaultMailFrom,
+			SMTP:   SMTPConfig{Port: defaultSMTPPort},
+		},
+		RateLimit: RateLimitConfig{
+			Store: defaultRateLimitStore,
+			Default: RateLimitPolicy{
+				Algorithm: defaultRateLimitAlgo,
+				Limit:     defaultRateLimitLimit,
+				Window:    defaultRateLimitWindow,
+				Key:       "ip",
+			},
+		},
+		Abuse: AbuseConfig{
+			Threshold:      defaultAbuseThreshold,
+			Window:         defaultAbuseWindow,
+			BanDuration:    defaultAbuseBan,
+			MaxBanDuration: defaultAbuseMaxBan,
+		},
+		Security: SecurityConfig{HSTSMaxAge: defaultHSTSMaxAge},
 	}
 
 	if v := strings.TrimSpace(os.Getenv("APP_NAME")); v != "" {
@@ -150,6 +328,19 @@ func Load() (Config, error) {
 		}
 		cfg.Auth.CookieSecure = b
 	}
+	cfg.Auth.CSRFSecret = strings.TrimSpace(os.Getenv("CSRF_SECRET"))
+	if v := strings.TrimSpace(os.Getenv("MFA_ENCRYPTION_KEY")); v != "" {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(key) != 32 {
+			return Config{}, errors.New("MFA_ENCRYPTION_KEY must be 32 bytes, base64 encoded")
+		}
+		cfg.Auth.MFAEncryptionKey = key
+	}
+	for _, v := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			cfg.Auth.AdminEmails = append(cfg.Auth.AdminEmails, v)
+		}
+	}
 	cfg.Auth.Social.Google.ClientID = strings.TrimSpace(os.Getenv("GOOGLE_CLIENT_ID"))
 	cfg.Auth.Social.Google.ClientSecret = strings.TrimSpace(os.Getenv("GOOGLE_CLIENT_SECRET"))
 	cfg.Auth.Social.GitHub.ClientID = strings.TrimSpace(os.Getenv("GITHUB_CLIENT_ID"))
@@ -172,6 +363,11 @@ func Load() (Config, error) {
 	if v := strings.TrimSpace(os.Getenv("API_REFRESH_COOKIE_NAME")); v != "" {
 		cfg.Auth.API.RefreshCookieName = v
 	}
+	for _, v := range strings.Split(os.Getenv("API_DEVICE_CLIENT_IDS"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			cfg.Auth.API.DeviceClientIDs = append(cfg.Auth.API.DeviceClientIDs, v)
+		}
+	}
 	if v := strings.TrimSpace(os.Getenv("HTTP_ADDR")); v != "" {
 		cfg.HTTPAddr = v
 	}
@@ -182,6 +378,16 @@ func Load() (Config, error) {
 		}
 		cfg.ShutdownTimeout = d
 	}
+	for _, v := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		prefix, err := parseIPPrefix(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("TRUSTED_PROXIES: %q is not an IP address or CIDR", v)
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, prefix)
+	}
 
 	appURL, err := url.Parse(strings.TrimSpace(cfg.AppURL))
 	if err != nil || appURL.Scheme == "" || appURL.Host == "" {
@@ -190,6 +396,9 @@ func Load() (Config, error) {
 	if strings.EqualFold(cfg.AppEnv, "production") && !strings.EqualFold(appURL.Scheme, "https") {
 		return Config{}, errors.New("APP_URL must use https in production")
 	}
+	if strings.EqualFold(cfg.AppEnv, "production") && len(cfg.Auth.CSRFSecret) < 32 {
+		return Config{}, errors.New("CSRF_SECRET must be at least 32 characters in production")
+	}
 	cfg.AppURL = appURL.String()
 	if strings.TrimSpace(cfg.Auth.SessionCookieName) == "" {
 		cfg.Auth.SessionCookieName = defaultSessionCookie
@@ -212,6 +421,18 @@ func Load() (Config, error) {
 		return Config{}, errors.New("DATABASE_URL is required")
 	}
 	cfg.Database.URL = dbURL
+	for _, v := range strings.Split(os.Getenv("DATABASE_REPLICA_URLS"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			cfg.Database.ReplicaURLs = append(cfg.Database.ReplicaURLs, v)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("DATABASE_REPLICA_MAX_LAG")); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d <= 0 {
+			return Config{}, errors.New("DATABASE_REPLICA_MAX_LAG must be a positive duration")
+		}
+		cfg.Database.ReplicaMaxLag = d
+	}
 
 	if v := strings.TrimSpace(os.Getenv("DATABASE_MAX_CONNS")); v != "" {
 		n, err := strconv.Atoi(v)
@@ -247,6 +468,202 @@ func Load() (Config, error) {
 	if !strings.HasPrefix(cfg.Storage.LocalPublicPath, "/") {
 		cfg.Storage.LocalPublicPath = "/" + cfg.Storage.LocalPublicPath
 	}
+	cfg.Storage.SigningSecret = strings.TrimSpace(os.Getenv("STORAGE_SIGNING_SECRET"))
+	if v := strings.TrimSpace(os.Getenv("STORAGE_DEDUPE")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("parse STORAGE_DEDUPE: %w", err)
+		}
+		cfg.Storage.Dedupe = b
+	}
+	if v := strings.TrimSpace(os.Getenv("STORAGE_GC_INTERVAL")); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d <= 0 {
+			return Config{}, errors.New("STORAGE_GC_INTERVAL must be a positive duration")
+		}
+		cfg.Storage.GCInterval = d
+	}
+	if v := strings.TrimSpace(os.Getenv("STORAGE_GC_GRACE")); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d < 0 {
+			return Config{}, errors.New("STORAGE_GC_GRACE must be a non-negative duration")
+		}
+		cfg.Storage.GCGrace = d
+	}
+
+	if v := strings.TrimSpace(os.Getenv("UPLOAD_MAX_BYTES")); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return Config{}, errors.New("UPLOAD_MAX_BYTES must be a positive integer")
+		}
+		cfg.Uploads.MaxBytes = n
+	}
+	if v := strings.TrimSpace(os.Getenv("UPLOAD_ALLOWED_TYPES")); v != "" {
+		types := []string{}
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+				types = append(types, t)
+			}
+		}
+		cfg.Uploads.AllowedContentTypes = types
+	}
+	if v := strings.TrimSpace(os.Getenv("UPLOAD_URL_TTL")); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d <= 0 {
+			return Config{}, errors.New("UPLOAD_URL_TTL must be a positive duration")
+		}
+		cfg.Uploads.URLTTL = d
+	}
+	if v := strings.TrimSpace(os.Getenv("UPLOAD_RESUMABLE_MAX_BYTES")); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return Config{}, errors.New("UPLOAD_RESUMABLE_MAX_BYTES must be a positive integer")
+		}
+		cfg.Uploads.ResumableMaxBytes = n
+	}
+	if v := strings.TrimSpace(os.Getenv("UPLOAD_PART_SIZE")); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < minUploadPartSize {
+			return Config{}, fmt.Errorf("UPLOAD_PART_SIZE must be an integer of at least %d", minUploadPartSize)
+		}
+		cfg.Uploads.PartSize = n
+	}
+	if v := strings.TrimSpace(os.Getenv("UPLOAD_RESUMABLE_TTL")); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d <= 0 {
+			return Config{}, errors.New("UPLOAD_RESUMABLE_TTL must be a positive duration")
+		}
+		cfg.Uploads.ResumableTTL = d
+	}
+
+	if v := strings.TrimSpace(os.Getenv("JOBS_WORKERS")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return Config{}, errors.New("JOBS_WORKERS must be a non-negative integer")
+		}
+		cfg.Jobs.Workers = n
+	}
+	if v := strings.TrimSpace(os.Getenv("JOBS_POLL_INTERVAL")); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d <= 0 {
+			return Config{}, errors.New("JOBS_POLL_INTERVAL must be a positive duration")
+		}
+		cfg.Jobs.PollInterval = d
+	}
+	if v := strings.TrimSpace(os.Getenv("SCHEDULER_ENABLED")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("parse SCHEDULER_ENABLED: %w", err)
+		}
+		cfg.Scheduler.Enabled = b
+	}
+
+	if v := strings.TrimSpace(os.Getenv("MAIL_DRIVER")); v != "" {
+		cfg.Mail.Driver = strings.ToLower(v)
+	}
+	if v := strings.TrimSpace(os.Getenv("MAIL_FROM")); v != "" {
+		cfg.Mail.From = v
+	}
+	cfg.Mail.Dir = strings.TrimSpace(os.Getenv("MAIL_DIR"))
+	cfg.Mail.SMTP.Host = strings.TrimSpace(os.Getenv("SMTP_HOST"))
+	if v := strings.TrimSpace(os.Getenv("SMTP_PORT")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 65535 {
+			return Config{}, errors.New("SMTP_PORT must be a valid port number")
+		}
+		cfg.Mail.SMTP.Port = n
+	}
+	cfg.Mail.SMTP.Username = strings.TrimSpace(os.Getenv("SMTP_USERNAME"))
+	cfg.Mail.SMTP.Password = os.Getenv("SMTP_PASSWORD")
+	switch cfg.Mail.Driver {
+	case "log":
+	case "smtp":
+		if cfg.Mail.SMTP.Host == "" {
+			return Config{}, errors.New("MAIL_DRIVER=smtp requires SMTP_HOST")
+		}
+	default:
+		return Config{}, fmt.Errorf("MAIL_DRIVER must be either log or smtp, got %q", cfg.Mail.Driver)
+	}
+
+	if v := strings.TrimSpace(os.Getenv("RATE_LIMIT_STORE")); v != "" {
+		cfg.RateLimit.Store = strings.ToLower(v)
+	}
+	if cfg.RateLimit.Store != "postgres" && cfg.RateLimit.Store != "memory" {
+		return Config{}, fmt.Errorf("RATE_LIMIT_STORE must be either postgres or memory, got %q", cfg.RateLimit.Store)
+	}
+	if v := strings.TrimSpace(os.Getenv("RATE_LIMIT_ALGORITHM")); v != "" {
+		cfg.RateLimit.Default.Algorithm = strings.ToLower(v)
+	}
+	if !validRateLimitAlgorithm(cfg.RateLimit.Default.Algorithm) {
+		return Config{}, fmt.Errorf("RATE_LIMIT_ALGORITHM must be one of fixed_window, sliding_log, sliding_window or token_bucket, got %q", cfg.RateLimit.Default.Algorithm)
+	}
+	if v := strings.TrimSpace(os.Getenv("RATE_LIMIT_REQUESTS")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return Config{}, errors.New("RATE_LIMIT_REQUESTS must be a positive integer")
+		}
+		cfg.RateLimit.Default.Limit = n
+	}
+	if v := strings.TrimSpace(os.Getenv("RATE_LIMIT_WINDOW")); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d <= 0 {
+			return Config{}, errors.New("RATE_LIMIT_WINDOW must be a positive duration")
+		}
+		cfg.RateLimit.Default.Window = d
+	}
+	if v := strings.TrimSpace(os.Getenv("RATE_LIMIT_POLICIES")); v != "" {
+		policies, err := parseRateLimitPolicies(v, cfg.RateLimit.Default)
+		if err != nil {
+			return Config{}, fmt.Errorf("RATE_LIMIT_POLICIES: %w", err)
+		}
+		cfg.RateLimit.Policies = policies
+	}
+	if v := strings.TrimSpace(os.Getenv("ABUSE_THRESHOLD")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return Config{}, errors.New("ABUSE_THRESHOLD must be a non-negative integer")
+		}
+		cfg.Abuse.Threshold = n
+	}
+	for _, d := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"ABUSE_WINDOW", &cfg.Abuse.Window},
+		{"ABUSE_BAN_DURATION", &cfg.Abuse.BanDuration},
+		{"ABUSE_MAX_BAN_DURATION", &cfg.Abuse.MaxBanDuration},
+	} {
+		if v := strings.TrimSpace(os.Getenv(d.name)); v != "" {
+			parsed, err := parseDuration(v)
+			if err != nil || parsed <= 0 {
+				return Config{}, fmt.Errorf("%s must be a positive duration", d.name)
+			}
+			*d.dst = parsed
+		}
+	}
+	if cfg.Abuse.MaxBanDuration < cfg.Abuse.BanDuration {
+		return Config{}, errors.New("ABUSE_MAX_BAN_DURATION must not be shorter than ABUSE_BAN_DURATION")
+	}
+	if v := strings.TrimSpace(os.Getenv("CSP_POLICY")); v != "" {
+		if err := validateCSP(v); err != nil {
+			return Config{}, fmt.Errorf("CSP_POLICY: %w", err)
+		}
+		cfg.Security.CSP = v
+	}
+	if v := strings.TrimSpace(os.Getenv("CSP_REPORT_ONLY")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("parse CSP_REPORT_ONLY: %w", err)
+		}
+		cfg.Security.CSPReportOnly = b
+	}
+	if v := strings.TrimSpace(os.Getenv("HSTS_MAX_AGE")); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d < 0 {
+			return Config{}, errors.New("HSTS_MAX_AGE must be a non-negative duration")
+		}
+		cfg.Security.HSTSMaxAge = d
+	}
 
 	if v := strings.TrimSpace(os.Getenv("R2_ENDPOINT")); v != "" {
 		cfg.R2.Endpoint = v
@@ -257,6 +674,7 @@ func Load() (Config, error) {
 	cfg.R2.AccessKeyID = strings.TrimSpace(os.Getenv("R2_ACCESS_KEY_ID"))
 	cfg.R2.SecretAccessKey = strings.TrimSpace(os.Getenv("R2_SECRET_ACCESS_KEY"))
 	cfg.R2.Bucket = strings.TrimSpace(os.Getenv("R2_BUCKET"))
+	cfg.R2.PrivateBucket = strings.TrimSpace(os.Getenv("R2_PRIVATE_BUCKET"))
 	cfg.R2.PublicBaseURL = strings.TrimSpace(os.Getenv("R2_PUBLIC_BASE_URL"))
 
 	switch cfg.Storage.Driver {
@@ -291,6 +709,96 @@ func Load() (Config, error) {
 	return cfg, nil
 }
 
+// parseRateLimitPolicies reads comma-separated scope=algorithm:limit/window
+// entries with an optional :key suffix, for example
+// "api_auth_refresh=token_bucket:30/1m:token". The key defaults to def.Key.
+func parseRateLimitPolicies(v string, def RateLimitPolicy) (map[string]RateLimitPolicy, error) {
+	policies := make(map[string]RateLimitPolicy)
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		scope, spec, ok := strings.Cut(entry, "=")
+		scope = strings.TrimSpace(scope)
+		if !ok || scope == "" {
+			return nil, fmt.Errorf("%q must look like scope=algorithm:limit/window", entry)
+		}
+		parts := strings.Split(strings.TrimSpace(spec), ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("%q must look like scope=algorithm:limit/window[:key]", entry)
+		}
+		policy := RateLimitPolicy{Algorithm: strings.ToLower(strings.TrimSpace(parts[0])), Key: def.Key}
+		if !validRateLimitAlgorithm(policy.Algorithm) {
+			return nil, fmt.Errorf("unknown algorithm %q for %s", parts[0], scope)
+		}
+		limit, window, ok := strings.Cut(parts[1], "/")
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if !ok || err != nil || n <= 0 {
+			return nil, fmt.Errorf("limit for %s must be a positive integer followed by /window", scope)
+		}
+		d, err := parseDuration(window)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("window for %s must be a positive duration", scope)
+		}
+		policy.Limit, policy.Window = n, d
+		if len(parts) == 3 {
+			policy.Key = strings.ToLower(strings.TrimSpace(parts[2]))
+			if policy.Key != "ip" && policy.Key != "user" && policy.Key != "token" && policy.Key != "email" {
+				return nil, fmt.Errorf("key for %s must be ip, user, token or email, got %q", scope, parts[2])
+			}
+		}
+		policies[scope] = policy
+	}
+	return policies, nil
+}
+
+func validRateLimitAlgorithm(v string) bool {
+	switch v {
+	case "fixed_window", "sliding_log", "sliding_window", "token_bucket":
+		return true
+	}
+	return false
+}
+
+// validateCSP checks that every ;-separated directive of v starts with a
+// directive name and contains no characters that would break the header.
+func validateCSP(v string) error {
+	if strings.ContainsAny(v, "\r\n,") {
+		return errors.New("must not contain commas or line breaks")
+	}
+	for _, directive := range strings.Split(v, ";") {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), " ")
+		if name == "" {
+			continue
+		}
+		for _, c := range name {
+			if (c < 'a' || c > 'z') && c != '-' {
+				return fmt.Errorf("invalid directive %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseIPPrefix accepts a CIDR or a single address, which becomes a /32 or
+// /128 prefix.
+func parseIPPrefix(v string) (netip.Prefix, error) {
+	if strings.Contains(v, "/") {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(v)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
 func parseDuration(v string) (time.Duration, error) {
 	v = strings.TrimSpace(v)
 	if v == "" {
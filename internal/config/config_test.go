@@ -1,8 +1,13 @@
 package config
 
 import (
+	"bytes"
+	"encoding/base64"
+	"net/netip"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadStorageDefaults(t *testing.T) {
@@ -88,11 +93,404 @@ func TestLoadStorageLocalPublicPathNormalized(t *testing.T) {
 	}
 }
 
+func TestLoadDatabaseReplicaURLs(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("DATABASE_REPLICA_URLS", " postgres://replica-a:5432/test , ,postgres://replica-b:5432/test")
+	t.Setenv("DATABASE_REPLICA_MAX_LAG", "3s")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(cfg.Database.ReplicaURLs) != 2 || cfg.Database.ReplicaURLs[1] != "postgres://replica-b:5432/test" {
+		t.Errorf("ReplicaURLs: got %q", cfg.Database.ReplicaURLs)
+	}
+	if cfg.Database.ReplicaMaxLag != 3*time.Second {
+		t.Errorf("ReplicaMaxLag: got %s, want 3s", cfg.Database.ReplicaMaxLag)
+	}
+}
+
+func TestLoadUploadPolicy(t *testing.T) {
+	setBaseEnv(t)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Uploads.MaxBytes != 10<<20 || cfg.Uploads.URLTTL != 15*time.Minute || len(cfg.Uploads.AllowedContentTypes) == 0 {
+		t.Errorf("unexpected upload defaults: %+v", cfg.Uploads)
+	}
+
+	t.Setenv("UPLOAD_MAX_BYTES", "1024")
+	t.Setenv("UPLOAD_ALLOWED_TYPES", "Image/PNG, text/plain")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Uploads.MaxBytes != 1024 {
+		t.Errorf("MaxBytes: got %d, want 1024", cfg.Uploads.MaxBytes)
+	}
+	if strings.Join(cfg.Uploads.AllowedContentTypes, ",") != "image/png,text/plain" {
+		t.Errorf("AllowedContentTypes: got %q", cfg.Uploads.AllowedContentTypes)
+	}
+
+	t.Setenv("UPLOAD_MAX_BYTES", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative UPLOAD_MAX_BYTES")
+	}
+}
+
+func TestLoadResumableUploadSettings(t *testing.T) {
+	setBaseEnv(t)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Uploads.PartSize != 8<<20 || cfg.Uploads.ResumableMaxBytes != 5<<30 || cfg.Uploads.ResumableTTL != 24*time.Hour {
+		t.Errorf("unexpected resumable defaults: %+v", cfg.Uploads)
+	}
+
+	t.Setenv("UPLOAD_PART_SIZE", "1024")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for UPLOAD_PART_SIZE below the multipart minimum")
+	}
+}
+
+func TestLoadStorageDedupeSettings(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("STORAGE_DEDUPE", "true")
+	t.Setenv("STORAGE_GC_GRACE", "0s")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !cfg.Storage.Dedupe || cfg.Storage.GCInterval != time.Hour || cfg.Storage.GCGrace != 0 {
+		t.Errorf("unexpected dedupe settings: %+v", cfg.Storage)
+	}
+
+	t.Setenv("STORAGE_GC_INTERVAL", "0s")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for a zero STORAGE_GC_INTERVAL")
+	}
+}
+
+func TestLoadJobsSettings(t *testing.T) {
+	setBaseEnv(t)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Jobs.Workers != 4 || cfg.Jobs.PollInterval != time.Second {
+		t.Errorf("unexpected default jobs settings: %+v", cfg.Jobs)
+	}
+
+	t.Setenv("JOBS_WORKERS", "0")
+	t.Setenv("JOBS_POLL_INTERVAL", "250ms")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Jobs.Workers != 0 || cfg.Jobs.PollInterval != 250*time.Millisecond {
+		t.Errorf("unexpected jobs settings: %+v", cfg.Jobs)
+	}
+
+	t.Setenv("JOBS_WORKERS", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for a negative JOBS_WORKERS")
+	}
+}
+
+func TestLoadSchedulerAndAdminSettings(t *testing.T) {
+	setBaseEnv(t)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !cfg.Scheduler.Enabled || len(cfg.Auth.AdminEmails) != 0 {
+		t.Errorf("unexpected defaults: scheduler=%+v admins=%v", cfg.Scheduler, cfg.Auth.AdminEmails)
+	}
+
+	t.Setenv("SCHEDULER_ENABLED", "false")
+	t.Setenv("ADMIN_EMAILS", " Ops@Example.com, ,dev@example.com")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Scheduler.Enabled {
+		t.Error("expected the scheduler to be disabled")
+	}
+	if want := []string{"ops@example.com", "dev@example.com"}; !slices.Equal(cfg.Auth.AdminEmails, want) {
+		t.Errorf("unexpected admin emails %v, want %v", cfg.Auth.AdminEmails, want)
+	}
+}
+
+func TestLoadMailSettings(t *testing.T) {
+	setBaseEnv(t)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Mail.Driver != "log" || cfg.Mail.SMTP.Port != 587 {
+		t.Errorf("unexpected defaults: %+v", cfg.Mail)
+	}
+
+	t.Setenv("MAIL_DRIVER", "SMTP")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "SMTP_HOST") {
+		t.Fatalf("expected an error mentioning SMTP_HOST, got %v", err)
+	}
+
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_PORT", "465")
+	t.Setenv("MAIL_FROM", "Acme <hello@example.com>")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Mail.Driver != "smtp" || cfg.Mail.SMTP.Host != "smtp.example.com" || cfg.Mail.SMTP.Port != 465 || cfg.Mail.From != "Acme <hello@example.com>" {
+		t.Errorf("unexpected mail config %+v", cfg.Mail)
+	}
+
+	t.Setenv("MAIL_DRIVER", "carrier-pigeon")
+	if _, err := Load(); err == nil {
+		t.Error("expected an error for an unknown MAIL_DRIVER")
+	}
+}
+
+func TestLoadRateLimitStore(t *testing.T) {
+	setBaseEnv(t)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.RateLimit.Store != "postgres" {
+		t.Errorf("Store default: got %q, want postgres", cfg.RateLimit.Store)
+	}
+	t.Setenv("RATE_LIMIT_STORE", "Memory")
+	if cfg, err = Load(); err != nil || cfg.RateLimit.Store != "memory" {
+		t.Errorf("expected memory, got %q err=%v", cfg.RateLimit.Store, err)
+	}
+	t.Setenv("RATE_LIMIT_STORE", "redis")
+	if _, err := Load(); err == nil {
+		t.Error("expected an error for an unknown RATE_LIMIT_STORE")
+	}
+}
+
+func TestLoadRateLimitPolicies(t *testing.T) {
+	setBaseEnv(t)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want := RateLimitPolicy{Algorithm: "sliding_window", Limit: 10, Window: time.Minute, Key: "ip"}
+	if cfg.RateLimit.Default != want || len(cfg.RateLimit.Policies) != 0 {
+		t.Errorf("unexpected defaults %+v %+v", cfg.RateLimit.Default, cfg.RateLimit.Policies)
+	}
+
+	t.Setenv("RATE_LIMIT_ALGORITHM", "token_bucket")
+	t.Setenv("RATE_LIMIT_REQUESTS", "20")
+	t.Setenv("RATE_LIMIT_WINDOW", "30s")
+	t.Setenv("RATE_LIMIT_POLICIES", "api_auth_refresh=sliding_log:30/1m:token, web_oauth_start=fixed_window:5/10m, web_magic_link_email=sliding_log:3/15m:email")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if want := (RateLimitPolicy{Algorithm: "token_bucket", Limit: 20, Window: 30 * time.Second, Key: "ip"}); cfg.RateLimit.Default != want {
+		t.Errorf("Default: got %+v, want %+v", cfg.RateLimit.Default, want)
+	}
+	if want := (RateLimitPolicy{Algorithm: "sliding_log", Limit: 30, Window: time.Minute, Key: "token"}); cfg.RateLimit.Policies["api_auth_refresh"] != want {
+		t.Errorf("api_auth_refresh: got %+v, want %+v", cfg.RateLimit.Policies["api_auth_refresh"], want)
+	}
+	if want := (RateLimitPolicy{Algorithm: "fixed_window", Limit: 5, Window: 10 * time.Minute, Key: "ip"}); cfg.RateLimit.Policies["web_oauth_start"] != want {
+		t.Errorf("web_oauth_start: got %+v, want %+v", cfg.RateLimit.Policies["web_oauth_start"], want)
+	}
+	if want := (RateLimitPolicy{Algorithm: "sliding_log", Limit: 3, Window: 15 * time.Minute, Key: "email"}); cfg.RateLimit.Policies["web_magic_link_email"] != want {
+		t.Errorf("web_magic_link_email: got %+v, want %+v", cfg.RateLimit.Policies["web_magic_link_email"], want)
+	}
+
+	for _, bad := range []string{"login", "login=leaky:5/1m", "login=token_bucket:0/1m", "login=token_bucket:5", "login=token_bucket:5/1m:cookie"} {
+		t.Setenv("RATE_LIMIT_POLICIES", bad)
+		if _, err := Load(); err == nil {
+			t.Errorf("expected an error for RATE_LIMIT_POLICIES=%q", bad)
+		}
+	}
+	t.Setenv("RATE_LIMIT_POLICIES", "")
+	t.Setenv("RATE_LIMIT_ALGORITHM", "leaky_bucket")
+	if _, err := Load(); err == nil {
+		t.Error("expected an error for an unknown RATE_LIMIT_ALGORITHM")
+	}
+}
+
+func TestLoadTrustedProxies(t *testing.T) {
+	setBaseEnv(t)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(cfg.TrustedProxies) != 0 {
+		t.Errorf("TrustedProxies default: got %v, want none", cfg.TrustedProxies)
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.7,fd00::1/64")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.7/32"),
+		netip.MustParsePrefix("fd00::/64"),
+	}
+	if !slices.Equal(cfg.TrustedProxies, want) {
+		t.Errorf("TrustedProxies: got %v, want %v", cfg.TrustedProxies, want)
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8,proxy.internal")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "TRUSTED_PROXIES") {
+		t.Errorf("expected a TRUSTED_PROXIES error, got %v", err)
+	}
+}
+
+func TestLoadAbuseSettings(t *testing.T) {
+	setBaseEnv(t)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want := AbuseConfig{Threshold: 20, Window: 10 * time.Minute, BanDuration: 15 * time.Minute, MaxBanDuration: 24 * time.Hour}
+	if cfg.Abuse != want {
+		t.Errorf("Abuse defaults: got %+v, want %+v", cfg.Abuse, want)
+	}
+
+	t.Setenv("ABUSE_THRESHOLD", "0")
+	t.Setenv("ABUSE_WINDOW", "5m")
+	t.Setenv("ABUSE_BAN_DURATION", "1h")
+	t.Setenv("ABUSE_MAX_BAN_DURATION", "168h")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want = AbuseConfig{Threshold: 0, Window: 5 * time.Minute, BanDuration: time.Hour, MaxBanDuration: 168 * time.Hour}
+	if cfg.Abuse != want {
+		t.Errorf("Abuse: got %+v, want %+v", cfg.Abuse, want)
+	}
+
+	t.Setenv("ABUSE_MAX_BAN_DURATION", "30m")
+	if _, err := Load(); err == nil {
+		t.Error("expected an error when the maximum ban is shorter than the first")
+	}
+}
+
+func TestLoadSecuritySettings(t *testing.T) {
+	setBaseEnv(t)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want := SecurityConfig{HSTSMaxAge: 365 * 24 * time.Hour}
+	if cfg.Security != want {
+		t.Errorf("Security defaults: got %+v, want %+v", cfg.Security, want)
+	}
+
+	t.Setenv("CSP_POLICY", "img-src 'self' https://cdn.example.com; frame-src 'none'")
+	t.Setenv("CSP_REPORT_ONLY", "true")
+	t.Setenv("HSTS_MAX_AGE", "0")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want = SecurityConfig{CSP: "img-src 'self' https://cdn.example.com; frame-src 'none'", CSPReportOnly: true}
+	if cfg.Security != want {
+		t.Errorf("Security: got %+v, want %+v", cfg.Security, want)
+	}
+
+	for _, v := range []string{"img-src 'self', https://cdn.example.com", "IMG_SRC 'self'"} {
+		t.Setenv("CSP_POLICY", v)
+		if _, err := Load(); err == nil {
+			t.Errorf("CSP_POLICY=%q: expected an error", v)
+		}
+	}
+}
+
+func TestLoadRequiresCSRFSecretInProduction(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("APP_ENV", "production")
+	t.Setenv("APP_URL", "https://example.com")
+
+	if _, err := Load(); err == nil {
+		t.Fatal("expected an error without CSRF_SECRET in production")
+	}
+	t.Setenv("CSRF_SECRET", "too-short")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected an error for a short CSRF_SECRET")
+	}
+	t.Setenv("CSRF_SECRET", strings.Repeat("s", 32))
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Auth.CSRFSecret != strings.Repeat("s", 32) {
+		t.Fatalf("CSRFSecret = %q", cfg.Auth.CSRFSecret)
+	}
+}
+
+func TestLoadMFAEncryptionKey(t *testing.T) {
+	setBaseEnv(t)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Auth.MFAEncryptionKey != nil {
+		t.Fatalf("MFAEncryptionKey should default to nil, got %x", cfg.Auth.MFAEncryptionKey)
+	}
+
+	key := bytes.Repeat([]byte{7}, 32)
+	t.Setenv("MFA_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !bytes.Equal(cfg.Auth.MFAEncryptionKey, key) {
+		t.Fatalf("MFAEncryptionKey = %x", cfg.Auth.MFAEncryptionKey)
+	}
+
+	for _, v := range []string{"not base64!", base64.StdEncoding.EncodeToString(key[:16])} {
+		t.Setenv("MFA_ENCRYPTION_KEY", v)
+		if _, err := Load(); err == nil {
+			t.Errorf("MFA_ENCRYPTION_KEY=%q: expected an error", v)
+		}
+	}
+}
+
 // setBaseEnv installs the minimum env vars required for Load() to succeed,
 // and neutralises storage/r2 env vars that may leak in from the host.
+func TestLoadDeviceClientIDs(t *testing.T) {
+	setBaseEnv(t)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(cfg.Auth.API.DeviceClientIDs) != 0 {
+		t.Fatalf("DeviceClientIDs should default to empty, got %v", cfg.Auth.API.DeviceClientIDs)
+	}
+
+	t.Setenv("API_DEVICE_CLIENT_IDS", " starter-cli, ,Deploy-Tool ")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := cfg.Auth.API.DeviceClientIDs; len(got) != 2 || got[0] != "starter-cli" || got[1] != "Deploy-Tool" {
+		t.Fatalf("DeviceClientIDs = %v", got)
+	}
+}
+
 func setBaseEnv(t *testing.T) {
 	t.Helper()
 	t.Setenv("DATABASE_URL", "postgres://localhost:5432/test")
+	t.Setenv("DATABASE_REPLICA_URLS", "")
+	t.Setenv("DATABASE_REPLICA_MAX_LAG", "")
 	t.Setenv("STORAGE_DRIVER", "")
 	t.Setenv("LOCAL_STORAGE_DIR", "")
 	t.Setenv("LOCAL_STORAGE_PUBLIC_PATH", "")
@@ -101,5 +499,43 @@ func setBaseEnv(t *testing.T) {
 	t.Setenv("R2_ACCESS_KEY_ID", "")
 	t.Setenv("R2_SECRET_ACCESS_KEY", "")
 	t.Setenv("R2_BUCKET", "")
+	t.Setenv("R2_PRIVATE_BUCKET", "")
 	t.Setenv("R2_PUBLIC_BASE_URL", "")
+	t.Setenv("STORAGE_SIGNING_SECRET", "")
+	t.Setenv("STORAGE_DEDUPE", "")
+	t.Setenv("STORAGE_GC_INTERVAL", "")
+	t.Setenv("STORAGE_GC_GRACE", "")
+	t.Setenv("UPLOAD_MAX_BYTES", "")
+	t.Setenv("UPLOAD_ALLOWED_TYPES", "")
+	t.Setenv("UPLOAD_URL_TTL", "")
+	t.Setenv("UPLOAD_RESUMABLE_MAX_BYTES", "")
+	t.Setenv("UPLOAD_PART_SIZE", "")
+	t.Setenv("UPLOAD_RESUMABLE_TTL", "")
+	t.Setenv("JOBS_WORKERS", "")
+	t.Setenv("JOBS_POLL_INTERVAL", "")
+	t.Setenv("SCHEDULER_ENABLED", "")
+	t.Setenv("ADMIN_EMAILS", "")
+	t.Setenv("MAIL_DRIVER", "")
+	t.Setenv("MAIL_FROM", "")
+	t.Setenv("MAIL_DIR", "")
+	t.Setenv("SMTP_HOST", "")
+	t.Setenv("SMTP_PORT", "")
+	t.Setenv("SMTP_USERNAME", "")
+	t.Setenv("SMTP_PASSWORD", "")
+	t.Setenv("RATE_LIMIT_STORE", "")
+	t.Setenv("RATE_LIMIT_ALGORITHM", "")
+	t.Setenv("RATE_LIMIT_REQUESTS", "")
+	t.Setenv("RATE_LIMIT_WINDOW", "")
+	t.Setenv("RATE_LIMIT_POLICIES", "")
+	t.Setenv("TRUSTED_PROXIES", "")
+	t.Setenv("ABUSE_THRESHOLD", "")
+	t.Setenv("ABUSE_WINDOW", "")
+	t.Setenv("ABUSE_BAN_DURATION", "")
+	t.Setenv("ABUSE_MAX_BAN_DURATION", "")
+	t.Setenv("CSP_POLICY", "")
+	t.Setenv("CSRF_SECRET", "")
+	t.Setenv("MFA_ENCRYPTION_KEY", "")
+	t.Setenv("API_DEVICE_CLIENT_IDS", "")
+	t.Setenv("CSP_REPORT_ONLY", "")
+	t.Setenv("HSTS_MAX_AGE", "")
 }
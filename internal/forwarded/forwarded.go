@@ -0,0 +1,231 @@
+// Package forwarded resolves a request's client IP and scheme from the
+// Forwarded, X-Forwarded-For, X-Forwarded-Proto and X-Real-IP headers,
+// believing them only when they were added by trusted proxies.
+package forwarded
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type schemeKey struct{}
+
+// Resolver rewrites requests that arrive through trusted proxies.
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// NewResolver trusts forwarding headers set by peers within trusted. With no
+// prefixes every header is ignored and the TCP peer is the client.
+func NewResolver(trusted []netip.Prefix) *Resolver {
+	return &Resolver{trusted: trusted}
+}
+
+// Middleware replaces r.RemoteAddr with the resolved client IP and records
+// the scheme the client used, for IsHTTPS.
+func (res *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, scheme, ok := res.Resolve(r)
+		if ok {
+			r.RemoteAddr = ip.String()
+			if scheme != "" {
+				r = r.WithContext(context.WithValue(r.Context(), schemeKey{}, scheme))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Resolve walks the forwarding chain from the TCP peer towards the client
+// and stops at the first hop that is not a trusted proxy. It reports
+// false when the peer itself is not trusted, so nothing was forwarded.
+func (res *Resolver) Resolve(r *http.Request) (netip.Addr, string, bool) {
+	peer, ok := parseNode(r.RemoteAddr)
+	if !ok || !res.isTrusted(peer) {
+		return netip.Addr{}, "", false
+	}
+
+	hops, fallbackProto := forwardedHops(r.Header.Values("Forwarded")), ""
+	if hops == nil {
+		hops, fallbackProto = xForwardedHops(r.Header)
+	}
+	client, scheme := peer, ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseNode(hops[i].node)
+		if !ok {
+			// "unknown", obfuscated or malformed: the hop after it is the
+			// closest we can get to the client.
+			break
+		}
+		client, scheme = addr, hops[i].proto
+		if !res.isTrusted(addr) {
+			break
+		}
+	}
+	if scheme == "" {
+		scheme = fallbackProto
+	}
+	return client, scheme, true
+}
+
+func (res *Resolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range res.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsHTTPS reports whether the client connected over TLS, directly or to a
+// trusted proxy.
+func IsHTTPS(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	if r.TLS != nil {
+		return true
+	}
+	scheme, _ := r.Context().Value(schemeKey{}).(string)
+	return scheme == "https"
+}
+
+// ClientKey identifies the client at ip for rate limits and bans: IPv4
+// addresses as they are, IPv6 addresses by their /64, the smallest block
+// usually given to one subscriber, so rotating within it changes nothing.
+func ClientKey(ip string) string {
+	addr, ok := parseNode(ip)
+	if !ok {
+		return ip
+	}
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.String()
+	}
+	return addr.String()
+}
+
+// hop is one client-to-proxy leg: the node that connected and the scheme it
+// used, when known.
+type hop struct {
+	node  string
+	proto string
+}
+
+// forwardedHops parses RFC 7239 Forwarded headers, oldest hop first, or
+// returns nil when there are none.
+func forwardedHops(values []string) []hop {
+	var hops []hop
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			var h hop
+			for _, pair := range splitQuoted(element, ';') {
+				name, val, ok := strings.Cut(pair, "=")
+				if !ok {
+					continue
+				}
+				val = unquote(strings.TrimSpace(val))
+				switch strings.ToLower(strings.TrimSpace(name)) {
+				case "for":
+					h.node = val
+				case "proto":
+					h.proto = strings.ToLower(val)
+				}
+			}
+			hops = append(hops, h)
+		}
+	}
+	return hops
+}
+
+// xForwardedHops builds the chain from X-Forwarded-For, or X-Real-IP when
+// it is absent. X-Forwarded-Proto is matched to hops by position when it
+// has one value per hop; otherwise its last value, set by the nearest
+// proxy, is returned as the fallback scheme.
+func xForwardedHops(header http.Header) ([]hop, string) {
+	var nodes []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, node := range strings.Split(value, ",") {
+			nodes = append(nodes, strings.TrimSpace(node))
+		}
+	}
+	if len(nodes) == 0 {
+		if realIP := strings.TrimSpace(header.Get("X-Real-IP")); realIP != "" {
+			nodes = []string{realIP}
+		}
+	}
+	var protos []string
+	for _, value := range header.Values("X-Forwarded-Proto") {
+		for _, proto := range strings.Split(value, ",") {
+			protos = append(protos, strings.ToLower(strings.TrimSpace(proto)))
+		}
+	}
+
+	hops := make([]hop, len(nodes))
+	for i, node := range nodes {
+		hops[i].node = node
+		if len(protos) == len(nodes) {
+			hops[i].proto = protos[i]
+		}
+	}
+	if len(protos) > 0 && len(protos) != len(nodes) {
+		return hops, protos[len(protos)-1]
+	}
+	return hops, ""
+}
+
+// parseNode accepts an IP, optionally with a port and IPv6 brackets, and
+// unmaps IPv4-mapped IPv6 addresses.
+func parseNode(node string) (netip.Addr, bool) {
+	node = strings.TrimSpace(node)
+	if addr, err := netip.ParseAddrPort(node); err == nil {
+		return addr.Addr().Unmap(), true
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(node, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.WithZone("").Unmap(), true
+}
+
+// splitQuoted splits s on sep outside double-quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var (
+		parts  []string
+		quoted bool
+		start  int
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,146 @@
+package forwarded
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	t.Parallel()
+
+	res := NewResolver([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8:ffff::/48"),
+	})
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+		wantScheme string
+		wantOK     bool
+	}{
+		{
+			name:       "untrusted peer ignores headers",
+			remoteAddr: "203.0.113.9:4000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Proto": "https"},
+		},
+		{
+			name:       "x-forwarded-for from trusted proxy",
+			remoteAddr: "10.0.0.2:4000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Proto": "https"},
+			want:       "198.51.100.1", wantScheme: "https", wantOK: true,
+		},
+		{
+			name:       "spoofed entries left of the first untrusted hop are ignored",
+			remoteAddr: "10.0.0.2:4000",
+			headers:    map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 10.0.0.7", "X-Forwarded-Proto": "https"},
+			want:       "198.51.100.1", wantScheme: "https", wantOK: true,
+		},
+		{
+			name:       "x-forwarded-proto per hop",
+			remoteAddr: "10.0.0.2:4000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.7", "X-Forwarded-Proto": "http, https"},
+			want:       "198.51.100.1", wantScheme: "http", wantOK: true,
+		},
+		{
+			name:       "x-real-ip",
+			remoteAddr: "10.0.0.2:4000",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.4"},
+			want:       "198.51.100.4", wantOK: true,
+		},
+		{
+			name:       "forwarded takes precedence",
+			remoteAddr: "10.0.0.2:4000",
+			headers: map[string]string{
+				"Forwarded":       `for=192.0.2.60;proto=https;by=10.0.0.7, for="[2001:db8:ffff::17]:4711";proto=http`,
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			want: "192.0.2.60", wantScheme: "https", wantOK: true,
+		},
+		{
+			name:       "forwarded ipv6 client",
+			remoteAddr: "[2001:db8:ffff::1]:443",
+			headers:    map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711";proto=https`},
+			want:       "2001:db8:cafe::17", wantScheme: "https", wantOK: true,
+		},
+		{
+			name:       "unknown node stops at the last known hop",
+			remoteAddr: "10.0.0.2:4000",
+			headers:    map[string]string{"Forwarded": `for=unknown, for=10.0.0.9;proto=https`},
+			want:       "10.0.0.9", wantScheme: "https", wantOK: true,
+		},
+		{
+			name:       "trusted peer without headers",
+			remoteAddr: "10.0.0.2:4000",
+			want:       "10.0.0.2", wantOK: true,
+		},
+		{
+			name:       "ipv4-mapped peer",
+			remoteAddr: "[::ffff:10.0.0.2]:4000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "198.51.100.1", wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			ip, scheme, ok := res.Resolve(r)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if ip.String() != tt.want || scheme != tt.wantScheme {
+				t.Fatalf("got %s %q, want %s %q", ip, scheme, tt.want, tt.wantScheme)
+			}
+		})
+	}
+}
+
+func TestMiddlewareRewritesRemoteAddrAndScheme(t *testing.T) {
+	t.Parallel()
+
+	res := NewResolver([]netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")})
+	var (
+		gotAddr  string
+		gotHTTPS bool
+	)
+	handler := res.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAddr, gotHTTPS = r.RemoteAddr, IsHTTPS(r)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if gotAddr != "198.51.100.1" || !gotHTTPS {
+		t.Fatalf("trusted proxy: got %s https=%v", gotAddr, gotHTTPS)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.9:5000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if gotAddr != "203.0.113.9:5000" || gotHTTPS {
+		t.Fatalf("untrusted peer: got %s https=%v", gotAddr, gotHTTPS)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.9:5000"
+	r.TLS = &tls.ConnectionState{}
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if !gotHTTPS {
+		t.Fatal("a direct TLS connection should be https")
+	}
+}
@@ -0,0 +1,173 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateDone      State = "done"
+	StateDead      State = "dead"
+	StateCancelled State = "cancelled"
+)
+
+const DefaultMaxAttempts = 10
+
+var ErrNotFound = errors.New("job not found")
+
+type Job struct {
+	ID          int64
+	Kind        string
+	Payload     json.RawMessage
+	State       State
+	Attempts    int
+	MaxAttempts int
+	RunAt       time.Time
+	UniqueKey   string
+	LastError   string
+	LockedAt    *time.Time
+	CreatedAt   time.Time
+	FinishedAt  *time.Time
+}
+
+// Args is the payload of a job. Kind names the handler that runs it and
+// must not depend on the receiver's fields.
+type Args interface {
+	Kind() string
+}
+
+// NewJob is what Client.Enqueue hands to the store.
+type NewJob struct {
+	Kind        string
+	Payload     json.RawMessage
+	RunAt       time.Time
+	MaxAttempts int
+	UniqueKey   string
+}
+
+type ListFilter struct {
+	State State
+	Kind  string
+	Limit int
+}
+
+// Store persists the queue. The Postgres implementation is
+// postgres.JobStore.
+type Store interface {
+	// Insert adds job. When job.UniqueKey matches a queued or running job,
+	// that job is returned instead and inserted is false.
+	Insert(ctx context.Context, job NewJob) (out Job, inserted bool, err error)
+	// Claim marks up to limit due jobs of the given kinds as running and
+	// counts an attempt on each. Jobs claimed by another worker are skipped.
+	Claim(ctx context.Context, kinds []string, limit int) ([]Job, error)
+	// Complete, Retry and Kill take the attempts of the claim being
+	// finished and return ErrNotFound when the job is no longer running
+	// that attempt, for example because it was rescued and claimed again.
+	Complete(ctx context.Context, id int64, attempts int) error
+	// Retry puts a running job back in the queue to run at runAt.
+	Retry(ctx context.Context, id int64, attempts int, runAt time.Time, lastError string) error
+	// Kill moves a running job to the dead state.
+	Kill(ctx context.Context, id int64, attempts int, lastError string) error
+	// RescueStuck requeues jobs that have been running since before
+	// lockedBefore, whose worker most likely died.
+	RescueStuck(ctx context.Context, lockedBefore time.Time) (int, error)
+	Get(ctx context.Context, id int64) (Job, error)
+	List(ctx context.Context, filter ListFilter) ([]Job, error)
+	// Requeue runs a dead or cancelled job again with a fresh set of attempts.
+	Requeue(ctx context.Context, id int64) error
+	// Cancel stops a queued job from running. Running jobs cannot be
+	// cancelled.
+	Cancel(ctx context.Context, id int64) error
+}
+
+type EnqueueOption func(*NewJob)
+
+// RunAt schedules the job for t instead of now.
+func RunAt(t time.Time) EnqueueOption {
+	return func(j *NewJob) { j.RunAt = t }
+}
+
+func Delay(d time.Duration) EnqueueOption {
+	return func(j *NewJob) { j.RunAt = time.Now().Add(d) }
+}
+
+func MaxAttempts(n int) EnqueueOption {
+	return func(j *NewJob) { j.MaxAttempts = n }
+}
+
+// Unique drops the enqueue while a queued or running job has the same key.
+func Unique(key string) EnqueueOption {
+	return func(j *NewJob) { j.UniqueKey = key }
+}
+
+type Client struct {
+	store Store
+}
+
+func NewClient(store Store) *Client {
+	return &Client{store: store}
+}
+
+// Enqueue adds a job for args. With the Postgres store, a ctx carrying a
+// transaction enqueues inside it, so the job only exists if it commits.
+func (c *Client) Enqueue(ctx context.Context, args Args, opts ...EnqueueOption) (Job, error) {
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return Job{}, fmt.Errorf("encode %s job: %w", args.Kind(), err)
+	}
+	job := NewJob{Kind: args.Kind(), Payload: payload, MaxAttempts: DefaultMaxAttempts}
+	for _, opt := range opts {
+		opt(&job)
+	}
+	if job.MaxAttempts <= 0 {
+		return Job{}, errors.New("max attempts must be positive")
+	}
+	out, _, err := c.store.Insert(ctx, job)
+	return out, err
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks a handler error as not worth retrying; the job goes
+// straight to the dead state.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+func IsPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+const (
+	backoffBase = 15 * time.Second
+	backoffMax  = 6 * time.Hour
+)
+
+// Backoff is the delay before retrying a job that has failed attempt times:
+// 15s doubling per attempt up to 6h, with ±20% jitter so failures from one
+// outage do not all retry together.
+func Backoff(attempt int) time.Duration {
+	d := backoffMax
+	if attempt >= 1 && attempt <= 20 {
+		d = min(backoffBase<<(attempt-1), backoffMax)
+	}
+	jitter := time.Duration(rand.Int64N(int64(d)/5*2+1)) - d/5
+	return d + jitter
+}
@@ -0,0 +1,230 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Handler func(ctx context.Context, job Job) error
+
+// Registry maps job kinds to their handlers.
+type Registry struct {
+	handlers map[string]Handler
+}
+
+func NewRegistry() *Registry {
+	return &Registry{handlers: map[string]Handler{}}
+}
+
+// Register panics when kind already has a handler.
+func (r *Registry) Register(kind string, h Handler) {
+	if _, ok := r.handlers[kind]; ok {
+		panic(fmt.Sprintf("jobs: handler for %q registered twice", kind))
+	}
+	r.handlers[kind] = h
+}
+
+// Handle registers fn for T's kind and decodes each job's payload into a T
+// before calling it. A payload that does not decode kills the job.
+func Handle[T Args](r *Registry, fn func(ctx context.Context, job Job, args T) error) {
+	var zero T
+	r.Register(zero.Kind(), func(ctx context.Context, job Job) error {
+		var args T
+		if err := json.Unmarshal(job.Payload, &args); err != nil {
+			return Permanent(fmt.Errorf("decode %s payload: %w", job.Kind, err))
+		}
+		return fn(ctx, job, args)
+	})
+}
+
+// Lookup returns the handler for kind.
+func (r *Registry) Lookup(kind string) (Handler, bool) {
+	h, ok := r.handlers[kind]
+	return h, ok
+}
+
+func (r *Registry) Kinds() []string {
+	kinds := make([]string, 0, len(r.handlers))
+	for kind := range r.handlers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+const (
+	defaultJobTimeout   = 10 * time.Minute
+	defaultDrainTimeout = 30 * time.Second
+	// stuckMargin is how long past JobTimeout a job may stay running before
+	// it is assumed abandoned and requeued.
+	stuckMargin = time.Minute
+	// finishTimeout bounds recording a job's outcome, which still happens
+	// while the worker drains.
+	finishTimeout = 10 * time.Second
+)
+
+type WorkerOptions struct {
+	Concurrency  int
+	PollInterval time.Duration
+	// JobTimeout bounds a single run of a handler.
+	JobTimeout time.Duration
+	// DrainTimeout is how long Run waits for running jobs after its context
+	// is done before cancelling them.
+	DrainTimeout time.Duration
+	// Backoff defaults to the package Backoff.
+	Backoff func(attempt int) time.Duration
+}
+
+// Worker claims jobs of the registered kinds and runs up to Concurrency of
+// them at a time.
+type Worker struct {
+	store    Store
+	registry *Registry
+	opts     WorkerOptions
+}
+
+func NewWorker(store Store, registry *Registry, opts WorkerOptions) *Worker {
+	opts.Concurrency = max(opts.Concurrency, 1)
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+	if opts.JobTimeout <= 0 {
+		opts.JobTimeout = defaultJobTimeout
+	}
+	if opts.DrainTimeout <= 0 {
+		opts.DrainTimeout = defaultDrainTimeout
+	}
+	if opts.Backoff == nil {
+		opts.Backoff = Backoff
+	}
+	return &Worker{store: store, registry: registry, opts: opts}
+}
+
+// Run processes jobs until ctx is done, then stops claiming and waits up to
+// DrainTimeout for running jobs to finish. Jobs still running after that are
+// cancelled and retried later like any other failure.
+func (w *Worker) Run(ctx context.Context) {
+	kinds := w.registry.Kinds()
+	if len(kinds) == 0 {
+		log.Printf("jobs: no handlers registered, worker not started")
+		return
+	}
+
+	jobCtx, cancelJobs := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelJobs()
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, w.opts.Concurrency)
+	finished := make(chan struct{}, 1)
+
+	poll := time.NewTicker(w.opts.PollInterval)
+	defer poll.Stop()
+	rescue := time.NewTicker(w.opts.JobTimeout)
+	defer rescue.Stop()
+	w.rescueStuck(ctx)
+
+	for {
+		if free := cap(slots) - len(slots); free > 0 {
+			claimed, err := w.store.Claim(ctx, kinds, free)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("jobs: claim: %v", err)
+			}
+			for _, job := range claimed {
+				slots <- struct{}{}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					w.run(jobCtx, job)
+					<-slots
+					select {
+					case finished <- struct{}{}:
+					default:
+					}
+				}()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			w.drain(&wg, cancelJobs)
+			return
+		case <-rescue.C:
+			w.rescueStuck(ctx)
+		case <-poll.C:
+		case <-finished:
+		}
+	}
+}
+
+func (w *Worker) drain(wg *sync.WaitGroup, cancelJobs context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(w.opts.DrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Printf("jobs: cancelling jobs still running after %s", w.opts.DrainTimeout)
+		cancelJobs()
+		<-done
+	}
+}
+
+func (w *Worker) rescueStuck(ctx context.Context) {
+	n, err := w.store.RescueStuck(ctx, time.Now().Add(-w.opts.JobTimeout-stuckMargin))
+	if err != nil && ctx.Err() == nil {
+		log.Printf("jobs: rescue stuck jobs: %v", err)
+	}
+	if n > 0 {
+		log.Printf("jobs: requeued %d stuck jobs", n)
+	}
+}
+
+func (w *Worker) run(ctx context.Context, job Job) {
+	ctx, cancel := context.WithTimeout(ctx, w.opts.JobTimeout)
+	defer cancel()
+	err := w.handle(ctx, job)
+	w.finish(context.WithoutCancel(ctx), job, err)
+}
+
+func (w *Worker) handle(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	h, ok := w.registry.Lookup(job.Kind)
+	if !ok {
+		return Permanent(fmt.Errorf("no handler for job kind %q", job.Kind))
+	}
+	return h(ctx, job)
+}
+
+func (w *Worker) finish(ctx context.Context, job Job, jobErr error) {
+	ctx, cancel := context.WithTimeout(ctx, finishTimeout)
+	defer cancel()
+
+	var err error
+	switch {
+	case jobErr == nil:
+		err = w.store.Complete(ctx, job.ID, job.Attempts)
+	case IsPermanent(jobErr) || job.Attempts >= job.MaxAttempts:
+		log.Printf("jobs: %s job %d failed for good after %d attempts: %v", job.Kind, job.ID, job.Attempts, jobErr)
+		err = w.store.Kill(ctx, job.ID, job.Attempts, jobErr.Error())
+	default:
+		delay := w.opts.Backoff(job.Attempts)
+		log.Printf("jobs: %s job %d failed (attempt %d of %d), retrying in %s: %v", job.Kind, job.ID, job.Attempts, job.MaxAttempts, delay.Round(time.Second), jobErr)
+		err = w.store.Retry(ctx, job.ID, job.Attempts, time.Now().Add(delay), jobErr.Error())
+	}
+	if err != nil {
+		log.Printf("jobs: record outcome of %s job %d: %v", job.Kind, job.ID, err)
+	}
+}
@@ -0,0 +1,372 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type emailArgs struct {
+	To string `json:"to"`
+}
+
+func (emailArgs) Kind() string { return "test.email" }
+
+func TestWorkerRunsTypedHandlerAndRetries(t *testing.T) {
+	store := newMemoryStore()
+	registry := NewRegistry()
+	var (
+		mu   sync.Mutex
+		seen []string
+	)
+	Handle(registry, func(_ context.Context, job Job, args emailArgs) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, args.To)
+		if job.Attempts < 3 {
+			return errors.New("smtp unavailable")
+		}
+		return nil
+	})
+
+	job, err := NewClient(store).Enqueue(context.Background(), emailArgs{To: "a@example.com"})
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	runUntil(t, store, registry, func() bool { return store.state(job.ID) == StateDone })
+
+	got := store.job(job.ID)
+	if got.Attempts != 3 || got.LastError != "" {
+		t.Fatalf("unexpected finished job %+v", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(seen, []string{"a@example.com", "a@example.com", "a@example.com"}) {
+		t.Fatalf("unexpected handler calls %v", seen)
+	}
+}
+
+func TestWorkerMovesFailingJobsToDead(t *testing.T) {
+	store := newMemoryStore()
+	registry := NewRegistry()
+	Handle(registry, func(_ context.Context, _ Job, args emailArgs) error {
+		switch args.To {
+		case "permanent":
+			return Permanent(errors.New("mailbox does not exist"))
+		case "panic":
+			panic("boom")
+		default:
+			return errors.New("temporary")
+		}
+	})
+	client := NewClient(store)
+	ctx := context.Background()
+	exhausted, _ := client.Enqueue(ctx, emailArgs{To: "retry"}, MaxAttempts(2))
+	permanent, _ := client.Enqueue(ctx, emailArgs{To: "permanent"})
+	panicking, _ := client.Enqueue(ctx, emailArgs{To: "panic"}, MaxAttempts(1))
+	undecodable, _, _ := store.Insert(ctx, NewJob{Kind: "test.email", Payload: []byte(`"not an object"`), MaxAttempts: 5})
+
+	runUntil(t, store, registry, func() bool {
+		for _, id := range []int64{exhausted.ID, permanent.ID, panicking.ID, undecodable.ID} {
+			if store.state(id) != StateDead {
+				return false
+			}
+		}
+		return true
+	})
+
+	if got := store.job(exhausted.ID); got.Attempts != 2 || got.LastError != "temporary" {
+		t.Errorf("expected two attempts before dying, got %+v", got)
+	}
+	if got := store.job(permanent.ID); got.Attempts != 1 {
+		t.Errorf("permanent errors should not be retried, got %d attempts", got.Attempts)
+	}
+	if got := store.job(panicking.ID); !strings.HasPrefix(got.LastError, "panic: boom\n") {
+		t.Errorf("expected the panic to be recorded, got %q", got.LastError)
+	}
+	if got := store.job(undecodable.ID); got.Attempts != 1 {
+		t.Errorf("undecodable payloads should not be retried, got %d attempts", got.Attempts)
+	}
+}
+
+func TestWorkerDrainsRunningJobsOnShutdown(t *testing.T) {
+	store := newMemoryStore()
+	registry := NewRegistry()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	Handle(registry, func(ctx context.Context, _ Job, _ emailArgs) error {
+		close(started)
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	job, _ := NewClient(store).Enqueue(context.Background(), emailArgs{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewWorker(store, registry, WorkerOptions{PollInterval: time.Millisecond, DrainTimeout: time.Minute}).Run(ctx)
+	}()
+	<-started
+	cancel()
+
+	select {
+	case <-done:
+		t.Fatal("Run returned before the running job finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-done
+	if got := store.state(job.ID); got != StateDone {
+		t.Fatalf("expected the drained job to complete, got %s", got)
+	}
+}
+
+func TestWorkerCancelsJobsAfterDrainTimeout(t *testing.T) {
+	store := newMemoryStore()
+	registry := NewRegistry()
+	started := make(chan struct{})
+	Handle(registry, func(ctx context.Context, _ Job, _ emailArgs) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	job, _ := NewClient(store).Enqueue(context.Background(), emailArgs{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewWorker(store, registry, WorkerOptions{PollInterval: time.Millisecond, DrainTimeout: 10 * time.Millisecond}).Run(ctx)
+	}()
+	<-started
+	cancel()
+	<-done
+
+	got := store.job(job.ID)
+	if got.State != StateQueued || got.LastError != context.Canceled.Error() {
+		t.Fatalf("expected the interrupted job to be queued for retry, got %+v", got)
+	}
+}
+
+func TestEnqueueUniqueAndScheduled(t *testing.T) {
+	store := newMemoryStore()
+	client := NewClient(store)
+	ctx := context.Background()
+
+	first, err := client.Enqueue(ctx, emailArgs{To: "a"}, Unique("welcome:1"))
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	second, err := client.Enqueue(ctx, emailArgs{To: "b"}, Unique("welcome:1"))
+	if err != nil || second.ID != first.ID {
+		t.Fatalf("expected the unique job to be reused: first=%d second=%d err=%v", first.ID, second.ID, err)
+	}
+	later, _ := client.Enqueue(ctx, emailArgs{}, Delay(time.Hour))
+	if _, err := client.Enqueue(ctx, emailArgs{}, MaxAttempts(0)); err == nil {
+		t.Fatal("expected an error for zero max attempts")
+	}
+
+	claimed, err := store.Claim(ctx, []string{"test.email"}, 10)
+	if err != nil || len(claimed) != 1 || claimed[0].ID != first.ID {
+		t.Fatalf("expected only the due job to be claimed, got %+v err=%v", claimed, err)
+	}
+	if got := store.state(later.ID); got != StateQueued {
+		t.Fatalf("scheduled job should stay queued, got %s", got)
+	}
+	if err := store.Complete(ctx, first.ID, claimed[0].Attempts+1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound completing another attempt, got %v", err)
+	}
+	if err := store.Complete(ctx, first.ID, claimed[0].Attempts); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	third, _ := client.Enqueue(ctx, emailArgs{}, Unique("welcome:1"))
+	if third.ID == first.ID {
+		t.Fatal("a finished unique job should not block a new one")
+	}
+}
+
+func TestBackoffGrowsAndIsCapped(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{1: 15 * time.Second, 3: time.Minute, 30: 6 * time.Hour} {
+		for range 20 {
+			got := Backoff(attempt)
+			if got < want*4/5 || got > want*6/5 {
+				t.Fatalf("Backoff(%d) = %s, want within 20%% of %s", attempt, got, want)
+			}
+		}
+	}
+}
+
+// runUntil runs a worker that retries immediately until cond holds.
+func runUntil(t *testing.T, store Store, registry *Registry, cond func() bool) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewWorker(store, registry, WorkerOptions{
+			Concurrency:  2,
+			PollInterval: time.Millisecond,
+			Backoff:      func(int) time.Duration { return 0 },
+		}).Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for jobs")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type memoryStore struct {
+	mu     sync.Mutex
+	nextID int64
+	jobs   map[int64]*Job
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{jobs: map[int64]*Job{}}
+}
+
+func (s *memoryStore) job(id int64) Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.jobs[id]
+}
+
+func (s *memoryStore) state(id int64) State {
+	return s.job(id).State
+}
+
+func (s *memoryStore) Insert(_ context.Context, job NewJob) (Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job.UniqueKey != "" {
+		for _, existing := range s.jobs {
+			if existing.UniqueKey == job.UniqueKey && (existing.State == StateQueued || existing.State == StateRunning) {
+				return *existing, false, nil
+			}
+		}
+	}
+	now := time.Now()
+	if job.RunAt.IsZero() {
+		job.RunAt = now
+	}
+	s.nextID++
+	out := &Job{ID: s.nextID, Kind: job.Kind, Payload: job.Payload, State: StateQueued, MaxAttempts: job.MaxAttempts, RunAt: job.RunAt, UniqueKey: job.UniqueKey, CreatedAt: now}
+	s.jobs[out.ID] = out
+	return *out, true, nil
+}
+
+func (s *memoryStore) Claim(_ context.Context, kinds []string, limit int) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var out []Job
+	for id := int64(1); id <= s.nextID && len(out) < limit; id++ {
+		job := s.jobs[id]
+		if job.State != StateQueued || job.RunAt.After(now) || !slices.Contains(kinds, job.Kind) {
+			continue
+		}
+		job.State = StateRunning
+		job.Attempts++
+		job.LockedAt = &now
+		out = append(out, *job)
+	}
+	return out, nil
+}
+
+func (s *memoryStore) finishRunning(id int64, attempts int, fn func(*Job)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok || job.State != StateRunning || job.Attempts != attempts {
+		return ErrNotFound
+	}
+	job.LockedAt = nil
+	fn(job)
+	return nil
+}
+
+func (s *memoryStore) Complete(_ context.Context, id int64, attempts int) error {
+	return s.finishRunning(id, attempts, func(j *Job) { j.State, j.LastError = StateDone, "" })
+}
+
+func (s *memoryStore) Retry(_ context.Context, id int64, attempts int, runAt time.Time, lastError string) error {
+	return s.finishRunning(id, attempts, func(j *Job) { j.State, j.RunAt, j.LastError = StateQueued, runAt, lastError })
+}
+
+func (s *memoryStore) Kill(_ context.Context, id int64, attempts int, lastError string) error {
+	return s.finishRunning(id, attempts, func(j *Job) { j.State, j.LastError = StateDead, lastError })
+}
+
+func (s *memoryStore) RescueStuck(_ context.Context, lockedBefore time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, job := range s.jobs {
+		if job.State == StateRunning && job.LockedAt.Before(lockedBefore) {
+			job.State, job.LockedAt = StateQueued, nil
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) Get(_ context.Context, id int64) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return *job, nil
+}
+
+func (s *memoryStore) List(_ context.Context, filter ListFilter) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Job
+	for id := s.nextID; id >= 1; id-- {
+		job := s.jobs[id]
+		if (filter.State == "" || job.State == filter.State) && (filter.Kind == "" || job.Kind == filter.Kind) {
+			out = append(out, *job)
+		}
+	}
+	return out, nil
+}
+
+func (s *memoryStore) Requeue(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok || (job.State != StateDead && job.State != StateCancelled) {
+		return ErrNotFound
+	}
+	job.State, job.Attempts, job.RunAt = StateQueued, 0, time.Now()
+	return nil
+}
+
+func (s *memoryStore) Cancel(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok || job.State != StateQueued {
+		return ErrNotFound
+	}
+	job.State = StateCancelled
+	return nil
+}
@@ -0,0 +1,62 @@
+package mail
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/benpsk/go-starter/internal/mail/templates"
+)
+
+// Welcome is sent when an account is created.
+type Welcome struct {
+	AppName     string
+	AppURL      string
+	DisplayName string
+}
+
+func (w Welcome) Subject() string { return "Welcome to " + w.AppName }
+
+func (w Welcome) HTML() templ.Component {
+	name := w.DisplayName
+	if strings.TrimSpace(name) == "" {
+		name = "there"
+	}
+	return templates.Welcome(w.AppName, strings.TrimRight(w.AppURL, "/"), name)
+}
+
+// NewDeviceSignIn tells a user their account was signed in to from a new
+// device.
+type NewDeviceSignIn struct {
+	AppName     string
+	AppURL      string
+	DisplayName string
+	Device      string
+	IP          string
+	At          time.Time
+}
+
+func (n NewDeviceSignIn) Subject() string { return "New sign-in to your " + n.AppName + " account" }
+
+func (n NewDeviceSignIn) HTML() templ.Component {
+	name := n.DisplayName
+	if strings.TrimSpace(name) == "" {
+		name = "there"
+	}
+	return templates.NewDeviceSignIn(n.AppName, strings.TrimRight(n.AppURL, "/"), name, n.Device, n.IP, n.At.UTC().Format("Jan 2, 2006 15:04 UTC"))
+}
+
+// MagicLink carries a one-time sign-in link.
+type MagicLink struct {
+	AppName   string
+	AppURL    string
+	Link      string
+	ExpiresIn time.Duration
+}
+
+func (m MagicLink) Subject() string { return "Sign in to " + m.AppName }
+
+func (m MagicLink) HTML() templ.Component {
+	return templates.MagicLink(m.AppName, strings.TrimRight(m.AppURL, "/"), m.Link, strconv.Itoa(int(m.ExpiresIn.Minutes()))+" minutes")
+}
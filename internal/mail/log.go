@@ -0,0 +1,60 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var urlRe = regexp.MustCompile(`https?://[^\s()<>]+`)
+
+// LogMailer is the development mailer. It logs each message and the links
+// in it, writes it as an .eml file when dir is set, and keeps it in memory
+// for Sent.
+type LogMailer struct {
+	dir  string
+	mu   sync.Mutex
+	sent []Message
+}
+
+func NewLogMailer(dir string) *LogMailer {
+	return &LogMailer{dir: dir}
+}
+
+func (m *LogMailer) Send(_ context.Context, msg Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dir != "" {
+		if err := os.MkdirAll(m.dir, 0o755); err != nil {
+			return fmt.Errorf("create mail dir: %w", err)
+		}
+		name := fmt.Sprintf("%s-%03d.eml", time.Now().UTC().Format("20060102T150405.000000000"), len(m.sent)+1)
+		if err := os.WriteFile(filepath.Join(m.dir, name), data, 0o644); err != nil {
+			return fmt.Errorf("write mail: %w", err)
+		}
+	}
+	log.Printf("mail: to %s: %s", strings.Join(msg.To, ", "), msg.Subject)
+	// Links are logged so sign-in links can be followed without an inbox.
+	for _, link := range urlRe.FindAllString(msg.Text, -1) {
+		log.Printf("mail: link %s", link)
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns every message sent so far, oldest first.
+func (m *LogMailer) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.sent...)
+}
@@ -0,0 +1,145 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/benpsk/go-starter/internal/config"
+)
+
+// Message is a rendered email.
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Email is one kind of message. HTML is a templ component; the plain-text
+// part is generated from it unless the email also implements TextEmail.
+type Email interface {
+	Subject() string
+	HTML() templ.Component
+}
+
+// TextEmail supplies its own plain-text part.
+type TextEmail interface {
+	Email
+	Text() string
+}
+
+// Render renders email into a message without sender or recipients.
+func Render(ctx context.Context, email Email) (Message, error) {
+	var html bytes.Buffer
+	if err := email.HTML().Render(ctx, &html); err != nil {
+		return Message{}, fmt.Errorf("render %T: %w", email, err)
+	}
+	msg := Message{Subject: email.Subject(), HTML: html.String()}
+	if te, ok := email.(TextEmail); ok {
+		msg.Text = te.Text()
+	} else {
+		msg.Text = HTMLToText(msg.HTML)
+	}
+	return msg, nil
+}
+
+func (m Message) validate() error {
+	if _, err := mail.ParseAddress(m.From); err != nil {
+		return fmt.Errorf("invalid from address %q: %w", m.From, err)
+	}
+	if len(m.To) == 0 {
+		return errors.New("message has no recipients")
+	}
+	for _, to := range m.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid recipient %q: %w", to, err)
+		}
+	}
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		return errors.New("subject must be a single line")
+	}
+	return nil
+}
+
+// Bytes encodes the message as a multipart/alternative MIME message.
+func (m Message) Bytes() ([]byte, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	from, _ := mail.ParseAddress(m.From)
+	var buf bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&buf, "%s: %s\r\n", k, v) }
+	header("From", m.From)
+	header("To", strings.Join(m.To, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", messageID(from.Address))
+	header("MIME-Version", "1.0")
+
+	parts := multipart.NewWriter(&buf)
+	header("Content-Type", `multipart/alternative; boundary="`+parts.Boundary()+`"`)
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func messageID(from string) string {
+	domain := "localhost"
+	if _, d, ok := strings.Cut(from, "@"); ok && d != "" {
+		domain = d
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+// FromConfig returns the mailer selected by cfg.Driver.
+func FromConfig(cfg config.MailConfig) (Mailer, error) {
+	switch cfg.Driver {
+	case "", "log":
+		return NewLogMailer(cfg.Dir), nil
+	case "smtp":
+		return NewSMTP(cfg.SMTP), nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", cfg.Driver)
+	}
+}
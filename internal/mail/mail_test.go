@@ -0,0 +1,333 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/jobs"
+)
+
+func TestHTMLToText(t *testing.T) {
+	got := HTMLToText(`<html><head><title>x</title><style>p{}</style></head><body>
+		<h1>Welcome</h1>
+		<p>Hi   <b>Ana</b> &amp; team,<br>thanks.</p>
+		<ul><li>One</li><li>Two</li></ul>
+		<p><a href="https://example.com/account">Open your account</a> or <a href="https://example.com">https://example.com</a></p>
+	</body></html>`)
+	want := "Welcome\n\nHi Ana & team,\nthanks.\n\n- One\n- Two\n\nOpen your account (https://example.com/account) or https://example.com\n"
+	if got != want {
+		t.Fatalf("unexpected text:\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestRenderWelcomeAndEncode(t *testing.T) {
+	msg, err := Render(context.Background(), Welcome{AppName: "Acme", AppURL: "https://acme.test/", DisplayName: "Zoë"})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if msg.Subject != "Welcome to Acme" || !strings.Contains(msg.HTML, `href="https://acme.test/account"`) {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if !strings.Contains(msg.Text, "Hi Zoë,") || !strings.Contains(msg.Text, "Open your account (https://acme.test/account)") {
+		t.Fatalf("unexpected text part %q", msg.Text)
+	}
+
+	msg.From, msg.To = "Acme <hello@acme.test>", []string{"zoe@example.com"}
+	data, err := msg.Bytes()
+	if err != nil {
+		t.Fatalf("bytes: %v", err)
+	}
+	parsed, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject")); subject != msg.Subject {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	if !strings.HasSuffix(parsed.Header.Get("Message-ID"), "@acme.test>") {
+		t.Errorf("unexpected Message-ID %q", parsed.Header.Get("Message-ID"))
+	}
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("unexpected content type %q: %v", parsed.Header.Get("Content-Type"), err)
+	}
+	parts := multipart.NewReader(parsed.Body, params["boundary"])
+	var bodies []string
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("next part: %v", err)
+		}
+		body, _ := io.ReadAll(part)
+		// Quoted-printable text parts use CRLF line endings on the wire.
+		bodies = append(bodies, strings.ReplaceAll(string(body), "\r\n", "\n"))
+	}
+	if len(bodies) != 2 || bodies[0] != msg.Text || bodies[1] != msg.HTML {
+		t.Fatalf("parts do not round-trip: %q", bodies)
+	}
+}
+
+func TestRenderMagicLink(t *testing.T) {
+	link := "https://acme.test/auth/magic-link?token=abc_-123"
+	msg, err := Render(context.Background(), MagicLink{AppName: "Acme", AppURL: "https://acme.test/", Link: link, ExpiresIn: 15 * time.Minute})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if msg.Subject != "Sign in to Acme" || !strings.Contains(msg.HTML, `href="`+link+`"`) {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if !strings.Contains(msg.Text, "Sign in ("+link+")") || !strings.Contains(msg.Text, "expires in 15 minutes") {
+		t.Fatalf("unexpected text part %q", msg.Text)
+	}
+}
+
+func TestMessageValidation(t *testing.T) {
+	base := Message{From: "a@example.com", To: []string{"b@example.com"}, Subject: "Hi"}
+	for name, msg := range map[string]Message{
+		"bad from":      {From: "nope", To: base.To, Subject: base.Subject},
+		"no recipients": {From: base.From, Subject: base.Subject},
+		"bad recipient": {From: base.From, To: []string{"b@example.com", "x"}, Subject: base.Subject},
+		"header inject": {From: base.From, To: base.To, Subject: "Hi\r\nBcc: c@example.com"},
+	} {
+		if _, err := msg.Bytes(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := base.Bytes(); err != nil {
+		t.Fatalf("valid message: %v", err)
+	}
+}
+
+func TestLogMailerKeepsAndWritesMessages(t *testing.T) {
+	dir := t.TempDir()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	m := NewLogMailer(dir)
+	msg := Message{From: "a@example.com", To: []string{"b@example.com"}, Subject: "Hi", HTML: "<p>Hi</p>", Text: "Hi\nSign in (https://example.com/auth/magic-link?token=abc)\n"}
+	if err := m.Send(context.Background(), msg); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if !strings.Contains(logged.String(), "mail: link https://example.com/auth/magic-link?token=abc\n") {
+		t.Fatalf("expected the link to be logged, got %q", logged.String())
+	}
+	if err := m.Send(context.Background(), Message{From: "a@example.com"}); err == nil {
+		t.Fatal("expected an invalid message to be rejected")
+	}
+	if sent := m.Sent(); len(sent) != 1 || sent[0].Subject != "Hi" {
+		t.Fatalf("unexpected sent messages %+v", sent)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected one .eml file, got %v", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(data), "To: b@example.com") {
+		t.Fatalf("unexpected file contents %q", data)
+	}
+}
+
+func TestSMTPMailerSends(t *testing.T) {
+	server := newFakeSMTP(t)
+	port, _ := strconv.Atoi(server.port)
+	mailer, err := FromConfig(config.MailConfig{Driver: "smtp", SMTP: config.SMTPConfig{Host: "127.0.0.1", Port: port}})
+	if err != nil {
+		t.Fatalf("from config: %v", err)
+	}
+	msg := Message{From: "App <app@example.com>", To: []string{"Ana <ana@example.com>", "bo@example.com"}, Subject: "Hi", HTML: "<p>Hi</p>", Text: "Hi\n"}
+	if err := mailer.Send(context.Background(), msg); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	got := server.received()
+	if got.from != "<app@example.com>" || strings.Join(got.to, ",") != "<ana@example.com>,<bo@example.com>" {
+		t.Fatalf("unexpected envelope %+v", got)
+	}
+	if !strings.Contains(got.data, "Subject: Hi") {
+		t.Fatalf("unexpected data %q", got.data)
+	}
+}
+
+func TestDeliverJob(t *testing.T) {
+	store := &memoryOutbox{messages: map[int64]*OutboxMessage{}}
+	mailer := &flakyMailer{LogMailer: NewLogMailer(""), failures: 1}
+	registry := jobs.NewRegistry()
+	RegisterJobs(registry, store, mailer)
+	deliver, ok := registry.Lookup(DeliverArgs{}.Kind())
+	if !ok {
+		t.Fatal("expected a mail.deliver handler")
+	}
+	store.messages[1] = &OutboxMessage{ID: 1, State: OutboxPending, Message: Message{From: "a@example.com", To: []string{"b@example.com"}, Subject: "Hi"}}
+	job := jobs.Job{Kind: DeliverArgs{}.Kind(), Payload: []byte(`{"outbox_id":1}`), Attempts: 1, MaxAttempts: 2}
+
+	if err := deliver(context.Background(), job); err == nil {
+		t.Fatal("expected the first attempt to fail")
+	}
+	if msg := store.messages[1]; msg.State != OutboxPending || msg.Attempts != 1 || msg.LastError != "connection refused" {
+		t.Fatalf("unexpected message after failure %+v", msg)
+	}
+	job.Attempts = 2
+	if err := deliver(context.Background(), job); err != nil {
+		t.Fatalf("second attempt: %v", err)
+	}
+	// A job retried after the message went out does not send it twice.
+	if err := deliver(context.Background(), job); err != nil {
+		t.Fatalf("repeat: %v", err)
+	}
+	if msg := store.messages[1]; msg.State != OutboxSent || len(mailer.Sent()) != 1 {
+		t.Fatalf("expected exactly one send, got state %s and %d sends", msg.State, len(mailer.Sent()))
+	}
+
+	missing := jobs.Job{Kind: DeliverArgs{}.Kind(), Payload: []byte(`{"outbox_id":9}`), Attempts: 1, MaxAttempts: 2}
+	if err := deliver(context.Background(), missing); !jobs.IsPermanent(err) {
+		t.Fatalf("expected a permanent error for a missing message, got %v", err)
+	}
+}
+
+type flakyMailer struct {
+	*LogMailer
+	failures int
+}
+
+func (m *flakyMailer) Send(ctx context.Context, msg Message) error {
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("connection refused")
+	}
+	return m.LogMailer.Send(ctx, msg)
+}
+
+type memoryOutbox struct {
+	messages map[int64]*OutboxMessage
+}
+
+func (s *memoryOutbox) Insert(_ context.Context, msg Message) (int64, error) {
+	id := int64(len(s.messages) + 1)
+	s.messages[id] = &OutboxMessage{ID: id, Message: msg, State: OutboxPending}
+	return id, nil
+}
+
+func (s *memoryOutbox) Get(_ context.Context, id int64) (OutboxMessage, error) {
+	msg, ok := s.messages[id]
+	if !ok {
+		return OutboxMessage{}, ErrNotFound
+	}
+	return *msg, nil
+}
+
+func (s *memoryOutbox) MarkSent(_ context.Context, id int64) error {
+	s.messages[id].State = OutboxSent
+	s.messages[id].Attempts++
+	return nil
+}
+
+func (s *memoryOutbox) RecordFailure(_ context.Context, id int64, sendErr string, final bool) error {
+	msg := s.messages[id]
+	msg.Attempts++
+	msg.LastError = sendErr
+	if final {
+		msg.State = OutboxFailed
+	}
+	return nil
+}
+
+type smtpEnvelope struct {
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTP accepts one plain-text SMTP session without TLS or AUTH.
+type fakeSMTP struct {
+	port string
+	mu   sync.Mutex
+	got  smtpEnvelope
+	done chan struct{}
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	s := &fakeSMTP{port: port, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s.serve(textproto.NewConn(conn))
+	}()
+	return s
+}
+
+func (s *fakeSMTP) serve(c *textproto.Conn) {
+	_ = c.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			_ = c.PrintfLine("250 fake")
+		case "MAIL":
+			s.mu.Lock()
+			s.got.from = strings.TrimPrefix(arg, "FROM:")
+			s.mu.Unlock()
+			_ = c.PrintfLine("250 ok")
+		case "RCPT":
+			s.mu.Lock()
+			s.got.to = append(s.got.to, strings.TrimPrefix(arg, "TO:"))
+			s.mu.Unlock()
+			_ = c.PrintfLine("250 ok")
+		case "DATA":
+			_ = c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.got.data = string(data)
+			s.mu.Unlock()
+			_ = c.PrintfLine("250 queued")
+		case "QUIT":
+			_ = c.PrintfLine("221 bye")
+			return
+		default:
+			_ = c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTP) received() smtpEnvelope {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.got
+}
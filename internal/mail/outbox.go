@@ -0,0 +1,111 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/jobs"
+)
+
+var ErrNotFound = errors.New("outbox message not found")
+
+type OutboxState string
+
+const (
+	OutboxPending OutboxState = "pending"
+	OutboxSent    OutboxState = "sent"
+	OutboxFailed  OutboxState = "failed"
+)
+
+// OutboxMessage is a message stored for delivery.
+type OutboxMessage struct {
+	ID        int64
+	Message   Message
+	State     OutboxState
+	Attempts  int
+	LastError string
+	CreatedAt time.Time
+	SentAt    *time.Time
+}
+
+// OutboxStore keeps messages until they are delivered. The Postgres
+// implementation is postgres.MailOutboxStore.
+type OutboxStore interface {
+	Insert(ctx context.Context, msg Message) (int64, error)
+	Get(ctx context.Context, id int64) (OutboxMessage, error)
+	MarkSent(ctx context.Context, id int64) error
+	// RecordFailure counts a failed attempt; final marks the message failed.
+	RecordFailure(ctx context.Context, id int64, sendErr string, final bool) error
+}
+
+// DeliverArgs sends one outbox message.
+type DeliverArgs struct {
+	OutboxID int64 `json:"outbox_id"`
+}
+
+func (DeliverArgs) Kind() string { return "mail.deliver" }
+
+// Outbox queues email for delivery by the jobs worker. The message row and
+// its delivery job are written in one transaction, so when Queue is called
+// inside a caller's transaction nothing is sent unless that transaction
+// commits.
+type Outbox struct {
+	store OutboxStore
+	jobs  *jobs.Client
+	inTx  func(ctx context.Context, fn func(ctx context.Context) error) error
+	from  string
+}
+
+// NewOutbox returns an outbox that sends from the given address. inTx runs
+// fn in a transaction, or a savepoint of one already in ctx.
+func NewOutbox(store OutboxStore, jobClient *jobs.Client, inTx func(ctx context.Context, fn func(ctx context.Context) error) error, from string) *Outbox {
+	return &Outbox{store: store, jobs: jobClient, inTx: inTx, from: from}
+}
+
+// Queue renders email and stores it for delivery to the given address.
+func (o *Outbox) Queue(ctx context.Context, to string, email Email) error {
+	msg, err := Render(ctx, email)
+	if err != nil {
+		return err
+	}
+	msg.From, msg.To = o.from, []string{to}
+	if err := msg.validate(); err != nil {
+		return err
+	}
+	return o.inTx(ctx, func(ctx context.Context) error {
+		id, err := o.store.Insert(ctx, msg)
+		if err != nil {
+			return err
+		}
+		_, err = o.jobs.Enqueue(ctx, DeliverArgs{OutboxID: id}, jobs.Unique("mail.deliver:"+strconv.FormatInt(id, 10)))
+		return err
+	})
+}
+
+// RegisterJobs adds the delivery handler to r. Delivery is at least once: a
+// message is sent again if recording it as sent fails.
+func RegisterJobs(r *jobs.Registry, store OutboxStore, mailer Mailer) {
+	jobs.Handle(r, func(ctx context.Context, job jobs.Job, args DeliverArgs) error {
+		out, err := store.Get(ctx, args.OutboxID)
+		if errors.Is(err, ErrNotFound) {
+			return jobs.Permanent(err)
+		}
+		if err != nil {
+			return err
+		}
+		if out.State != OutboxPending {
+			return nil
+		}
+		if err := mailer.Send(ctx, out.Message); err != nil {
+			final := job.Attempts >= job.MaxAttempts
+			if recordErr := store.RecordFailure(context.WithoutCancel(ctx), out.ID, err.Error(), final); recordErr != nil {
+				return errors.Join(err, recordErr)
+			}
+			return fmt.Errorf("send outbox message %d: %w", out.ID, err)
+		}
+		return store.MarkSent(context.WithoutCancel(ctx), out.ID)
+	})
+}
@@ -0,0 +1,105 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/config"
+)
+
+const (
+	smtpDialTimeout = 10 * time.Second
+	smtpSendTimeout = time.Minute
+)
+
+// SMTPMailer sends through an SMTP server. Port 465 uses implicit TLS;
+// other ports upgrade with STARTTLS when the server offers it.
+type SMTPMailer struct {
+	host     string
+	port     int
+	username string
+	password string
+}
+
+func NewSMTP(cfg config.SMTPConfig) *SMTPMailer {
+	return &SMTPMailer{host: cfg.Host, port: cfg.Port, username: cfg.Username, password: cfg.Password}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	conn, err := m.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("smtp dial: %w", err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpSendTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp greeting: %w", err)
+	}
+	defer c.Close()
+	if _, isTLS := conn.(*tls.Conn); !isTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+				return fmt.Errorf("smtp starttls: %w", err)
+			}
+		}
+	}
+	if m.username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp server does not support AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return fmt.Errorf("smtp auth: %w", err)
+		}
+	}
+
+	from, _ := mail.ParseAddress(msg.From)
+	if err := c.Mail(from.Address); err != nil {
+		return fmt.Errorf("smtp mail from: %w", err)
+	}
+	for _, to := range msg.To {
+		addr, _ := mail.ParseAddress(to)
+		if err := c.Rcpt(addr.Address); err != nil {
+			return fmt.Errorf("smtp rcpt to %s: %w", addr.Address, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp data: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("smtp data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp data: %w", err)
+	}
+	return c.Quit()
+}
+
+func (m *SMTPMailer) dial(ctx context.Context) (net.Conn, error) {
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+	if m.port == 465 {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: m.host}}
+		return tlsDialer.DialContext(ctx, "tcp", addr)
+	}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
@@ -0,0 +1,45 @@
+package mail
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	invisibleRe  = regexp.MustCompile(`(?is)<head\b.*?</head>|<style\b.*?</style>|<script\b.*?</script>`)
+	linkRe       = regexp.MustCompile(`(?is)<a\s[^>]*?href="([^"]*)"[^>]*>(.*?)</a>`)
+	lineBreakRe  = regexp.MustCompile(`(?i)<br\s*/?>|</(?:tr|div)>`)
+	paragraphRe  = regexp.MustCompile(`(?i)</(?:p|h[1-6]|table|ul|ol)>`)
+	listItemRe   = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+	tagRe        = regexp.MustCompile(`<[^>]*>`)
+	blankLinesRe = regexp.MustCompile(`\n{3,}`)
+)
+
+// HTMLToText turns an HTML email body into a readable plain-text
+// alternative: links keep their URL, block elements become line breaks and
+// list items become dashes.
+func HTMLToText(s string) string {
+	s = invisibleRe.ReplaceAllString(s, "")
+	s = linkRe.ReplaceAllStringFunc(s, func(m string) string {
+		parts := linkRe.FindStringSubmatch(m)
+		href := html.UnescapeString(parts[1])
+		text := strings.TrimSpace(tagRe.ReplaceAllString(parts[2], ""))
+		if text == "" || html.UnescapeString(text) == href {
+			return href
+		}
+		return text + " (" + href + ")"
+	})
+	s = lineBreakRe.ReplaceAllString(s, "\n")
+	s = paragraphRe.ReplaceAllString(s, "\n\n")
+	s = listItemRe.ReplaceAllString(s, "\n- ")
+	s = tagRe.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	s = blankLinesRe.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(s) + "\n"
+}
@@ -0,0 +1,164 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/abuse"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// AbuseStore is the Postgres abuse.Store. Failures are counted in
+// rate_limit_buckets with the sliding window algorithm.
+type AbuseStore struct {
+	db     *pgxpool.Pool
+	limits *RateLimitStore
+}
+
+var _ abuse.Store = (*AbuseStore)(nil)
+
+func NewAbuseStore(pool *pgxpool.Pool) *AbuseStore {
+	return &AbuseStore{db: pool, limits: NewRateLimitStore(pool)}
+}
+
+func (s *AbuseStore) AddFailure(ctx context.Context, key string, now time.Time, window time.Duration) (int, error) {
+	previous, current, _, err := s.limits.AddSlidingWindow(ctx, failureKey(key), math.MaxInt32, 1, now, window)
+	if err != nil {
+		return 0, fmt.Errorf("count failure: %w", err)
+	}
+	weight := 1 - float64(now.Sub(now.Truncate(window)))/float64(window)
+	return current + int(math.Ceil(float64(previous)*weight)), nil
+}
+
+// Ban leaves an active ban as it is, so failures already in flight when it
+// started do not escalate it.
+func (s *AbuseStore) Ban(ctx context.Context, key, reason string, now time.Time, base, max, forgetAfter time.Duration) (abuse.Ban, error) {
+	db := DBFromContext(ctx, s.db)
+	ban := abuse.Ban{Key: key}
+	err := db.QueryRow(ctx, `
+		insert into ip_bans as b (key, reason, offences, banned_at, banned_until)
+		values ($1, $2, 1, $3, $3 + make_interval(secs => $4::float8))
+		on conflict (key) do update set
+			reason = excluded.reason,
+			offences = case when b.banned_until < $6 then 1 else b.offences + 1 end,
+			banned_at = $3,
+			banned_until = $3 + make_interval(secs => least(
+				$4::float8 * power(4, case when b.banned_until < $6 then 0 else b.offences end), $5::float8))
+		where b.banned_until <= $3
+		returning reason, offences, banned_at, banned_until
+	`, key, reason, now, base.Seconds(), max.Seconds(), now.Add(-forgetAfter)).Scan(&ban.Reason, &ban.Offences, &ban.CreatedAt, &ban.Until)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = db.QueryRow(ctx, `
+			select reason, offences, banned_at, banned_until from ip_bans where key = $1
+		`, key).Scan(&ban.Reason, &ban.Offences, &ban.CreatedAt, &ban.Until)
+	}
+	if err != nil {
+		return abuse.Ban{}, fmt.Errorf("ban %s: %w", key, err)
+	}
+	return ban, nil
+}
+
+func (s *AbuseStore) ActiveBans(ctx context.Context, now time.Time) ([]abuse.Ban, error) {
+	db := DBFromContext(ctx, s.db)
+	rows, err := db.Query(ctx, `
+		select key, reason, offences, banned_at, banned_until
+		from ip_bans
+		where banned_until > $1
+		order by banned_until desc
+	`, now)
+	if err != nil {
+		return nil, fmt.Errorf("list active bans: %w", err)
+	}
+	bans, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (abuse.Ban, error) {
+		var ban abuse.Ban
+		err := row.Scan(&ban.Key, &ban.Reason, &ban.Offences, &ban.CreatedAt, &ban.Until)
+		return ban, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list active bans: %w", err)
+	}
+	return bans, nil
+}
+
+// Unban lifts key's ban and forgets its offences and recent failures.
+func (s *AbuseStore) Unban(ctx context.Context, key string) error {
+	return InTx(ctx, s.db, func(ctx context.Context) error {
+		db := DBFromContext(ctx, s.db)
+		tag, err := db.Exec(ctx, `delete from ip_bans where key = $1`, key)
+		if err != nil {
+			return fmt.Errorf("unban %s: %w", key, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return abuse.ErrNotFound
+		}
+		if _, err := db.Exec(ctx, `delete from rate_limit_buckets where key = $1`, failureKey(key)); err != nil {
+			return fmt.Errorf("reset failures of %s: %w", key, err)
+		}
+		return nil
+	})
+}
+
+// DeleteExpiredBans removes bans that ended before before. Offences are
+// forgotten with them, so pass a time at least forgetAfter ago.
+func (s *AbuseStore) DeleteExpiredBans(ctx context.Context, before time.Time) (int64, error) {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `delete from ip_bans where banned_until < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired bans: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *AbuseStore) Rules(ctx context.Context) ([]abuse.Rule, error) {
+	db := DBFromContext(ctx, s.db)
+	rows, err := db.Query(ctx, `select id, network, action, note, created_at from ip_rules order by network`)
+	if err != nil {
+		return nil, fmt.Errorf("list ip rules: %w", err)
+	}
+	rules, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (abuse.Rule, error) {
+		var rule abuse.Rule
+		err := row.Scan(&rule.ID, &rule.Network, &rule.Action, &rule.Note, &rule.CreatedAt)
+		return rule, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list ip rules: %w", err)
+	}
+	return rules, nil
+}
+
+// PutRule adds a rule for network, or replaces the existing one.
+func (s *AbuseStore) PutRule(ctx context.Context, network netip.Prefix, action abuse.Action, note string) (abuse.Rule, error) {
+	db := DBFromContext(ctx, s.db)
+	rule := abuse.Rule{Network: network.Masked(), Action: action, Note: note}
+	err := db.QueryRow(ctx, `
+		insert into ip_rules (network, action, note)
+		values ($1, $2, $3)
+		on conflict (network) do update set action = excluded.action, note = excluded.note
+		returning id, created_at
+	`, rule.Network, string(action), note).Scan(&rule.ID, &rule.CreatedAt)
+	if err != nil {
+		return abuse.Rule{}, fmt.Errorf("put ip rule: %w", err)
+	}
+	return rule, nil
+}
+
+func (s *AbuseStore) DeleteRule(ctx context.Context, id int64) error {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `delete from ip_rules where id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("delete ip rule: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return abuse.ErrNotFound
+	}
+	return nil
+}
+
+func failureKey(key string) string {
+	return "abuse:" + key
+}
@@ -0,0 +1,146 @@
+package postgres
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/abuse"
+)
+
+func TestAbuseStoreBanEscalates(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewAbuseStore(integrationPool)
+	key := "198.51.100." + time.Now().Format("150405.000000")
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	base, max, forget := 15*time.Minute, 2*time.Hour, 24*time.Hour
+
+	ban, err := store.Ban(ctx, key, string(abuse.OAuthFailure), now, base, max, forget)
+	if err != nil || ban.Offences != 1 || !ban.Until.Equal(now.Add(base)) {
+		t.Fatalf("first ban: %+v err=%v", ban, err)
+	}
+	again, err := store.Ban(ctx, key, string(abuse.CSRFFailure), now.Add(time.Minute), base, max, forget)
+	if err != nil || again.Offences != 1 || !again.Until.Equal(ban.Until) || again.Reason != ban.Reason {
+		t.Fatalf("an active ban should not escalate: %+v err=%v", again, err)
+	}
+	now = ban.Until.Add(time.Minute)
+	ban, err = store.Ban(ctx, key, string(abuse.CSRFFailure), now, base, max, forget)
+	if err != nil || ban.Offences != 2 || !ban.Until.Equal(now.Add(4*base)) || ban.Reason != string(abuse.CSRFFailure) {
+		t.Fatalf("second ban should last four times as long: %+v err=%v", ban, err)
+	}
+	now = ban.Until.Add(time.Minute)
+	ban, err = store.Ban(ctx, key, string(abuse.CSRFFailure), now, base, max, forget)
+	if err != nil || ban.Offences != 3 || !ban.Until.Equal(now.Add(max)) {
+		t.Fatalf("third ban should be capped: %+v err=%v", ban, err)
+	}
+
+	bans, err := store.ActiveBans(ctx, now)
+	if err != nil {
+		t.Fatalf("active bans: %v", err)
+	}
+	if !containsBan(bans, key) {
+		t.Fatalf("expected %s among active bans: %+v", key, bans)
+	}
+
+	now = ban.Until.Add(forget + time.Minute)
+	ban, err = store.Ban(ctx, key, string(abuse.OAuthFailure), now, base, max, forget)
+	if err != nil || ban.Offences != 1 || !ban.Until.Equal(now.Add(base)) {
+		t.Fatalf("offences should be forgotten after a clean period: %+v err=%v", ban, err)
+	}
+}
+
+func TestAbuseStoreCountsFailuresAndUnbans(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewAbuseStore(integrationPool)
+	key := "2001:db8:" + time.Now().Format("1504") + "::/64"
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := range 3 {
+		count, err := store.AddFailure(ctx, key, now.Add(time.Duration(i)*time.Second), 10*time.Minute)
+		if err != nil || count != i+1 {
+			t.Fatalf("failure %d: count=%d err=%v", i+1, count, err)
+		}
+	}
+	if _, err := store.Ban(ctx, key, string(abuse.InvalidRefreshToken), now, time.Minute, time.Hour, time.Hour); err != nil {
+		t.Fatalf("ban: %v", err)
+	}
+
+	if err := store.Unban(ctx, key); err != nil {
+		t.Fatalf("unban: %v", err)
+	}
+	if err := store.Unban(ctx, key); !errors.Is(err, abuse.ErrNotFound) {
+		t.Fatalf("second unban: got %v, want ErrNotFound", err)
+	}
+	if count, err := store.AddFailure(ctx, key, now.Add(5*time.Second), 10*time.Minute); err != nil || count != 1 {
+		t.Fatalf("unban should reset failures: count=%d err=%v", count, err)
+	}
+
+	if _, err := store.Ban(ctx, key, string(abuse.InvalidRefreshToken), now, time.Minute, time.Hour, time.Hour); err != nil {
+		t.Fatalf("ban: %v", err)
+	}
+	deleted, err := store.DeleteExpiredBans(ctx, now.Add(2*time.Minute))
+	if err != nil || deleted < 1 {
+		t.Fatalf("expected the expired ban to be deleted: %d err=%v", deleted, err)
+	}
+}
+
+func TestAbuseStoreRules(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewAbuseStore(integrationPool)
+	network := netip.MustParsePrefix("203.0.113.77/24")
+
+	rule, err := store.PutRule(ctx, network, abuse.Deny, "scanner")
+	if err != nil || rule.ID == 0 || rule.Network != network.Masked() {
+		t.Fatalf("put rule: %+v err=%v", rule, err)
+	}
+	replaced, err := store.PutRule(ctx, network, abuse.Allow, "office")
+	if err != nil || replaced.ID != rule.ID {
+		t.Fatalf("putting the same network should replace the rule: %+v err=%v", replaced, err)
+	}
+
+	rules, err := store.Rules(ctx)
+	if err != nil {
+		t.Fatalf("rules: %v", err)
+	}
+	var found bool
+	for _, r := range rules {
+		if r.ID == rule.ID {
+			found = true
+			if r.Action != abuse.Allow || r.Note != "office" || r.Network != network.Masked() {
+				t.Fatalf("unexpected rule: %+v", r)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("rule %d not listed: %+v", rule.ID, rules)
+	}
+
+	if err := store.DeleteRule(ctx, rule.ID); err != nil {
+		t.Fatalf("delete rule: %v", err)
+	}
+	if err := store.DeleteRule(ctx, rule.ID); !errors.Is(err, abuse.ErrNotFound) {
+		t.Fatalf("second delete: got %v, want ErrNotFound", err)
+	}
+}
+
+func containsBan(bans []abuse.Ban, key string) bool {
+	for _, ban := range bans {
+		if ban.Key == key {
+			return true
+		}
+	}
+	return false
+}
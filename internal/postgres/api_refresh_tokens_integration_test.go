@@ -13,6 +13,8 @@ import (
 )
 
 func TestUserAuthStoreRotateAPIRefreshToken(t *testing.T) {
+	t.Parallel()
+
 	ctx := context.Background()
 
 	store := NewUserAuthStore(integrationPool)
@@ -0,0 +1,201 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/storage"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// BlobStore is the Postgres storage.BlobIndex behind storage.DedupeStore.
+type BlobStore struct {
+	db *pgxpool.Pool
+}
+
+var _ storage.BlobIndex = (*BlobStore)(nil)
+
+func NewBlobStore(pool *pgxpool.Pool) *BlobStore {
+	return &BlobStore{db: pool}
+}
+
+const blobLinkColumns = `r.key, b.sha256, b.visibility, b.size_bytes, b.content_type, r.linked_at`
+
+func scanBlobLink(row pgx.Row) (storage.BlobLink, error) {
+	var out storage.BlobLink
+	err := row.Scan(&out.Key, &out.Blob.SHA256, &out.Blob.Visibility, &out.Blob.Size, &out.Blob.ContentType, &out.LinkedAt)
+	return out, err
+}
+
+// Link takes a reference on blob for key and releases the one key held
+// before. The blob row is locked while referenced, so it cannot be collected
+// between the upsert and the new reference.
+func (s *BlobStore) Link(ctx context.Context, key string, blob storage.Blob) (bool, error) {
+	var created bool
+	err := InTx(ctx, s.db, func(ctx context.Context) error {
+		db := DBFromContext(ctx, s.db)
+		var blobID int64
+		err := db.QueryRow(ctx, `
+			insert into storage_blobs (sha256, visibility, size_bytes, content_type, ref_count)
+			values ($1, $2, $3, $4, 1)
+			on conflict (sha256, visibility) do update
+			set ref_count = storage_blobs.ref_count + 1, unreferenced_at = null
+			returning id, xmax = 0
+		`, blob.SHA256, blob.Visibility, blob.Size, blob.ContentType).Scan(&blobID, &created)
+		if err != nil {
+			return fmt.Errorf("upsert storage blob: %w", err)
+		}
+
+		var previous *int64
+		err = db.QueryRow(ctx, `
+			with old as (
+				select blob_id from storage_blob_refs where visibility = $1 and key = $2 for update
+			), upserted as (
+				insert into storage_blob_refs (visibility, key, blob_id)
+				values ($1, $2, $3)
+				on conflict (visibility, key) do update set blob_id = excluded.blob_id, linked_at = now()
+			)
+			select (select blob_id from old)
+		`, blob.Visibility, key, blobID).Scan(&previous)
+		if err != nil {
+			return fmt.Errorf("link storage key: %w", err)
+		}
+		if previous != nil {
+			return releaseBlobs(ctx, db, []int64{*previous})
+		}
+		return nil
+	})
+	return created, err
+}
+
+func (s *BlobStore) Resolve(ctx context.Context, key string, visibility storage.Visibility) (storage.BlobLink, error) {
+	db := DBFromContext(ctx, s.db)
+	out, err := scanBlobLink(db.QueryRow(ctx, `
+		select `+blobLinkColumns+`
+		from storage_blob_refs r
+		join storage_blobs b on b.id = r.blob_id
+		where r.visibility = $1 and r.key = $2
+	`, visibility, key))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return storage.BlobLink{}, storage.ErrNotFound
+		}
+		return storage.BlobLink{}, fmt.Errorf("resolve storage key: %w", err)
+	}
+	return out, nil
+}
+
+func (s *BlobStore) List(ctx context.Context, prefix string, visibility storage.Visibility, cursor string, limit int) ([]storage.BlobLink, error) {
+	db := DBFromContext(ctx, s.db)
+	rows, err := db.Query(ctx, `
+		select `+blobLinkColumns+`
+		from storage_blob_refs r
+		join storage_blobs b on b.id = r.blob_id
+		where r.visibility = $1 and starts_with(r.key, $2) and r.key > $3
+		order by r.key collate "C"
+		limit $4
+	`, visibility, prefix, cursor, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list storage keys: %w", err)
+	}
+	defer rows.Close()
+	var out []storage.BlobLink
+	for rows.Next() {
+		link, err := scanBlobLink(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan storage key: %w", err)
+		}
+		out = append(out, link)
+	}
+	return out, rows.Err()
+}
+
+func (s *BlobStore) Unlink(ctx context.Context, key string) error {
+	return InTx(ctx, s.db, func(ctx context.Context) error {
+		db := DBFromContext(ctx, s.db)
+		rows, err := db.Query(ctx, `delete from storage_blob_refs where key = $1 returning blob_id`, key)
+		if err != nil {
+			return fmt.Errorf("unlink storage key: %w", err)
+		}
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+		if err != nil {
+			return fmt.Errorf("unlink storage key: %w", err)
+		}
+		return releaseBlobs(ctx, db, ids)
+	})
+}
+
+func releaseBlobs(ctx context.Context, db DBHandle, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := db.Exec(ctx, `
+		update storage_blobs
+		set ref_count = ref_count - 1,
+			unreferenced_at = case when ref_count = 1 then now() else unreferenced_at end
+		where id = any($1)
+	`, ids)
+	if err != nil {
+		return fmt.Errorf("release storage blob: %w", err)
+	}
+	return nil
+}
+
+// CollectGarbage deletes up to limit blobs that have had no references since
+// before cutoff. Each row stays locked while remove deletes the object, so a
+// concurrent Link of the same content waits and then recreates both.
+func (s *BlobStore) CollectGarbage(ctx context.Context, cutoff time.Time, limit int, remove func(context.Context, storage.Blob) error) (int, error) {
+	db := DBFromContext(ctx, s.db)
+	rows, err := db.Query(ctx, `
+		select id from storage_blobs
+		where ref_count = 0 and unreferenced_at < $1
+		order by unreferenced_at
+		limit $2
+	`, cutoff, limit)
+	if err != nil {
+		return 0, fmt.Errorf("list unreferenced blobs: %w", err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return 0, fmt.Errorf("list unreferenced blobs: %w", err)
+	}
+
+	removed := 0
+	for _, id := range ids {
+		deleted := false
+		err := InTx(ctx, s.db, func(ctx context.Context) error {
+			db := DBFromContext(ctx, s.db)
+			var blob storage.Blob
+			err := db.QueryRow(ctx, `
+				select sha256, visibility, size_bytes, content_type
+				from storage_blobs
+				where id = $1 and ref_count = 0 and unreferenced_at < $2
+				for update skip locked
+			`, id, cutoff).Scan(&blob.SHA256, &blob.Visibility, &blob.Size, &blob.ContentType)
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("lock unreferenced blob: %w", err)
+			}
+			if err := remove(ctx, blob); err != nil {
+				return err
+			}
+			if _, err := db.Exec(ctx, `delete from storage_blobs where id = $1`, id); err != nil {
+				return fmt.Errorf("delete storage blob: %w", err)
+			}
+			deleted = true
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+		if deleted {
+			removed++
+		}
+	}
+	return removed, nil
+}
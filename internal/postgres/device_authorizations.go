@@ -0,0 +1,131 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/user"
+	"github.com/jackc/pgx/v5"
+)
+
+const deviceAuthorizationColumns = `id, device_code_hash, user_code, client_id, user_id, status, interval_seconds, last_polled_at, expires_at, created_at, decided_at`
+
+// CreateDeviceAuthorization stores a pending authorization. It reports false
+// when its user code or device code is already taken, so the caller can
+// retry with new codes.
+func (s *UserAuthStore) CreateDeviceAuthorization(ctx context.Context, a user.DeviceAuthorization) (bool, error) {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		insert into device_authorizations (device_code_hash, user_code, client_id, interval_seconds, expires_at)
+		values ($1, $2, $3, $4, $5)
+		on conflict do nothing
+	`, strings.TrimSpace(a.DeviceCodeHash), strings.TrimSpace(a.UserCode), strings.TrimSpace(a.ClientID), a.IntervalSeconds, a.ExpiresAt)
+	if err != nil {
+		return false, fmt.Errorf("create device authorization: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// FindDeviceAuthorizationForPoll finds the authorization for a device code
+// and locks it until the transaction ends, so concurrent polls see each
+// other's last_polled_at.
+func (s *UserAuthStore) FindDeviceAuthorizationForPoll(ctx context.Context, deviceCodeHash string) (user.DeviceAuthorization, error) {
+	db := DBFromContext(ctx, s.db)
+	row := db.QueryRow(ctx, `select `+deviceAuthorizationColumns+` from device_authorizations where device_code_hash = $1 for update`, strings.TrimSpace(deviceCodeHash))
+	out, err := scanDeviceAuthorization(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user.DeviceAuthorization{}, user.ErrNotFound
+		}
+		return user.DeviceAuthorization{}, fmt.Errorf("find device authorization: %w", err)
+	}
+	return out, nil
+}
+
+// FindPendingDeviceAuthorization finds the unexpired authorization waiting
+// for a user to approve userCode.
+func (s *UserAuthStore) FindPendingDeviceAuthorization(ctx context.Context, userCode string, now time.Time) (user.DeviceAuthorization, error) {
+	db := DBFromContext(ctx, s.db)
+	row := db.QueryRow(ctx, `
+		select `+deviceAuthorizationColumns+` from device_authorizations
+		where user_code = $1 and status = 'pending' and expires_at > $2
+	`, strings.TrimSpace(userCode), now)
+	out, err := scanDeviceAuthorization(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user.DeviceAuthorization{}, user.ErrNotFound
+		}
+		return user.DeviceAuthorization{}, fmt.Errorf("find pending device authorization: %w", err)
+	}
+	return out, nil
+}
+
+// PollDeviceAuthorization records a poll and the interval the device must
+// wait before the next one.
+func (s *UserAuthStore) PollDeviceAuthorization(ctx context.Context, id int64, intervalSeconds int, at time.Time) error {
+	db := DBFromContext(ctx, s.db)
+	_, err := db.Exec(ctx, `update device_authorizations set last_polled_at = $3, interval_seconds = $2 where id = $1`, id, intervalSeconds, at)
+	if err != nil {
+		return fmt.Errorf("poll device authorization: %w", err)
+	}
+	return nil
+}
+
+// DecideDeviceAuthorization approves or denies the unexpired pending
+// authorization for userCode on behalf of userID. It returns
+// user.ErrNotFound when there is none, including when it was decided
+// concurrently.
+func (s *UserAuthStore) DecideDeviceAuthorization(ctx context.Context, userCode string, userID int64, approve bool, now time.Time) (user.DeviceAuthorization, error) {
+	status := user.DeviceAuthorizationDenied
+	if approve {
+		status = user.DeviceAuthorizationApproved
+	}
+	db := DBFromContext(ctx, s.db)
+	row := db.QueryRow(ctx, `
+		update device_authorizations
+		set status = $3, user_id = $4, decided_at = $2
+		where user_code = $1 and status = 'pending' and expires_at > $2
+		returning `+deviceAuthorizationColumns, strings.TrimSpace(userCode), now, status, userID)
+	out, err := scanDeviceAuthorization(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user.DeviceAuthorization{}, user.ErrNotFound
+		}
+		return user.DeviceAuthorization{}, fmt.Errorf("decide device authorization: %w", err)
+	}
+	return out, nil
+}
+
+// ConsumeDeviceAuthorization marks an approved authorization as exchanged
+// for tokens. It reports false when it was not approved or already used.
+func (s *UserAuthStore) ConsumeDeviceAuthorization(ctx context.Context, id int64) (bool, error) {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `update device_authorizations set status = 'consumed' where id = $1 and status = 'approved'`, id)
+	if err != nil {
+		return false, fmt.Errorf("consume device authorization: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// DeleteExpiredDeviceAuthorizations deletes authorizations that expired
+// before before, whatever their status, and reports how many it removed.
+func (s *UserAuthStore) DeleteExpiredDeviceAuthorizations(ctx context.Context, before time.Time) (int64, error) {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `delete from device_authorizations where expires_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired device authorizations: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func scanDeviceAuthorization(row pgx.Row) (user.DeviceAuthorization, error) {
+	var a user.DeviceAuthorization
+	err := row.Scan(
+		&a.ID, &a.DeviceCodeHash, &a.UserCode, &a.ClientID, &a.UserID, &a.Status,
+		&a.IntervalSeconds, &a.LastPolledAt, &a.ExpiresAt, &a.CreatedAt, &a.DecidedAt,
+	)
+	return a, err
+}
@@ -0,0 +1,79 @@
+package postgres
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/user"
+)
+
+func TestDeviceAuthorizationLifecycle(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewUserAuthStore(integrationPool)
+	u := createTestUser(t, ctx, store)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	now := time.Now().UTC()
+	a := user.DeviceAuthorization{
+		DeviceCodeHash:  "device-" + suffix,
+		UserCode:        "CODE" + suffix,
+		ClientID:        "starter-cli",
+		IntervalSeconds: 5,
+		ExpiresAt:       now.Add(10 * time.Minute),
+	}
+	created, err := store.CreateDeviceAuthorization(ctx, a)
+	if err != nil || !created {
+		t.Fatalf("create device authorization: %v %v", created, err)
+	}
+	dup := a
+	dup.DeviceCodeHash = "other-" + suffix
+	if created, err := store.CreateDeviceAuthorization(ctx, dup); err != nil || created {
+		t.Fatalf("user code reused: %v %v", created, err)
+	}
+
+	pending, err := store.FindPendingDeviceAuthorization(ctx, a.UserCode, now)
+	if err != nil || pending.Status != user.DeviceAuthorizationPending || pending.ClientID != "starter-cli" || pending.UserID != nil {
+		t.Fatalf("find pending: %+v %v", pending, err)
+	}
+	if err := store.PollDeviceAuthorization(ctx, pending.ID, 10, now); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	polled, err := store.FindDeviceAuthorizationForPoll(ctx, a.DeviceCodeHash)
+	if err != nil || polled.IntervalSeconds != 10 || polled.LastPolledAt == nil {
+		t.Fatalf("find for poll: %+v %v", polled, err)
+	}
+
+	if _, err := store.DecideDeviceAuthorization(ctx, a.UserCode, u.ID, true, now.Add(11*time.Minute)); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("expired authorization approved: %v", err)
+	}
+	approved, err := store.DecideDeviceAuthorization(ctx, a.UserCode, u.ID, true, now)
+	if err != nil || approved.Status != user.DeviceAuthorizationApproved || approved.UserID == nil || *approved.UserID != u.ID {
+		t.Fatalf("approve: %+v %v", approved, err)
+	}
+	if _, err := store.DecideDeviceAuthorization(ctx, a.UserCode, u.ID, false, now); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("decided twice: %v", err)
+	}
+	if _, err := store.FindPendingDeviceAuthorization(ctx, a.UserCode, now); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("approved authorization still pending: %v", err)
+	}
+
+	if ok, err := store.ConsumeDeviceAuthorization(ctx, approved.ID); err != nil || !ok {
+		t.Fatalf("consume: %v %v", ok, err)
+	}
+	if ok, err := store.ConsumeDeviceAuthorization(ctx, approved.ID); err != nil || ok {
+		t.Fatalf("consumed twice: %v %v", ok, err)
+	}
+
+	deleted, err := store.DeleteExpiredDeviceAuthorizations(ctx, now.Add(11*time.Minute))
+	if err != nil || deleted < 1 {
+		t.Fatalf("delete expired: %d %v", deleted, err)
+	}
+	if _, err := store.FindDeviceAuthorizationForPoll(ctx, a.DeviceCodeHash); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("expected the authorization to be deleted: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/jobs"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// JobStore is the Postgres jobs.Store. Workers claim jobs with
+// FOR UPDATE SKIP LOCKED, so any number of them can share the table.
+type JobStore struct {
+	db *pgxpool.Pool
+}
+
+var _ jobs.Store = (*JobStore)(nil)
+
+func NewJobStore(pool *pgxpool.Pool) *JobStore {
+	return &JobStore{db: pool}
+}
+
+const jobColumns = `id, kind, payload, state, attempts, max_attempts, run_at, coalesce(unique_key, ''), coalesce(last_error, ''), locked_at, created_at, finished_at`
+
+func scanJob(row pgx.Row) (jobs.Job, error) {
+	var out jobs.Job
+	err := row.Scan(&out.ID, &out.Kind, &out.Payload, &out.State, &out.Attempts, &out.MaxAttempts, &out.RunAt, &out.UniqueKey, &out.LastError, &out.LockedAt, &out.CreatedAt, &out.FinishedAt)
+	return out, err
+}
+
+func collectJobs(rows pgx.Rows) ([]jobs.Job, error) {
+	defer rows.Close()
+	var out []jobs.Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, job)
+	}
+	return out, rows.Err()
+}
+
+func (s *JobStore) Insert(ctx context.Context, job jobs.NewJob) (jobs.Job, bool, error) {
+	db := DBFromContext(ctx, s.db)
+	var runAt *time.Time
+	if !job.RunAt.IsZero() {
+		runAt = &job.RunAt
+	}
+	// A unique job can finish between the conflicting insert and the lookup
+	// of the job it conflicted with, so try once more in that case.
+	for range 2 {
+		out, err := scanJob(db.QueryRow(ctx, `
+			insert into jobs (kind, payload, run_at, max_attempts, unique_key)
+			values ($1, $2, coalesce($3, now()), $4, nullif($5, ''))
+			on conflict (unique_key) where unique_key is not null and state in ('queued', 'running') do nothing
+			returning `+jobColumns,
+			job.Kind, job.Payload, runAt, job.MaxAttempts, job.UniqueKey))
+		if err == nil {
+			return out, true, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return jobs.Job{}, false, fmt.Errorf("insert job: %w", err)
+		}
+
+		out, err = scanJob(db.QueryRow(ctx, `
+			select `+jobColumns+` from jobs
+			where unique_key = $1 and state in ('queued', 'running')
+		`, job.UniqueKey))
+		if err == nil {
+			return out, false, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return jobs.Job{}, false, fmt.Errorf("find unique job: %w", err)
+		}
+	}
+	return jobs.Job{}, false, fmt.Errorf("insert job: unique key %q kept conflicting", job.UniqueKey)
+}
+
+func (s *JobStore) Claim(ctx context.Context, kinds []string, limit int) ([]jobs.Job, error) {
+	db := DBFromContext(ctx, s.db)
+	rows, err := db.Query(ctx, `
+		with next as (
+			select id from jobs
+			where state = 'queued' and run_at <= now() and kind = any($1)
+			order by run_at, id
+			limit $2
+			for update skip locked
+		)
+		update jobs
+		set state = 'running', attempts = attempts + 1, locked_at = now(), updated_at = now()
+		where id in (select id from next)
+		returning `+jobColumns,
+		kinds, limit)
+	if err != nil {
+		return nil, fmt.Errorf("claim jobs: %w", err)
+	}
+	out, err := collectJobs(rows)
+	if err != nil {
+		return nil, fmt.Errorf("claim jobs: %w", err)
+	}
+	return out, nil
+}
+
+func (s *JobStore) Complete(ctx context.Context, id int64, attempts int) error {
+	return s.finishRunning(ctx, id, attempts, `state = 'done', last_error = null, finished_at = now()`)
+}
+
+func (s *JobStore) Retry(ctx context.Context, id int64, attempts int, runAt time.Time, lastError string) error {
+	return s.finishRunning(ctx, id, attempts, `state = 'queued', run_at = $3, last_error = $4`, runAt, lastError)
+}
+
+func (s *JobStore) Kill(ctx context.Context, id int64, attempts int, lastError string) error {
+	return s.finishRunning(ctx, id, attempts, `state = 'dead', last_error = $3, finished_at = now()`, lastError)
+}
+
+// finishRunning applies set to a job still running the claim that counted
+// attempts. A job that is no longer running it was rescued and may have
+// been claimed again by another worker, which owns it now.
+func (s *JobStore) finishRunning(ctx context.Context, id int64, attempts int, set string, args ...any) error {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		update jobs set `+set+`, locked_at = null, updated_at = now()
+		where id = $1 and attempts = $2 and state = 'running'
+	`, append([]any{id, attempts}, args...)...)
+	if err != nil {
+		return fmt.Errorf("update job %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("update job %d: %w", id, jobs.ErrNotFound)
+	}
+	return nil
+}
+
+func (s *JobStore) RescueStuck(ctx context.Context, lockedBefore time.Time) (int, error) {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		update jobs
+		set state = case when attempts >= max_attempts then 'dead' else 'queued' end,
+			finished_at = case when attempts >= max_attempts then now() end,
+			last_error = 'worker stopped while the job was running',
+			run_at = now(), locked_at = null, updated_at = now()
+		where state = 'running' and locked_at < $1
+	`, lockedBefore)
+	if err != nil {
+		return 0, fmt.Errorf("rescue stuck jobs: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (s *JobStore) Get(ctx context.Context, id int64) (jobs.Job, error) {
+	db := DBFromContext(ctx, s.db)
+	out, err := scanJob(db.QueryRow(ctx, `select `+jobColumns+` from jobs where id = $1`, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return jobs.Job{}, jobs.ErrNotFound
+		}
+		return jobs.Job{}, fmt.Errorf("get job: %w", err)
+	}
+	return out, nil
+}
+
+// List returns the newest jobs first.
+func (s *JobStore) List(ctx context.Context, filter jobs.ListFilter) ([]jobs.Job, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	db := DBFromContext(ctx, s.db)
+	rows, err := db.Query(ctx, `
+		select `+jobColumns+` from jobs
+		where ($1 = '' or state = $1) and ($2 = '' or kind = $2)
+		order by created_at desc, id desc
+		limit $3
+	`, string(filter.State), filter.Kind, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list jobs: %w", err)
+	}
+	out, err := collectJobs(rows)
+	if err != nil {
+		return nil, fmt.Errorf("list jobs: %w", err)
+	}
+	return out, nil
+}
+
+func (s *JobStore) Requeue(ctx context.Context, id int64) error {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		update jobs
+		set state = 'queued', attempts = 0, run_at = now(), finished_at = null, updated_at = now()
+		where id = $1 and state in ('dead', 'cancelled')
+	`, id)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("requeue job %d: another job with its unique key is pending", id)
+		}
+		return fmt.Errorf("requeue job %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("requeue job %d: %w", id, jobs.ErrNotFound)
+	}
+	return nil
+}
+
+func (s *JobStore) Cancel(ctx context.Context, id int64) error {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		update jobs
+		set state = 'cancelled', finished_at = now(), updated_at = now()
+		where id = $1 and state = 'queued'
+	`, id)
+	if err != nil {
+		return fmt.Errorf("cancel job %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("cancel job %d: %w", id, jobs.ErrNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package postgres
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/jobs"
+)
+
+func TestJobStoreClaimRetryAndDeadLetter(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewJobStore(integrationPool)
+	kind := "test.job_store"
+	due, inserted, err := store.Insert(ctx, jobs.NewJob{Kind: kind, Payload: []byte(`{"n":1}`), MaxAttempts: 2, UniqueKey: "job-store-test"})
+	if err != nil || !inserted {
+		t.Fatalf("insert: inserted=%v err=%v", inserted, err)
+	}
+	dup, inserted, err := store.Insert(ctx, jobs.NewJob{Kind: kind, Payload: []byte(`{"n":2}`), MaxAttempts: 2, UniqueKey: "job-store-test"})
+	if err != nil || inserted || dup.ID != due.ID {
+		t.Fatalf("expected the unique job back: id=%d inserted=%v err=%v", dup.ID, inserted, err)
+	}
+	later, _, err := store.Insert(ctx, jobs.NewJob{Kind: kind, Payload: []byte(`{}`), MaxAttempts: 1, RunAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("insert scheduled: %v", err)
+	}
+
+	claimed, err := store.Claim(ctx, []string{kind}, 10)
+	if err != nil || len(claimed) != 1 || claimed[0].ID != due.ID || claimed[0].Attempts != 1 || claimed[0].State != jobs.StateRunning {
+		t.Fatalf("unexpected claim %+v err=%v", claimed, err)
+	}
+	if string(claimed[0].Payload) != `{"n": 1}` {
+		t.Fatalf("unexpected payload %s", claimed[0].Payload)
+	}
+	if err := store.Retry(ctx, due.ID, 1, time.Now().Add(-time.Second), "first failure"); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if err := store.Retry(ctx, due.ID, 1, time.Now(), "again"); !errors.Is(err, jobs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound retrying a queued job, got %v", err)
+	}
+
+	claimed, err = store.Claim(ctx, []string{kind}, 10)
+	if err != nil || len(claimed) != 1 || claimed[0].Attempts != 2 || claimed[0].LastError != "first failure" {
+		t.Fatalf("unexpected second claim %+v err=%v", claimed, err)
+	}
+	if err := store.Complete(ctx, due.ID, 1); !errors.Is(err, jobs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound finishing an earlier attempt, got %v", err)
+	}
+	if err := store.Kill(ctx, due.ID, 2, "gave up"); err != nil {
+		t.Fatalf("kill: %v", err)
+	}
+	dead, err := store.List(ctx, jobs.ListFilter{State: jobs.StateDead, Kind: kind})
+	if err != nil || len(dead) != 1 || dead[0].ID != due.ID || dead[0].FinishedAt == nil {
+		t.Fatalf("unexpected dead jobs %+v err=%v", dead, err)
+	}
+
+	// A dead unique job no longer blocks its key, and requeueing it resets
+	// its attempts.
+	if _, inserted, err := store.Insert(ctx, jobs.NewJob{Kind: kind, Payload: []byte(`{}`), MaxAttempts: 1, UniqueKey: "job-store-test"}); err != nil || !inserted {
+		t.Fatalf("expected a new unique job: inserted=%v err=%v", inserted, err)
+	}
+	if err := store.Cancel(ctx, later.ID); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if err := store.Requeue(ctx, later.ID); err != nil {
+		t.Fatalf("requeue cancelled job: %v", err)
+	}
+	got, err := store.Get(ctx, later.ID)
+	if err != nil || got.State != jobs.StateQueued || got.Attempts != 0 || got.RunAt.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("unexpected requeued job %+v err=%v", got, err)
+	}
+	if err := store.Cancel(ctx, due.ID); !errors.Is(err, jobs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound cancelling a dead job, got %v", err)
+	}
+}
+
+func TestJobStoreRescuesStuckJobs(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewJobStore(integrationPool)
+	kind := "test.job_store_stuck"
+	retryable, _, err := store.Insert(ctx, jobs.NewJob{Kind: kind, Payload: []byte(`{}`), MaxAttempts: 3})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	exhausted, _, err := store.Insert(ctx, jobs.NewJob{Kind: kind, Payload: []byte(`{}`), MaxAttempts: 1})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if claimed, err := store.Claim(ctx, []string{kind}, 10); err != nil || len(claimed) != 2 {
+		t.Fatalf("claim: %+v err=%v", claimed, err)
+	}
+
+	if n, err := store.RescueStuck(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("fresh jobs should not be rescued: n=%d err=%v", n, err)
+	}
+	if n, err := store.RescueStuck(ctx, time.Now().Add(time.Hour)); err != nil || n != 2 {
+		t.Fatalf("expected both jobs rescued: n=%d err=%v", n, err)
+	}
+	if got, _ := store.Get(ctx, retryable.ID); got.State != jobs.StateQueued {
+		t.Fatalf("expected retryable job queued, got %s", got.State)
+	}
+	if got, _ := store.Get(ctx, exhausted.ID); got.State != jobs.StateDead {
+		t.Fatalf("expected exhausted job dead, got %s", got.State)
+	}
+}
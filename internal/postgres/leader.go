@@ -0,0 +1,100 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/scheduler"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const leaseCheckInterval = 5 * time.Second
+
+// AdvisoryElector elects a leader with a session-level advisory lock held on
+// a connection of its own, outside the pool. Postgres drops the lock when
+// that session ends, so leadership passes on when the leader crashes or
+// loses its connection as well as when it releases the lease.
+type AdvisoryElector struct {
+	config *pgx.ConnConfig
+	key    int64
+}
+
+var _ scheduler.Elector = (*AdvisoryElector)(nil)
+
+// NewAdvisoryElector elects among all processes that use the same name.
+func NewAdvisoryElector(pool *pgxpool.Pool, name string) *AdvisoryElector {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("leader:" + name))
+	return &AdvisoryElector{config: pool.Config().ConnConfig.Copy(), key: int64(h.Sum64())}
+}
+
+func (e *AdvisoryElector) TryLead(ctx context.Context) (scheduler.Lease, error) {
+	conn, err := pgx.ConnectConfig(ctx, e.config)
+	if err != nil {
+		return nil, fmt.Errorf("connect for leader lock: %w", err)
+	}
+	var acquired bool
+	if err := conn.QueryRow(ctx, `select pg_try_advisory_lock($1)`, e.key).Scan(&acquired); err != nil {
+		_ = conn.Close(context.Background())
+		return nil, fmt.Errorf("try leader lock: %w", err)
+	}
+	if !acquired {
+		_ = conn.Close(context.Background())
+		return nil, nil
+	}
+	lease := &advisoryLease{conn: conn, key: e.key, lost: make(chan struct{}), stop: make(chan struct{}), stopped: make(chan struct{})}
+	go lease.watch()
+	return lease, nil
+}
+
+type advisoryLease struct {
+	conn    *pgx.Conn
+	key     int64
+	lost    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	release sync.Once
+}
+
+func (l *advisoryLease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// watch pings the lock's session and reports the lease lost when it fails.
+func (l *advisoryLease) watch() {
+	defer close(l.stopped)
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), leaseCheckInterval)
+			err := l.conn.Ping(ctx)
+			cancel()
+			if err != nil {
+				close(l.lost)
+				return
+			}
+		}
+	}
+}
+
+// Release unlocks and closes the session. Closing alone would free the
+// lock, but unlocking first hands over without waiting for the server to
+// notice the disconnect.
+func (l *advisoryLease) Release() {
+	l.release.Do(func() {
+		close(l.stop)
+		<-l.stopped
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, _ = l.conn.Exec(ctx, `select pg_advisory_unlock($1)`, l.key)
+		_ = l.conn.Close(ctx)
+	})
+}
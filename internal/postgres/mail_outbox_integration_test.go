@@ -0,0 +1,86 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/a-h/templ"
+	"github.com/benpsk/go-starter/internal/jobs"
+	"github.com/benpsk/go-starter/internal/mail"
+)
+
+type outboxTestEmail struct{}
+
+func (outboxTestEmail) Subject() string       { return "Outbox test" }
+func (outboxTestEmail) HTML() templ.Component { return templ.Raw("<p>Hello <b>there</b></p>") }
+
+func TestMailOutboxQueuesOnlyOnCommit(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewMailOutboxStore(integrationPool)
+	jobStore := NewJobStore(integrationPool)
+	inTx := func(ctx context.Context, fn func(ctx context.Context) error) error {
+		return InTx(ctx, integrationPool, fn)
+	}
+	outbox := mail.NewOutbox(store, jobs.NewClient(jobStore), inTx, "App <no-reply@example.com>")
+	kind := mail.DeliverArgs{}.Kind()
+	before, err := jobStore.List(ctx, jobs.ListFilter{Kind: kind, Limit: 1000})
+	if err != nil {
+		t.Fatalf("list jobs: %v", err)
+	}
+
+	rollback := errors.New("rollback")
+	err = InTx(ctx, integrationPool, func(ctx context.Context) error {
+		if err := outbox.Queue(ctx, "rolled-back@example.com", outboxTestEmail{}); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatalf("expected the rollback error, got %v", err)
+	}
+	if after, _ := jobStore.List(ctx, jobs.ListFilter{Kind: kind, Limit: 1000}); len(after) != len(before) {
+		t.Fatalf("a rolled back message must not enqueue delivery: %d jobs, want %d", len(after), len(before))
+	}
+
+	if err := outbox.Queue(ctx, "user@example.com", outboxTestEmail{}); err != nil {
+		t.Fatalf("queue: %v", err)
+	}
+	queued, err := jobStore.List(ctx, jobs.ListFilter{Kind: kind, Limit: 1})
+	if err != nil || len(queued) != 1 {
+		t.Fatalf("expected a delivery job: %+v err=%v", queued, err)
+	}
+	var args mail.DeliverArgs
+	if err := json.Unmarshal(queued[0].Payload, &args); err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	msg, err := store.Get(ctx, args.OutboxID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if msg.State != mail.OutboxPending || msg.Message.To[0] != "user@example.com" || msg.Message.Text != "Hello there\n" {
+		t.Fatalf("unexpected outbox message %+v", msg)
+	}
+
+	if err := store.RecordFailure(ctx, msg.ID, "connection refused", false); err != nil {
+		t.Fatalf("record failure: %v", err)
+	}
+	if err := store.MarkSent(ctx, msg.ID); err != nil {
+		t.Fatalf("mark sent: %v", err)
+	}
+	msg, err = store.Get(ctx, msg.ID)
+	if err != nil || msg.State != mail.OutboxSent || msg.Attempts != 2 || msg.LastError != "" || msg.SentAt == nil {
+		t.Fatalf("unexpected sent message %+v err=%v", msg, err)
+	}
+	if err := store.RecordFailure(ctx, msg.ID, "late", true); !errors.Is(err, mail.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a sent message, got %v", err)
+	}
+	if _, err := store.Get(ctx, -1); !errors.Is(err, mail.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/benpsk/go-starter/internal/mail"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// MailOutboxStore is the Postgres mail.OutboxStore.
+type MailOutboxStore struct {
+	db *pgxpool.Pool
+}
+
+var _ mail.OutboxStore = (*MailOutboxStore)(nil)
+
+func NewMailOutboxStore(pool *pgxpool.Pool) *MailOutboxStore {
+	return &MailOutboxStore{db: pool}
+}
+
+func (s *MailOutboxStore) Insert(ctx context.Context, msg mail.Message) (int64, error) {
+	db := DBFromContext(ctx, s.db)
+	var id int64
+	err := db.QueryRow(ctx, `
+		insert into mail_outbox (from_address, to_addresses, subject, html_body, text_body)
+		values ($1, $2, $3, $4, $5)
+		returning id
+	`, msg.From, msg.To, msg.Subject, msg.HTML, msg.Text).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("insert mail outbox message: %w", err)
+	}
+	return id, nil
+}
+
+func (s *MailOutboxStore) Get(ctx context.Context, id int64) (mail.OutboxMessage, error) {
+	db := DBFromContext(ctx, s.db)
+	var out mail.OutboxMessage
+	err := db.QueryRow(ctx, `
+		select id, from_address, to_addresses, subject, html_body, text_body,
+			state, attempts, coalesce(last_error, ''), created_at, sent_at
+		from mail_outbox where id = $1
+	`, id).Scan(&out.ID, &out.Message.From, &out.Message.To, &out.Message.Subject, &out.Message.HTML, &out.Message.Text,
+		&out.State, &out.Attempts, &out.LastError, &out.CreatedAt, &out.SentAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return mail.OutboxMessage{}, mail.ErrNotFound
+		}
+		return mail.OutboxMessage{}, fmt.Errorf("get mail outbox message: %w", err)
+	}
+	return out, nil
+}
+
+func (s *MailOutboxStore) MarkSent(ctx context.Context, id int64) error {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		update mail_outbox set state = 'sent', attempts = attempts + 1, last_error = null, sent_at = now()
+		where id = $1 and state = 'pending'
+	`, id)
+	if err != nil {
+		return fmt.Errorf("mark mail outbox message sent: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("mark mail outbox message %d sent: %w", id, mail.ErrNotFound)
+	}
+	return nil
+}
+
+func (s *MailOutboxStore) RecordFailure(ctx context.Context, id int64, sendErr string, final bool) error {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		update mail_outbox
+		set attempts = attempts + 1, last_error = $2,
+			state = case when $3 then 'failed' else state end
+		where id = $1 and state = 'pending'
+	`, id, sendErr, final)
+	if err != nil {
+		return fmt.Errorf("record mail outbox failure: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("record mail outbox failure %d: %w", id, mail.ErrNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package postgres_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/benpsk/go-starter/internal/postgres"
+	"github.com/benpsk/go-starter/internal/testenv"
+)
+
+func TestMain(m *testing.M) {
+	if err := testenv.Load(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	pool, cleanup, err := testenv.OpenIsolatedDB(ctx, "postgres", testenv.Migrate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	postgres.SetIntegrationPoolForTest(pool)
+	code := m.Run()
+	cleanup()
+	os.Exit(code)
+}
@@ -0,0 +1,129 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// RateLimitStore keeps rate limit state in Postgres so every replica
+// shares one count per key. Each hit is a single atomic upsert; the
+// allowed column records whether the last one was let through.
+type RateLimitStore struct {
+	db *pgxpool.Pool
+}
+
+func NewRateLimitStore(pool *pgxpool.Pool) *RateLimitStore {
+	return &RateLimitStore{db: pool}
+}
+
+func (s *RateLimitStore) Add(ctx context.Context, key string, n int, now time.Time, window time.Duration) (time.Time, int, error) {
+	db := DBFromContext(ctx, s.db)
+	var (
+		start time.Time
+		hits  int
+	)
+	err := db.QueryRow(ctx, `
+		insert into rate_limit_buckets as b (key, window_start, hits, expires_at)
+		values ($1, $2, $3, $4)
+		on conflict (key) do update set
+			window_start = case when b.expires_at <= excluded.window_start then excluded.window_start else b.window_start end,
+			hits = case when b.expires_at <= excluded.window_start then excluded.hits else b.hits + excluded.hits end,
+			expires_at = case when b.expires_at <= excluded.window_start then excluded.expires_at else b.expires_at end
+		returning window_start, hits
+	`, key, now, n, now.Add(window)).Scan(&start, &hits)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("add rate limit hits: %w", err)
+	}
+	return start, hits, nil
+}
+
+func (s *RateLimitStore) AddSlidingWindow(ctx context.Context, key string, limit, n int, now time.Time, window time.Duration) (int, int, bool, error) {
+	db := DBFromContext(ctx, s.db)
+	start := now.Truncate(window)
+	weight := 1 - float64(now.Sub(start))/float64(window)
+	var (
+		previous, current int
+		allowed           bool
+	)
+	err := db.QueryRow(ctx, `
+		insert into rate_limit_buckets as b (key, window_start, hits, expires_at)
+		values ($1, $2, $7, $6)
+		on conflict (key) do update set
+			previous_hits = case when b.window_start = $2 then b.previous_hits when b.window_start = $3 then b.hits else 0 end,
+			hits = case when b.window_start = $2 then b.hits else 0 end + case when
+				(case when b.window_start = $2 then b.previous_hits when b.window_start = $3 then b.hits else 0 end) * $5::float8
+				+ (case when b.window_start = $2 then b.hits else 0 end) + $7 <= $4::integer then $7 else 0 end,
+			allowed = (case when b.window_start = $2 then b.previous_hits when b.window_start = $3 then b.hits else 0 end) * $5::float8
+				+ (case when b.window_start = $2 then b.hits else 0 end) + $7 <= $4::integer,
+			window_start = $2,
+			expires_at = $6
+		returning previous_hits, hits, allowed
+	`, key, start, start.Add(-window), limit, weight, start.Add(2*window), n).Scan(&previous, &current, &allowed)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("add sliding window hits: %w", err)
+	}
+	return previous, current, allowed, nil
+}
+
+func (s *RateLimitStore) AddSlidingLog(ctx context.Context, key string, limit int, now time.Time, window time.Duration) ([]time.Time, bool, error) {
+	db := DBFromContext(ctx, s.db)
+	var (
+		hits    []time.Time
+		allowed bool
+	)
+	err := db.QueryRow(ctx, `
+		insert into rate_limit_buckets as b (key, window_start, hits, expires_at, hit_log)
+		values ($1, $2, 1, $5, array[$2::timestamptz])
+		on conflict (key) do update set
+			hit_log = array(select h from unnest(b.hit_log) as h where h > $3 order by h)
+				|| case when cardinality(array(select h from unnest(b.hit_log) as h where h > $3)) < $4
+					then array[$2::timestamptz] else '{}'::timestamptz[] end,
+			hits = least(cardinality(array(select h from unnest(b.hit_log) as h where h > $3)) + 1, $4),
+			allowed = cardinality(array(select h from unnest(b.hit_log) as h where h > $3)) < $4,
+			window_start = $2,
+			expires_at = case when cardinality(array(select h from unnest(b.hit_log) as h where h > $3)) < $4
+				then $5 else b.expires_at end
+		returning hit_log, allowed
+	`, key, now, now.Add(-window), limit, now.Add(window)).Scan(&hits, &allowed)
+	if err != nil {
+		return nil, false, fmt.Errorf("add sliding log hit: %w", err)
+	}
+	return hits, allowed, nil
+}
+
+func (s *RateLimitStore) TakeToken(ctx context.Context, key string, capacity int, now time.Time, window time.Duration) (float64, bool, error) {
+	db := DBFromContext(ctx, s.db)
+	var (
+		tokens  float64
+		allowed bool
+	)
+	err := db.QueryRow(ctx, `
+		insert into rate_limit_buckets as b (key, window_start, hits, expires_at, tokens)
+		values ($1, $2, 0, $5, $3::float8 - 1)
+		on conflict (key) do update set
+			tokens = least($3::float8, b.tokens + greatest(0, extract(epoch from $2 - b.window_start)::float8) * $3::float8 / $4::float8)
+				- case when least($3::float8, b.tokens + greatest(0, extract(epoch from $2 - b.window_start)::float8) * $3::float8 / $4::float8) >= 1
+					then 1 else 0 end,
+			allowed = least($3::float8, b.tokens + greatest(0, extract(epoch from $2 - b.window_start)::float8) * $3::float8 / $4::float8) >= 1,
+			window_start = greatest(b.window_start, $2),
+			expires_at = $5
+		returning tokens, allowed
+	`, key, now, float64(capacity), window.Seconds(), now.Add(window)).Scan(&tokens, &allowed)
+	if err != nil {
+		return 0, false, fmt.Errorf("take rate limit token: %w", err)
+	}
+	return tokens, allowed, nil
+}
+
+// DeleteExpired removes windows that ended before before.
+func (s *RateLimitStore) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `delete from rate_limit_buckets where expires_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired rate limits: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
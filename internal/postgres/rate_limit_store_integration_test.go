@@ -0,0 +1,127 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitStoreCountsPerWindow(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewRateLimitStore(integrationPool)
+	key := "test:" + time.Now().Format(time.RFC3339Nano)
+	start := time.Now().Truncate(time.Second)
+
+	for i, at := range []time.Time{start, start.Add(10 * time.Second), start.Add(59 * time.Second)} {
+		windowStart, count, err := store.Add(ctx, key, 1, at, time.Minute)
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		if !windowStart.Equal(start) || count != i+1 {
+			t.Fatalf("hit %d: got window %s count %d", i+1, windowStart, count)
+		}
+	}
+	if _, count, err := store.Add(ctx, "other:"+key, 2, start, time.Minute); err != nil || count != 2 {
+		t.Fatalf("keys should be counted separately: count=%d err=%v", count, err)
+	}
+
+	next := start.Add(time.Minute)
+	windowStart, count, err := store.Add(ctx, key, 1, next, time.Minute)
+	if err != nil || !windowStart.Equal(next) || count != 1 {
+		t.Fatalf("expected a new window at %s: got %s count %d err=%v", next, windowStart, count, err)
+	}
+
+	deleted, err := store.DeleteExpired(ctx, next.Add(2*time.Minute))
+	if err != nil || deleted < 2 {
+		t.Fatalf("expected both windows to be deleted: %d err=%v", deleted, err)
+	}
+}
+
+func TestRateLimitStoreSlidingWindow(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewRateLimitStore(integrationPool)
+	key := "sliding_window:" + time.Now().Format(time.RFC3339Nano)
+	start := time.Date(2026, 2, 24, 12, 0, 0, 0, time.UTC)
+
+	for i := range 3 {
+		previous, current, allowed, err := store.AddSlidingWindow(ctx, key, 3, 1, start.Add(time.Duration(i)*time.Second), time.Minute)
+		if err != nil || !allowed || previous != 0 || current != i+1 {
+			t.Fatalf("hit %d: previous=%d current=%d allowed=%v err=%v", i+1, previous, current, allowed, err)
+		}
+	}
+	if _, current, allowed, err := store.AddSlidingWindow(ctx, key, 3, 1, start.Add(30*time.Second), time.Minute); err != nil || allowed || current != 3 {
+		t.Fatalf("expected a denial that is not counted: current=%d allowed=%v err=%v", current, allowed, err)
+	}
+	// 20s into the next minute the previous window still weighs 2/3 × 3 = 2.
+	previous, current, allowed, err := store.AddSlidingWindow(ctx, key, 3, 1, start.Add(80*time.Second), time.Minute)
+	if err != nil || !allowed || previous != 3 || current != 1 {
+		t.Fatalf("expected the window to roll over: previous=%d current=%d allowed=%v err=%v", previous, current, allowed, err)
+	}
+	if _, _, allowed, _ := store.AddSlidingWindow(ctx, key, 3, 1, start.Add(81*time.Second), time.Minute); allowed {
+		t.Fatal("expected the weighted previous window to deny the hit")
+	}
+	previous, current, allowed, err = store.AddSlidingWindow(ctx, key, 3, 1, start.Add(5*time.Minute), time.Minute)
+	if err != nil || !allowed || previous != 0 || current != 1 {
+		t.Fatalf("expected stale windows to be dropped: previous=%d current=%d allowed=%v err=%v", previous, current, allowed, err)
+	}
+}
+
+func TestRateLimitStoreSlidingLog(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewRateLimitStore(integrationPool)
+	key := "sliding_log:" + time.Now().Format(time.RFC3339Nano)
+	start := time.Date(2026, 2, 24, 12, 0, 0, 0, time.UTC)
+
+	for i := range 2 {
+		hits, allowed, err := store.AddSlidingLog(ctx, key, 2, start.Add(time.Duration(i)*10*time.Second), time.Minute)
+		if err != nil || !allowed || len(hits) != i+1 {
+			t.Fatalf("hit %d: hits=%v allowed=%v err=%v", i+1, hits, allowed, err)
+		}
+	}
+	hits, allowed, err := store.AddSlidingLog(ctx, key, 2, start.Add(59*time.Second), time.Minute)
+	if err != nil || allowed || len(hits) != 2 || !hits[0].Equal(start) {
+		t.Fatalf("expected a denial with the oldest hit first: hits=%v allowed=%v err=%v", hits, allowed, err)
+	}
+	hits, allowed, err = store.AddSlidingLog(ctx, key, 2, start.Add(61*time.Second), time.Minute)
+	if err != nil || !allowed || len(hits) != 2 || !hits[0].Equal(start.Add(10*time.Second)) {
+		t.Fatalf("expected the oldest hit to age out: hits=%v allowed=%v err=%v", hits, allowed, err)
+	}
+}
+
+func TestRateLimitStoreTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewRateLimitStore(integrationPool)
+	key := "token_bucket:" + time.Now().Format(time.RFC3339Nano)
+	start := time.Date(2026, 2, 24, 12, 0, 0, 0, time.UTC)
+
+	for i := range 3 {
+		tokens, allowed, err := store.TakeToken(ctx, key, 3, start, 30*time.Second)
+		if err != nil || !allowed || tokens != float64(2-i) {
+			t.Fatalf("take %d: tokens=%v allowed=%v err=%v", i+1, tokens, allowed, err)
+		}
+	}
+	if tokens, allowed, err := store.TakeToken(ctx, key, 3, start.Add(5*time.Second), 30*time.Second); err != nil || allowed || tokens != 0.5 {
+		t.Fatalf("expected half a token and a denial: tokens=%v allowed=%v err=%v", tokens, allowed, err)
+	}
+	if tokens, allowed, err := store.TakeToken(ctx, key, 3, start.Add(10*time.Second), 30*time.Second); err != nil || !allowed || tokens != 0 {
+		t.Fatalf("expected a refilled token: tokens=%v allowed=%v err=%v", tokens, allowed, err)
+	}
+	if tokens, _, err := store.TakeToken(ctx, key, 3, start.Add(time.Hour), 30*time.Second); err != nil || tokens != 2 {
+		t.Fatalf("expected the bucket to refill up to its capacity: tokens=%v err=%v", tokens, err)
+	}
+}
@@ -0,0 +1,236 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/benpsk/go-starter/internal/config"
+)
+
+const (
+	defaultReplicaMaxLag        = 10 * time.Second
+	defaultReplicaCheckInterval = 5 * time.Second
+	replicaCheckTimeout         = 2 * time.Second
+)
+
+type primaryReadsKey struct{}
+
+// WithPrimaryReads forces reads made with ctx onto the primary. Use it right
+// after a write whose result the same request (or the next one) must see.
+func WithPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadsKey{}, true)
+}
+
+func primaryReadsForced(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	forced, _ := ctx.Value(primaryReadsKey{}).(bool)
+	return forced
+}
+
+type ReplicaStatus struct {
+	Name      string
+	Healthy   bool
+	Lag       time.Duration
+	Error     string
+	CheckedAt time.Time
+}
+
+type replica struct {
+	name string
+	pool *pgxpool.Pool
+
+	mu     sync.RWMutex
+	status ReplicaStatus
+}
+
+func (r *replica) healthy() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.status.Healthy
+}
+
+// ReadRouter sends read-only queries to a healthy replica, round-robin, and
+// falls back to the primary when none are healthy or none are configured.
+type ReadRouter struct {
+	primary       *pgxpool.Pool
+	replicas      []*replica
+	maxLag        time.Duration
+	checkInterval time.Duration
+	next          atomic.Uint64
+}
+
+func NewReadRouter(primary *pgxpool.Pool, replicas []*pgxpool.Pool, maxLag time.Duration) *ReadRouter {
+	if maxLag <= 0 {
+		maxLag = defaultReplicaMaxLag
+	}
+	r := &ReadRouter{primary: primary, maxLag: maxLag, checkInterval: defaultReplicaCheckInterval}
+	for _, pool := range replicas {
+		r.replicas = append(r.replicas, &replica{name: replicaName(pool), pool: pool})
+	}
+	return r
+}
+
+// ConnectReplicas opens a pool per DATABASE_REPLICA_URLS entry and runs an
+// initial health check. A replica that cannot be reached at startup is kept
+// and marked unhealthy so it can recover later.
+func ConnectReplicas(ctx context.Context, cfg config.DatabaseConfig, primary *pgxpool.Pool) (*ReadRouter, error) {
+	pools := make([]*pgxpool.Pool, 0, len(cfg.ReplicaURLs))
+	for _, raw := range cfg.ReplicaURLs {
+		poolConfig, err := pgxpool.ParseConfig(raw)
+		if err != nil {
+			closePools(pools)
+			return nil, fmt.Errorf("parse replica config: %w", err)
+		}
+		if cfg.MaxConns > 0 {
+			poolConfig.MaxConns = cfg.MaxConns
+		}
+		if cfg.MaxConnLifetime > 0 {
+			poolConfig.MaxConnLifetime = cfg.MaxConnLifetime
+		}
+		if cfg.MaxConnIdleTime > 0 {
+			poolConfig.MaxConnIdleTime = cfg.MaxConnIdleTime
+		}
+		pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+		if err != nil {
+			closePools(pools)
+			return nil, fmt.Errorf("dial replica: %w", err)
+		}
+		pools = append(pools, pool)
+	}
+
+	router := NewReadRouter(primary, pools, cfg.ReplicaMaxLag)
+	router.CheckReplicas(ctx)
+	return router, nil
+}
+
+func (r *ReadRouter) Primary() *pgxpool.Pool {
+	if r == nil {
+		return nil
+	}
+	return r.primary
+}
+
+// Reader picks the handle for a read-only query: the transaction in ctx if
+// any, the primary when forced via WithPrimaryReads, otherwise a healthy
+// replica.
+func (r *ReadRouter) Reader(ctx context.Context) DBHandle {
+	if r == nil {
+		return DBFromContext(ctx, nil)
+	}
+	if db := DBFromContext(ctx, nil); db != nil {
+		return db
+	}
+	if primaryReadsForced(ctx) || len(r.replicas) == 0 {
+		return r.primary
+	}
+	n := len(r.replicas)
+	start := int(r.next.Add(1) % uint64(n))
+	for i := 0; i < n; i++ {
+		candidate := r.replicas[(start+i)%n]
+		if candidate.healthy() {
+			return candidate.pool
+		}
+	}
+	return r.primary
+}
+
+// Run re-checks replica health until ctx is done.
+func (r *ReadRouter) Run(ctx context.Context) {
+	if r == nil || len(r.replicas) == 0 {
+		return
+	}
+	ticker := time.NewTicker(r.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.CheckReplicas(ctx)
+		}
+	}
+}
+
+func (r *ReadRouter) CheckReplicas(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	for _, rep := range r.replicas {
+		status := r.checkReplica(ctx, rep)
+		rep.mu.Lock()
+		rep.status = status
+		rep.mu.Unlock()
+	}
+}
+
+func (r *ReadRouter) checkReplica(ctx context.Context, rep *replica) ReplicaStatus {
+	ctx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+	defer cancel()
+
+	status := ReplicaStatus{Name: rep.name, CheckedAt: time.Now()}
+	var lagSeconds float64
+	// Replay timestamps stop advancing on an idle primary, so a replica that
+	// has replayed everything it received is treated as zero lag.
+	err := rep.pool.QueryRow(ctx, `
+		select
+			case
+				when not pg_is_in_recovery() then 0
+				when pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() then 0
+				else coalesce(extract(epoch from now() - pg_last_xact_replay_timestamp()), 0)
+			end::float8
+	`).Scan(&lagSeconds)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Lag = time.Duration(lagSeconds * float64(time.Second))
+	if status.Lag > r.maxLag {
+		status.Error = fmt.Sprintf("replication lag %s exceeds %s", status.Lag.Round(time.Millisecond), r.maxLag)
+		return status
+	}
+	status.Healthy = true
+	return status
+}
+
+func (r *ReadRouter) ReplicaStatuses() []ReplicaStatus {
+	if r == nil {
+		return nil
+	}
+	out := make([]ReplicaStatus, 0, len(r.replicas))
+	for _, rep := range r.replicas {
+		rep.mu.RLock()
+		out = append(out, rep.status)
+		rep.mu.RUnlock()
+	}
+	return out
+}
+
+// Close closes the replica pools. The primary is owned by the caller.
+func (r *ReadRouter) Close() {
+	if r == nil {
+		return
+	}
+	for _, rep := range r.replicas {
+		rep.pool.Close()
+	}
+}
+
+func closePools(pools []*pgxpool.Pool) {
+	for _, pool := range pools {
+		pool.Close()
+	}
+}
+
+// replicaName identifies a replica in health output without leaking
+// credentials.
+func replicaName(pool *pgxpool.Pool) string {
+	cc := pool.Config().ConnConfig
+	return fmt.Sprintf("%s:%d/%s", cc.Host, cc.Port, cc.Database)
+}
@@ -0,0 +1,65 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestReadRouterRoutesReadsToHealthyReplicas(t *testing.T) {
+	t.Parallel()
+
+	// Pools connect lazily, so these never dial.
+	newPool := func(host string) *pgxpool.Pool {
+		pool, err := pgxpool.New(context.Background(), "postgres://user@"+host+":5432/app")
+		if err != nil {
+			t.Fatalf("new pool: %v", err)
+		}
+		t.Cleanup(pool.Close)
+		return pool
+	}
+	primary := newPool("primary")
+	replicaA := newPool("replica-a")
+	replicaB := newPool("replica-b")
+
+	router := NewReadRouter(primary, []*pgxpool.Pool{replicaA, replicaB}, 0)
+	setHealthy := func(i int, healthy bool) {
+		router.replicas[i].mu.Lock()
+		router.replicas[i].status.Healthy = healthy
+		router.replicas[i].mu.Unlock()
+	}
+	ctx := context.Background()
+
+	if got := router.Reader(ctx); got != primary {
+		t.Fatalf("expected primary fallback while replicas are unchecked")
+	}
+
+	setHealthy(0, true)
+	setHealthy(1, true)
+	seen := map[DBHandle]bool{}
+	for i := 0; i < 4; i++ {
+		seen[router.Reader(ctx)] = true
+	}
+	if !seen[replicaA] || !seen[replicaB] || seen[primary] {
+		t.Fatalf("expected reads spread across healthy replicas, got %v", seen)
+	}
+
+	setHealthy(0, false)
+	for i := 0; i < 4; i++ {
+		if got := router.Reader(ctx); got != replicaB {
+			t.Fatalf("expected unhealthy replica to be skipped")
+		}
+	}
+
+	if got := router.Reader(WithPrimaryReads(ctx)); got != primary {
+		t.Fatalf("expected WithPrimaryReads to force primary")
+	}
+
+	tx := fakeHandle{}
+	if got := router.Reader(WithDBHandle(ctx, tx)); got != tx {
+		t.Fatalf("expected ambient transaction to win over replicas")
+	}
+}
+
+type fakeHandle struct{ DBHandle }
@@ -0,0 +1,185 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/scheduler"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// runHistoryPerTask is how many runs FinishRun keeps for each task.
+const runHistoryPerTask = 100
+
+// SchedulerStore is the Postgres scheduler.Store.
+type SchedulerStore struct {
+	db *pgxpool.Pool
+}
+
+var _ scheduler.Store = (*SchedulerStore)(nil)
+
+func NewSchedulerStore(pool *pgxpool.Pool) *SchedulerStore {
+	return &SchedulerStore{db: pool}
+}
+
+func (s *SchedulerStore) EnsureTask(ctx context.Context, name, spec string, next time.Time) (time.Time, error) {
+	db := DBFromContext(ctx, s.db)
+	var at time.Time
+	err := db.QueryRow(ctx, `
+		insert into scheduled_tasks (name, spec, next_run_at)
+		values ($1, $2, $3)
+		on conflict (name) do update
+		set spec = excluded.spec,
+			next_run_at = case when scheduled_tasks.spec = excluded.spec then scheduled_tasks.next_run_at else excluded.next_run_at end,
+			updated_at = case when scheduled_tasks.spec = excluded.spec then scheduled_tasks.updated_at else now() end
+		returning next_run_at
+	`, name, spec, next).Scan(&at)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("ensure scheduled task: %w", err)
+	}
+	return at, nil
+}
+
+// StartRun also fails any run of the task still marked running, which can
+// only be left over from a leader that died mid-run.
+func (s *SchedulerStore) StartRun(ctx context.Context, name, instance string, due, next time.Time) (int64, bool, error) {
+	var (
+		id int64
+		ok bool
+	)
+	err := InTx(ctx, s.db, func(ctx context.Context) error {
+		db := DBFromContext(ctx, s.db)
+		tag, err := db.Exec(ctx, `
+			update scheduled_tasks set next_run_at = $3, updated_at = now()
+			where name = $1 and next_run_at <= $2
+		`, name, due, next)
+		if err != nil {
+			return fmt.Errorf("advance scheduled task: %w", err)
+		}
+		if ok = tag.RowsAffected() == 1; !ok {
+			return nil
+		}
+		_, err = db.Exec(ctx, `
+			update scheduled_task_runs
+			set status = 'failed', error = 'leader stopped before the run finished',
+				finished_at = now(), duration_ms = (extract(epoch from now() - started_at) * 1000)::bigint
+			where task = $1 and status = 'running'
+		`, name)
+		if err != nil {
+			return fmt.Errorf("fail abandoned runs: %w", err)
+		}
+		err = db.QueryRow(ctx, `
+			insert into scheduled_task_runs (task, instance) values ($1, $2) returning id
+		`, name, instance).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("insert scheduled task run: %w", err)
+		}
+		return nil
+	})
+	return id, ok, err
+}
+
+func (s *SchedulerStore) FinishRun(ctx context.Context, id int64, runErr string) error {
+	return InTx(ctx, s.db, func(ctx context.Context) error {
+		db := DBFromContext(ctx, s.db)
+		var task string
+		err := db.QueryRow(ctx, `
+			update scheduled_task_runs
+			set status = case when $2 = '' then 'succeeded' else 'failed' end,
+				error = nullif($2, ''),
+				finished_at = clock_timestamp(),
+				duration_ms = (extract(epoch from clock_timestamp() - started_at) * 1000)::bigint
+			where id = $1
+			returning task
+		`, id, runErr).Scan(&task)
+		if err != nil {
+			return fmt.Errorf("finish scheduled task run: %w", err)
+		}
+		_, err = db.Exec(ctx, `
+			delete from scheduled_task_runs
+			where task = $1 and id not in (
+				select id from scheduled_task_runs where task = $1 order by started_at desc, id desc limit $2
+			)
+		`, task, runHistoryPerTask)
+		if err != nil {
+			return fmt.Errorf("prune scheduled task runs: %w", err)
+		}
+		return nil
+	})
+}
+
+const taskRunColumns = `r.id, r.task, r.instance, r.status, coalesce(r.error, ''), r.started_at, r.finished_at, coalesce(r.duration_ms, 0)`
+
+func scanTaskRun(row pgx.Row, run *scheduler.Run) error {
+	var durationMS int64
+	if err := row.Scan(&run.ID, &run.Task, &run.Instance, &run.Status, &run.Error, &run.StartedAt, &run.FinishedAt, &durationMS); err != nil {
+		return err
+	}
+	run.Duration = time.Duration(durationMS) * time.Millisecond
+	return nil
+}
+
+func (s *SchedulerStore) Tasks(ctx context.Context) ([]scheduler.TaskStatus, error) {
+	db := DBFromContext(ctx, s.db)
+	rows, err := db.Query(ctx, `
+		select t.name, t.spec, t.next_run_at, r.id is not null,
+			coalesce(r.id, 0), coalesce(r.task, ''), coalesce(r.instance, ''), coalesce(r.status, ''), coalesce(r.error, ''),
+			coalesce(r.started_at, t.updated_at), r.finished_at, coalesce(r.duration_ms, 0)
+		from scheduled_tasks t
+		left join lateral (
+			select * from scheduled_task_runs where task = t.name order by started_at desc, id desc limit 1
+		) r on true
+		order by t.name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("list scheduled tasks: %w", err)
+	}
+	defer rows.Close()
+	var out []scheduler.TaskStatus
+	for rows.Next() {
+		var (
+			status     scheduler.TaskStatus
+			hasRun     bool
+			run        scheduler.Run
+			durationMS int64
+		)
+		err := rows.Scan(&status.Name, &status.Spec, &status.NextRunAt, &hasRun,
+			&run.ID, &run.Task, &run.Instance, &run.Status, &run.Error, &run.StartedAt, &run.FinishedAt, &durationMS)
+		if err != nil {
+			return nil, fmt.Errorf("scan scheduled task: %w", err)
+		}
+		if hasRun {
+			run.Duration = time.Duration(durationMS) * time.Millisecond
+			status.LastRun = &run
+		}
+		out = append(out, status)
+	}
+	return out, rows.Err()
+}
+
+// Runs returns the newest runs first, of every task when task is empty.
+func (s *SchedulerStore) Runs(ctx context.Context, task string, limit int) ([]scheduler.Run, error) {
+	db := DBFromContext(ctx, s.db)
+	rows, err := db.Query(ctx, `
+		select `+taskRunColumns+`
+		from scheduled_task_runs r
+		where $1 = '' or r.task = $1
+		order by r.started_at desc, r.id desc
+		limit $2
+	`, task, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list scheduled task runs: %w", err)
+	}
+	defer rows.Close()
+	var out []scheduler.Run
+	for rows.Next() {
+		var run scheduler.Run
+		if err := scanTaskRun(rows, &run); err != nil {
+			return nil, fmt.Errorf("scan scheduled task run: %w", err)
+		}
+		out = append(out, run)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,95 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSchedulerStoreRecordsRunsAndGuardsNextRun(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewSchedulerStore(integrationPool)
+	due := time.Now().Add(-time.Minute).Truncate(time.Second)
+	next, err := store.EnsureTask(ctx, "test.cleanup", "@hourly", due)
+	if err != nil || !next.Equal(due) {
+		t.Fatalf("ensure task: next=%s err=%v", next, err)
+	}
+	// Re-registering with the same spec keeps the stored schedule.
+	if next, err = store.EnsureTask(ctx, "test.cleanup", "@hourly", due.Add(time.Hour)); err != nil || !next.Equal(due) {
+		t.Fatalf("expected the stored next run: next=%s err=%v", next, err)
+	}
+
+	following := due.Add(time.Hour)
+	id, ok, err := store.StartRun(ctx, "test.cleanup", "instance-a", due, following)
+	if err != nil || !ok {
+		t.Fatalf("start run: ok=%v err=%v", ok, err)
+	}
+	// A second leader holding the old due time must not start the run again.
+	if _, ok, err := store.StartRun(ctx, "test.cleanup", "instance-b", due, following); err != nil || ok {
+		t.Fatalf("expected a stale start to be refused: ok=%v err=%v", ok, err)
+	}
+	if err := store.FinishRun(ctx, id, "boom"); err != nil {
+		t.Fatalf("finish run: %v", err)
+	}
+
+	tasks, err := store.Tasks(ctx)
+	if err != nil {
+		t.Fatalf("tasks: %v", err)
+	}
+	var found bool
+	for _, task := range tasks {
+		if task.Name != "test.cleanup" {
+			continue
+		}
+		found = true
+		if !task.NextRunAt.Equal(following) || task.LastRun == nil || task.LastRun.Status != "failed" || task.LastRun.Error != "boom" || task.LastRun.FinishedAt == nil {
+			t.Fatalf("unexpected task status %+v last run %+v", task, task.LastRun)
+		}
+	}
+	if !found {
+		t.Fatal("task missing from Tasks")
+	}
+
+	// A changed spec resets the schedule.
+	if next, err = store.EnsureTask(ctx, "test.cleanup", "@daily", following.Add(24*time.Hour)); err != nil || !next.Equal(following.Add(24*time.Hour)) {
+		t.Fatalf("expected a new spec to reset next run: next=%s err=%v", next, err)
+	}
+	runs, err := store.Runs(ctx, "test.cleanup", 10)
+	if err != nil || len(runs) != 1 || runs[0].Instance != "instance-a" {
+		t.Fatalf("unexpected runs %+v err=%v", runs, err)
+	}
+}
+
+func TestAdvisoryElectorHasOneLeaderAtATime(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	name := "test-" + time.Now().Format(time.RFC3339Nano)
+	first, second := NewAdvisoryElector(integrationPool, name), NewAdvisoryElector(integrationPool, name)
+
+	lease, err := first.TryLead(ctx)
+	if err != nil || lease == nil {
+		t.Fatalf("expected the first elector to lead: lease=%v err=%v", lease, err)
+	}
+	if other, err := second.TryLead(ctx); err != nil || other != nil {
+		t.Fatalf("expected the second elector to follow: lease=%v err=%v", other, err)
+	}
+	lease.Release()
+
+	other, err := second.TryLead(ctx)
+	if err != nil || other == nil {
+		t.Fatalf("expected leadership to pass on release: lease=%v err=%v", other, err)
+	}
+	defer other.Release()
+	select {
+	case <-other.Lost():
+		t.Fatal("lease reported lost while held")
+	default:
+	}
+}
@@ -0,0 +1,80 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/storage"
+)
+
+func TestBlobStoreCountsReferencesAndCollectsGarbage(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewBlobStore(integrationPool)
+	first := storage.Blob{SHA256: strings.Repeat("a1", 32), Visibility: storage.VisibilityPublic, Size: 5, ContentType: "text/plain"}
+	second := storage.Blob{SHA256: strings.Repeat("b2", 32), Visibility: storage.VisibilityPublic, Size: 7, ContentType: "text/plain"}
+
+	created, err := store.Link(ctx, "blob-test/a.txt", first)
+	if err != nil || !created {
+		t.Fatalf("first link: created=%v err=%v", created, err)
+	}
+	created, err = store.Link(ctx, "blob-test/b.txt", first)
+	if err != nil || created {
+		t.Fatalf("second link should reuse the blob: created=%v err=%v", created, err)
+	}
+	// Relinking a key to other content releases its old blob.
+	if _, err := store.Link(ctx, "blob-test/b.txt", second); err != nil {
+		t.Fatalf("relink: %v", err)
+	}
+
+	link, err := store.Resolve(ctx, "blob-test/b.txt", storage.VisibilityPublic)
+	if err != nil || link.Blob.SHA256 != second.SHA256 || link.Blob.Size != 7 {
+		t.Fatalf("unexpected resolve result %+v err=%v", link, err)
+	}
+	if _, err := store.Resolve(ctx, "blob-test/b.txt", storage.VisibilityPrivate); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for other visibility, got %v", err)
+	}
+	links, err := store.List(ctx, "blob-test/", storage.VisibilityPublic, "blob-test/a.txt", 10)
+	if err != nil || len(links) != 1 || links[0].Key != "blob-test/b.txt" {
+		t.Fatalf("unexpected list %+v err=%v", links, err)
+	}
+
+	var removed []storage.Blob
+	remove := func(_ context.Context, blob storage.Blob) error {
+		removed = append(removed, blob)
+		return nil
+	}
+	future := time.Now().Add(time.Hour)
+	if n, err := store.CollectGarbage(ctx, future, 10, remove); err != nil || n != 0 {
+		t.Fatalf("nothing should be collectable yet: n=%d err=%v", n, err)
+	}
+
+	if err := store.Unlink(ctx, "blob-test/a.txt"); err != nil {
+		t.Fatalf("unlink: %v", err)
+	}
+	if n, err := store.CollectGarbage(ctx, time.Now().Add(-time.Hour), 10, remove); err != nil || n != 0 {
+		t.Fatalf("grace period should protect the blob: n=%d err=%v", n, err)
+	}
+	n, err := store.CollectGarbage(ctx, future, 10, remove)
+	if err != nil || n != 1 || len(removed) != 1 || removed[0].SHA256 != first.SHA256 {
+		t.Fatalf("unexpected collection: n=%d removed=%+v err=%v", n, removed, err)
+	}
+
+	// A failed removal keeps the record for the next run.
+	if err := store.Unlink(ctx, "blob-test/b.txt"); err != nil {
+		t.Fatalf("unlink: %v", err)
+	}
+	boom := errors.New("boom")
+	if _, err := store.CollectGarbage(ctx, future, 10, func(context.Context, storage.Blob) error { return boom }); !errors.Is(err, boom) {
+		t.Fatalf("expected removal error, got %v", err)
+	}
+	if n, err := store.CollectGarbage(ctx, future, 10, remove); err != nil || n != 1 {
+		t.Fatalf("expected retry to collect the blob: n=%d err=%v", n, err)
+	}
+}
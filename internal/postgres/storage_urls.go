@@ -0,0 +1,53 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// storedURLColumns are the columns that keep full public storage URLs rather
+// than keys, and so must be rewritten when objects move between backends.
+var storedURLColumns = []struct {
+	table  string
+	column string
+}{
+	{table: "users", column: "avatar_url"},
+}
+
+// RewriteStorageURLs replaces the oldBase prefix with newBase in every known
+// URL column and returns the number of rows changed per table.column. With
+// dryRun it only counts the rows that would change.
+func RewriteStorageURLs(ctx context.Context, pool *pgxpool.Pool, oldBase, newBase string, dryRun bool) (map[string]int64, error) {
+	oldBase = strings.TrimRight(oldBase, "/") + "/"
+	newBase = strings.TrimRight(newBase, "/") + "/"
+	out := map[string]int64{}
+	err := InTx(ctx, pool, func(ctx context.Context) error {
+		db := DBFromContext(ctx, pool)
+		for _, c := range storedURLColumns {
+			name := c.table + "." + c.column
+			if dryRun {
+				var n int64
+				err := db.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where starts_with(%s, $1)`, c.table, c.column), oldBase).Scan(&n)
+				if err != nil {
+					return fmt.Errorf("count %s: %w", name, err)
+				}
+				out[name] = n
+				continue
+			}
+			tag, err := db.Exec(ctx, fmt.Sprintf(`
+				update %[1]s
+				set %[2]s = $2 || substr(%[2]s, length($1) + 1)
+				where starts_with(%[2]s, $1)
+			`, c.table, c.column), oldBase, newBase)
+			if err != nil {
+				return fmt.Errorf("rewrite %s: %w", name, err)
+			}
+			out[name] = tag.RowsAffected()
+		}
+		return nil
+	})
+	return out, err
+}
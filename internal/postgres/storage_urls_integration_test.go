@@ -0,0 +1,41 @@
+package postgres
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRewriteStorageURLs(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewUserAuthStore(integrationPool)
+	u := createTestUser(t, ctx, store)
+	oldBase := "http://sync-" + strconv.FormatInt(time.Now().UnixNano(), 10) + ".example/media"
+	if _, err := store.SetCustomAvatar(ctx, u.ID, oldBase+"/avatars/1/a/256.jpg", []string{"avatars/1/a/256.jpg"}); err != nil {
+		t.Fatalf("set custom avatar: %v", err)
+	}
+
+	counts, err := RewriteStorageURLs(ctx, integrationPool, oldBase, "https://cdn.example.com/", true)
+	if err != nil || counts["users.avatar_url"] != 1 {
+		t.Fatalf("unexpected dry run counts %v err=%v", counts, err)
+	}
+	if got, _ := store.FindByID(ctx, u.ID); got.AvatarURL != oldBase+"/avatars/1/a/256.jpg" {
+		t.Fatalf("dry run changed the url: %q", got.AvatarURL)
+	}
+
+	counts, err = RewriteStorageURLs(ctx, integrationPool, oldBase, "https://cdn.example.com/", false)
+	if err != nil || counts["users.avatar_url"] != 1 {
+		t.Fatalf("unexpected rewrite counts %v err=%v", counts, err)
+	}
+	got, err := store.FindByID(ctx, u.ID)
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+	if got.AvatarURL != "https://cdn.example.com/avatars/1/a/256.jpg" {
+		t.Fatalf("unexpected rewritten url %q", got.AvatarURL)
+	}
+}
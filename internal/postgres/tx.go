@@ -0,0 +1,106 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const defaultTxMaxAttempts = 3
+
+// TxOptions configures InTxWithOptions. The zero value runs a read-write
+// transaction at the server's default isolation level with up to three
+// attempts.
+type TxOptions struct {
+	IsoLevel    pgx.TxIsoLevel
+	ReadOnly    bool
+	MaxAttempts int
+}
+
+type txBeginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// InTx runs fn inside a transaction carried in the context passed to fn, so
+// every store call made with that context joins it. See InTxWithOptions.
+func InTx(ctx context.Context, pool *pgxpool.Pool, fn func(ctx context.Context) error) error {
+	return InTxWithOptions(ctx, pool, TxOptions{}, fn)
+}
+
+// InTxWithOptions commits when fn returns nil and rolls back otherwise.
+//
+// When ctx already carries a transaction, fn runs inside a savepoint of it:
+// an error rolls back only the savepoint, and options and retries are left to
+// the outermost call. Outermost transactions that fail with a serialization
+// failure or deadlock are retried, so fn must be safe to run more than once.
+func InTxWithOptions(ctx context.Context, pool *pgxpool.Pool, opts TxOptions, fn func(ctx context.Context) error) error {
+	if outer, ok := DBFromContext(ctx, nil).(pgx.Tx); ok {
+		return runInTx(ctx, outer, fn)
+	}
+	if pool == nil {
+		return errors.New("begin transaction: nil pool")
+	}
+
+	attempts := opts.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultTxMaxAttempts
+	}
+	txOptions := pgx.TxOptions{IsoLevel: opts.IsoLevel}
+	if opts.ReadOnly {
+		txOptions.AccessMode = pgx.ReadOnly
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = runInTx(ctx, txStarter{pool: pool, opts: txOptions}, fn)
+		if err == nil || !IsRetryableTxError(err) || attempt == attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt*attempt) * 10 * time.Millisecond):
+		}
+	}
+	return err
+}
+
+// IsRetryableTxError reports whether err is a serialization failure or a
+// deadlock, both of which succeed when the whole transaction is replayed.
+func IsRetryableTxError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
+
+type txStarter struct {
+	pool *pgxpool.Pool
+	opts pgx.TxOptions
+}
+
+func (s txStarter) Begin(ctx context.Context) (pgx.Tx, error) {
+	return s.pool.BeginTx(ctx, s.opts)
+}
+
+func runInTx(ctx context.Context, db txBeginner, fn func(ctx context.Context) error) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck - safe to ignore rollback errors
+
+	if err := fn(WithDBHandle(ctx, tx)); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestInTxCommitsRollsBackAndUsesSavepoints(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := NewUserAuthStore(integrationPool)
+
+	t.Run("commit and rollback", func(t *testing.T) {
+		var committedID int64
+		err := InTx(ctx, integrationPool, func(ctx context.Context) error {
+			committedID = createTestUser(t, ctx, store).ID
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("in tx: %v", err)
+		}
+		if _, err := store.FindByID(ctx, committedID); err != nil {
+			t.Fatalf("expected committed user: %v", err)
+		}
+
+		var rolledBackID int64
+		errBoom := errors.New("boom")
+		err = InTx(ctx, integrationPool, func(ctx context.Context) error {
+			rolledBackID = createTestUser(t, ctx, store).ID
+			return errBoom
+		})
+		if !errors.Is(err, errBoom) {
+			t.Fatalf("expected fn error, got %v", err)
+		}
+		if _, err := store.FindByID(ctx, rolledBackID); err == nil {
+			t.Fatalf("expected rolled back user to be absent")
+		}
+	})
+
+	t.Run("nested call rolls back only its savepoint", func(t *testing.T) {
+		var outerID, innerID int64
+		err := InTx(ctx, integrationPool, func(ctx context.Context) error {
+			outerID = createTestUser(t, ctx, store).ID
+			_ = InTx(ctx, integrationPool, func(ctx context.Context) error {
+				innerID = createTestUser(t, ctx, store).ID
+				return errors.New("inner failed")
+			})
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("outer tx: %v", err)
+		}
+		if _, err := store.FindByID(ctx, outerID); err != nil {
+			t.Fatalf("expected outer user committed: %v", err)
+		}
+		if _, err := store.FindByID(ctx, innerID); err == nil {
+			t.Fatalf("expected inner user rolled back")
+		}
+	})
+
+	t.Run("retries serialization failures", func(t *testing.T) {
+		attempts := 0
+		err := InTxWithOptions(ctx, integrationPool, TxOptions{MaxAttempts: 3}, func(ctx context.Context) error {
+			attempts++
+			if attempts < 3 {
+				return &pgconn.PgError{Code: "40001"}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("expected success after retries: %v", err)
+		}
+		if attempts != 3 {
+			t.Fatalf("attempts = %d, want 3", attempts)
+		}
+	})
+
+	t.Run("does not retry inside an outer transaction", func(t *testing.T) {
+		txCtx, cleanup := withTx(t)
+		defer cleanup()
+
+		attempts := 0
+		err := InTx(txCtx, integrationPool, func(ctx context.Context) error {
+			attempts++
+			return &pgconn.PgError{Code: "40P01"}
+		})
+		if !IsRetryableTxError(err) {
+			t.Fatalf("expected deadlock error, got %v", err)
+		}
+		if attempts != 1 {
+			t.Fatalf("attempts = %d, want 1", attempts)
+		}
+	})
+}
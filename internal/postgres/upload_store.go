@@ -0,0 +1,215 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/upload"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type UploadStore struct {
+	db *pgxpool.Pool
+}
+
+func NewUploadStore(pool *pgxpool.Pool) *UploadStore {
+	return &UploadStore{db: pool}
+}
+
+const uploadColumns = `id, user_id, storage_key, filename, content_type, size_bytes, status, created_at, completed_at`
+
+func scanUpload(row pgx.Row) (upload.Upload, error) {
+	var out upload.Upload
+	err := row.Scan(&out.ID, &out.UserID, &out.StorageKey, &out.Filename, &out.ContentType, &out.SizeBytes, &out.Status, &out.CreatedAt, &out.CompletedAt)
+	return out, err
+}
+
+func (s *UploadStore) Create(ctx context.Context, in upload.Upload) (upload.Upload, error) {
+	db := DBFromContext(ctx, s.db)
+	out, err := scanUpload(db.QueryRow(ctx, `
+		insert into uploads (user_id, storage_key, filename, content_type, size_bytes)
+		values ($1, $2, $3, $4, $5)
+		returning `+uploadColumns,
+		in.UserID, strings.TrimSpace(in.StorageKey), strings.TrimSpace(in.Filename), strings.TrimSpace(in.ContentType), in.SizeBytes,
+	))
+	if err != nil {
+		return upload.Upload{}, fmt.Errorf("create upload: %w", err)
+	}
+	return out, nil
+}
+
+func (s *UploadStore) FindByIDForUser(ctx context.Context, id, userID int64) (upload.Upload, error) {
+	db := DBFromContext(ctx, s.db)
+	out, err := scanUpload(db.QueryRow(ctx, `
+		select `+uploadColumns+`
+		from uploads
+		where id = $1 and user_id = $2
+	`, id, userID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return upload.Upload{}, upload.ErrNotFound
+		}
+		return upload.Upload{}, fmt.Errorf("find upload: %w", err)
+	}
+	return out, nil
+}
+
+// MarkCompleted flips a pending upload owned by userID to completed.
+func (s *UploadStore) MarkCompleted(ctx context.Context, id, userID int64, at time.Time) (upload.Upload, error) {
+	db := DBFromContext(ctx, s.db)
+	out, err := scanUpload(db.QueryRow(ctx, `
+		update uploads
+		set status = 'completed', completed_at = $3
+		where id = $1 and user_id = $2 and status = 'pending'
+		returning `+uploadColumns,
+		id, userID, at,
+	))
+	if err == nil {
+		return out, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return upload.Upload{}, fmt.Errorf("complete upload: %w", err)
+	}
+	if _, findErr := s.FindByIDForUser(ctx, id, userID); findErr == nil {
+		return upload.Upload{}, upload.ErrAlreadyCompleted
+	}
+	return upload.Upload{}, upload.ErrNotFound
+}
+
+const resumableColumns = `u.id, u.user_id, u.storage_key, u.filename, u.content_type, u.size_bytes, u.status, u.created_at, u.completed_at,
+	r.storage_upload_id, r.part_size, r.offset_bytes, r.parts, r.tail, r.expires_at`
+
+func scanResumable(row pgx.Row) (upload.Resumable, error) {
+	var out upload.Resumable
+	err := row.Scan(
+		&out.ID, &out.UserID, &out.StorageKey, &out.Filename, &out.ContentType, &out.SizeBytes, &out.Status, &out.CreatedAt, &out.CompletedAt,
+		&out.StorageUploadID, &out.PartSize, &out.Offset, &out.Parts, &out.Tail, &out.ExpiresAt,
+	)
+	return out, err
+}
+
+// CreateResumable records a pending upload together with the storage
+// multipart upload that will receive its parts.
+func (s *UploadStore) CreateResumable(ctx context.Context, in upload.Resumable) (upload.Resumable, error) {
+	var out upload.Resumable
+	err := InTx(ctx, s.db, func(ctx context.Context) error {
+		created, err := s.Create(ctx, in.Upload)
+		if err != nil {
+			return err
+		}
+		_, err = DBFromContext(ctx, s.db).Exec(ctx, `
+			insert into resumable_uploads (upload_id, storage_upload_id, part_size, expires_at)
+			values ($1, $2, $3, $4)
+		`, created.ID, in.StorageUploadID, in.PartSize, in.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("create resumable upload: %w", err)
+		}
+		out = in
+		out.Upload = created
+		out.Offset = 0
+		out.Parts = []upload.Part{}
+		return nil
+	})
+	return out, err
+}
+
+func (s *UploadStore) FindResumableForUser(ctx context.Context, id, userID int64) (upload.Resumable, error) {
+	db := DBFromContext(ctx, s.db)
+	out, err := scanResumable(db.QueryRow(ctx, `
+		select `+resumableColumns+`
+		from resumable_uploads r
+		join uploads u on u.id = r.upload_id
+		where u.id = $1 and u.user_id = $2
+	`, id, userID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return upload.Resumable{}, upload.ErrNotFound
+		}
+		return upload.Resumable{}, fmt.Errorf("find resumable upload: %w", err)
+	}
+	return out, nil
+}
+
+// AdvanceResumable appends parts, replaces the held tail and moves the
+// offset from fromOffset to toOffset. It fails with ErrOffsetMismatch when
+// another request advanced the upload first.
+func (s *UploadStore) AdvanceResumable(ctx context.Context, id, fromOffset, toOffset int64, parts []upload.Part, tail []byte) error {
+	if parts == nil {
+		parts = []upload.Part{}
+	}
+	if tail == nil {
+		tail = []byte{}
+	}
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		update resumable_uploads
+		set offset_bytes = $3, parts = parts || $4::jsonb, tail = $5, updated_at = now()
+		where upload_id = $1 and offset_bytes = $2
+	`, id, fromOffset, toOffset, parts, tail)
+	if err != nil {
+		return fmt.Errorf("advance resumable upload: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return upload.ErrOffsetMismatch
+	}
+	return nil
+}
+
+// CompleteResumable marks the upload completed and drops its resumable
+// state once storage has assembled the object.
+func (s *UploadStore) CompleteResumable(ctx context.Context, id, userID int64, at time.Time) (upload.Upload, error) {
+	var out upload.Upload
+	err := InTx(ctx, s.db, func(ctx context.Context) error {
+		var err error
+		out, err = s.MarkCompleted(ctx, id, userID, at)
+		if err != nil {
+			return err
+		}
+		if _, err := DBFromContext(ctx, s.db).Exec(ctx, `delete from resumable_uploads where upload_id = $1`, id); err != nil {
+			return fmt.Errorf("delete resumable upload: %w", err)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// DeleteResumable removes an unfinished upload and its resumable state.
+func (s *UploadStore) DeleteResumable(ctx context.Context, id int64) error {
+	db := DBFromContext(ctx, s.db)
+	_, err := db.Exec(ctx, `delete from uploads where id = $1 and status = 'pending'`, id)
+	if err != nil {
+		return fmt.Errorf("delete resumable upload: %w", err)
+	}
+	return nil
+}
+
+// ListExpiredResumable returns unfinished uploads that expired before now,
+// oldest first.
+func (s *UploadStore) ListExpiredResumable(ctx context.Context, now time.Time, limit int) ([]upload.Resumable, error) {
+	db := DBFromContext(ctx, s.db)
+	rows, err := db.Query(ctx, `
+		select `+resumableColumns+`
+		from resumable_uploads r
+		join uploads u on u.id = r.upload_id
+		where r.expires_at < $1
+		order by r.expires_at
+		limit $2
+	`, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list expired resumable uploads: %w", err)
+	}
+	defer rows.Close()
+	var out []upload.Resumable
+	for rows.Next() {
+		r, err := scanResumable(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan resumable upload: %w", err)
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
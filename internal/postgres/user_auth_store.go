@@ -15,24 +15,39 @@ import (
 )
 
 type UserAuthStore struct {
-	db *pgxpool.Pool
+	db    *pgxpool.Pool
+	reads *ReadRouter
 }
 
 func NewUserAuthStore(pool *pgxpool.Pool) *UserAuthStore {
 	return &UserAuthStore{db: pool}
 }
 
+// UseReadRouter lets read-only lookups go to replicas. Session lookups stay on
+// the primary: they run right after login, where replica lag would sign the
+// user straight back out.
+func (s *UserAuthStore) UseReadRouter(reads *ReadRouter) {
+	s.reads = reads
+}
+
+func (s *UserAuthStore) reader(ctx context.Context) DBHandle {
+	if s.reads != nil {
+		return s.reads.Reader(ctx)
+	}
+	return DBFromContext(ctx, s.db)
+}
+
 func (s *UserAuthStore) FindByIdentity(ctx context.Context, provider, providerUserID string) (user.User, error) {
-	db := DBFromContext(ctx, s.db)
+	db := s.reader(ctx)
 	var out user.User
 	var email sql.NullString
 	err := db.QueryRow(ctx, `
-		select u.id, coalesce(u.email, ''), u.display_name, coalesce(u.avatar_url, ''), u.created_at, u.updated_at
+		select u.id, coalesce(u.email, ''), u.display_name, coalesce(u.avatar_url, ''), u.avatar_source, u.created_at, u.updated_at, u.email_verified_at is not null
 		from user_identities ui
 		join users u on u.id = ui.user_id
 		where ui.provider = $1 and ui.provider_user_id = $2
 	`, strings.TrimSpace(strings.ToLower(provider)), strings.TrimSpace(providerUserID)).Scan(
-		&out.ID, &email, &out.DisplayName, &out.AvatarURL, &out.CreatedAt, &out.UpdatedAt,
+		&out.ID, &email, &out.DisplayName, &out.AvatarURL, &out.AvatarSource, &out.CreatedAt, &out.UpdatedAt, &out.EmailVerified,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -45,17 +60,17 @@ func (s *UserAuthStore) FindByIdentity(ctx context.Context, provider, providerUs
 }
 
 func (s *UserAuthStore) FindByEmail(ctx context.Context, email string) (user.User, error) {
-	db := DBFromContext(ctx, s.db)
+	db := s.reader(ctx)
 	email = strings.TrimSpace(strings.ToLower(email))
 	if email == "" {
 		return user.User{}, user.ErrNotFound
 	}
 	var out user.User
 	err := db.QueryRow(ctx, `
-		select id, coalesce(email, ''), display_name, coalesce(avatar_url, ''), created_at, updated_at
+		select id, coalesce(email, ''), display_name, coalesce(avatar_url, ''), avatar_source, created_at, updated_at, email_verified_at is not null
 		from users
 		where email = $1
-	`, email).Scan(&out.ID, &out.Email, &out.DisplayName, &out.AvatarURL, &out.CreatedAt, &out.UpdatedAt)
+	`, email).Scan(&out.ID, &out.Email, &out.DisplayName, &out.AvatarURL, &out.AvatarSource, &out.CreatedAt, &out.UpdatedAt, &out.EmailVerified)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return user.User{}, user.ErrNotFound
@@ -66,13 +81,13 @@ func (s *UserAuthStore) FindByEmail(ctx context.Context, email string) (user.Use
 }
 
 func (s *UserAuthStore) FindByID(ctx context.Context, id int64) (user.User, error) {
-	db := DBFromContext(ctx, s.db)
+	db := s.reader(ctx)
 	var out user.User
 	err := db.QueryRow(ctx, `
-		select id, coalesce(email, ''), display_name, coalesce(avatar_url, ''), created_at, updated_at
+		select id, coalesce(email, ''), display_name, coalesce(avatar_url, ''), avatar_source, created_at, updated_at, email_verified_at is not null
 		from users
 		where id = $1
-	`, id).Scan(&out.ID, &out.Email, &out.DisplayName, &out.AvatarURL, &out.CreatedAt, &out.UpdatedAt)
+	`, id).Scan(&out.ID, &out.Email, &out.DisplayName, &out.AvatarURL, &out.AvatarSource, &out.CreatedAt, &out.UpdatedAt, &out.EmailVerified)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return user.User{}, user.ErrNotFound
@@ -87,16 +102,25 @@ func (s *UserAuthStore) CreateUserWithIdentity(ctx context.Context, profile user
 		return user.User{}, err
 	}
 
-	tx, err := s.db.Begin(ctx)
+	var out user.User
+	err := InTx(ctx, s.db, func(ctx context.Context) error {
+		var err error
+		out, err = s.createUserWithIdentity(ctx, profile)
+		return err
+	})
 	if err != nil {
-		return user.User{}, fmt.Errorf("begin create user with identity: %w", err)
+		return user.User{}, err
 	}
-	defer tx.Rollback(ctx) //nolint:errcheck
+	return out, nil
+}
+
+func (s *UserAuthStore) createUserWithIdentity(ctx context.Context, profile user.SocialProfile) (user.User, error) {
+	db := DBFromContext(ctx, s.db)
 
 	var existingID int64
 	email := strings.TrimSpace(strings.ToLower(profile.Email))
 	if email != "" {
-		err = tx.QueryRow(ctx, `select id from users where email = $1`, email).Scan(&existingID)
+		err := db.QueryRow(ctx, `select id from users where email = $1`, email).Scan(&existingID)
 		if err == nil && existingID > 0 {
 			return user.User{}, user.ErrEmailConflict
 		}
@@ -118,12 +142,12 @@ func (s *UserAuthStore) CreateUserWithIdentity(ctx context.Context, profile user
 	if email != "" {
 		nullableEmail = email
 	}
-	err = tx.QueryRow(ctx, `
-		insert into users (email, display_name, avatar_url)
-		values ($1, $2, nullif($3, ''))
-		returning id, coalesce(email, ''), display_name, coalesce(avatar_url, ''), created_at, updated_at
-	`, nullableEmail, displayName, strings.TrimSpace(profile.AvatarURL)).Scan(
-		&out.ID, &out.Email, &out.DisplayName, &out.AvatarURL, &out.CreatedAt, &out.UpdatedAt,
+	err := db.QueryRow(ctx, `
+		insert into users (email, display_name, avatar_url, email_verified_at)
+		values ($1, $2, nullif($3, ''), case when $1::text is not null and $4 then now() end)
+		returning id, coalesce(email, ''), display_name, coalesce(avatar_url, ''), avatar_source, created_at, updated_at, email_verified_at is not null
+	`, nullableEmail, displayName, strings.TrimSpace(profile.AvatarURL), profile.EmailVerified).Scan(
+		&out.ID, &out.Email, &out.DisplayName, &out.AvatarURL, &out.AvatarSource, &out.CreatedAt, &out.UpdatedAt, &out.EmailVerified,
 	)
 	if err != nil {
 		if isUniqueViolation(err) {
@@ -132,7 +156,7 @@ func (s *UserAuthStore) CreateUserWithIdentity(ctx context.Context, profile user
 		return user.User{}, fmt.Errorf("insert user: %w", err)
 	}
 
-	_, err = tx.Exec(ctx, `
+	_, err = db.Exec(ctx, `
 		insert into user_identities (
 			user_id, provider, provider_user_id, provider_email, provider_name, provider_handle, avatar_url
 		) values ($1, $2, $3, nullif($4, ''), nullif($5, ''), nullif($6, ''), nullif($7, ''))
@@ -150,10 +174,6 @@ func (s *UserAuthStore) CreateUserWithIdentity(ctx context.Context, profile user
 		}
 		return user.User{}, fmt.Errorf("insert identity: %w", err)
 	}
-
-	if err := tx.Commit(ctx); err != nil {
-		return user.User{}, fmt.Errorf("commit create user with identity: %w", err)
-	}
 	return out, nil
 }
 
@@ -162,9 +182,10 @@ func (s *UserAuthStore) UpdateUserFromProfile(ctx context.Context, userID int64,
 	_, err := db.Exec(ctx, `
 		update users
 		set display_name = case when nullif($2, '') is not null then $2 else display_name end,
-		    avatar_url = case when nullif($3, '') is not null then $3 else avatar_url end
+		    avatar_url = case when avatar_source = 'provider' and nullif($3, '') is not null then $3 else avatar_url end,
+		    email_verified_at = case when $4 and email = nullif($5, '') then coalesce(email_verified_at, now()) else email_verified_at end
 		where id = $1
-	`, userID, strings.TrimSpace(profile.Name), strings.TrimSpace(profile.AvatarURL))
+	`, userID, strings.TrimSpace(profile.Name), strings.TrimSpace(profile.AvatarURL), profile.EmailVerified, strings.TrimSpace(strings.ToLower(profile.Email)))
 	if err != nil {
 		return fmt.Errorf("update user from profile: %w", err)
 	}
@@ -188,8 +209,62 @@ func (s *UserAuthStore) UpdateUserFromProfile(ctx context.Context, userID int64,
 	return nil
 }
 
-func (s *UserAuthStore) ListIdentitiesByUserID(ctx context.Context, userID int64) ([]user.Identity, error) {
+// SetCustomAvatar points the user's avatar at uploaded objects and returns
+// the storage keys of the custom avatar it replaced, if any.
+func (s *UserAuthStore) SetCustomAvatar(ctx context.Context, userID int64, avatarURL string, keys []string) ([]string, error) {
 	db := DBFromContext(ctx, s.db)
+	var previous []string
+	err := db.QueryRow(ctx, `
+		update users u
+		set avatar_url = $2,
+		    avatar_source = 'custom',
+		    avatar_keys = $3,
+		    updated_at = now()
+		from (select id, avatar_keys from users where id = $1 for update) old
+		where u.id = old.id
+		returning old.avatar_keys
+	`, userID, strings.TrimSpace(avatarURL), keys).Scan(&previous)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, user.ErrNotFound
+		}
+		return nil, fmt.Errorf("set custom avatar: %w", err)
+	}
+	return previous, nil
+}
+
+// ResetAvatar switches the user back to their most recently updated provider
+// avatar and returns the storage keys of the custom avatar it dropped.
+func (s *UserAuthStore) ResetAvatar(ctx context.Context, userID int64) ([]string, error) {
+	db := DBFromContext(ctx, s.db)
+	var previous []string
+	err := db.QueryRow(ctx, `
+		update users u
+		set avatar_url = (
+		        select ui.avatar_url
+		        from user_identities ui
+		        where ui.user_id = u.id and ui.avatar_url is not null
+		        order by ui.updated_at desc
+		        limit 1
+		    ),
+		    avatar_source = 'provider',
+		    avatar_keys = '{}',
+		    updated_at = now()
+		from (select id, avatar_keys from users where id = $1 for update) old
+		where u.id = old.id
+		returning old.avatar_keys
+	`, userID).Scan(&previous)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, user.ErrNotFound
+		}
+		return nil, fmt.Errorf("reset avatar: %w", err)
+	}
+	return previous, nil
+}
+
+func (s *UserAuthStore) ListIdentitiesByUserID(ctx context.Context, userID int64) ([]user.Identity, error) {
+	db := s.reader(ctx)
 	rows, err := db.Query(ctx, `
 		select id, user_id, provider, provider_user_id, coalesce(provider_email, ''), coalesce(provider_name, ''), coalesce(provider_handle, ''), coalesce(avatar_url, ''), created_at, updated_at
 		from user_identities
@@ -221,9 +296,9 @@ func (s *UserAuthStore) ListIdentitiesByUserID(ctx context.Context, userID int64
 func (s *UserAuthStore) CreateSession(ctx context.Context, sess user.Session) error {
 	db := DBFromContext(ctx, s.db)
 	_, err := db.Exec(ctx, `
-		insert into user_sessions (user_id, token_hash, expires_at, last_seen_at, ip, user_agent)
-		values ($1, $2, $3, coalesce($4, now()), nullif($5, ''), nullif($6, ''))
-	`, sess.UserID, sess.TokenHash, sess.ExpiresAt, sess.LastSeenAt, strings.TrimSpace(sess.IP), strings.TrimSpace(sess.UserAgent))
+		insert into user_sessions (user_id, token_hash, expires_at, last_seen_at, ip, user_agent, mfa_pending)
+		values ($1, $2, $3, coalesce($4, now()), nullif($5, ''), nullif($6, ''), $7)
+	`, sess.UserID, sess.TokenHash, sess.ExpiresAt, sess.LastSeenAt, strings.TrimSpace(sess.IP), strings.TrimSpace(sess.UserAgent), sess.MFAPending)
 	if err != nil {
 		return fmt.Errorf("create session: %w", err)
 	}
@@ -237,14 +312,14 @@ func (s *UserAuthStore) FindSessionAndUserByTokenHash(ctx context.Context, token
 	err := db.QueryRow(ctx, `
 		select
 			s.id, s.user_id, s.token_hash, s.expires_at, s.created_at, s.last_seen_at,
-			coalesce(s.ip, ''), coalesce(s.user_agent, ''), s.revoked_at,
-			u.id, coalesce(u.email, ''), u.display_name, coalesce(u.avatar_url, ''), u.created_at, u.updated_at
+			coalesce(s.ip, ''), coalesce(s.user_agent, ''), s.revoked_at, s.mfa_pending,
+			u.id, coalesce(u.email, ''), u.display_name, coalesce(u.avatar_url, ''), u.avatar_source, u.created_at, u.updated_at, u.email_verified_at is not null
 		from user_sessions s
 		join users u on u.id = s.user_id
 		where s.token_hash = $1
 	`, strings.TrimSpace(tokenHash)).Scan(
-		&sess.ID, &sess.UserID, &sess.TokenHash, &sess.ExpiresAt, &sess.CreatedAt, &sess.LastSeenAt, &sess.IP, &sess.UserAgent, &sess.RevokedAt,
-		&u.ID, &u.Email, &u.DisplayName, &u.AvatarURL, &u.CreatedAt, &u.UpdatedAt,
+		&sess.ID, &sess.UserID, &sess.TokenHash, &sess.ExpiresAt, &sess.CreatedAt, &sess.LastSeenAt, &sess.IP, &sess.UserAgent, &sess.RevokedAt, &sess.MFAPending,
+		&u.ID, &u.Email, &u.DisplayName, &u.AvatarURL, &u.AvatarSource, &u.CreatedAt, &u.UpdatedAt, &u.EmailVerified,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -273,6 +348,26 @@ func (s *UserAuthStore) TouchSession(ctx context.Context, sessionID int64, at ti
 	return nil
 }
 
+// PruneExpired deletes sessions and API refresh tokens that expired before
+// before and reports how many of each it removed.
+func (s *UserAuthStore) PruneExpired(ctx context.Context, before time.Time) (sessions, refreshTokens int64, err error) {
+	err = InTx(ctx, s.db, func(ctx context.Context) error {
+		db := DBFromContext(ctx, s.db)
+		tag, err := db.Exec(ctx, `delete from user_sessions where expires_at < $1`, before)
+		if err != nil {
+			return fmt.Errorf("prune sessions: %w", err)
+		}
+		sessions = tag.RowsAffected()
+		tag, err = db.Exec(ctx, `delete from api_refresh_tokens where expires_at < $1`, before)
+		if err != nil {
+			return fmt.Errorf("prune api refresh tokens: %w", err)
+		}
+		refreshTokens = tag.RowsAffected()
+		return nil
+	})
+	return sessions, refreshTokens, err
+}
+
 func (s *UserAuthStore) CreateAPIRefreshToken(ctx context.Context, token user.APIRefreshToken) error {
 	db := DBFromContext(ctx, s.db)
 	_, err := db.Exec(ctx, `
@@ -286,7 +381,7 @@ func (s *UserAuthStore) CreateAPIRefreshToken(ctx context.Context, token user.AP
 }
 
 func (s *UserAuthStore) GetAPIRefreshTokenByHash(ctx context.Context, tokenHash string) (user.APIRefreshToken, error) {
-	db := DBFromContext(ctx, s.db)
+	db := s.reader(ctx)
 	var out user.APIRefreshToken
 	err := db.QueryRow(ctx, `
 		select id, user_id, family_id, token_hash, expires_at, created_at, last_used_at, revoked_at, replaced_by_token_id
@@ -312,14 +407,23 @@ type APIRotateRefreshTokenResult struct {
 }
 
 func (s *UserAuthStore) RotateAPIRefreshToken(ctx context.Context, oldTokenHash string, newToken user.APIRefreshToken, now time.Time) (APIRotateRefreshTokenResult, error) {
-	tx, err := s.db.Begin(ctx)
+	var result APIRotateRefreshTokenResult
+	err := InTx(ctx, s.db, func(ctx context.Context) error {
+		var err error
+		result, err = s.rotateAPIRefreshToken(ctx, oldTokenHash, newToken, now)
+		return err
+	})
 	if err != nil {
-		return APIRotateRefreshTokenResult{}, fmt.Errorf("begin rotate api refresh token: %w", err)
+		return APIRotateRefreshTokenResult{}, err
 	}
-	defer tx.Rollback(ctx) //nolint:errcheck
+	return result, nil
+}
+
+func (s *UserAuthStore) rotateAPIRefreshToken(ctx context.Context, oldTokenHash string, newToken user.APIRefreshToken, now time.Time) (APIRotateRefreshTokenResult, error) {
+	db := DBFromContext(ctx, s.db)
 
 	var current user.APIRefreshToken
-	err = tx.QueryRow(ctx, `
+	err := db.QueryRow(ctx, `
 		select id, user_id, family_id, token_hash, expires_at, created_at, last_used_at, revoked_at, replaced_by_token_id
 		from api_refresh_tokens
 		where token_hash = $1
@@ -335,9 +439,8 @@ func (s *UserAuthStore) RotateAPIRefreshToken(ctx context.Context, oldTokenHash
 	}
 
 	if current.RevokedAt != nil || current.ReplacedByTokenID != nil || now.After(current.ExpiresAt) {
-		_, _ = tx.Exec(ctx, `update api_refresh_tokens set revoked_at = coalesce(revoked_at, $2) where family_id = $1`, current.FamilyID, now)
-		if err := tx.Commit(ctx); err != nil {
-			return APIRotateRefreshTokenResult{}, fmt.Errorf("commit revoke family on reuse: %w", err)
+		if _, err := db.Exec(ctx, `update api_refresh_tokens set revoked_at = coalesce(revoked_at, $2) where family_id = $1`, current.FamilyID, now); err != nil {
+			return APIRotateRefreshTokenResult{}, fmt.Errorf("revoke family on reuse: %w", err)
 		}
 		return APIRotateRefreshTokenResult{
 			UserID:        current.UserID,
@@ -357,7 +460,7 @@ func (s *UserAuthStore) RotateAPIRefreshToken(ctx context.Context, oldTokenHash
 		familyID = current.FamilyID
 	}
 
-	err = tx.QueryRow(ctx, `
+	err = db.QueryRow(ctx, `
 		insert into api_refresh_tokens (user_id, family_id, token_hash, expires_at)
 		values ($1, $2, $3, $4)
 		returning id
@@ -366,7 +469,7 @@ func (s *UserAuthStore) RotateAPIRefreshToken(ctx context.Context, oldTokenHash
 		return APIRotateRefreshTokenResult{}, fmt.Errorf("insert rotated api refresh token: %w", err)
 	}
 
-	_, err = tx.Exec(ctx, `
+	_, err = db.Exec(ctx, `
 		update api_refresh_tokens
 		set last_used_at = $2, revoked_at = $2, replaced_by_token_id = $3
 		where id = $1
@@ -375,10 +478,6 @@ func (s *UserAuthStore) RotateAPIRefreshToken(ctx context.Context, oldTokenHash
 		return APIRotateRefreshTokenResult{}, fmt.Errorf("mark current api refresh token rotated: %w", err)
 	}
 
-	if err := tx.Commit(ctx); err != nil {
-		return APIRotateRefreshTokenResult{}, fmt.Errorf("commit rotate api refresh token: %w", err)
-	}
-
 	return APIRotateRefreshTokenResult{
 		UserID:     current.UserID,
 		FamilyID:   current.FamilyID,
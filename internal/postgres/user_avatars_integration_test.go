@@ -0,0 +1,70 @@
+package postgres
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/benpsk/go-starter/internal/user"
+)
+
+func TestCustomAvatarSurvivesProviderLoginUntilReset(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewUserAuthStore(integrationPool)
+	u := createTestUser(t, ctx, store)
+	identities, err := store.ListIdentitiesByUserID(ctx, u.ID)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("list identities: %v (%d)", err, len(identities))
+	}
+	profile := user.SocialProfile{
+		Provider:       identities[0].Provider,
+		ProviderUserID: identities[0].ProviderUserID,
+		Name:           "Store Test User",
+		AvatarURL:      "https://provider.example/avatar-1.png",
+	}
+	if err := store.UpdateUserFromProfile(ctx, u.ID, profile); err != nil {
+		t.Fatalf("update from profile: %v", err)
+	}
+
+	keys := []string{"avatars/1/a/64.jpg", "avatars/1/a/256.jpg"}
+	previous, err := store.SetCustomAvatar(ctx, u.ID, "https://cdn.example/avatars/1/a/256.jpg", keys)
+	if err != nil {
+		t.Fatalf("set custom avatar: %v", err)
+	}
+	if len(previous) != 0 {
+		t.Fatalf("expected no previous keys, got %v", previous)
+	}
+	previous, err = store.SetCustomAvatar(ctx, u.ID, "https://cdn.example/avatars/1/b/256.jpg", []string{"avatars/1/b/256.jpg"})
+	if err != nil {
+		t.Fatalf("replace custom avatar: %v", err)
+	}
+	if !slices.Equal(previous, keys) {
+		t.Fatalf("previous keys = %v, want %v", previous, keys)
+	}
+
+	profile.AvatarURL = "https://provider.example/avatar-2.png"
+	if err := store.UpdateUserFromProfile(ctx, u.ID, profile); err != nil {
+		t.Fatalf("update from profile: %v", err)
+	}
+	got, err := store.FindByID(ctx, u.ID)
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+	if got.AvatarSource != user.AvatarSourceCustom || got.AvatarURL != "https://cdn.example/avatars/1/b/256.jpg" {
+		t.Fatalf("custom avatar was overwritten: %+v", got)
+	}
+
+	if _, err := store.ResetAvatar(ctx, u.ID); err != nil {
+		t.Fatalf("reset avatar: %v", err)
+	}
+	got, err = store.FindByID(ctx, u.ID)
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+	if got.AvatarSource != user.AvatarSourceProvider || got.AvatarURL != profile.AvatarURL {
+		t.Fatalf("expected provider avatar after reset, got %+v", got)
+	}
+}
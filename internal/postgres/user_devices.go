@@ -0,0 +1,118 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/user"
+	"github.com/jackc/pgx/v5"
+)
+
+// RememberDevice records that userID signed in from fingerprint at at. It
+// reports isNew only when the fingerprint was unknown and the user already
+// had other devices, so the first sign-in of an account is not flagged.
+func (s *UserAuthStore) RememberDevice(ctx context.Context, userID int64, fingerprint string, at time.Time) (isNew bool, err error) {
+	db := DBFromContext(ctx, s.db)
+	var (
+		inserted bool
+		known    int64
+	)
+	err = db.QueryRow(ctx, `
+		with known as (
+			select count(*) as n from user_devices where user_id = $1
+		), seen as (
+			insert into user_devices (user_id, fingerprint, first_seen_at, last_seen_at)
+			values ($1, $2, $3, $3)
+			on conflict (user_id, fingerprint) do update set last_seen_at = excluded.last_seen_at
+			returning (xmax = 0) as inserted
+		)
+		select seen.inserted, known.n from seen, known
+	`, userID, fingerprint, at).Scan(&inserted, &known)
+	if err != nil {
+		return false, fmt.Errorf("remember device: %w", err)
+	}
+	return inserted && known > 0, nil
+}
+
+func (s *UserAuthStore) CreateSecurityEvent(ctx context.Context, ev user.SecurityEvent) (user.SecurityEvent, error) {
+	db := DBFromContext(ctx, s.db)
+	err := db.QueryRow(ctx, `
+		insert into security_events (user_id, kind, client, fingerprint, device, ip, user_agent)
+		values ($1, $2, $3, $4, $5, nullif($6, ''), nullif($7, ''))
+		returning id, created_at
+	`, ev.UserID, ev.Kind, ev.Client, ev.Fingerprint, ev.Device, strings.TrimSpace(ev.IP), strings.TrimSpace(ev.UserAgent)).Scan(&ev.ID, &ev.CreatedAt)
+	if err != nil {
+		return user.SecurityEvent{}, fmt.Errorf("create security event: %w", err)
+	}
+	return ev, nil
+}
+
+// ListSecurityEvents returns the user's newest events first.
+func (s *UserAuthStore) ListSecurityEvents(ctx context.Context, userID int64, limit int) ([]user.SecurityEvent, error) {
+	db := DBFromContext(ctx, s.db)
+	rows, err := db.Query(ctx, `
+		select id, user_id, kind, client, fingerprint, device, coalesce(ip, ''), coalesce(user_agent, ''), created_at, reported_at
+		from security_events
+		where user_id = $1
+		order by created_at desc, id desc
+		limit $2
+	`, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list security events: %w", err)
+	}
+	defer rows.Close()
+	var out []user.SecurityEvent
+	for rows.Next() {
+		var ev user.SecurityEvent
+		if err := rows.Scan(&ev.ID, &ev.UserID, &ev.Kind, &ev.Client, &ev.Fingerprint, &ev.Device, &ev.IP, &ev.UserAgent, &ev.CreatedAt, &ev.ReportedAt); err != nil {
+			return nil, fmt.Errorf("scan security event: %w", err)
+		}
+		out = append(out, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate security events: %w", err)
+	}
+	return out, nil
+}
+
+// ReportSecurityEvent marks the user's event as not recognised and forgets
+// its device, so another sign-in from it is flagged again.
+func (s *UserAuthStore) ReportSecurityEvent(ctx context.Context, userID, eventID int64, at time.Time) error {
+	return InTx(ctx, s.db, func(ctx context.Context) error {
+		db := DBFromContext(ctx, s.db)
+		var fingerprint string
+		err := db.QueryRow(ctx, `
+			update security_events set reported_at = coalesce(reported_at, $3)
+			where id = $1 and user_id = $2
+			returning fingerprint
+		`, eventID, userID, at).Scan(&fingerprint)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return user.ErrNotFound
+			}
+			return fmt.Errorf("report security event: %w", err)
+		}
+		if _, err := db.Exec(ctx, `delete from user_devices where user_id = $1 and fingerprint = $2`, userID, fingerprint); err != nil {
+			return fmt.Errorf("forget device: %w", err)
+		}
+		return nil
+	})
+}
+
+// RevokeAllSessions signs the user out of every browser session and API
+// refresh token family.
+func (s *UserAuthStore) RevokeAllSessions(ctx context.Context, userID int64, at time.Time) error {
+	return InTx(ctx, s.db, func(ctx context.Context) error {
+		db := DBFromContext(ctx, s.db)
+		if _, err := db.Exec(ctx, `update user_sessions set revoked_at = coalesce(revoked_at, $2) where user_id = $1`, userID, at); err != nil {
+			return fmt.Errorf("revoke sessions: %w", err)
+		}
+		if _, err := db.Exec(ctx, `update api_refresh_tokens set revoked_at = coalesce(revoked_at, $2) where user_id = $1`, userID, at); err != nil {
+			return fmt.Errorf("revoke api refresh tokens: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,80 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/user"
+	"github.com/jackc/pgx/v5"
+)
+
+func (s *UserAuthStore) CreateMagicLink(ctx context.Context, link user.MagicLink) error {
+	db := DBFromContext(ctx, s.db)
+	_, err := db.Exec(ctx, `
+		insert into magic_links (email, token_hash, redirect_to, expires_at)
+		values ($1, $2, $3, $4)
+	`, strings.TrimSpace(strings.ToLower(link.Email)), strings.TrimSpace(link.TokenHash), strings.TrimSpace(link.RedirectTo), link.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("create magic link: %w", err)
+	}
+	return nil
+}
+
+// UseMagicLink marks the unexpired, unused link with tokenHash as used and
+// returns it. Concurrent uses of one link cannot both succeed.
+func (s *UserAuthStore) UseMagicLink(ctx context.Context, tokenHash string, now time.Time) (user.MagicLink, error) {
+	db := DBFromContext(ctx, s.db)
+	var out user.MagicLink
+	err := db.QueryRow(ctx, `
+		update magic_links
+		set used_at = $2
+		where token_hash = $1 and used_at is null and expires_at > $2
+		returning id, email, token_hash, redirect_to, expires_at, created_at, used_at
+	`, strings.TrimSpace(tokenHash), now).Scan(
+		&out.ID, &out.Email, &out.TokenHash, &out.RedirectTo, &out.ExpiresAt, &out.CreatedAt, &out.UsedAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user.MagicLink{}, user.ErrNotFound
+		}
+		return user.MagicLink{}, fmt.Errorf("use magic link: %w", err)
+	}
+	return out, nil
+}
+
+// DeleteExpiredMagicLinks deletes links that expired before before, used or
+// not, and reports how many it removed.
+func (s *UserAuthStore) DeleteExpiredMagicLinks(ctx context.Context, before time.Time) (int64, error) {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `delete from magic_links where expires_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired magic links: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// FindByVerifiedEmail finds the user whose email was verified by a provider
+// or a magic link.
+func (s *UserAuthStore) FindByVerifiedEmail(ctx context.Context, email string) (user.User, error) {
+	db := DBFromContext(ctx, s.db)
+	email = strings.TrimSpace(strings.ToLower(email))
+	if email == "" {
+		return user.User{}, user.ErrNotFound
+	}
+	var out user.User
+	err := db.QueryRow(ctx, `
+		select id, coalesce(email, ''), display_name, coalesce(avatar_url, ''), avatar_source, created_at, updated_at, email_verified_at is not null
+		from users
+		where email = $1 and email_verified_at is not null
+	`, email).Scan(&out.ID, &out.Email, &out.DisplayName, &out.AvatarURL, &out.AvatarSource, &out.CreatedAt, &out.UpdatedAt, &out.EmailVerified)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user.User{}, user.ErrNotFound
+		}
+		return user.User{}, fmt.Errorf("find user by verified email: %w", err)
+	}
+	return out, nil
+}
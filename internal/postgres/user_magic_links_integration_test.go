@@ -0,0 +1,101 @@
+package postgres
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/user"
+)
+
+func TestMagicLinksAreSingleUse(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewUserAuthStore(integrationPool)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	now := time.Now().UTC()
+	link := user.MagicLink{Email: " Ada@Example.com ", TokenHash: "magic-" + suffix, RedirectTo: "/account", ExpiresAt: now.Add(15 * time.Minute)}
+	if err := store.CreateMagicLink(ctx, link); err != nil {
+		t.Fatalf("create magic link: %v", err)
+	}
+	expired := user.MagicLink{Email: "ada@example.com", TokenHash: "expired-" + suffix, ExpiresAt: now.Add(-time.Minute)}
+	if err := store.CreateMagicLink(ctx, expired); err != nil {
+		t.Fatalf("create expired magic link: %v", err)
+	}
+
+	used, err := store.UseMagicLink(ctx, link.TokenHash, now)
+	if err != nil || used.Email != "ada@example.com" || used.RedirectTo != "/account" || used.UsedAt == nil {
+		t.Fatalf("use magic link: %+v %v", used, err)
+	}
+	if _, err := store.UseMagicLink(ctx, link.TokenHash, now); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("link used twice: %v", err)
+	}
+	if _, err := store.UseMagicLink(ctx, expired.TokenHash, now); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("expired link used: %v", err)
+	}
+
+	deleted, err := store.DeleteExpiredMagicLinks(ctx, now)
+	if err != nil || deleted < 1 {
+		t.Fatalf("delete expired: %d %v", deleted, err)
+	}
+	if _, err := store.UseMagicLink(ctx, expired.TokenHash, now.Add(-time.Hour)); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("expected the expired link to be deleted: %v", err)
+	}
+}
+
+func TestFindByVerifiedEmail(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewUserAuthStore(integrationPool)
+	verified := createTestUser(t, ctx, store)
+	found, err := store.FindByVerifiedEmail(ctx, verified.Email)
+	if err != nil || found.ID != verified.ID {
+		t.Fatalf("find verified: %+v %v", found, err)
+	}
+
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	unverified, err := store.CreateUserWithIdentity(ctx, user.SocialProfile{
+		Provider:       "google",
+		ProviderUserID: "unverified-" + suffix,
+		Email:          "unverified+" + suffix + "@example.com",
+		Name:           "Unverified",
+	})
+	if err != nil {
+		t.Fatalf("create unverified user: %v", err)
+	}
+	if _, err := store.FindByVerifiedEmail(ctx, unverified.Email); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("unverified email was found: %v", err)
+	}
+
+	// A later sign-in where the provider vouches for the address verifies it.
+	profile := user.SocialProfile{Provider: "google", ProviderUserID: "unverified-" + suffix, Email: unverified.Email, Name: "Unverified"}
+	if err := store.UpdateUserFromProfile(ctx, unverified.ID, profile); err != nil {
+		t.Fatalf("update unverified: %v", err)
+	}
+	if _, err := store.FindByVerifiedEmail(ctx, unverified.Email); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("email verified without the provider saying so: %v", err)
+	}
+	profile.Email = "other+" + suffix + "@example.com"
+	profile.EmailVerified = true
+	if err := store.UpdateUserFromProfile(ctx, unverified.ID, profile); err != nil {
+		t.Fatalf("update with another email: %v", err)
+	}
+	if _, err := store.FindByVerifiedEmail(ctx, unverified.Email); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("a different verified address verified the stored one: %v", err)
+	}
+	profile.Email = strings.ToUpper(unverified.Email)
+	if err := store.UpdateUserFromProfile(ctx, unverified.ID, profile); err != nil {
+		t.Fatalf("update verified: %v", err)
+	}
+	if found, err := store.FindByVerifiedEmail(ctx, unverified.Email); err != nil || found.ID != unverified.ID || !found.EmailVerified {
+		t.Fatalf("find after verification: %+v %v", found, err)
+	}
+}
@@ -0,0 +1,156 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/user"
+	"github.com/jackc/pgx/v5"
+)
+
+// PutPendingMFA stores a new, unconfirmed TOTP secret for userID, replacing
+// an earlier unconfirmed one. It returns user.ErrMFAEnabled when the user
+// already has a confirmed enrollment.
+func (s *UserAuthStore) PutPendingMFA(ctx context.Context, userID int64, ciphertext []byte) error {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		insert into user_mfa (user_id, secret_ciphertext)
+		values ($1, $2)
+		on conflict (user_id) do update set
+			secret_ciphertext = excluded.secret_ciphertext,
+			last_used_step = 0,
+			created_at = now()
+		where user_mfa.confirmed_at is null
+	`, userID, ciphertext)
+	if err != nil {
+		return fmt.Errorf("put pending mfa: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return user.ErrMFAEnabled
+	}
+	return nil
+}
+
+func (s *UserAuthStore) FindMFA(ctx context.Context, userID int64) (user.MFA, error) {
+	db := DBFromContext(ctx, s.db)
+	var m user.MFA
+	err := db.QueryRow(ctx, `
+		select user_id, secret_ciphertext, confirmed_at, last_used_step, created_at
+		from user_mfa
+		where user_id = $1
+	`, userID).Scan(&m.UserID, &m.SecretCiphertext, &m.ConfirmedAt, &m.LastUsedStep, &m.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user.MFA{}, user.ErrNotFound
+		}
+		return user.MFA{}, fmt.Errorf("find mfa: %w", err)
+	}
+	return m, nil
+}
+
+// ConfirmMFA enables a pending enrollment after its first valid code, which
+// was for TOTP time step step.
+func (s *UserAuthStore) ConfirmMFA(ctx context.Context, userID, step int64, at time.Time) error {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		update user_mfa set confirmed_at = $3, last_used_step = $2
+		where user_id = $1 and confirmed_at is null
+	`, userID, step, at)
+	if err != nil {
+		return fmt.Errorf("confirm mfa: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return user.ErrNotFound
+	}
+	return nil
+}
+
+// UseMFAStep records that the code for step was used. It reports false when
+// that step or a later one was used already, so each code works once.
+func (s *UserAuthStore) UseMFAStep(ctx context.Context, userID, step int64) (bool, error) {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		update user_mfa set last_used_step = $2
+		where user_id = $1 and confirmed_at is not null and last_used_step < $2
+	`, userID, step)
+	if err != nil {
+		return false, fmt.Errorf("use mfa step: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// DeleteMFA turns two-factor authentication off and drops recovery codes.
+func (s *UserAuthStore) DeleteMFA(ctx context.Context, userID int64) error {
+	return InTx(ctx, s.db, func(ctx context.Context) error {
+		db := DBFromContext(ctx, s.db)
+		if _, err := db.Exec(ctx, `delete from user_recovery_codes where user_id = $1`, userID); err != nil {
+			return fmt.Errorf("delete recovery codes: %w", err)
+		}
+		if _, err := db.Exec(ctx, `delete from user_mfa where user_id = $1`, userID); err != nil {
+			return fmt.Errorf("delete mfa: %w", err)
+		}
+		return nil
+	})
+}
+
+// ReplaceRecoveryCodes swaps all of userID's recovery codes for hashes.
+func (s *UserAuthStore) ReplaceRecoveryCodes(ctx context.Context, userID int64, hashes []string) error {
+	return InTx(ctx, s.db, func(ctx context.Context) error {
+		db := DBFromContext(ctx, s.db)
+		if _, err := db.Exec(ctx, `delete from user_recovery_codes where user_id = $1`, userID); err != nil {
+			return fmt.Errorf("delete recovery codes: %w", err)
+		}
+		_, err := db.Exec(ctx, `
+			insert into user_recovery_codes (user_id, code_hash)
+			select $1, unnest($2::text[])
+		`, userID, hashes)
+		if err != nil {
+			return fmt.Errorf("insert recovery codes: %w", err)
+		}
+		return nil
+	})
+}
+
+// UseRecoveryCode spends the unused code with hash and reports whether
+// there was one.
+func (s *UserAuthStore) UseRecoveryCode(ctx context.Context, userID int64, hash string, at time.Time) (bool, error) {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		update user_recovery_codes set used_at = $3
+		where user_id = $1 and code_hash = $2 and used_at is null
+	`, userID, strings.TrimSpace(hash), at)
+	if err != nil {
+		return false, fmt.Errorf("use recovery code: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (s *UserAuthStore) CountRecoveryCodes(ctx context.Context, userID int64) (int, error) {
+	db := DBFromContext(ctx, s.db)
+	var n int
+	err := db.QueryRow(ctx, `select count(*) from user_recovery_codes where user_id = $1 and used_at is null`, userID).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("count recovery codes: %w", err)
+	}
+	return n, nil
+}
+
+// CompleteMFASession marks a pending session fully signed in. The token is
+// replaced, so a token seen before the second factor is worthless.
+func (s *UserAuthStore) CompleteMFASession(ctx context.Context, oldTokenHash, newTokenHash string, expiresAt, now time.Time) error {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		update user_sessions set token_hash = $2, expires_at = $3, mfa_pending = false, last_seen_at = $4
+		where token_hash = $1 and mfa_pending and revoked_at is null and expires_at > $4
+	`, strings.TrimSpace(oldTokenHash), newTokenHash, expiresAt, now)
+	if err != nil {
+		return fmt.Errorf("complete mfa session: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return user.ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package postgres
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/user"
+)
+
+func TestMFAEnrollmentAndOneTimeCodes(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewUserAuthStore(integrationPool)
+	u := createTestUser(t, ctx, store)
+	if _, err := store.FindMFA(ctx, u.ID); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("expected no enrollment, got %v", err)
+	}
+	if err := store.PutPendingMFA(ctx, u.ID, []byte("first")); err != nil {
+		t.Fatalf("put pending: %v", err)
+	}
+	if err := store.PutPendingMFA(ctx, u.ID, []byte("second")); err != nil {
+		t.Fatalf("replace pending: %v", err)
+	}
+	if used, err := store.UseMFAStep(ctx, u.ID, 100); err != nil || used {
+		t.Fatalf("unconfirmed enrollment accepted a code: %v %v", used, err)
+	}
+
+	now := time.Now().UTC()
+	if err := store.ConfirmMFA(ctx, u.ID, 100, now); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	m, err := store.FindMFA(ctx, u.ID)
+	if err != nil || string(m.SecretCiphertext) != "second" || m.ConfirmedAt == nil || m.LastUsedStep != 100 {
+		t.Fatalf("find after confirm: %+v %v", m, err)
+	}
+	if err := store.PutPendingMFA(ctx, u.ID, []byte("third")); !errors.Is(err, user.ErrMFAEnabled) {
+		t.Fatalf("confirmed enrollment was replaced: %v", err)
+	}
+	for _, tc := range []struct {
+		step int64
+		want bool
+	}{{100, false}, {99, false}, {101, true}, {101, false}} {
+		if used, err := store.UseMFAStep(ctx, u.ID, tc.step); err != nil || used != tc.want {
+			t.Fatalf("use step %d = %v %v, want %v", tc.step, used, err, tc.want)
+		}
+	}
+
+	if err := store.ReplaceRecoveryCodes(ctx, u.ID, []string{"hash-a", "hash-b"}); err != nil {
+		t.Fatalf("replace codes: %v", err)
+	}
+	if used, err := store.UseRecoveryCode(ctx, u.ID, "hash-a", now); err != nil || !used {
+		t.Fatalf("use code: %v %v", used, err)
+	}
+	if used, err := store.UseRecoveryCode(ctx, u.ID, "hash-a", now); err != nil || used {
+		t.Fatalf("code used twice: %v %v", used, err)
+	}
+	if n, err := store.CountRecoveryCodes(ctx, u.ID); err != nil || n != 1 {
+		t.Fatalf("count codes = %d %v", n, err)
+	}
+	if err := store.ReplaceRecoveryCodes(ctx, u.ID, []string{"hash-c"}); err != nil {
+		t.Fatalf("regenerate codes: %v", err)
+	}
+	if used, _ := store.UseRecoveryCode(ctx, u.ID, "hash-b", now); used {
+		t.Fatal("old code still works after regenerating")
+	}
+
+	if err := store.DeleteMFA(ctx, u.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.FindMFA(ctx, u.ID); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("expected enrollment to be gone, got %v", err)
+	}
+	if n, _ := store.CountRecoveryCodes(ctx, u.ID); n != 0 {
+		t.Fatalf("%d recovery codes left after delete", n)
+	}
+}
+
+func TestCompleteMFASessionReplacesToken(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewUserAuthStore(integrationPool)
+	u := createTestUser(t, ctx, store)
+	now := time.Now().UTC()
+	err := store.CreateSession(ctx, user.Session{
+		UserID:     u.ID,
+		TokenHash:  "pending-hash",
+		ExpiresAt:  now.Add(10 * time.Minute),
+		LastSeenAt: now,
+		MFAPending: true,
+	})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	sess, _, err := store.FindSessionAndUserByTokenHash(ctx, "pending-hash")
+	if err != nil || !sess.MFAPending {
+		t.Fatalf("pending session: %+v %v", sess, err)
+	}
+	if err := store.CompleteMFASession(ctx, "pending-hash", "full-hash", now.Add(time.Hour), now); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	if _, _, err := store.FindSessionAndUserByTokenHash(ctx, "pending-hash"); err == nil {
+		t.Fatal("pending token still works")
+	}
+	sess, _, err = store.FindSessionAndUserByTokenHash(ctx, "full-hash")
+	if err != nil || sess.MFAPending {
+		t.Fatalf("completed session: %+v %v", sess, err)
+	}
+	if err := store.CompleteMFASession(ctx, "full-hash", "again", now.Add(time.Hour), now); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("completed session upgraded twice: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/user"
+	"github.com/jackc/pgx/v5"
+)
+
+const passkeyColumns = `id, user_id, credential_id, public_key, sign_count, transports, backup_eligible, backed_up, name, created_at, last_used_at`
+
+// LinkIdentity adds another sign-in identity to an existing user.
+func (s *UserAuthStore) LinkIdentity(ctx context.Context, userID int64, profile user.SocialProfile) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	db := DBFromContext(ctx, s.db)
+	_, err := db.Exec(ctx, `
+		insert into user_identities (user_id, provider, provider_user_id, provider_name)
+		values ($1, $2, $3, nullif($4, ''))
+	`, userID, strings.TrimSpace(strings.ToLower(profile.Provider)), strings.TrimSpace(profile.ProviderUserID), strings.TrimSpace(profile.Name))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return user.ErrIdentityConflict
+		}
+		return fmt.Errorf("link identity: %w", err)
+	}
+	return nil
+}
+
+func (s *UserAuthStore) CreatePasskey(ctx context.Context, p user.Passkey) (user.Passkey, error) {
+	db := DBFromContext(ctx, s.db)
+	transports := p.Transports
+	if transports == nil {
+		transports = []string{}
+	}
+	row := db.QueryRow(ctx, `
+		insert into webauthn_credentials (user_id, credential_id, public_key, sign_count, transports, backup_eligible, backed_up, name)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)
+		returning `+passkeyColumns,
+		p.UserID, p.CredentialID, p.PublicKey, int64(p.SignCount), transports, p.BackupEligible, p.BackedUp, strings.TrimSpace(p.Name),
+	)
+	out, err := scanPasskey(row)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return user.Passkey{}, user.ErrPasskeyExists
+		}
+		return user.Passkey{}, fmt.Errorf("create passkey: %w", err)
+	}
+	return out, nil
+}
+
+func (s *UserAuthStore) FindPasskeyByCredentialID(ctx context.Context, credentialID []byte) (user.Passkey, error) {
+	db := DBFromContext(ctx, s.db)
+	row := db.QueryRow(ctx, `select `+passkeyColumns+` from webauthn_credentials where credential_id = $1`, credentialID)
+	out, err := scanPasskey(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user.Passkey{}, user.ErrNotFound
+		}
+		return user.Passkey{}, fmt.Errorf("find passkey: %w", err)
+	}
+	return out, nil
+}
+
+func (s *UserAuthStore) ListPasskeys(ctx context.Context, userID int64) ([]user.Passkey, error) {
+	db := s.reader(ctx)
+	rows, err := db.Query(ctx, `select `+passkeyColumns+` from webauthn_credentials where user_id = $1 order by created_at, id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list passkeys: %w", err)
+	}
+	defer rows.Close()
+
+	out := make([]user.Passkey, 0)
+	for rows.Next() {
+		p, err := scanPasskey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan passkey: %w", err)
+		}
+		out = append(out, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate passkeys: %w", err)
+	}
+	return out, nil
+}
+
+// UsePasskey stores the counter and backup state of a verified sign-in. It
+// reports false when another sign-in updated the counter since prevCount
+// was read, so two concurrent uses of a cloned key cannot both pass.
+func (s *UserAuthStore) UsePasskey(ctx context.Context, id int64, prevCount, signCount uint32, backedUp bool, at time.Time) (bool, error) {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `
+		update webauthn_credentials set sign_count = $3, backed_up = $4, last_used_at = $5
+		where id = $1 and sign_count = $2
+	`, id, int64(prevCount), int64(signCount), backedUp, at)
+	if err != nil {
+		return false, fmt.Errorf("use passkey: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (s *UserAuthStore) DeletePasskey(ctx context.Context, userID, id int64) error {
+	db := DBFromContext(ctx, s.db)
+	tag, err := db.Exec(ctx, `delete from webauthn_credentials where id = $1 and user_id = $2`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete passkey: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return user.ErrNotFound
+	}
+	return nil
+}
+
+func scanPasskey(row pgx.Row) (user.Passkey, error) {
+	var p user.Passkey
+	var signCount int64
+	err := row.Scan(
+		&p.ID, &p.UserID, &p.CredentialID, &p.PublicKey, &signCount, &p.Transports,
+		&p.BackupEligible, &p.BackedUp, &p.Name, &p.CreatedAt, &p.LastUsedAt,
+	)
+	p.SignCount = uint32(signCount)
+	return p, err
+}
@@ -0,0 +1,94 @@
+package postgres
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/user"
+)
+
+func TestPasskeyStore(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewUserAuthStore(integrationPool)
+	u := createTestUser(t, ctx, store)
+	credentialID := []byte("credential-" + time.Now().Format(time.RFC3339Nano))
+
+	created, err := store.CreatePasskey(ctx, user.Passkey{
+		UserID:         u.ID,
+		CredentialID:   credentialID,
+		PublicKey:      []byte("cose-key"),
+		SignCount:      5,
+		Transports:     []string{"internal", "hybrid"},
+		BackupEligible: true,
+		Name:           " Chrome on macOS ",
+	})
+	if err != nil {
+		t.Fatalf("create passkey: %v", err)
+	}
+	if created.Name != "Chrome on macOS" || created.SignCount != 5 || created.LastUsedAt != nil || len(created.Transports) != 2 {
+		t.Fatalf("created passkey = %+v", created)
+	}
+	if _, err := store.CreatePasskey(ctx, user.Passkey{UserID: u.ID, CredentialID: credentialID, PublicKey: []byte("x")}); !errors.Is(err, user.ErrPasskeyExists) {
+		t.Fatalf("expected ErrPasskeyExists, got %v", err)
+	}
+
+	found, err := store.FindPasskeyByCredentialID(ctx, credentialID)
+	if err != nil || found.ID != created.ID || found.UserID != u.ID || string(found.PublicKey) != "cose-key" {
+		t.Fatalf("find passkey: %+v %v", found, err)
+	}
+	if _, err := store.FindPasskeyByCredentialID(ctx, []byte("missing")); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	now := time.Now().UTC()
+	if ok, err := store.UsePasskey(ctx, created.ID, 5, 6, true, now); err != nil || !ok {
+		t.Fatalf("use passkey: %v %v", ok, err)
+	}
+	// A second sign-in that read the old counter loses the race.
+	if ok, err := store.UsePasskey(ctx, created.ID, 5, 7, true, now); err != nil || ok {
+		t.Fatalf("stale counter accepted: %v %v", ok, err)
+	}
+	list, err := store.ListPasskeys(ctx, u.ID)
+	if err != nil || len(list) != 1 || list[0].SignCount != 6 || !list[0].BackedUp || list[0].LastUsedAt == nil {
+		t.Fatalf("list passkeys: %+v %v", list, err)
+	}
+
+	other := createTestUser(t, ctx, store)
+	if err := store.DeletePasskey(ctx, other.ID, created.ID); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("deleted another user's passkey: %v", err)
+	}
+	if err := store.DeletePasskey(ctx, u.ID, created.ID); err != nil {
+		t.Fatalf("delete passkey: %v", err)
+	}
+	if list, _ := store.ListPasskeys(ctx, u.ID); len(list) != 0 {
+		t.Fatalf("expected no passkeys, got %+v", list)
+	}
+}
+
+func TestLinkIdentity(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	store := NewUserAuthStore(integrationPool)
+	u := createTestUser(t, ctx, store)
+	other := createTestUser(t, ctx, store)
+	profile := user.SocialProfile{Provider: user.ProviderPasskey, ProviderUserID: "handle-" + time.Now().Format(time.RFC3339Nano)}
+
+	if err := store.LinkIdentity(ctx, u.ID, profile); err != nil {
+		t.Fatalf("link identity: %v", err)
+	}
+	found, err := store.FindByIdentity(ctx, profile.Provider, profile.ProviderUserID)
+	if err != nil || found.ID != u.ID {
+		t.Fatalf("find by identity: %+v %v", found, err)
+	}
+	if err := store.LinkIdentity(ctx, other.ID, profile); !errors.Is(err, user.ErrIdentityConflict) {
+		t.Fatalf("expected ErrIdentityConflict, got %v", err)
+	}
+}
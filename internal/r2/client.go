@@ -2,24 +2,52 @@ package r2
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type Client struct {
 	s3            *s3.Client
+	presign       *s3.PresignClient
 	bucket        string
+	privateBucket string
 	publicBaseURL string
 }
 
-func New(ctx context.Context, endpoint, region, accessKey, secretKey, bucket, publicBaseURL string) (*Client, error) {
+type PresignedRequest struct {
+	URL       string
+	Method    string
+	Headers   http.Header
+	ExpiresAt time.Time
+}
+
+// Option adjusts the underlying S3 client.
+type Option func(*s3.Options)
+
+// WithPathStyle addresses buckets as /bucket/key instead of through a
+// bucket subdomain, which endpoints on a bare IP or localhost need.
+func WithPathStyle() Option {
+	return func(o *s3.Options) { o.UsePathStyle = true }
+}
+
+// WithHTTPClient sends requests through client instead of the SDK default.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *s3.Options) { o.HTTPClient = client }
+}
+
+func New(ctx context.Context, endpoint, region, accessKey, secretKey, bucket, privateBucket, publicBaseURL string, opts ...Option) (*Client, error) {
 	r2Resolver := aws.EndpointResolverWithOptionsFunc(func(service, r string, options ...interface{}) (aws.Endpoint, error) {
 		return aws.Endpoint{URL: endpoint}, nil
 	})
@@ -33,25 +61,48 @@ func New(ctx context.Context, endpoint, region, accessKey, secretKey, bucket, pu
 		return nil, fmt.Errorf("load r2 config: %w", err)
 	}
 
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		for _, opt := range opts {
+			opt(o)
+		}
+	})
 	return &Client{
-		s3:            s3.NewFromConfig(cfg),
+		s3:            client,
+		presign:       s3.NewPresignClient(client),
 		bucket:        bucket,
+		privateBucket: privateBucket,
 		publicBaseURL: publicBaseURL,
 	}, nil
 }
 
 func (c *Client) Upload(ctx context.Context, key string, body io.Reader, contentType string) (string, error) {
+	if err := c.putObject(ctx, c.bucket, key, body, contentType); err != nil {
+		return "", err
+	}
+	return c.GetPublicURL(key), nil
+}
+
+// HasPrivateBucket reports whether R2_PRIVATE_BUCKET is configured. Private
+// objects live in their own bucket because R2 has no per-object ACLs.
+func (c *Client) HasPrivateBucket() bool {
+	return c.privateBucket != ""
+}
+
+func (c *Client) UploadPrivate(ctx context.Context, key string, body io.Reader, contentType string) error {
+	return c.putObject(ctx, c.privateBucket, key, body, contentType)
+}
+
+func (c *Client) putObject(ctx context.Context, bucket, key string, body io.Reader, contentType string) error {
 	_, err := c.s3.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(c.bucket),
+		Bucket:      aws.String(bucket),
 		Key:         aws.String(key),
 		Body:        body,
 		ContentType: aws.String(contentType),
 	})
 	if err != nil {
-		return "", fmt.Errorf("upload to r2: %w", err)
+		return fmt.Errorf("upload to r2: %w", err)
 	}
-
-	return c.GetPublicURL(key), nil
+	return nil
 }
 
 func (c *Client) GetPublicURL(key string) string {
@@ -61,8 +112,16 @@ func (c *Client) GetPublicURL(key string) string {
 }
 
 func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.deleteObject(ctx, c.bucket, key)
+}
+
+func (c *Client) DeletePrivate(ctx context.Context, key string) error {
+	return c.deleteObject(ctx, c.privateBucket, key)
+}
+
+func (c *Client) deleteObject(ctx context.Context, bucket, key string) error {
 	_, err := c.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
-		Bucket: aws.String(c.bucket),
+		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
@@ -70,3 +129,251 @@ func (c *Client) Delete(ctx context.Context, key string) error {
 	}
 	return nil
 }
+
+// PresignGet returns a time-limited GET URL for an object in the private
+// bucket.
+func (c *Client) PresignGet(ctx context.Context, key string, ttl time.Duration) (PresignedRequest, error) {
+	req, err := c.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.privateBucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return PresignedRequest{}, fmt.Errorf("presign r2 get: %w", err)
+	}
+	return PresignedRequest{
+		URL:       req.URL,
+		Method:    req.Method,
+		Headers:   clientHeaders(req.SignedHeader),
+		ExpiresAt: time.Now().Add(ttl),
+	}, nil
+}
+
+// PresignPut returns a PUT request the client can send straight to the
+// bucket. Content type and length are part of the signature, so the upload
+// must match what was presigned.
+func (c *Client) PresignPut(ctx context.Context, key, contentType string, size int64, ttl time.Duration) (PresignedRequest, error) {
+	req, err := c.presign.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(c.bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return PresignedRequest{}, fmt.Errorf("presign r2 put: %w", err)
+	}
+	return PresignedRequest{
+		URL:       req.URL,
+		Method:    req.Method,
+		Headers:   clientHeaders(req.SignedHeader),
+		ExpiresAt: time.Now().Add(ttl),
+	}, nil
+}
+
+// clientHeaders drops headers the HTTP client sets on its own.
+func clientHeaders(signed http.Header) http.Header {
+	out := http.Header{}
+	for name, values := range signed {
+		if strings.EqualFold(name, "Host") {
+			continue
+		}
+		out[name] = values
+	}
+	return out
+}
+
+// Bucket selects between the public bucket and R2_PRIVATE_BUCKET.
+type Bucket int
+
+const (
+	PublicBucket Bucket = iota
+	PrivateBucket
+)
+
+var ErrNotFound = errors.New("r2 object not found")
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
+type ListResult struct {
+	Objects   []ObjectInfo
+	NextToken string
+}
+
+func (c *Client) bucketName(b Bucket) string {
+	if b == PrivateBucket {
+		return c.privateBucket
+	}
+	return c.bucket
+}
+
+// Open streams an object. The caller must close the returned body.
+func (c *Client) Open(ctx context.Context, b Bucket, key string) (io.ReadCloser, ObjectInfo, error) {
+	out, err := c.s3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucketName(b)),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ObjectInfo{}, ErrNotFound
+		}
+		return nil, ObjectInfo{}, fmt.Errorf("get r2 object: %w", err)
+	}
+	return out.Body, ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		ETag:         aws.ToString(out.ETag),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (c *Client) Stat(ctx context.Context, b Bucket, key string) (ObjectInfo, error) {
+	out, err := c.s3.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(c.bucketName(b)),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return ObjectInfo{}, ErrNotFound
+		}
+		return ObjectInfo{}, fmt.Errorf("head r2 object: %w", err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		ETag:         aws.ToString(out.ETag),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+// List returns up to limit objects under prefix, starting after the page
+// identified by token. Listings do not include content types.
+func (c *Client) List(ctx context.Context, b Bucket, prefix, token string, limit int32) (ListResult, error) {
+	in := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(c.bucketName(b)),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int32(limit),
+	}
+	if token != "" {
+		in.ContinuationToken = aws.String(token)
+	}
+	out, err := c.s3.ListObjectsV2(ctx, in)
+	if err != nil {
+		return ListResult{}, fmt.Errorf("list r2 objects: %w", err)
+	}
+	result := ListResult{Objects: make([]ObjectInfo, 0, len(out.Contents))}
+	for _, obj := range out.Contents {
+		result.Objects = append(result.Objects, ObjectInfo{
+			Key:          aws.ToString(obj.Key),
+			Size:         aws.ToInt64(obj.Size),
+			ETag:         aws.ToString(obj.ETag),
+			LastModified: aws.ToTime(obj.LastModified),
+		})
+	}
+	if aws.ToBool(out.IsTruncated) {
+		result.NextToken = aws.ToString(out.NextContinuationToken)
+	}
+	return result, nil
+}
+
+// Copy duplicates srcKey to dstKey within the bucket, keeping its metadata.
+func (c *Client) Copy(ctx context.Context, b Bucket, srcKey, dstKey string) error {
+	bucket := c.bucketName(b)
+	_, err := c.s3.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(copySource(bucket, srcKey)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("copy r2 object: %w", err)
+	}
+	return nil
+}
+
+func copySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return url.PathEscape(bucket) + "/" + strings.Join(segments, "/")
+}
+
+func isNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound)
+}
+
+type CompletedPart struct {
+	Number int32
+	ETag   string
+}
+
+func (c *Client) CreateMultipart(ctx context.Context, b Bucket, key, contentType string) (string, error) {
+	out, err := c.s3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(c.bucketName(b)),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", fmt.Errorf("create r2 multipart upload: %w", err)
+	}
+	return aws.ToString(out.UploadId), nil
+}
+
+func (c *Client) UploadPart(ctx context.Context, b Bucket, key, uploadID string, number int32, body io.Reader, size int64) (string, error) {
+	out, err := c.s3.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(c.bucketName(b)),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int32(number),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	})
+	if err != nil {
+		return "", fmt.Errorf("upload r2 part %d: %w", number, err)
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+func (c *Client) CompleteMultipart(ctx context.Context, b Bucket, key, uploadID string, parts []CompletedPart) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		completed = append(completed, types.CompletedPart{PartNumber: aws.Int32(p.Number), ETag: aws.String(p.ETag)})
+	}
+	_, err := c.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(c.bucketName(b)),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("complete r2 multipart upload: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) AbortMultipart(ctx context.Context, b Bucket, key, uploadID string) error {
+	_, err := c.s3.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(c.bucketName(b)),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		var noSuchUpload *types.NoSuchUpload
+		if errors.As(err, &noSuchUpload) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("abort r2 multipart upload: %w", err)
+	}
+	return nil
+}
@@ -25,3 +25,13 @@ func TestGetPublicURLCleansDuplicateSlashes(t *testing.T) {
 		t.Fatalf("unexpected public url: got %q want %q", got, want)
 	}
 }
+
+func TestCopySourceEscapesKeySegments(t *testing.T) {
+	t.Parallel()
+
+	got := copySource("bucket", "uploads/1/my file+1.pdf")
+	want := "bucket/uploads/1/my%20file+1.pdf"
+	if got != want {
+		t.Fatalf("unexpected copy source: got %q want %q", got, want)
+	}
+}
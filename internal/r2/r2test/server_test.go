@@ -0,0 +1,165 @@
+package r2test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/r2"
+)
+
+func TestClientRoundTripsObjects(t *testing.T) {
+	t.Parallel()
+
+	srv := NewServer(t)
+	client := srv.Client(t)
+	ctx := context.Background()
+
+	// A plain io.Reader has no length, which makes the SDK stream it.
+	url, err := client.Upload(ctx, "docs/a.txt", io.MultiReader(strings.NewReader("hello")), "text/plain")
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if url != PublicBaseURL+"/docs/a.txt" {
+		t.Fatalf("unexpected public url %q", url)
+	}
+	if obj, ok := srv.Object(PublicBucket, "docs/a.txt"); !ok || string(obj.Data) != "hello" || obj.ContentType != "text/plain" {
+		t.Fatalf("unexpected stored object: %+v ok=%v", obj, ok)
+	}
+
+	body, info, err := client.Open(ctx, r2.PublicBucket, "docs/a.txt")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "hello" || info.Size != 5 || info.ETag == "" {
+		t.Fatalf("unexpected open result %q %+v", data, info)
+	}
+
+	if err := client.Copy(ctx, r2.PublicBucket, "docs/a.txt", "docs/b.txt"); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	page, err := client.List(ctx, r2.PublicBucket, "docs/", "", 1)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(page.Objects) != 1 || page.Objects[0].Key != "docs/a.txt" || page.NextToken == "" {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+	page, err = client.List(ctx, r2.PublicBucket, "docs/", page.NextToken, 1)
+	if err != nil || len(page.Objects) != 1 || page.Objects[0].Key != "docs/b.txt" || page.NextToken != "" {
+		t.Fatalf("unexpected second page: %+v err=%v", page, err)
+	}
+
+	if err := client.Delete(ctx, "docs/a.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := client.Stat(ctx, r2.PublicBucket, "docs/a.txt"); !errors.Is(err, r2.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+	if _, _, err := client.Open(ctx, r2.PublicBucket, "docs/a.txt"); !errors.Is(err, r2.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound on open, got %v", err)
+	}
+}
+
+func TestClientPresignedRequests(t *testing.T) {
+	t.Parallel()
+
+	srv := NewServer(t)
+	client := srv.Client(t)
+	ctx := context.Background()
+
+	put, err := client.PresignPut(ctx, "uploads/1/a.png", "image/png", 4, time.Minute)
+	if err != nil {
+		t.Fatalf("presign put: %v", err)
+	}
+	req, _ := http.NewRequest(put.Method, put.URL, bytes.NewReader([]byte("\x89PNG")))
+	for name, values := range put.Headers {
+		req.Header[name] = values
+	}
+	res, err := srv.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatalf("presigned put: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected presigned put status %d", res.StatusCode)
+	}
+	if obj, ok := srv.Object(PublicBucket, "uploads/1/a.png"); !ok || obj.ContentType != "image/png" {
+		t.Fatalf("presigned put did not store object: %+v", obj)
+	}
+
+	if err := client.UploadPrivate(ctx, "invoices/1.pdf", strings.NewReader("%PDF"), "application/pdf"); err != nil {
+		t.Fatalf("upload private: %v", err)
+	}
+	get, err := client.PresignGet(ctx, "invoices/1.pdf", time.Minute)
+	if err != nil {
+		t.Fatalf("presign get: %v", err)
+	}
+	res, err = srv.HTTPClient().Get(get.URL)
+	if err != nil {
+		t.Fatalf("presigned get: %v", err)
+	}
+	data, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(data) != "%PDF" {
+		t.Fatalf("unexpected presigned get: %d %q", res.StatusCode, data)
+	}
+
+	res, err = srv.HTTPClient().Get(srv.URL() + "/" + PrivateBucket + "/invoices/1.pdf")
+	if err != nil {
+		t.Fatalf("unsigned get: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected unsigned request to be rejected, got %d", res.StatusCode)
+	}
+}
+
+func TestClientMultipartUpload(t *testing.T) {
+	t.Parallel()
+
+	srv := NewServer(t)
+	srv.MinPartSize = 4
+	client := srv.Client(t)
+	ctx := context.Background()
+
+	id, err := client.CreateMultipart(ctx, r2.PublicBucket, "big.bin", "application/octet-stream")
+	if err != nil {
+		t.Fatalf("create multipart: %v", err)
+	}
+	var parts []r2.CompletedPart
+	for i, chunk := range []string{"abcd", "ef"} {
+		etag, err := client.UploadPart(ctx, r2.PublicBucket, "big.bin", id, int32(i+1), strings.NewReader(chunk), int64(len(chunk)))
+		if err != nil {
+			t.Fatalf("upload part %d: %v", i+1, err)
+		}
+		parts = append(parts, r2.CompletedPart{Number: int32(i + 1), ETag: etag})
+	}
+	if err := client.CompleteMultipart(ctx, r2.PublicBucket, "big.bin", id, parts); err != nil {
+		t.Fatalf("complete multipart: %v", err)
+	}
+	if obj, ok := srv.Object(PublicBucket, "big.bin"); !ok || string(obj.Data) != "abcdef" {
+		t.Fatalf("unexpected assembled object: %q", obj.Data)
+	}
+
+	id, err = client.CreateMultipart(ctx, r2.PublicBucket, "abandoned.bin", "application/octet-stream")
+	if err != nil {
+		t.Fatalf("create multipart: %v", err)
+	}
+	if err := client.AbortMultipart(ctx, r2.PublicBucket, "abandoned.bin", id); err != nil {
+		t.Fatalf("abort multipart: %v", err)
+	}
+	if err := client.AbortMultipart(ctx, r2.PublicBucket, "abandoned.bin", id); !errors.Is(err, r2.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for aborted upload, got %v", err)
+	}
+	if srv.PendingUploads() != 0 {
+		t.Fatalf("expected no pending uploads, got %d", srv.PendingUploads())
+	}
+}
@@ -0,0 +1,229 @@
+package scheduler
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule reports when a task runs next.
+type Schedule interface {
+	// Next returns the first run time strictly after t.
+	Next(t time.Time) time.Time
+}
+
+// Parse accepts the five standard cron fields (minute, hour, day of month,
+// month, day of week) with lists, ranges, steps and JAN/MON style names,
+// the descriptors @yearly, @monthly, @weekly, @daily and @hourly, and
+// "@every <duration>". When both day fields are restricted a day matches
+// either of them, as in cron.
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if rest, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("cron %q: @every needs a duration of at least 1s", spec)
+		}
+		return everySchedule(d), nil
+	}
+	switch spec {
+	case "@yearly", "@annually":
+		spec = "0 0 1 1 *"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@hourly":
+		spec = "0 * * * *"
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: want 5 fields, got %d", spec, len(fields))
+	}
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("cron %q: minute: %w", spec, err)
+	}
+	if s.hour, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("cron %q: hour: %w", spec, err)
+	}
+	if s.dom, err = parseField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("cron %q: day of month: %w", spec, err)
+	}
+	if s.month, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("cron %q: month: %w", spec, err)
+	}
+	if s.dow, err = parseField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("cron %q: day of week: %w", spec, err)
+	}
+	// 7 is another name for Sunday.
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	s.anyDOM = fields[2] == "*" || fields[2] == "?"
+	s.anyDOW = fields[4] == "*" || fields[4] == "?"
+	if !s.anyDOM && s.anyDOW && !s.domFitsMonth() {
+		return nil, fmt.Errorf("cron %q: day of month never occurs in the given months", spec)
+	}
+	return s, nil
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseField returns a bit set of the values field allows.
+func parseField(field string, lo, hi int, names map[string]int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			step = n
+		}
+
+		start, end := lo, hi
+		switch {
+		case rangePart == "*" || rangePart == "?":
+		case strings.Contains(rangePart, "-"):
+			a, b, _ := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = fieldValue(a, lo, hi, names); err != nil {
+				return 0, err
+			}
+			if end, err = fieldValue(b, lo, hi, names); err != nil {
+				return 0, err
+			}
+			if start > end {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+		default:
+			v, err := fieldValue(rangePart, lo, hi, names)
+			if err != nil {
+				return 0, err
+			}
+			start = v
+			if !hasStep {
+				end = v
+			}
+		}
+		for v := start; v <= end; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func fieldValue(s string, lo, hi int, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < lo || v > hi {
+		return 0, fmt.Errorf("value %q out of range %d-%d", s, lo, hi)
+	}
+	return v, nil
+}
+
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDOM, anyDOW                bool
+}
+
+// maxSearchYears bounds Next. Parse rejects specs that never match, and the
+// longest gap between matches is February 29th skipping a century year.
+const maxSearchYears = 9
+
+// daysInMonth is the longest length of each month, counting leap years.
+var daysInMonth = [13]int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+// domFitsMonth reports whether the earliest allowed day of month exists in
+// one of the allowed months, so "0 0 31 2 *" is rejected rather than never
+// running.
+func (s cronSchedule) domFitsMonth() bool {
+	first := bits.TrailingZeros64(s.dom)
+	for m := 1; m <= 12; m++ {
+		if s.month&(1<<uint(m)) != 0 && first <= daysInMonth[m] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s cronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(maxSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			next := nextBit(s.minute, t.Minute())
+			if next < 0 {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			} else {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), next, 0, 0, loc)
+			}
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDOM && s.anyDOW:
+		return true
+	case s.anyDOM:
+		return dow
+	case s.anyDOW:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// nextBit returns the lowest set bit above from, or -1.
+func nextBit(set uint64, from int) int {
+	rest := set >> uint(from+1)
+	if rest == 0 {
+		return -1
+	}
+	return from + 1 + bits.TrailingZeros64(rest)
+}
+
+type everySchedule time.Duration
+
+func (e everySchedule) Next(t time.Time) time.Time {
+	d := time.Duration(e)
+	return t.Truncate(d).Add(d)
+}
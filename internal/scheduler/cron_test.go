@@ -0,0 +1,68 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAndNext(t *testing.T) {
+	from := time.Date(2026, time.March, 14, 10, 17, 30, 0, time.UTC) // a Saturday
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, time.March, 14, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, time.March, 14, 10, 30, 0, 0, time.UTC)},
+		{"5 * * * *", time.Date(2026, time.March, 14, 11, 5, 0, 0, time.UTC)},
+		{"0 9-17 * * MON-FRI", time.Date(2026, time.March, 16, 9, 0, 0, 0, time.UTC)},
+		{"30 2 1,15 * *", time.Date(2026, time.March, 15, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * FEB *", time.Date(2027, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2026, time.March, 15, 12, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: the 20th or any Monday.
+		{"0 0 20 * 1", time.Date(2026, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, time.March, 14, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2026, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 10m", time.Date(2026, time.March, 14, 10, 20, 0, 0, time.UTC)},
+	}
+	for _, tc := range tests {
+		schedule, err := Parse(tc.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.spec, err)
+			continue
+		}
+		if got := schedule.Next(from); !got.Equal(tc.want) {
+			t.Errorf("Parse(%q).Next = %s, want %s", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestParseRejectsNeverMatchingSpecs(t *testing.T) {
+	for _, spec := range []string{"0 0 30 2 *", "0 0 31 2 *", "0 0 31 4,6,9,11 *", "0 0 30-31 FEB *"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q): expected an error for a day that never occurs", spec)
+		}
+	}
+	leap, _ := Parse("0 0 29 2 *")
+	from := time.Date(2097, time.March, 1, 0, 0, 0, 0, time.UTC)
+	if got, want := leap.Next(from), time.Date(2104, time.February, 29, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("February 29th across 2100: Next = %s, want %s", got, want)
+	}
+	// A day of week widens the match, so these still run.
+	for _, spec := range []string{"0 0 31 2 MON", "0 0 31 1-2 *"} {
+		if _, err := Parse(spec); err != nil {
+			t.Errorf("Parse(%q): %v", spec, err)
+		}
+	}
+}
+
+func TestParseRejectsInvalidSpecs(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "5-1 * * * *", "*/0 * * * *", "@every 0s", "@every soon", "@fortnightly"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q): expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+type RunStatus string
+
+const (
+	RunRunning   RunStatus = "running"
+	RunSucceeded RunStatus = "succeeded"
+	RunFailed    RunStatus = "failed"
+)
+
+// Run is one execution of a task.
+type Run struct {
+	ID         int64
+	Task       string
+	Instance   string
+	Status     RunStatus
+	Error      string
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	Duration   time.Duration
+}
+
+// TaskStatus is a task as last recorded by the leader, with its latest run.
+type TaskStatus struct {
+	Name      string
+	Spec      string
+	NextRunAt time.Time
+	LastRun   *Run
+}
+
+// Store records tasks and their runs. The Postgres implementation is
+// postgres.SchedulerStore.
+type Store interface {
+	// EnsureTask records a task and returns its stored next run time. New
+	// tasks, and tasks whose spec changed, are stored with next.
+	EnsureTask(ctx context.Context, name, spec string, next time.Time) (time.Time, error)
+	// StartRun records a run of name and moves its next run time from due to
+	// next. It returns ok false, without starting a run, when the stored next
+	// run time is no longer due, which means another leader ran the task.
+	StartRun(ctx context.Context, name, instance string, due, next time.Time) (id int64, ok bool, err error)
+	// FinishRun records the outcome of a run; runErr is empty on success.
+	FinishRun(ctx context.Context, id int64, runErr string) error
+	Tasks(ctx context.Context) ([]TaskStatus, error)
+	Runs(ctx context.Context, task string, limit int) ([]Run, error)
+}
+
+// Elector decides which process runs the tasks.
+type Elector interface {
+	// TryLead returns a lease while this process is the leader, or nil when
+	// another process leads.
+	TryLead(ctx context.Context) (Lease, error)
+}
+
+type Lease interface {
+	// Lost is closed when leadership is lost without Release, for example
+	// when the database connection holding it breaks.
+	Lost() <-chan struct{}
+	Release()
+}
+
+type Options struct {
+	// Instance identifies this process in run history. It defaults to the
+	// host name and process id.
+	Instance string
+	// ElectionInterval is how often a follower tries to become the leader.
+	ElectionInterval time.Duration
+	// DrainTimeout is how long a leader that is shutting down waits for
+	// running tasks before cancelling them and stepping down.
+	DrainTimeout time.Duration
+}
+
+type task struct {
+	name     string
+	spec     string
+	schedule Schedule
+	fn       func(context.Context) error
+}
+
+// Scheduler runs registered tasks on their cron schedules in whichever
+// process holds leadership, so each run happens once across replicas.
+type Scheduler struct {
+	store   Store
+	elector Elector
+	opts    Options
+	tasks   map[string]task
+	// tick is how often the leader checks for due tasks.
+	tick time.Duration
+}
+
+func New(store Store, elector Elector, opts Options) *Scheduler {
+	if opts.Instance == "" {
+		host, _ := os.Hostname()
+		opts.Instance = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+	if opts.ElectionInterval <= 0 {
+		opts.ElectionInterval = 10 * time.Second
+	}
+	if opts.DrainTimeout <= 0 {
+		opts.DrainTimeout = 30 * time.Second
+	}
+	return &Scheduler{store: store, elector: elector, opts: opts, tasks: map[string]task{}, tick: time.Second}
+}
+
+// Register adds a task that runs fn on the cron spec. Overlapping runs of
+// one task are skipped.
+func (s *Scheduler) Register(name, spec string, fn func(ctx context.Context) error) error {
+	if name == "" {
+		return errors.New("scheduler: task name is required")
+	}
+	if _, ok := s.tasks[name]; ok {
+		return fmt.Errorf("scheduler: task %q registered twice", name)
+	}
+	schedule, err := Parse(spec)
+	if err != nil {
+		return err
+	}
+	s.tasks[name] = task{name: name, spec: spec, schedule: schedule, fn: fn}
+	return nil
+}
+
+// Run campaigns for leadership until ctx is done and runs due tasks while
+// leading. On shutdown the leader lets running tasks finish for up to
+// DrainTimeout and then releases leadership so another replica takes over.
+func (s *Scheduler) Run(ctx context.Context) {
+	if len(s.tasks) == 0 {
+		return
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		lease, err := s.elector.TryLead(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("scheduler: elect leader: %v", err)
+		}
+		if lease != nil {
+			log.Printf("scheduler: %s is now the leader", s.opts.Instance)
+			s.lead(ctx, lease)
+			lease.Release()
+			log.Printf("scheduler: %s stepped down", s.opts.Instance)
+		}
+		timer.Reset(s.opts.ElectionInterval)
+	}
+}
+
+func (s *Scheduler) lead(ctx context.Context, lease Lease) {
+	taskCtx, cancelTasks := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelTasks()
+
+	next := map[string]time.Time{}
+	for _, name := range s.taskNames() {
+		t := s.tasks[name]
+		at, err := s.store.EnsureTask(ctx, t.name, t.spec, t.schedule.Next(time.Now()))
+		if err != nil {
+			log.Printf("scheduler: record task %s: %v", t.name, err)
+			return
+		}
+		next[name] = at
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		running = map[string]bool{}
+	)
+	ticker := time.NewTicker(s.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.drain(&wg, cancelTasks)
+			return
+		case <-lease.Lost():
+			log.Printf("scheduler: lost leadership, cancelling running tasks")
+			cancelTasks()
+			wg.Wait()
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		for _, name := range s.taskNames() {
+			t := s.tasks[name]
+			mu.Lock()
+			busy := running[name]
+			mu.Unlock()
+			// A zero time means the schedule has no further runs.
+			if busy || next[name].IsZero() || now.Before(next[name]) {
+				continue
+			}
+			following := t.schedule.Next(now)
+			id, ok, err := s.store.StartRun(ctx, name, s.opts.Instance, next[name], following)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("scheduler: start %s: %v", name, err)
+				}
+				continue
+			}
+			if !ok {
+				if at, err := s.store.EnsureTask(ctx, t.name, t.spec, following); err == nil {
+					next[name] = at
+				}
+				continue
+			}
+			next[name] = following
+
+			mu.Lock()
+			running[name] = true
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.execute(taskCtx, t, id)
+				mu.Lock()
+				delete(running, name)
+				mu.Unlock()
+			}()
+		}
+	}
+}
+
+func (s *Scheduler) drain(wg *sync.WaitGroup, cancelTasks context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(s.opts.DrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Printf("scheduler: cancelling tasks still running after %s", s.opts.DrainTimeout)
+		cancelTasks()
+		<-done
+	}
+}
+
+func (s *Scheduler) execute(ctx context.Context, t task, runID int64) {
+	err := runTask(ctx, t)
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+		log.Printf("scheduler: task %s failed: %v", t.name, err)
+	}
+	finishCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	if err := s.store.FinishRun(finishCtx, runID, msg); err != nil {
+		log.Printf("scheduler: record run of %s: %v", t.name, err)
+	}
+}
+
+func runTask(ctx context.Context, t task) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return t.fn(ctx)
+}
+
+func (s *Scheduler) taskNames() []string {
+	names := make([]string, 0, len(s.tasks))
+	for name := range s.tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
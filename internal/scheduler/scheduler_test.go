@@ -0,0 +1,346 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeaderRunsDueTasksAndRecordsRuns(t *testing.T) {
+	store := newMemoryStore()
+	store.seed("ok", "@hourly", time.Now().Add(-time.Minute))
+	store.seed("fail", "@hourly", time.Now().Add(-time.Minute))
+	store.seed("later", "@hourly", time.Now().Add(time.Hour))
+
+	s := testScheduler(store, &memoryElector{})
+	calls := map[string]int{}
+	var mu sync.Mutex
+	for _, name := range []string{"ok", "fail", "later"} {
+		if err := s.Register(name, "@hourly", func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[name]++
+			if name == "fail" {
+				return errors.New("report generator unavailable")
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+	}
+
+	stop := runScheduler(s)
+	waitFor(t, func() bool { return store.finishedRuns() == 2 })
+	time.Sleep(20 * time.Millisecond)
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["ok"] != 1 || calls["fail"] != 1 || calls["later"] != 0 {
+		t.Fatalf("unexpected task calls %v", calls)
+	}
+	for _, status := range store.statuses() {
+		if status.Name == "later" {
+			continue
+		}
+		if !status.NextRunAt.After(time.Now()) {
+			t.Errorf("%s: next run should move to the future, got %s", status.Name, status.NextRunAt)
+		}
+		want := RunSucceeded
+		if status.Name == "fail" {
+			want = RunFailed
+		}
+		if status.LastRun == nil || status.LastRun.Status != want {
+			t.Errorf("%s: unexpected last run %+v", status.Name, status.LastRun)
+		}
+	}
+	if run := store.lastRun("fail"); run.Error != "report generator unavailable" {
+		t.Errorf("expected the task error to be recorded, got %q", run.Error)
+	}
+}
+
+func TestFollowerDoesNotRunTasks(t *testing.T) {
+	store := newMemoryStore()
+	store.seed("prune", "@hourly", time.Now().Add(-time.Minute))
+	elector := &memoryElector{follower: true}
+	s := testScheduler(store, elector)
+	if err := s.Register("prune", "@hourly", func(context.Context) error {
+		t.Error("a follower must not run tasks")
+		return nil
+	}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	stop := runScheduler(s)
+	waitFor(t, func() bool { return elector.attempts() >= 3 })
+	stop()
+	if n := store.finishedRuns(); n != 0 {
+		t.Fatalf("expected no runs, got %d", n)
+	}
+}
+
+func TestLeaderCancelsTasksWhenLeaseIsLostAndReleasesOnShutdown(t *testing.T) {
+	store := newMemoryStore()
+	store.seed("slow", "@hourly", time.Now().Add(-time.Minute))
+	elector := &memoryElector{}
+	s := testScheduler(store, elector)
+	started := make(chan struct{}, 1)
+	if err := s.Register("slow", "@hourly", func(ctx context.Context) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	stop := runScheduler(s)
+	<-started
+	first := elector.lease(0)
+	close(first.lost)
+	waitFor(t, func() bool { return store.finishedRuns() == 1 })
+	if run := store.lastRun("slow"); run.Status != RunFailed || run.Error != context.Canceled.Error() {
+		t.Fatalf("expected the run to be cancelled, got %+v", run)
+	}
+	waitFor(t, first.isReleased)
+
+	// The scheduler campaigns again and leads with a new lease.
+	waitFor(t, func() bool { return elector.attempts() >= 2 })
+	stop()
+	second := elector.lease(1)
+	if !second.isReleased() {
+		t.Fatal("expected the lease to be released on shutdown")
+	}
+}
+
+func TestLeaderSkipsTasksWithoutANextRun(t *testing.T) {
+	store := newMemoryStore()
+	s := testScheduler(store, &memoryElector{})
+	if err := s.Register("never", "@hourly", func(context.Context) error {
+		t.Error("a task without a next run must not run")
+		return nil
+	}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	never := s.tasks["never"]
+	never.schedule = neverSchedule{}
+	s.tasks["never"] = never
+
+	stop := runScheduler(s)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	if n := store.finishedRuns(); n != 0 {
+		t.Fatalf("expected no runs, got %d", n)
+	}
+}
+
+type neverSchedule struct{}
+
+func (neverSchedule) Next(time.Time) time.Time { return time.Time{} }
+
+func TestRegisterRejectsBadTasks(t *testing.T) {
+	s := testScheduler(newMemoryStore(), &memoryElector{})
+	noop := func(context.Context) error { return nil }
+	if err := s.Register("a", "not a spec", noop); err == nil {
+		t.Error("expected an error for an invalid spec")
+	}
+	if err := s.Register("a", "@daily", noop); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := s.Register("a", "@daily", noop); err == nil {
+		t.Error("expected an error for a duplicate task")
+	}
+}
+
+func testScheduler(store Store, elector Elector) *Scheduler {
+	s := New(store, elector, Options{Instance: "test", ElectionInterval: time.Millisecond, DrainTimeout: time.Second})
+	s.tick = time.Millisecond
+	return s
+}
+
+func runScheduler(s *Scheduler) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type memoryStore struct {
+	mu    sync.Mutex
+	tasks map[string]*TaskStatus
+	runs  []*Run
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{tasks: map[string]*TaskStatus{}}
+}
+
+func (s *memoryStore) seed(name, spec string, next time.Time) {
+	s.tasks[name] = &TaskStatus{Name: name, Spec: spec, NextRunAt: next}
+}
+
+func (s *memoryStore) finishedRuns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, run := range s.runs {
+		if run.FinishedAt != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *memoryStore) lastRun(task string) Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		if s.runs[i].Task == task {
+			return *s.runs[i]
+		}
+	}
+	return Run{}
+}
+
+func (s *memoryStore) statuses() []TaskStatus {
+	out, _ := s.Tasks(context.Background())
+	return out
+}
+
+func (s *memoryStore) EnsureTask(_ context.Context, name, spec string, next time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[name]
+	if !ok || task.Spec != spec {
+		s.tasks[name] = &TaskStatus{Name: name, Spec: spec, NextRunAt: next}
+		return next, nil
+	}
+	return task.NextRunAt, nil
+}
+
+func (s *memoryStore) StartRun(_ context.Context, name, instance string, due, next time.Time) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task := s.tasks[name]
+	if task.NextRunAt.After(due) {
+		return 0, false, nil
+	}
+	task.NextRunAt = next
+	run := &Run{ID: int64(len(s.runs) + 1), Task: name, Instance: instance, Status: RunRunning, StartedAt: time.Now()}
+	s.runs = append(s.runs, run)
+	return run.ID, true, nil
+}
+
+func (s *memoryStore) FinishRun(_ context.Context, id int64, runErr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run := s.runs[id-1]
+	now := time.Now()
+	run.FinishedAt = &now
+	run.Duration = now.Sub(run.StartedAt)
+	run.Status, run.Error = RunSucceeded, runErr
+	if runErr != "" {
+		run.Status = RunFailed
+	}
+	return nil
+}
+
+func (s *memoryStore) Tasks(context.Context) ([]TaskStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []TaskStatus
+	for _, task := range s.tasks {
+		status := *task
+		for i := len(s.runs) - 1; i >= 0; i-- {
+			if s.runs[i].Task == task.Name {
+				run := *s.runs[i]
+				status.LastRun = &run
+				break
+			}
+		}
+		out = append(out, status)
+	}
+	return out, nil
+}
+
+func (s *memoryStore) Runs(_ context.Context, task string, limit int) ([]Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Run
+	for i := len(s.runs) - 1; i >= 0 && len(out) < limit; i-- {
+		if task == "" || s.runs[i].Task == task {
+			out = append(out, *s.runs[i])
+		}
+	}
+	return out, nil
+}
+
+// memoryElector grants a new lease on every attempt unless follower is set.
+type memoryElector struct {
+	follower bool
+	mu       sync.Mutex
+	tries    int
+	leases   []*memoryLease
+}
+
+func (e *memoryElector) TryLead(context.Context) (Lease, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.tries++
+	if e.follower {
+		return nil, nil
+	}
+	lease := &memoryLease{lost: make(chan struct{})}
+	e.leases = append(e.leases, lease)
+	return lease, nil
+}
+
+func (e *memoryElector) attempts() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.tries
+}
+
+func (e *memoryElector) lease(i int) *memoryLease {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leases[i]
+}
+
+type memoryLease struct {
+	lost     chan struct{}
+	mu       sync.Mutex
+	released bool
+}
+
+func (l *memoryLease) Lost() <-chan struct{} { return l.lost }
+
+func (l *memoryLease) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.released = true
+}
+
+func (l *memoryLease) isReleased() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.released
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/benpsk/go-starter/internal/config"
+)
+
+const cspReportPath = "/csp-report"
+
+type cspDirective struct {
+	name    string
+	sources []string
+}
+
+// contentSecurityPolicy builds the Content-Security-Policy header. Each
+// request gets its own nonce, added to script-src and style-src so the
+// layout's inline scripts and htmx's indicator styles still run.
+type contentSecurityPolicy struct {
+	directives []cspDirective
+	reportOnly bool
+}
+
+// newContentSecurityPolicy starts from a same-origin policy, allows Google
+// tag when googleTagID is set, and applies the directives in cfg.CSP on top:
+// a directive there replaces the default one of the same name.
+func newContentSecurityPolicy(cfg config.SecurityConfig, googleTagID string) *contentSecurityPolicy {
+	scripts := []string{"'self'"}
+	connect := []string{"'self'"}
+	if strings.TrimSpace(googleTagID) != "" {
+		scripts = append(scripts, "https://www.googletagmanager.com")
+		connect = append(connect, "https://*.google-analytics.com", "https://*.analytics.google.com", "https://*.googletagmanager.com")
+	}
+	p := &contentSecurityPolicy{
+		directives: []cspDirective{
+			{"default-src", []string{"'self'"}},
+			{"script-src", scripts},
+			{"style-src", []string{"'self'"}},
+			// Avatars come from OAuth providers and public storage buckets.
+			{"img-src", []string{"'self'", "data:", "https:"}},
+			{"connect-src", connect},
+			{"font-src", []string{"'self'"}},
+			{"object-src", []string{"'none'"}},
+			{"base-uri", []string{"'self'"}},
+			{"frame-ancestors", []string{"'self'"}},
+			{"report-uri", []string{cspReportPath}},
+		},
+		reportOnly: cfg.CSPReportOnly,
+	}
+	for _, part := range strings.Split(cfg.CSP, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		p.set(strings.ToLower(fields[0]), fields[1:])
+	}
+	return p
+}
+
+func (p *contentSecurityPolicy) set(name string, sources []string) {
+	for i := range p.directives {
+		if p.directives[i].name == name {
+			p.directives[i].sources = sources
+			return
+		}
+	}
+	p.directives = append(p.directives, cspDirective{name, sources})
+}
+
+func (p *contentSecurityPolicy) headerName() string {
+	if p.reportOnly {
+		return "Content-Security-Policy-Report-Only"
+	}
+	return "Content-Security-Policy"
+}
+
+// header renders the policy for one request. Directives that allow
+// 'unsafe-inline' get no nonce, since a nonce would turn it off.
+func (p *contentSecurityPolicy) header(nonce string) string {
+	var b strings.Builder
+	for i, d := range p.directives {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(d.name)
+		for _, source := range d.sources {
+			b.WriteByte(' ')
+			b.WriteString(source)
+		}
+		if nonce != "" && (d.name == "script-src" || d.name == "style-src") && !slices.Contains(d.sources, "'unsafe-inline'") {
+			b.WriteString(" 'nonce-")
+			b.WriteString(nonce)
+			b.WriteByte('\'')
+		}
+	}
+	return b.String()
+}
+
+func newCSPNonce() (string, error) {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw[:]), nil
+}
+
+// cspReport logs violation reports sent by browsers, in both the
+// report-uri (application/csp-report) and Reporting API formats.
+func cspReport(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, v := range parseCSPReports(body) {
+		log.Printf("csp violation: directive=%q blocked=%q document=%q disposition=%q", v.directive, v.blocked, v.document, v.disposition)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type cspViolation struct {
+	document    string
+	directive   string
+	blocked     string
+	disposition string
+}
+
+func parseCSPReports(body []byte) []cspViolation {
+	var legacy struct {
+		Report *struct {
+			DocumentURI        string `json:"document-uri"`
+			ViolatedDirective  string `json:"violated-directive"`
+			EffectiveDirective string `json:"effective-directive"`
+			BlockedURI         string `json:"blocked-uri"`
+			Disposition        string `json:"disposition"`
+		} `json:"csp-report"`
+	}
+	if err := json.Unmarshal(body, &legacy); err == nil && legacy.Report != nil {
+		directive := legacy.Report.EffectiveDirective
+		if directive == "" {
+			directive = legacy.Report.ViolatedDirective
+		}
+		return []cspViolation{{
+			document:    legacy.Report.DocumentURI,
+			directive:   directive,
+			blocked:     legacy.Report.BlockedURI,
+			disposition: legacy.Report.Disposition,
+		}}
+	}
+
+	var reports []struct {
+		Type string `json:"type"`
+		Body struct {
+			DocumentURL        string `json:"documentURL"`
+			EffectiveDirective string `json:"effectiveDirective"`
+			BlockedURL         string `json:"blockedURL"`
+			Disposition        string `json:"disposition"`
+		} `json:"body"`
+	}
+	if err := json.Unmarshal(body, &reports); err != nil {
+		return nil
+	}
+	var violations []cspViolation
+	for _, report := range reports {
+		if report.Type != "csp-violation" {
+			continue
+		}
+		violations = append(violations, cspViolation{
+			document:    report.Body.DocumentURL,
+			directive:   report.Body.EffectiveDirective,
+			blocked:     report.Body.BlockedURL,
+			disposition: report.Body.Disposition,
+		})
+	}
+	return violations
+}
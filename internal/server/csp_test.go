@@ -0,0 +1,117 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/benpsk/go-starter/internal/config"
+)
+
+func TestContentSecurityPolicyHeader(t *testing.T) {
+	t.Parallel()
+
+	p := newContentSecurityPolicy(config.SecurityConfig{}, "G-TEST")
+	got := p.header("abc")
+	for _, want := range []string{
+		"default-src 'self'",
+		"script-src 'self' https://www.googletagmanager.com 'nonce-abc'",
+		"style-src 'self' 'nonce-abc'",
+		"object-src 'none'",
+		"report-uri /csp-report",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("policy %q does not contain %q", got, want)
+		}
+	}
+	if p.headerName() != "Content-Security-Policy" {
+		t.Errorf("header name = %q", p.headerName())
+	}
+
+	p = newContentSecurityPolicy(config.SecurityConfig{
+		CSP:           "img-src 'self' https://cdn.example.com; style-src 'self' 'unsafe-inline'; frame-src 'none'",
+		CSPReportOnly: true,
+	}, "")
+	got = p.header("abc")
+	for _, want := range []string{
+		"script-src 'self' 'nonce-abc';",
+		"img-src 'self' https://cdn.example.com;",
+		"style-src 'self' 'unsafe-inline';",
+		"; frame-src 'none'",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("policy %q does not contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "googletagmanager") {
+		t.Errorf("policy %q allows Google tag without a tag ID", got)
+	}
+	if p.headerName() != "Content-Security-Policy-Report-Only" {
+		t.Errorf("report-only header name = %q", p.headerName())
+	}
+}
+
+func TestSecurityHeadersNonceAndHSTS(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.Config{AppEnv: "production", Security: config.SecurityConfig{HSTSMaxAge: 24 * time.Hour}}
+	var nonces []string
+	handler := securityHeaders(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonces = append(nonces, templ.GetNonce(r.Context()))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("HSTS should not be sent over plain HTTP")
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "max-age=86400; includeSubDomains" {
+		t.Errorf("HSTS = %q", got)
+	}
+
+	if len(nonces) != 2 || nonces[0] == "" || nonces[0] == nonces[1] {
+		t.Fatalf("expected a fresh nonce per request: %q", nonces)
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "'nonce-"+nonces[1]+"'") {
+		t.Errorf("policy %q does not carry the request nonce %q", csp, nonces[1])
+	}
+
+	handler = securityHeaders(config.Config{AppEnv: "development", Security: cfg.Security})(http.NotFoundHandler())
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	if rec.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("HSTS should only be sent in production")
+	}
+}
+
+func TestCSPReportParsesBothFormats(t *testing.T) {
+	t.Parallel()
+
+	legacy := parseCSPReports([]byte(`{"csp-report":{"document-uri":"https://example.com/","violated-directive":"script-src-elem","blocked-uri":"inline","disposition":"enforce"}}`))
+	if len(legacy) != 1 || legacy[0].directive != "script-src-elem" || legacy[0].blocked != "inline" {
+		t.Fatalf("legacy report: %+v", legacy)
+	}
+	reports := parseCSPReports([]byte(`[
+		{"type":"csp-violation","body":{"documentURL":"https://example.com/","effectiveDirective":"img-src","blockedURL":"https://evil.example/x.png","disposition":"report"}},
+		{"type":"deprecation","body":{}}
+	]`))
+	if len(reports) != 1 || reports[0].directive != "img-src" || reports[0].disposition != "report" {
+		t.Fatalf("reporting API reports: %+v", reports)
+	}
+
+	rec := httptest.NewRecorder()
+	cspReport(rec, httptest.NewRequest(http.MethodPost, cspReportPath, strings.NewReader("not json")))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if len(body) != 0 {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
@@ -1,105 +1,162 @@
 package server
 
 import (
-	"crypto/rand"
-	"crypto/subtle"
-	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/benpsk/go-starter/internal/abuse"
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/forwarded"
+	"github.com/benpsk/go-starter/internal/web"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
-const csrfCookieName = "csrf_token"
-
-func securityHeaders(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
-		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
-		w.Header().Set("Permissions-Policy", "camera=(), microphone=(), geolocation=()")
-		next.ServeHTTP(w, r)
-	})
-}
-
-func csrfProtection(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasPrefix(r.URL.Path, "/api/") {
+// securityHeaders sets the static security headers, a Content-Security-Policy
+// with a fresh nonce that templates read with templ.GetNonce, and HSTS on
+// HTTPS requests in production.
+func securityHeaders(cfg config.Config) func(http.Handler) http.Handler {
+	csp := newContentSecurityPolicy(cfg.Security, cfg.GoogleTagID)
+	var hsts string
+	if strings.EqualFold(cfg.AppEnv, "production") && cfg.Security.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d; includeSubDomains", int64(cfg.Security.HSTSMaxAge.Seconds()))
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+			w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+			w.Header().Set("Permissions-Policy", "camera=(), microphone=(), geolocation=()")
+			if hsts != "" && forwarded.IsHTTPS(r) {
+				w.Header().Set("Strict-Transport-Security", hsts)
+			}
+			nonce, err := newCSPNonce()
+			if err == nil {
+				r = r.WithContext(templ.WithNonce(r.Context(), nonce))
+			}
+			w.Header().Set(csp.headerName(), csp.header(nonce))
 			next.ServeHTTP(w, r)
-			return
-		}
+		})
+	}
+}
 
-		ensureCSRFCookie(w, r)
+// requestTimeout applies middleware.Timeout to everything except upload
+// bodies, which can legitimately stream for far longer.
+func requestTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		timed := middleware.Timeout(d)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if (r.Method == http.MethodPatch || r.Method == http.MethodPut) && strings.HasPrefix(r.URL.Path, "/api/uploads/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			timed.ServeHTTP(w, r)
+		})
+	}
+}
 
-		if isSafeMethod(r.Method) {
+// csrfProtection rejects unsafe web requests that come from another site
+// or lack a CSRF token signed for the caller's session, and reports bad
+// tokens to the abuse detector when csrfFailureCounts. /api/ is exempt
+// except for the refresh and logout calls that authenticate with the
+// refresh cookie.
+func csrfProtection(authService *auth.Service, appURL string) func(http.Handler) http.Handler {
+	origins := appOrigins(appURL)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				if isSafeMethod(r.Method) || !usesRefreshCookie(authService, r) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			} else if r.URL.Path == cspReportPath {
+				// Browsers post CSP reports without a token.
+				next.ServeHTTP(w, r)
+				return
+			} else {
+				authService.EnsureCSRFCookie(w, r)
+				if isSafeMethod(r.Method) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				// The token may be a form field, so the form is read here,
+				// before any handler could bound the body.
+				r.Body = http.MaxBytesReader(w, r.Body, web.MaxFormBytes)
+				var tooLarge *http.MaxBytesError
+				if err := r.ParseMultipartForm(web.MaxFormBytes); errors.As(err, &tooLarge) {
+					http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+			}
+
+			if !sameOriginRequest(r, origins) {
+				http.Error(w, "cross-site request rejected", http.StatusForbidden)
+				return
+			}
+			if !authService.CheckCSRF(r) {
+				if csrfFailureCounts(r) {
+					authService.Abuse().Report(r, abuse.CSRFFailure)
+				}
+				http.Error(w, "invalid csrf token", http.StatusForbidden)
+				return
+			}
 			next.ServeHTTP(w, r)
-			return
-		}
-
-		cookieToken := currentCSRFCookie(r)
-		headerToken := strings.TrimSpace(r.Header.Get("X-CSRF-Token"))
-		formToken := strings.TrimSpace(r.FormValue("csrf_token"))
+		})
+	}
+}
 
-		candidate := headerToken
-		if candidate == "" {
-			candidate = formToken
-		}
-		if !csrfTokensEqual(cookieToken, candidate) {
-			http.Error(w, "invalid csrf token", http.StatusForbidden)
-			return
-		}
+// csrfFailureCounts reports whether a same-origin request that failed the
+// token check counts towards an abuse ban. Without the CSRF cookie it may
+// come from another site, which could otherwise get its visitors banned.
+func csrfFailureCounts(r *http.Request) bool {
+	return !auth.IsCrossSite(r) && auth.CSRFCookieFromRequest(r) != ""
+}
 
-		next.ServeHTTP(w, r)
-	})
+// usesRefreshCookie reports whether r is an API call that a browser could
+// be tricked into authenticating with the HttpOnly refresh cookie.
+func usesRefreshCookie(authService *auth.Service, r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/auth/refresh", "/api/auth/logout":
+		return authService.APIRefreshTokenFromRequest(r) != ""
+	}
+	return false
 }
 
-func isSafeMethod(method string) bool {
-	switch strings.ToUpper(strings.TrimSpace(method)) {
-	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+// sameOriginRequest checks Sec-Fetch-Site, or Origin for browsers that do
+// not send it. Requests with neither, such as from older browsers and
+// non-browser clients, are left to the token check.
+func sameOriginRequest(r *http.Request, origins []string) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
 		return true
+	case "":
 	default:
 		return false
 	}
-}
-
-func ensureCSRFCookie(w http.ResponseWriter, r *http.Request) string {
-	if token := currentCSRFCookie(r); token != "" {
-		return token
-	}
-
-	token, err := newCSRFToken()
-	if err != nil {
-		return ""
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
 	}
-
-	http.SetCookie(w, &http.Cookie{
-		Name:     csrfCookieName,
-		Value:    token,
-		Path:     "/",
-		HttpOnly: false, // JS reads this to set htmx header and hidden form fields.
-		SameSite: http.SameSiteLaxMode,
-		Secure:   r.TLS != nil,
-	})
-	return token
-}
-
-func currentCSRFCookie(r *http.Request) string {
-	c, err := r.Cookie(csrfCookieName)
-	if err != nil {
-		return ""
+	if slices.Contains(origins, origin) {
+		return true
 	}
-	return strings.TrimSpace(c.Value)
-}
-
-func newCSRFToken() (string, error) {
-	var raw [32]byte
-	if _, err := rand.Read(raw[:]); err != nil {
-		return "", err
+	scheme := "http"
+	if forwarded.IsHTTPS(r) {
+		scheme = "https"
 	}
-	return base64.RawURLEncoding.EncodeToString(raw[:]), nil
+	return origin == scheme+"://"+r.Host
 }
 
-func csrfTokensEqual(a, b string) bool {
-	if a == "" || b == "" {
+func isSafeMethod(method string) bool {
+	switch strings.ToUpper(strings.TrimSpace(method)) {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
 		return false
 	}
-	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
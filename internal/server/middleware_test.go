@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/web"
+)
+
+func TestCSRFProtection(t *testing.T) {
+	t.Parallel()
+
+	authService := auth.NewService(nil, config.Config{
+		AppEnv: "test",
+		AppURL: "https://app.example.com",
+		Auth: config.AuthConfig{
+			SessionCookieName: "test_session",
+			CSRFSecret:        "test-csrf-secret",
+			API:               config.APIAuthConfig{RefreshCookieName: "test_api_refresh"},
+		},
+	})
+	handler := csrfProtection(authService, "https://app.example.com")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	token, _ := authService.NewCSRFToken("session-a")
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		cookies map[string]string
+		want    int
+	}{
+		{
+			name:    "signed token from the same origin",
+			path:    "/auth/logout",
+			headers: map[string]string{"X-CSRF-Token": token, "Origin": "https://app.example.com", "Sec-Fetch-Site": "same-origin"},
+			cookies: map[string]string{"csrf_token": token, "test_session": "session-a"},
+			want:    http.StatusNoContent,
+		},
+		{
+			name:    "cross-site request with a valid token",
+			path:    "/auth/logout",
+			headers: map[string]string{"X-CSRF-Token": token, "Sec-Fetch-Site": "cross-site"},
+			cookies: map[string]string{"csrf_token": token, "test_session": "session-a"},
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "foreign origin without fetch metadata",
+			path:    "/auth/logout",
+			headers: map[string]string{"X-CSRF-Token": token, "Origin": "https://evil.example"},
+			cookies: map[string]string{"csrf_token": token, "test_session": "session-a"},
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "token of another session",
+			path:    "/auth/logout",
+			headers: map[string]string{"X-CSRF-Token": token},
+			cookies: map[string]string{"csrf_token": token, "test_session": "session-b"},
+			want:    http.StatusForbidden,
+		},
+		{
+			name: "bearer api call",
+			path: "/api/uploads/",
+			want: http.StatusNoContent,
+		},
+		{
+			name:    "refresh with the refresh cookie and no token",
+			path:    "/api/auth/refresh",
+			cookies: map[string]string{"test_api_refresh": "refresh"},
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "refresh with the refresh cookie and a token",
+			path:    "/api/auth/refresh",
+			headers: map[string]string{"X-CSRF-Token": token, "Sec-Fetch-Site": "same-origin"},
+			cookies: map[string]string{"test_api_refresh": "refresh", "csrf_token": token, "test_session": "session-a"},
+			want:    http.StatusNoContent,
+		},
+		{
+			name: "refresh with a body token",
+			path: "/api/auth/logout",
+			want: http.StatusNoContent,
+		},
+		{
+			name: "csp report",
+			path: cspReportPath,
+			want: http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "https://app.example.com"+tt.path, nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			for k, v := range tt.cookies {
+				r.AddCookie(&http.Cookie{Name: k, Value: v})
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSRFProtectionBoundsFormBodies(t *testing.T) {
+	t.Parallel()
+
+	authService := auth.NewService(nil, config.Config{
+		AppEnv: "test",
+		AppURL: "https://app.example.com",
+		Auth:   config.AuthConfig{SessionCookieName: "test_session", CSRFSecret: "test-csrf-secret"},
+	})
+	handler := csrfProtection(authService, "https://app.example.com")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	token, _ := authService.NewCSRFToken("session-a")
+
+	for _, tt := range []struct {
+		name string
+		size int
+		want int
+	}{
+		{name: "avatar sized", size: 1 << 20, want: http.StatusNoContent},
+		{name: "oversized", size: web.MaxFormBytes, want: http.StatusRequestEntityTooLarge},
+	} {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		_ = form.WriteField(auth.CSRFFormField, token)
+		part, _ := form.CreateFormFile("avatar", "avatar.png")
+		_, _ = part.Write(make([]byte, tt.size))
+		_ = form.Close()
+
+		r := httptest.NewRequest(http.MethodPost, "https://app.example.com/account/avatar", &body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		r.Header.Set("Sec-Fetch-Site", "same-origin")
+		r.AddCookie(&http.Cookie{Name: auth.CSRFCookieName, Value: token})
+		r.AddCookie(&http.Cookie{Name: "test_session", Value: "session-a"})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestCSRFFailureCounts(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		cookie  bool
+		want    bool
+	}{
+		{name: "same origin with the csrf cookie", headers: map[string]string{"Sec-Fetch-Site": "same-origin"}, cookie: true, want: true},
+		{name: "no fetch metadata with the csrf cookie", cookie: true, want: true},
+		{name: "same origin without the csrf cookie", headers: map[string]string{"Sec-Fetch-Site": "same-origin"}},
+		{name: "cross-site with the csrf cookie", headers: map[string]string{"Sec-Fetch-Site": "cross-site"}, cookie: true},
+		{name: "same-site with the csrf cookie", headers: map[string]string{"Sec-Fetch-Site": "same-site"}, cookie: true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "https://app.example.com/auth/logout", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if tt.cookie {
+			r.AddCookie(&http.Cookie{Name: auth.CSRFCookieName, Value: "token"})
+		}
+		if got := csrfFailureCounts(r); got != tt.want {
+			t.Errorf("%s: csrfFailureCounts = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"github.com/benpsk/go-starter/internal/api"
 	"github.com/benpsk/go-starter/internal/auth"
 	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/forwarded"
+	"github.com/benpsk/go-starter/internal/postgres"
 	"github.com/benpsk/go-starter/internal/storage"
 	"github.com/benpsk/go-starter/internal/web"
 	webstatic "github.com/benpsk/go-starter/static"
@@ -19,52 +21,85 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func NewRouter(cfg config.Config, db *pgxpool.Pool, store storage.Store) *chi.Mux {
+func NewRouter(cfg config.Config, db *pgxpool.Pool, reads *postgres.ReadRouter, store storage.Store) *chi.Mux {
 	r := chi.NewRouter()
 
+	authService := auth.NewService(db, cfg)
+	authService.Users().UseReadRouter(reads)
+	authRateLimiter := auth.NewRateLimiter(auth.DefaultRateLimitRequests, auth.DefaultRateLimitWindow).
+		WithPolicies(cfg.RateLimit).
+		WithIdentity(authService.RequestUserID, authService.RequestToken)
+	if cfg.RateLimit.Store == "postgres" {
+		authRateLimiter.WithStore(postgres.NewRateLimitStore(db))
+	}
+	webHandler := web.NewHandler(cfg, authService).WithStorage(store).WithScheduler(postgres.NewSchedulerStore(db))
+	apiHandler := api.NewHandler(db, authService).WithReadRouter(reads).WithUploads(store, cfg.Uploads)
+
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   appOrigins(cfg.AppURL),
-		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedOrigins: appOrigins(cfg.AppURL),
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{
+			"Accept", "Authorization", "Content-Type", "X-CSRF-Token",
+			"Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Checksum",
+		},
+		ExposedHeaders: []string{
+			"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+			"Tus-Checksum-Algorithm", "Upload-Offset", "Upload-Length", "Upload-Expires",
+		},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(forwarded.NewResolver(cfg.TrustedProxies).Middleware)
 	r.Use(middleware.Logger)
-	r.Use(middleware.Timeout(30 * time.Second))
-	r.Use(securityHeaders)
-	r.Use(csrfProtection)
+	r.Use(securityHeaders(cfg))
+	r.Use(authService.Abuse().Middleware(banned(webHandler)))
+	r.Use(requestTimeout(30 * time.Second))
+	r.Use(csrfProtection(authService, cfg.AppURL))
 	r.Use(middleware.Recoverer)
 
-	authService := auth.NewService(db, cfg)
-	authRateLimiter := auth.NewRateLimiter(auth.DefaultRateLimitRequests, auth.DefaultRateLimitWindow)
-	webHandler := web.NewHandler(cfg, authService)
-	apiHandler := api.NewHandler(db, authService)
-
 	staticFS := webstatic.FileSystem()
 	if _, err := os.Stat("static"); err == nil {
 		staticFS = http.Dir("static")
 	}
 
-	_ = store
 	r.Use(authService.LoadSession)
 
 	r.NotFound(webHandler.NotFound)
 	r.MethodNotAllowed(webHandler.MethodNotAllowed)
 
 	r.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(staticFS)))
-	if cfg.Storage.Driver == "local" {
+	if local, ok := storage.AsLocal(store); ok {
 		mediaPrefix := strings.TrimRight(cfg.Storage.LocalPublicPath, "/") + "/"
-		r.Handle(mediaPrefix+"*", http.StripPrefix(mediaPrefix, http.FileServer(http.Dir(cfg.Storage.LocalDir))))
+		r.Handle(mediaPrefix+"*", http.StripPrefix(mediaPrefix, local.MediaHandler(currentUserID)))
 	}
 	r.Get("/healthz", apiHandler.Health)
+	r.With(authRateLimiter.Limit("csp_report")).Post(cspReportPath, cspReport)
 	r.Mount("/api", api.Routes(apiHandler, authRateLimiter))
 	r.Mount("/", web.Routes(webHandler, authRateLimiter))
 
 	return r
 }
 
+// banned answers clients blocked by the abuse detector with JSON under
+// /api and a page elsewhere.
+func banned(webHandler web.Handler) func(http.ResponseWriter, *http.Request, time.Time) {
+	return func(w http.ResponseWriter, r *http.Request, until time.Time) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			api.Banned(w, r, until)
+			return
+		}
+		webHandler.Banned(w, r, until)
+	}
+}
+
+func currentUserID(r *http.Request) int64 {
+	if u := auth.CurrentUserFromRequest(r); u != nil {
+		return u.ID
+	}
+	return 0
+}
+
 func appOrigins(appURL string) []string {
 	appURL = strings.TrimSpace(appURL)
 	if appURL == "" {
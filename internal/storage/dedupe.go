@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Blob is one stored copy of some content, shared by every key linked to it.
+type Blob struct {
+	SHA256      string
+	Visibility  Visibility
+	Size        int64
+	ContentType string
+}
+
+// Key is where the blob lives in the underlying store. Visibility is part of
+// the key because Delete removes a key from both visibilities.
+func (b Blob) Key() string {
+	return "blobs/" + string(b.Visibility) + "/" + b.SHA256[:2] + "/" + b.SHA256
+}
+
+// BlobLink is a logical key and the blob it currently points at.
+type BlobLink struct {
+	Key      string
+	Blob     Blob
+	LinkedAt time.Time
+}
+
+// BlobIndex records which logical keys point at which blobs and how many
+// references each blob has.
+type BlobIndex interface {
+	// Link points key at blob, taking a reference on it and releasing the
+	// blob key pointed at before. It reports whether the blob record is new.
+	Link(ctx context.Context, key string, blob Blob) (created bool, err error)
+	// Resolve returns ErrNotFound for keys that were never linked.
+	Resolve(ctx context.Context, key string, visibility Visibility) (BlobLink, error)
+	List(ctx context.Context, prefix string, visibility Visibility, cursor string, limit int) ([]BlobLink, error)
+	// Unlink drops key in every visibility.
+	Unlink(ctx context.Context, key string) error
+	// CollectGarbage calls remove for up to limit blobs unreferenced since
+	// before cutoff and forgets those it removed.
+	CollectGarbage(ctx context.Context, cutoff time.Time, limit int, remove func(context.Context, Blob) error) (int, error)
+}
+
+const gcBatchSize = 100
+
+// DedupeStore stores each distinct body once under its SHA-256 and maps
+// logical keys onto those blobs through a BlobIndex. Blobs are deleted by
+// CollectGarbage once nothing has referenced them for a grace period.
+//
+// Only Upload and Copy deduplicate. Multipart and presigned uploads write the
+// logical key straight to the underlying store, and keys that were never
+// linked fall through to it on reads, so the layer can be turned on over
+// existing data. List only returns linked keys.
+type DedupeStore struct {
+	inner Store
+	index BlobIndex
+}
+
+func NewDedupe(inner Store, index BlobIndex) *DedupeStore {
+	return &DedupeStore{inner: inner, index: index}
+}
+
+// Unwrap returns the underlying store.
+func (s *DedupeStore) Unwrap() Store {
+	return s.inner
+}
+
+// Upload spools body to a temporary file while hashing it, then stores the
+// blob only if the underlying store does not already have it.
+func (s *DedupeStore) Upload(ctx context.Context, key string, body io.Reader, contentType string, opts ...ObjectOption) (string, error) {
+	if _, err := cleanKey(key); err != nil {
+		return "", err
+	}
+	visibility := applyObjectOptions(opts).visibility
+	spool, err := os.CreateTemp("", "storage-blob-*")
+	if err != nil {
+		return "", fmt.Errorf("create upload spool: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), body)
+	if err != nil {
+		return "", fmt.Errorf("spool upload: %w", err)
+	}
+	blob := Blob{SHA256: hex.EncodeToString(hash.Sum(nil)), Visibility: visibility, Size: size, ContentType: contentType}
+
+	uploaded, err := s.ensureBlob(ctx, spool, blob)
+	if err != nil {
+		return "", err
+	}
+	created, err := s.index.Link(ctx, key, blob)
+	if err != nil {
+		return "", err
+	}
+	if created && !uploaded {
+		// The blob was collected between the existence check and Link, which
+		// recreated its record; put the object back.
+		if _, err := s.ensureBlob(ctx, spool, blob); err != nil {
+			return "", err
+		}
+	}
+	if visibility == VisibilityPrivate {
+		return "", nil
+	}
+	return s.inner.PublicURL(blob.Key()), nil
+}
+
+func (s *DedupeStore) ensureBlob(ctx context.Context, spool *os.File, blob Blob) (bool, error) {
+	_, err := s.inner.Stat(ctx, blob.Key(), WithVisibility(blob.Visibility))
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return false, fmt.Errorf("rewind upload spool: %w", err)
+	}
+	if _, err := s.inner.Upload(ctx, blob.Key(), spool, blob.ContentType, WithVisibility(blob.Visibility)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *DedupeStore) Open(ctx context.Context, key string, opts ...ObjectOption) (*Object, error) {
+	link, err := s.index.Resolve(ctx, key, applyObjectOptions(opts).visibility)
+	if errors.Is(err, ErrNotFound) {
+		return s.inner.Open(ctx, key, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.inner.Open(ctx, link.Blob.Key(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	obj.ObjectInfo = linkInfo(link, obj.ObjectInfo)
+	return obj, nil
+}
+
+func (s *DedupeStore) Stat(ctx context.Context, key string, opts ...ObjectOption) (ObjectInfo, error) {
+	link, err := s.index.Resolve(ctx, key, applyObjectOptions(opts).visibility)
+	if errors.Is(err, ErrNotFound) {
+		return s.inner.Stat(ctx, key, opts...)
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := s.inner.Stat(ctx, link.Blob.Key(), opts...)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return linkInfo(link, info), nil
+}
+
+func (s *DedupeStore) List(ctx context.Context, prefix string, page ListOptions, opts ...ObjectOption) (ListPage, error) {
+	limit := page.limit()
+	links, err := s.index.List(ctx, prefix, applyObjectOptions(opts).visibility, page.Cursor, limit+1)
+	if err != nil {
+		return ListPage{}, err
+	}
+	var out ListPage
+	if len(links) > limit {
+		links = links[:limit]
+		out.NextCursor = links[limit-1].Key
+	}
+	out.Objects = make([]ObjectInfo, 0, len(links))
+	for _, link := range links {
+		out.Objects = append(out.Objects, linkInfo(link, ObjectInfo{LastModified: link.LinkedAt}))
+	}
+	return out, nil
+}
+
+// Copy only adds a reference; no bytes move.
+func (s *DedupeStore) Copy(ctx context.Context, srcKey, dstKey string, opts ...ObjectOption) error {
+	if _, err := cleanKey(dstKey); err != nil {
+		return err
+	}
+	link, err := s.index.Resolve(ctx, srcKey, applyObjectOptions(opts).visibility)
+	if errors.Is(err, ErrNotFound) {
+		return s.inner.Copy(ctx, srcKey, dstKey, opts...)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.index.Link(ctx, dstKey, link.Blob)
+	return err
+}
+
+// Delete drops the key's references and any unlinked object stored under
+// it. Blobs themselves go in CollectGarbage.
+func (s *DedupeStore) Delete(ctx context.Context, key string) error {
+	if err := s.index.Unlink(ctx, key); err != nil {
+		return err
+	}
+	return s.inner.Delete(ctx, key)
+}
+
+func (s *DedupeStore) CreateMultipart(ctx context.Context, key, contentType string, opts ...ObjectOption) (string, error) {
+	return s.inner.CreateMultipart(ctx, key, contentType, opts...)
+}
+
+func (s *DedupeStore) UploadPart(ctx context.Context, key, uploadID string, number int, body io.Reader, size int64, opts ...ObjectOption) (Part, error) {
+	return s.inner.UploadPart(ctx, key, uploadID, number, body, size, opts...)
+}
+
+func (s *DedupeStore) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part, opts ...ObjectOption) error {
+	return s.inner.CompleteMultipart(ctx, key, uploadID, parts, opts...)
+}
+
+func (s *DedupeStore) AbortMultipart(ctx context.Context, key, uploadID string, opts ...ObjectOption) error {
+	return s.inner.AbortMultipart(ctx, key, uploadID, opts...)
+}
+
+// PublicURL has no context to resolve the key with, so it does the lookup
+// under a short timeout of its own. Prefer the URL returned by Upload.
+func (s *DedupeStore) PublicURL(key string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if link, err := s.index.Resolve(ctx, key, VisibilityPublic); err == nil {
+		return s.inner.PublicURL(link.Blob.Key())
+	}
+	return s.inner.PublicURL(key)
+}
+
+func (s *DedupeStore) SignedURL(ctx context.Context, key string, ttl time.Duration, opts ...SignOption) (string, error) {
+	link, err := s.index.Resolve(ctx, key, VisibilityPrivate)
+	if errors.Is(err, ErrNotFound) {
+		return s.inner.SignedURL(ctx, key, ttl, opts...)
+	}
+	if err != nil {
+		return "", err
+	}
+	return s.inner.SignedURL(ctx, link.Blob.Key(), ttl, opts...)
+}
+
+func (s *DedupeStore) PresignUpload(ctx context.Context, key, contentType string, size int64, ttl time.Duration) (PresignedUpload, error) {
+	return s.inner.PresignUpload(ctx, key, contentType, size, ttl)
+}
+
+// CollectGarbage deletes blobs that have been unreferenced for longer than
+// grace and returns how many it removed. The grace period covers uploads
+// that found a blob present just before its last reference went away.
+func (s *DedupeStore) CollectGarbage(ctx context.Context, grace time.Duration) (int, error) {
+	cutoff := time.Now().Add(-grace)
+	remove := func(ctx context.Context, blob Blob) error {
+		return s.inner.Delete(ctx, blob.Key())
+	}
+	total := 0
+	for {
+		n, err := s.index.CollectGarbage(ctx, cutoff, gcBatchSize, remove)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n < gcBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// RunGC collects garbage every interval until ctx is done.
+func (s *DedupeStore) RunGC(ctx context.Context, interval, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.CollectGarbage(ctx, grace)
+			if err != nil {
+				log.Printf("storage gc: %v", err)
+			}
+			if n > 0 {
+				log.Printf("storage gc: removed %d unreferenced blobs", n)
+			}
+		}
+	}
+}
+
+func linkInfo(link BlobLink, info ObjectInfo) ObjectInfo {
+	info.Key = link.Key
+	info.Size = link.Blob.Size
+	info.ContentType = link.Blob.ContentType
+	info.ETag = `"` + link.Blob.SHA256 + `"`
+	return info
+}
+
+// AsLocal returns the LocalStore under store, looking through wrappers such
+// as DedupeStore.
+func AsLocal(store Store) (*LocalStore, bool) {
+	for {
+		switch s := store.(type) {
+		case *LocalStore:
+			return s, true
+		case interface{ Unwrap() Store }:
+			store = s.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryBlobIndex is a BlobIndex kept in maps, without the locking the
+// Postgres index does for concurrent garbage collection.
+type memoryBlobIndex struct {
+	mu           sync.Mutex
+	links        map[string]BlobLink
+	refs         map[string]int
+	unreferenced map[string]time.Time
+	blobs        map[string]Blob
+}
+
+func newMemoryBlobIndex() *memoryBlobIndex {
+	return &memoryBlobIndex{links: map[string]BlobLink{}, refs: map[string]int{}, unreferenced: map[string]time.Time{}, blobs: map[string]Blob{}}
+}
+
+func (m *memoryBlobIndex) Link(ctx context.Context, key string, blob Blob) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, exists := m.blobs[blob.Key()]
+	m.blobs[blob.Key()] = blob
+	m.refs[blob.Key()]++
+	delete(m.unreferenced, blob.Key())
+	linkKey := string(blob.Visibility) + ":" + key
+	if old, ok := m.links[linkKey]; ok {
+		m.release(old.Blob.Key())
+	}
+	m.links[linkKey] = BlobLink{Key: key, Blob: blob, LinkedAt: time.Now()}
+	return !exists, nil
+}
+
+func (m *memoryBlobIndex) release(blobKey string) {
+	m.refs[blobKey]--
+	if m.refs[blobKey] == 0 {
+		m.unreferenced[blobKey] = time.Now()
+	}
+}
+
+func (m *memoryBlobIndex) Resolve(ctx context.Context, key string, visibility Visibility) (BlobLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link, ok := m.links[string(visibility)+":"+key]
+	if !ok {
+		return BlobLink{}, ErrNotFound
+	}
+	return link, nil
+}
+
+func (m *memoryBlobIndex) List(ctx context.Context, prefix string, visibility Visibility, cursor string, limit int) ([]BlobLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []BlobLink
+	for _, link := range m.links {
+		if link.Blob.Visibility == visibility && strings.HasPrefix(link.Key, prefix) && link.Key > cursor {
+			out = append(out, link)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out[:min(limit, len(out))], nil
+}
+
+func (m *memoryBlobIndex) Unlink(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range []Visibility{VisibilityPublic, VisibilityPrivate} {
+		if link, ok := m.links[string(v)+":"+key]; ok {
+			delete(m.links, string(v)+":"+key)
+			m.release(link.Blob.Key())
+		}
+	}
+	return nil
+}
+
+func (m *memoryBlobIndex) CollectGarbage(ctx context.Context, cutoff time.Time, limit int, remove func(context.Context, Blob) error) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for blobKey, at := range m.unreferenced {
+		if n == limit || !at.Before(cutoff) {
+			continue
+		}
+		if err := remove(ctx, m.blobs[blobKey]); err != nil {
+			return n, err
+		}
+		delete(m.unreferenced, blobKey)
+		delete(m.blobs, blobKey)
+		delete(m.refs, blobKey)
+		n++
+	}
+	return n, nil
+}
+
+func TestDedupeStoreStoresIdenticalContentOnce(t *testing.T) {
+	t.Parallel()
+
+	local, err := NewLocal(t.TempDir(), "http://127.0.0.1:8080", "/media")
+	if err != nil {
+		t.Fatalf("new local store: %v", err)
+	}
+	index := newMemoryBlobIndex()
+	store := NewDedupe(local, index)
+	ctx := context.Background()
+
+	urlA, err := store.Upload(ctx, "docs/a.txt", strings.NewReader("same body"), "text/plain")
+	if err != nil {
+		t.Fatalf("upload a: %v", err)
+	}
+	urlB, err := store.Upload(ctx, "docs/b.txt", strings.NewReader("same body"), "text/plain")
+	if err != nil {
+		t.Fatalf("upload b: %v", err)
+	}
+	if urlA != urlB || !strings.Contains(urlA, "/blobs/public/") {
+		t.Fatalf("expected both keys to share one blob url, got %q and %q", urlA, urlB)
+	}
+	if store.PublicURL("docs/a.txt") != urlA {
+		t.Fatalf("PublicURL should resolve to the blob, got %q", store.PublicURL("docs/a.txt"))
+	}
+	blobs, err := local.List(ctx, "blobs/", ListOptions{})
+	if err != nil || len(blobs.Objects) != 1 {
+		t.Fatalf("expected one stored blob, got %+v err=%v", blobs.Objects, err)
+	}
+
+	if err := store.Copy(ctx, "docs/a.txt", "docs/c.txt"); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	obj, err := store.Open(ctx, "docs/c.txt")
+	if err != nil {
+		t.Fatalf("open copy: %v", err)
+	}
+	data, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(data) != "same body" || obj.Key != "docs/c.txt" || obj.ContentType != "text/plain" {
+		t.Fatalf("unexpected copied object %q %+v", data, obj.ObjectInfo)
+	}
+	page, err := store.List(ctx, "docs/", ListOptions{Limit: 2})
+	if err != nil || len(page.Objects) != 2 || page.NextCursor != "docs/b.txt" {
+		t.Fatalf("unexpected list %+v err=%v", page, err)
+	}
+
+	// Keys written before dedupe was enabled still resolve.
+	if _, err := local.Upload(ctx, "legacy.txt", strings.NewReader("old"), "text/plain"); err != nil {
+		t.Fatalf("legacy upload: %v", err)
+	}
+	if info, err := store.Stat(ctx, "legacy.txt"); err != nil || info.Size != 3 {
+		t.Fatalf("unexpected legacy stat %+v err=%v", info, err)
+	}
+
+	for _, key := range []string{"docs/a.txt", "docs/b.txt"} {
+		if err := store.Delete(ctx, key); err != nil {
+			t.Fatalf("delete %s: %v", key, err)
+		}
+	}
+	if n, err := store.CollectGarbage(ctx, 0); err != nil || n != 0 {
+		t.Fatalf("blob still referenced by the copy: n=%d err=%v", n, err)
+	}
+	if err := store.Delete(ctx, "docs/c.txt"); err != nil {
+		t.Fatalf("delete copy: %v", err)
+	}
+	if n, err := store.CollectGarbage(ctx, time.Hour); err != nil || n != 0 {
+		t.Fatalf("grace period should keep the blob: n=%d err=%v", n, err)
+	}
+	if n, err := store.CollectGarbage(ctx, -time.Second); err != nil || n != 1 {
+		t.Fatalf("expected the blob to be collected: n=%d err=%v", n, err)
+	}
+	if blobs, _ := local.List(ctx, "blobs/", ListOptions{}); len(blobs.Objects) != 0 {
+		t.Fatalf("expected blob to be deleted, got %+v", blobs.Objects)
+	}
+}
+
+func TestAsLocalLooksThroughWrappers(t *testing.T) {
+	t.Parallel()
+
+	local, err := NewLocal(t.TempDir(), "http://127.0.0.1:8080", "/media")
+	if err != nil {
+		t.Fatalf("new local store: %v", err)
+	}
+	if got, ok := AsLocal(NewDedupe(local, newMemoryBlobIndex())); !ok || got != local {
+		t.Fatal("expected AsLocal to unwrap the dedupe store")
+	}
+}
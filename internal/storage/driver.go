@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/r2"
+)
+
+// FromConfig builds the Store selected by STORAGE_DRIVER.
+func FromConfig(ctx context.Context, cfg config.Config) (Store, error) {
+	return FromDriver(ctx, cfg.Storage.Driver, cfg)
+}
+
+// FromDriver builds the named driver from cfg whatever STORAGE_DRIVER says,
+// so tools can read one backend and write another.
+func FromDriver(ctx context.Context, driver string, cfg config.Config) (Store, error) {
+	switch driver {
+	case "local":
+		store, err := NewLocal(cfg.Storage.LocalDir, cfg.AppURL, cfg.Storage.LocalPublicPath)
+		if err != nil {
+			return nil, err
+		}
+		store.EnableSigning(cfg.Storage.SigningSecret)
+		return store, nil
+	case "r2":
+		if cfg.R2.Endpoint == "" || cfg.R2.Bucket == "" || cfg.R2.PublicBaseURL == "" {
+			return nil, fmt.Errorf("r2 storage needs R2_ENDPOINT, R2_BUCKET and R2_PUBLIC_BASE_URL")
+		}
+		client, err := r2.New(ctx, cfg.R2.Endpoint, cfg.R2.Region, cfg.R2.AccessKeyID, cfg.R2.SecretAccessKey, cfg.R2.Bucket, cfg.R2.PrivateBucket, cfg.R2.PublicBaseURL)
+		if err != nil {
+			return nil, err
+		}
+		return NewR2(client), nil
+	default:
+		return nil, fmt.Errorf("unsupported storage driver %q", driver)
+	}
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// localMultipartDir holds in-progress multipart uploads, one directory per
+// upload with a manifest and one file per part.
+const localMultipartDir = ".multipart"
+
+var (
+	ErrInvalidPart     = errors.New("invalid multipart part")
+	localUploadIDChars = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+type localMultipartManifest struct {
+	Key         string     `json:"key"`
+	ContentType string     `json:"content_type"`
+	Visibility  Visibility `json:"visibility"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+func (s *LocalStore) CreateMultipart(ctx context.Context, key, contentType string, opts ...ObjectOption) (string, error) {
+	_ = ctx
+	clean, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", fmt.Errorf("random multipart id: %w", err)
+	}
+	uploadID := hex.EncodeToString(raw[:])
+	dir := filepath.Join(s.root, localMultipartDir, uploadID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("create multipart dir: %w", err)
+	}
+	manifest, err := json.Marshal(localMultipartManifest{
+		Key:         filepath.ToSlash(clean),
+		ContentType: contentType,
+		Visibility:  applyObjectOptions(opts).visibility,
+		CreatedAt:   time.Now().UTC(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("encode multipart manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "manifest.json"), manifest, 0o644); err != nil {
+		return "", fmt.Errorf("write multipart manifest: %w", err)
+	}
+	return uploadID, nil
+}
+
+// UploadPart writes the part to a temp file and renames it into place, so a
+// retried part replaces the earlier attempt atomically.
+func (s *LocalStore) UploadPart(ctx context.Context, key, uploadID string, number int, body io.Reader, size int64, opts ...ObjectOption) (Part, error) {
+	_ = ctx
+	_ = opts
+	dir, _, err := s.multipartDir(key, uploadID)
+	if err != nil {
+		return Part{}, err
+	}
+	if number < 1 {
+		return Part{}, ErrInvalidPart
+	}
+	tmp, err := os.CreateTemp(dir, "part-*.tmp")
+	if err != nil {
+		return Part{}, fmt.Errorf("create multipart part: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Part{}, fmt.Errorf("write multipart part: %w", err)
+	}
+	if size >= 0 && written != size {
+		return Part{}, fmt.Errorf("%w: got %d bytes, want %d", ErrInvalidPart, written, size)
+	}
+	if err := os.Rename(tmp.Name(), localPartPath(dir, number)); err != nil {
+		return Part{}, fmt.Errorf("store multipart part: %w", err)
+	}
+	return Part{Number: number, ETag: `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`, Size: written}, nil
+}
+
+func (s *LocalStore) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part, opts ...ObjectOption) error {
+	_ = opts
+	dir, manifest, err := s.multipartDir(key, uploadID)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return ErrInvalidPart
+	}
+	readers := make([]io.Reader, 0, len(parts))
+	for i, p := range parts {
+		if p.Number != i+1 {
+			return fmt.Errorf("%w: parts must be numbered 1..n in order", ErrInvalidPart)
+		}
+		f, err := os.Open(localPartPath(dir, p.Number))
+		if err != nil {
+			return fmt.Errorf("%w: part %d is missing", ErrInvalidPart, p.Number)
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.Size() != p.Size {
+			return fmt.Errorf("%w: part %d size mismatch", ErrInvalidPart, p.Number)
+		}
+		readers = append(readers, f)
+	}
+	if _, err := s.Upload(ctx, manifest.Key, io.MultiReader(readers...), manifest.ContentType, WithVisibility(manifest.Visibility)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("remove multipart dir: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStore) AbortMultipart(ctx context.Context, key, uploadID string, opts ...ObjectOption) error {
+	_ = ctx
+	_ = opts
+	dir, _, err := s.multipartDir(key, uploadID)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("remove multipart dir: %w", err)
+	}
+	return nil
+}
+
+// PruneMultipart removes multipart uploads started before cutoff that were
+// never completed or aborted, such as those orphaned by a crash.
+func (s *LocalStore) PruneMultipart(cutoff time.Time) (int, error) {
+	base := filepath.Join(s.root, localMultipartDir)
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("list multipart uploads: %w", err)
+	}
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(base, entry.Name())); err != nil {
+			return removed, fmt.Errorf("remove multipart upload: %w", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (s *LocalStore) multipartDir(key, uploadID string) (string, localMultipartManifest, error) {
+	var manifest localMultipartManifest
+	if !localUploadIDChars.MatchString(uploadID) {
+		return "", manifest, ErrNotFound
+	}
+	dir := filepath.Join(s.root, localMultipartDir, uploadID)
+	raw, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", manifest, ErrNotFound
+		}
+		return "", manifest, fmt.Errorf("read multipart manifest: %w", err)
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return "", manifest, fmt.Errorf("decode multipart manifest: %w", err)
+	}
+	clean, err := cleanKey(key)
+	if err != nil || filepath.ToSlash(clean) != manifest.Key {
+		return "", manifest, ErrNotFound
+	}
+	return dir, manifest, nil
+}
+
+func localPartPath(dir string, number int) string {
+	return filepath.Join(dir, fmt.Sprintf("part-%05d", number))
+}
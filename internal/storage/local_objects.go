@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// localMeta is kept in a dot-prefixed sidecar next to each object, which
+// keys cannot address and listings skip.
+type localMeta struct {
+	ContentType string `json:"content_type"`
+	ETag        string `json:"etag"`
+}
+
+func localMetaPath(p string) string {
+	return filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".meta")
+}
+
+func writeLocalMeta(p string, meta localMeta) error {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("encode local storage metadata: %w", err)
+	}
+	if err := os.WriteFile(localMetaPath(p), raw, 0o644); err != nil {
+		return fmt.Errorf("write local storage metadata: %w", err)
+	}
+	return nil
+}
+
+// readLocalMeta returns the sidecar, or zero values for files written before
+// sidecars existed.
+func readLocalMeta(p string) localMeta {
+	var meta localMeta
+	raw, err := os.ReadFile(localMetaPath(p))
+	if err == nil {
+		_ = json.Unmarshal(raw, &meta)
+	}
+	return meta
+}
+
+func (s *LocalStore) Open(ctx context.Context, key string, opts ...ObjectOption) (*Object, error) {
+	_ = ctx
+	f, info, err := s.openFile(key, applyObjectOptions(opts).visibility)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{ReadCloser: f, ObjectInfo: info}, nil
+}
+
+func (s *LocalStore) Stat(ctx context.Context, key string, opts ...ObjectOption) (ObjectInfo, error) {
+	_ = ctx
+	p, err := s.objectPath(key, applyObjectOptions(opts).visibility)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil || fi.IsDir() {
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			return ObjectInfo{}, ErrNotFound
+		}
+		return ObjectInfo{}, fmt.Errorf("stat local storage file: %w", err)
+	}
+	return localObjectInfo(key, p, fi), nil
+}
+
+// List walks the whole tree and sorts it, which is fine for a development
+// driver but not meant for millions of files.
+func (s *LocalStore) List(ctx context.Context, prefix string, page ListOptions, opts ...ObjectOption) (ListPage, error) {
+	_ = ctx
+	base := s.root
+	if applyObjectOptions(opts).visibility == VisibilityPrivate {
+		base = filepath.Join(s.root, localPrivateDir)
+	}
+	prefix = strings.TrimPrefix(prefix, "/")
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if p == base {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) || key <= page.Cursor {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, localObjectInfo(key, p, fi))
+		return nil
+	})
+	if err != nil {
+		return ListPage{}, fmt.Errorf("list local storage: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	out := ListPage{Objects: objects}
+	if limit := page.limit(); len(objects) > limit {
+		out.Objects = objects[:limit]
+		out.NextCursor = objects[limit-1].Key
+	}
+	return out, nil
+}
+
+func (s *LocalStore) Copy(ctx context.Context, srcKey, dstKey string, opts ...ObjectOption) error {
+	visibility := applyObjectOptions(opts).visibility
+	srcPath, err := s.objectPath(srcKey, visibility)
+	if err != nil {
+		return err
+	}
+	dstPath, err := s.objectPath(dstKey, visibility)
+	if err != nil {
+		return err
+	}
+	if srcPath == dstPath {
+		return nil
+	}
+	f, info, err := s.openFile(srcKey, visibility)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = s.Upload(ctx, dstKey, f, info.ContentType, opts...)
+	return err
+}
+
+func (s *LocalStore) openFile(key string, visibility Visibility) (*os.File, ObjectInfo, error) {
+	p, err := s.objectPath(key, visibility)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ObjectInfo{}, ErrNotFound
+		}
+		return nil, ObjectInfo{}, fmt.Errorf("open local storage file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		f.Close()
+		if err != nil {
+			return nil, ObjectInfo{}, fmt.Errorf("stat local storage file: %w", err)
+		}
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	return f, localObjectInfo(key, p, fi), nil
+}
+
+func localObjectInfo(key, p string, fi fs.FileInfo) ObjectInfo {
+	meta := readLocalMeta(p)
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(p))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	etag := meta.ETag
+	if etag == "" {
+		etag = fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+	}
+	return ObjectInfo{
+		Key:          strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+key)), "/"),
+		Size:         fi.Size(),
+		ContentType:  contentType,
+		ETag:         etag,
+		LastModified: fi.ModTime(),
+	}
+}
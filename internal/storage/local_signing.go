@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// localPrivateDir holds private objects under the store root. cleanKey
+// rejects dot-prefixed segments, so no key can address it directly.
+const localPrivateDir = ".private"
+
+// LocalSignedUploadPath is where the API mounts the handler that accepts
+// signed PUTs for LocalStore, mirroring a presigned object storage URL.
+const LocalSignedUploadPath = "/api/uploads/local"
+
+var (
+	ErrSigningNotConfigured = errors.New("storage signing secret is not configured")
+	ErrInvalidSignature     = errors.New("invalid storage signature")
+	ErrSignatureExpired     = errors.New("storage signature expired")
+	ErrContentTypeMismatch  = errors.New("content type does not match signature")
+	ErrTooLarge             = errors.New("object exceeds signed size")
+	ErrTooSmall             = errors.New("object is shorter than signed size")
+	ErrSignedForOtherUser   = errors.New("signed url belongs to another user")
+)
+
+// EnableSigning turns on signed URLs for the local store. Without a secret
+// PresignUpload returns ErrSigningNotConfigured.
+func (s *LocalStore) EnableSigning(secret string) {
+	s.signingSecret = []byte(strings.TrimSpace(secret))
+}
+
+func (s *LocalStore) PresignUpload(ctx context.Context, key, contentType string, size int64, ttl time.Duration) (PresignedUpload, error) {
+	_ = ctx
+	if len(s.signingSecret) == 0 {
+		return PresignedUpload{}, ErrSigningNotConfigured
+	}
+	if _, err := s.pathForKey(key); err != nil {
+		return PresignedUpload{}, err
+	}
+	expiresAt := time.Now().Add(ttl)
+	q := url.Values{}
+	q.Set("content_type", contentType)
+	q.Set("size", strconv.FormatInt(size, 10))
+	q.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	q.Set("sig", s.sign("PUT", key, contentType, strconv.FormatInt(size, 10), q.Get("expires")))
+
+	u, _ := url.Parse(s.appURL)
+	u.Path = strings.TrimRight(u.Path, "/") + LocalSignedUploadPath + "/" + strings.TrimPrefix(key, "/")
+	u.RawQuery = q.Encode()
+	return PresignedUpload{
+		URL:       u.String(),
+		Method:    "PUT",
+		Headers:   map[string]string{"Content-Type": contentType},
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// ReceiveSignedUpload stores body under key if query carries a valid,
+// unexpired signature for it and the request matches the signed content
+// type. Bodies that are not exactly the signed size are rejected.
+func (s *LocalStore) ReceiveSignedUpload(ctx context.Context, key string, query url.Values, contentType string, body io.Reader) error {
+	if len(s.signingSecret) == 0 {
+		return ErrSigningNotConfigured
+	}
+	signedType := query.Get("content_type")
+	size := query.Get("size")
+	expires := query.Get("expires")
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(s.sign("PUT", key, signedType, size, expires))) {
+		return ErrInvalidSignature
+	}
+	if err := checkExpiry(expires, time.Now()); err != nil {
+		return err
+	}
+	if !sameMediaType(contentType, signedType) {
+		return ErrContentTypeMismatch
+	}
+	maxBytes, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || maxBytes < 0 {
+		return ErrInvalidSignature
+	}
+
+	// A body of the wrong size fails the read, so Upload never moves it
+	// into place.
+	limited := &limitedReader{r: body, remaining: maxBytes}
+	if _, err := s.Upload(ctx, key, limited, signedType); err != nil {
+		switch {
+		case errors.Is(err, ErrTooLarge):
+			return ErrTooLarge
+		case errors.Is(err, ErrTooSmall):
+			return ErrTooSmall
+		}
+		return err
+	}
+	return nil
+}
+
+// SignedURL returns a media URL for a private object that stays valid for
+// ttl. With ForOwner it is only served to that user's session.
+func (s *LocalStore) SignedURL(ctx context.Context, key string, ttl time.Duration, opts ...SignOption) (string, error) {
+	_ = ctx
+	if len(s.signingSecret) == 0 {
+		return "", ErrSigningNotConfigured
+	}
+	clean, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	key = filepath.ToSlash(clean)
+	owner := ""
+	if o := applySignOptions(opts); o.ownerID > 0 {
+		owner = strconv.FormatInt(o.ownerID, 10)
+	}
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	if owner != "" {
+		q.Set("owner", owner)
+	}
+	q.Set("sig", s.sign("GET", key, q.Get("expires"), owner))
+	return s.PublicURL(key) + "?" + q.Encode(), nil
+}
+
+// MediaHandler serves objects under the public path with the prefix
+// stripped. Plain requests get public objects; requests carrying a signature
+// from SignedURL get the private object. currentUserID returns the signed-in
+// user, or 0, for owner-bound URLs.
+func (s *LocalStore) MediaHandler(currentUserID func(*http.Request) int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		query := r.URL.Query()
+		if query.Get("sig") == "" {
+			s.serveObject(w, r, key, VisibilityPublic)
+			return
+		}
+
+		var userID int64
+		if currentUserID != nil {
+			userID = currentUserID(r)
+		}
+		if err := s.verifyDownload(key, query, userID); err != nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Cache-Control", "private, no-store")
+		s.serveObject(w, r, key, VisibilityPrivate)
+	})
+}
+
+// serveObject leaves Range, If-None-Match and If-Modified-Since handling to
+// http.ServeContent, using the stored content type and ETag.
+func (s *LocalStore) serveObject(w http.ResponseWriter, r *http.Request, key string, visibility Visibility) {
+	f, info, err := s.openFile(key, visibility)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("ETag", info.ETag)
+	http.ServeContent(w, r, "", info.LastModified, f)
+}
+
+func (s *LocalStore) verifyDownload(key string, query url.Values, userID int64) error {
+	if len(s.signingSecret) == 0 {
+		return ErrSigningNotConfigured
+	}
+	clean, err := cleanKey(key)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	expires := query.Get("expires")
+	owner := query.Get("owner")
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(s.sign("GET", filepath.ToSlash(clean), expires, owner))) {
+		return ErrInvalidSignature
+	}
+	if err := checkExpiry(expires, time.Now()); err != nil {
+		return err
+	}
+	if owner != "" && owner != strconv.FormatInt(userID, 10) {
+		return ErrSignedForOtherUser
+	}
+	return nil
+}
+
+func (s *LocalStore) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, s.signingSecret)
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func checkExpiry(expires string, now time.Time) error {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if now.After(time.Unix(unix, 0)) {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+func sameMediaType(a, b string) bool {
+	ma, _, errA := mime.ParseMediaType(a)
+	mb, _, errB := mime.ParseMediaType(b)
+	return errA == nil && errB == nil && strings.EqualFold(ma, mb)
+}
+
+// limitedReader fails the read, rather than truncating, once the body is
+// longer or shorter than remaining bytes.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, fmt.Errorf("read signed upload: %w", ErrTooLarge)
+	}
+	if errors.Is(err, io.EOF) && l.remaining > 0 {
+		return n, fmt.Errorf("read signed upload: %w", ErrTooSmall)
+	}
+	return n, err
+}
@@ -2,6 +2,9 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
@@ -9,20 +12,154 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/benpsk/go-starter/internal/r2"
 )
 
 type Store interface {
-	Upload(ctx context.Context, key string, body io.Reader, contentType string) (string, error)
+	// Upload stores body under key and returns its public URL, or "" for a
+	// private object.
+	Upload(ctx context.Context, key string, body io.Reader, contentType string, opts ...ObjectOption) (string, error)
+	// Open streams an object; the caller must close it.
+	Open(ctx context.Context, key string, opts ...ObjectOption) (*Object, error)
+	Stat(ctx context.Context, key string, opts ...ObjectOption) (ObjectInfo, error)
+	// List returns objects under prefix in key order, one page at a time.
+	List(ctx context.Context, prefix string, page ListOptions, opts ...ObjectOption) (ListPage, error)
+	// Copy duplicates srcKey to dstKey, keeping its content type.
+	Copy(ctx context.Context, srcKey, dstKey string, opts ...ObjectOption) error
+	// Delete removes key whatever its visibility.
 	Delete(ctx context.Context, key string) error
+	// Multipart uploads assemble one object from parts uploaded separately,
+	// numbered from 1. Every part but the last must be at least MinPartSize.
+	CreateMultipart(ctx context.Context, key, contentType string, opts ...ObjectOption) (string, error)
+	UploadPart(ctx context.Context, key, uploadID string, number int, body io.Reader, size int64, opts ...ObjectOption) (Part, error)
+	CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part, opts ...ObjectOption) error
+	AbortMultipart(ctx context.Context, key, uploadID string, opts ...ObjectOption) error
 	PublicURL(key string) string
+	// SignedURL returns a time-limited download URL for a private object.
+	SignedURL(ctx context.Context, key string, ttl time.Duration, opts ...SignOption) (string, error)
+	PresignUpload(ctx context.Context, key, contentType string, size int64, ttl time.Duration) (PresignedUpload, error)
+}
+
+type Visibility string
+
+const (
+	VisibilityPublic  Visibility = "public"
+	VisibilityPrivate Visibility = "private"
+)
+
+var (
+	ErrNotFound             = errors.New("storage object not found")
+	ErrPrivateNotConfigured = errors.New("private storage is not configured")
+)
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 1000
+)
+
+// MinPartSize is the S3 minimum for every multipart part except the last.
+const MinPartSize = 5 << 20
+
+type Part struct {
+	Number int
+	ETag   string
+	Size   int64
+}
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
+type Object struct {
+	io.ReadCloser
+	ObjectInfo
+}
+
+// ListOptions pages through List. Cursor is the NextCursor of the previous
+// page; Limit defaults to and is capped at 1000.
+type ListOptions struct {
+	Cursor string
+	Limit  int
+}
+
+type ListPage struct {
+	Objects    []ObjectInfo
+	NextCursor string
+}
+
+func (o ListOptions) limit() int {
+	if o.Limit <= 0 {
+		return defaultListLimit
+	}
+	return min(o.Limit, maxListLimit)
+}
+
+type ObjectOption func(*objectOptions)
+
+type objectOptions struct {
+	visibility Visibility
+}
+
+// WithVisibility selects public or private objects. Objects are public unless
+// told otherwise, and Upload only serves public ones at PublicURL.
+func WithVisibility(v Visibility) ObjectOption {
+	return func(o *objectOptions) { o.visibility = v }
+}
+
+// VisibilityOf reports the visibility opts select, for Store implementations
+// outside this package.
+func VisibilityOf(opts ...ObjectOption) Visibility {
+	return applyObjectOptions(opts).visibility
+}
+
+func applyObjectOptions(opts []ObjectOption) objectOptions {
+	o := objectOptions{visibility: VisibilityPublic}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+type SignOption func(*signOptions)
+
+type signOptions struct {
+	ownerID int64
+}
+
+// ForOwner binds a signed URL to a user. The local store only serves it to
+// that user's session; presigned R2 URLs cannot carry the check and ignore it.
+func ForOwner(userID int64) SignOption {
+	return func(o *signOptions) { o.ownerID = userID }
+}
+
+func applySignOptions(opts []SignOption) signOptions {
+	var o signOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// PresignedUpload describes a request the client sends directly to storage,
+// bypassing the app for the file body.
+type PresignedUpload struct {
+	URL       string
+	Method    string
+	Headers   map[string]string
+	ExpiresAt time.Time
 }
 
 type LocalStore struct {
-	root       string
-	appURL     string
-	publicPath string
+	root          string
+	appURL        string
+	publicPath    string
+	signingSecret []byte
 }
 
 func NewLocal(root, appURL, publicPath string) (*LocalStore, error) {
@@ -38,35 +175,61 @@ func NewLocal(root, appURL, publicPath string) (*LocalStore, error) {
 	return &LocalStore{root: root, appURL: appURL, publicPath: publicPath}, nil
 }
 
-func (s *LocalStore) Upload(ctx context.Context, key string, body io.Reader, contentType string) (string, error) {
+// Upload writes to a hidden temp file next to the object and renames it into
+// place, so readers never see a half-written object and a failed upload
+// leaves the previous one, if any, untouched.
+func (s *LocalStore) Upload(ctx context.Context, key string, body io.Reader, contentType string, opts ...ObjectOption) (string, error) {
 	_ = ctx
-	_ = contentType
-	dstPath, err := s.pathForKey(key)
+	o := applyObjectOptions(opts)
+	dstPath, err := s.objectPath(key, o.visibility)
 	if err != nil {
 		return "", err
 	}
 	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
 		return "", fmt.Errorf("create local storage subdir: %w", err)
 	}
-	dst, err := os.Create(dstPath)
+	tmp, err := os.CreateTemp(filepath.Dir(dstPath), ".upload-*.tmp")
 	if err != nil {
 		return "", fmt.Errorf("create local storage file: %w", err)
 	}
-	defer dst.Close()
-	if _, err := io.Copy(dst, body); err != nil {
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), body)
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
 		return "", fmt.Errorf("write local storage file: %w", err)
 	}
+	meta := localMeta{ContentType: contentType, ETag: `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`}
+	if err := writeLocalMeta(dstPath, meta); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), dstPath); err != nil {
+		return "", fmt.Errorf("store local storage file: %w", err)
+	}
+	if o.visibility == VisibilityPrivate {
+		return "", nil
+	}
 	return s.PublicURL(key), nil
 }
 
 func (s *LocalStore) Delete(ctx context.Context, key string) error {
 	_ = ctx
-	p, err := s.pathForKey(key)
-	if err != nil {
-		return err
-	}
-	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("delete local storage file: %w", err)
+	for _, pathForKey := range []func(string) (string, error){s.pathForKey, s.privatePathForKey} {
+		p, err := pathForKey(key)
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{p, localMetaPath(p)} {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("delete local storage file: %w", err)
+			}
+		}
 	}
 	return nil
 }
@@ -82,11 +245,43 @@ func (s *LocalStore) Dir() string {
 }
 
 func (s *LocalStore) pathForKey(key string) (string, error) {
+	clean, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, clean), nil
+}
+
+// privatePathForKey maps key into a directory under root that the media
+// handler never serves without a signature.
+func (s *LocalStore) privatePathForKey(key string) (string, error) {
+	clean, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, localPrivateDir, clean), nil
+}
+
+func (s *LocalStore) objectPath(key string, visibility Visibility) (string, error) {
+	if visibility == VisibilityPrivate {
+		return s.privatePathForKey(key)
+	}
+	return s.pathForKey(key)
+}
+
+// cleanKey rejects traversal and any dot-prefixed segment, which keeps keys
+// out of the private directory and away from hidden files.
+func cleanKey(key string) (string, error) {
 	clean := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(key, "/")))
-	if clean == "." || filepath.IsAbs(clean) || strings.HasPrefix(clean, ".."+string(filepath.Separator)) || clean == ".." {
+	if clean == "." || filepath.IsAbs(clean) {
 		return "", fmt.Errorf("invalid storage key")
 	}
-	return filepath.Join(s.root, clean), nil
+	for _, segment := range strings.Split(filepath.ToSlash(clean), "/") {
+		if strings.HasPrefix(segment, ".") {
+			return "", fmt.Errorf("invalid storage key")
+		}
+	}
+	return clean, nil
 }
 
 type R2Store struct {
@@ -97,14 +292,160 @@ func NewR2(client *r2.Client) *R2Store {
 	return &R2Store{client: client}
 }
 
-func (s *R2Store) Upload(ctx context.Context, key string, body io.Reader, contentType string) (string, error) {
+func (s *R2Store) Upload(ctx context.Context, key string, body io.Reader, contentType string, opts ...ObjectOption) (string, error) {
+	if applyObjectOptions(opts).visibility == VisibilityPrivate {
+		if !s.client.HasPrivateBucket() {
+			return "", ErrPrivateNotConfigured
+		}
+		return "", s.client.UploadPrivate(ctx, key, body, contentType)
+	}
 	return s.client.Upload(ctx, key, body, contentType)
 }
 
+func (s *R2Store) Open(ctx context.Context, key string, opts ...ObjectOption) (*Object, error) {
+	bucket, err := s.bucket(opts)
+	if err != nil {
+		return nil, err
+	}
+	body, info, err := s.client.Open(ctx, bucket, key)
+	if err != nil {
+		return nil, r2Error(err)
+	}
+	return &Object{ReadCloser: body, ObjectInfo: ObjectInfo(info)}, nil
+}
+
+func (s *R2Store) Stat(ctx context.Context, key string, opts ...ObjectOption) (ObjectInfo, error) {
+	bucket, err := s.bucket(opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := s.client.Stat(ctx, bucket, key)
+	if err != nil {
+		return ObjectInfo{}, r2Error(err)
+	}
+	return ObjectInfo(info), nil
+}
+
+func (s *R2Store) List(ctx context.Context, prefix string, page ListOptions, opts ...ObjectOption) (ListPage, error) {
+	bucket, err := s.bucket(opts)
+	if err != nil {
+		return ListPage{}, err
+	}
+	result, err := s.client.List(ctx, bucket, prefix, page.Cursor, int32(page.limit()))
+	if err != nil {
+		return ListPage{}, err
+	}
+	out := ListPage{Objects: make([]ObjectInfo, 0, len(result.Objects)), NextCursor: result.NextToken}
+	for _, obj := range result.Objects {
+		out.Objects = append(out.Objects, ObjectInfo(obj))
+	}
+	return out, nil
+}
+
+func (s *R2Store) Copy(ctx context.Context, srcKey, dstKey string, opts ...ObjectOption) error {
+	bucket, err := s.bucket(opts)
+	if err != nil {
+		return err
+	}
+	return r2Error(s.client.Copy(ctx, bucket, srcKey, dstKey))
+}
+
+func (s *R2Store) CreateMultipart(ctx context.Context, key, contentType string, opts ...ObjectOption) (string, error) {
+	bucket, err := s.bucket(opts)
+	if err != nil {
+		return "", err
+	}
+	return s.client.CreateMultipart(ctx, bucket, key, contentType)
+}
+
+func (s *R2Store) UploadPart(ctx context.Context, key, uploadID string, number int, body io.Reader, size int64, opts ...ObjectOption) (Part, error) {
+	bucket, err := s.bucket(opts)
+	if err != nil {
+		return Part{}, err
+	}
+	etag, err := s.client.UploadPart(ctx, bucket, key, uploadID, int32(number), body, size)
+	if err != nil {
+		return Part{}, err
+	}
+	return Part{Number: number, ETag: etag, Size: size}, nil
+}
+
+func (s *R2Store) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part, opts ...ObjectOption) error {
+	bucket, err := s.bucket(opts)
+	if err != nil {
+		return err
+	}
+	completed := make([]r2.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		completed = append(completed, r2.CompletedPart{Number: int32(p.Number), ETag: p.ETag})
+	}
+	return s.client.CompleteMultipart(ctx, bucket, key, uploadID, completed)
+}
+
+func (s *R2Store) AbortMultipart(ctx context.Context, key, uploadID string, opts ...ObjectOption) error {
+	bucket, err := s.bucket(opts)
+	if err != nil {
+		return err
+	}
+	return r2Error(s.client.AbortMultipart(ctx, bucket, key, uploadID))
+}
+
+func (s *R2Store) bucket(opts []ObjectOption) (r2.Bucket, error) {
+	if applyObjectOptions(opts).visibility != VisibilityPrivate {
+		return r2.PublicBucket, nil
+	}
+	if !s.client.HasPrivateBucket() {
+		return 0, ErrPrivateNotConfigured
+	}
+	return r2.PrivateBucket, nil
+}
+
+func r2Error(err error) error {
+	if errors.Is(err, r2.ErrNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
 func (s *R2Store) Delete(ctx context.Context, key string) error {
-	return s.client.Delete(ctx, key)
+	if err := s.client.Delete(ctx, key); err != nil {
+		return err
+	}
+	if s.client.HasPrivateBucket() {
+		return s.client.DeletePrivate(ctx, key)
+	}
+	return nil
+}
+
+func (s *R2Store) SignedURL(ctx context.Context, key string, ttl time.Duration, opts ...SignOption) (string, error) {
+	_ = opts
+	if !s.client.HasPrivateBucket() {
+		return "", ErrPrivateNotConfigured
+	}
+	req, err := s.client.PresignGet(ctx, key, ttl)
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
 }
 
 func (s *R2Store) PublicURL(key string) string {
 	return s.client.GetPublicURL(key)
 }
+
+func (s *R2Store) PresignUpload(ctx context.Context, key, contentType string, size int64, ttl time.Duration) (PresignedUpload, error) {
+	req, err := s.client.PresignPut(ctx, key, contentType, size, ttl)
+	if err != nil {
+		return PresignedUpload{}, err
+	}
+	headers := make(map[string]string, len(req.Headers))
+	for name := range req.Headers {
+		headers[name] = req.Headers.Get(name)
+	}
+	return PresignedUpload{
+		URL:       req.URL,
+		Method:    req.Method,
+		Headers:   headers,
+		ExpiresAt: req.ExpiresAt,
+	}, nil
+}
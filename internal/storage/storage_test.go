@@ -2,10 +2,19 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/r2/r2test"
 )
 
 func TestLocalStoreUploadDeleteAndPublicURL(t *testing.T) {
@@ -39,6 +48,36 @@ func TestLocalStoreUploadDeleteAndPublicURL(t *testing.T) {
 	}
 }
 
+func TestLocalStoreFailedUploadKeepsPreviousObject(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewLocal(root, "http://localhost:8080", "/media")
+	if err != nil {
+		t.Fatalf("new local store: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := store.Upload(ctx, "uploads/1/test.txt", strings.NewReader("hello"), "text/plain"); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	interrupted := io.MultiReader(strings.NewReader("half"), iotest.ErrReader(errors.New("connection reset")))
+	if _, err := store.Upload(ctx, "uploads/1/test.txt", interrupted, "text/plain"); err == nil {
+		t.Fatal("expected the interrupted upload to fail")
+	}
+	got, err := os.ReadFile(filepath.Join(root, "uploads", "1", "test.txt"))
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("expected the previous object to stay, got %q err=%v", got, err)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "uploads", "1"))
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	for _, e := range entries {
+		if e.Name() != "test.txt" && e.Name() != ".test.txt.meta" {
+			t.Fatalf("unexpected file left behind: %s", e.Name())
+		}
+	}
+}
+
 func TestLocalStoreRejectsTraversalKeys(t *testing.T) {
 	store, err := NewLocal(t.TempDir(), "http://localhost:8080", "/media")
 	if err != nil {
@@ -48,3 +87,396 @@ func TestLocalStoreRejectsTraversalKeys(t *testing.T) {
 		t.Fatal("expected traversal key upload to fail")
 	}
 }
+
+func TestLocalStoreSignedUpload(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocal(t.TempDir(), "http://localhost:8080", "/media")
+	if err != nil {
+		t.Fatalf("new local store: %v", err)
+	}
+	if _, err := store.PresignUpload(ctx, "uploads/1/a.png", "image/png", 5, time.Minute); !errors.Is(err, ErrSigningNotConfigured) {
+		t.Fatalf("expected ErrSigningNotConfigured, got %v", err)
+	}
+	store.EnableSigning("secret")
+
+	signedQuery := func(t *testing.T, key string, size int64, ttl time.Duration) url.Values {
+		t.Helper()
+		presigned, err := store.PresignUpload(ctx, key, "image/png", size, ttl)
+		if err != nil {
+			t.Fatalf("presign: %v", err)
+		}
+		u, err := url.Parse(presigned.URL)
+		if err != nil {
+			t.Fatalf("parse presigned url: %v", err)
+		}
+		if u.Path != LocalSignedUploadPath+"/"+key {
+			t.Fatalf("unexpected presigned path: %q", u.Path)
+		}
+		return u.Query()
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		q := signedQuery(t, "uploads/1/a.png", 5, time.Minute)
+		if err := store.ReceiveSignedUpload(ctx, "uploads/1/a.png", q, "image/png", strings.NewReader("hello")); err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(store.root, "uploads", "1", "a.png"))
+		if err != nil || string(got) != "hello" {
+			t.Fatalf("unexpected stored file: %q err=%v", got, err)
+		}
+	})
+
+	t.Run("tampered key", func(t *testing.T) {
+		q := signedQuery(t, "uploads/1/b.png", 5, time.Minute)
+		err := store.ReceiveSignedUpload(ctx, "uploads/2/b.png", q, "image/png", strings.NewReader("hello"))
+		if !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("expected ErrInvalidSignature, got %v", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		q := signedQuery(t, "uploads/1/c.png", 5, -time.Minute)
+		err := store.ReceiveSignedUpload(ctx, "uploads/1/c.png", q, "image/png", strings.NewReader("hello"))
+		if !errors.Is(err, ErrSignatureExpired) {
+			t.Fatalf("expected ErrSignatureExpired, got %v", err)
+		}
+	})
+
+	t.Run("content type mismatch", func(t *testing.T) {
+		q := signedQuery(t, "uploads/1/d.png", 5, time.Minute)
+		err := store.ReceiveSignedUpload(ctx, "uploads/1/d.png", q, "text/html", strings.NewReader("hello"))
+		if !errors.Is(err, ErrContentTypeMismatch) {
+			t.Fatalf("expected ErrContentTypeMismatch, got %v", err)
+		}
+	})
+
+	t.Run("oversize", func(t *testing.T) {
+		q := signedQuery(t, "uploads/1/e.png", 3, time.Minute)
+		err := store.ReceiveSignedUpload(ctx, "uploads/1/e.png", q, "image/png", strings.NewReader("hello"))
+		if !errors.Is(err, ErrTooLarge) {
+			t.Fatalf("expected ErrTooLarge, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(store.root, "uploads", "1", "e.png")); !os.IsNotExist(err) {
+			t.Fatalf("expected oversize upload removed, stat err=%v", err)
+		}
+	})
+
+	t.Run("short body", func(t *testing.T) {
+		q := signedQuery(t, "uploads/1/f.png", 10, time.Minute)
+		err := store.ReceiveSignedUpload(ctx, "uploads/1/f.png", q, "image/png", strings.NewReader("hello"))
+		if !errors.Is(err, ErrTooSmall) {
+			t.Fatalf("expected ErrTooSmall, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(store.root, "uploads", "1", "f.png")); !os.IsNotExist(err) {
+			t.Fatalf("expected short upload removed, stat err=%v", err)
+		}
+	})
+}
+
+func TestLocalStorePrivateObjectsRequireSignedURL(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocal(t.TempDir(), "http://localhost:8080", "/media")
+	if err != nil {
+		t.Fatalf("new local store: %v", err)
+	}
+	store.EnableSigning("secret")
+
+	publicURL, err := store.Upload(ctx, "invoices/7/inv.txt", strings.NewReader("invoice"), "text/plain", WithVisibility(VisibilityPrivate))
+	if err != nil {
+		t.Fatalf("upload private: %v", err)
+	}
+	if publicURL != "" {
+		t.Fatalf("expected no public url for private object, got %q", publicURL)
+	}
+
+	signedInAs := int64(0)
+	handler := http.StripPrefix("/media/", store.MediaHandler(func(*http.Request) int64 { return signedInAs }))
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	pathAndQuery := func(raw string) string {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatalf("parse url: %v", err)
+		}
+		return u.RequestURI()
+	}
+
+	if rec := get("/media/invoices/7/inv.txt"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected private object hidden from public path, got %d", rec.Code)
+	}
+	if rec := get("/media/.private/invoices/7/inv.txt"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected private dir unreachable, got %d", rec.Code)
+	}
+
+	signed, err := store.SignedURL(ctx, "invoices/7/inv.txt", time.Minute)
+	if err != nil {
+		t.Fatalf("signed url: %v", err)
+	}
+	rec := get(pathAndQuery(signed))
+	if rec.Code != http.StatusOK || rec.Body.String() != "invoice" {
+		t.Fatalf("expected signed download, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Cache-Control") != "private, no-store" {
+		t.Fatalf("unexpected cache-control: %q", rec.Header().Get("Cache-Control"))
+	}
+
+	expired, err := store.SignedURL(ctx, "invoices/7/inv.txt", -time.Minute)
+	if err != nil {
+		t.Fatalf("signed url: %v", err)
+	}
+	if rec := get(pathAndQuery(expired)); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected expired url rejected, got %d", rec.Code)
+	}
+	if rec := get(strings.Replace(pathAndQuery(signed), "inv.txt", "other.txt", 1)); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected tampered url rejected, got %d", rec.Code)
+	}
+
+	owned, err := store.SignedURL(ctx, "invoices/7/inv.txt", time.Minute, ForOwner(7))
+	if err != nil {
+		t.Fatalf("signed url: %v", err)
+	}
+	signedInAs = 8
+	if rec := get(pathAndQuery(owned)); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected other user rejected, got %d", rec.Code)
+	}
+	signedInAs = 7
+	if rec := get(pathAndQuery(owned)); rec.Code != http.StatusOK {
+		t.Fatalf("expected owner allowed, got %d", rec.Code)
+	}
+
+	if err := store.Delete(ctx, "invoices/7/inv.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if rec := get(pathAndQuery(signed)); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected deleted private object gone, got %d", rec.Code)
+	}
+}
+
+func TestLocalStoreOpenStatListCopy(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocal(t.TempDir(), "http://localhost:8080", "/media")
+	if err != nil {
+		t.Fatalf("new local store: %v", err)
+	}
+	for _, key := range []string{"docs/b.txt", "docs/a.txt", "docs/sub/c.txt", "docs-other/d.txt"} {
+		if _, err := store.Upload(ctx, key, strings.NewReader("body of "+key), "text/plain; charset=utf-8"); err != nil {
+			t.Fatalf("upload %s: %v", key, err)
+		}
+	}
+
+	obj, err := store.Open(ctx, "docs/a.txt")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	body, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil || string(body) != "body of docs/a.txt" {
+		t.Fatalf("unexpected body %q err=%v", body, err)
+	}
+	if obj.ContentType != "text/plain; charset=utf-8" || obj.Size != int64(len(body)) || obj.ETag == "" {
+		t.Fatalf("unexpected object info: %+v", obj.ObjectInfo)
+	}
+
+	if _, err := store.Stat(ctx, "docs/missing.txt"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.Open(ctx, "docs/a.txt", WithVisibility(VisibilityPrivate)); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected public object invisible as private, got %v", err)
+	}
+
+	var keys []string
+	cursor := ""
+	for {
+		page, err := store.List(ctx, "docs/", ListOptions{Cursor: cursor, Limit: 2})
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		for _, o := range page.Objects {
+			keys = append(keys, o.Key)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if strings.Join(keys, ",") != "docs/a.txt,docs/b.txt,docs/sub/c.txt" {
+		t.Fatalf("unexpected listing: %v", keys)
+	}
+
+	if err := store.Copy(ctx, "docs/a.txt", "copies/a.txt"); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	copied, err := store.Stat(ctx, "copies/a.txt")
+	if err != nil {
+		t.Fatalf("stat copy: %v", err)
+	}
+	if copied.ContentType != obj.ContentType || copied.ETag != obj.ETag {
+		t.Fatalf("copy lost metadata: %+v", copied)
+	}
+	if err := store.Copy(ctx, "docs/missing.txt", "copies/missing.txt"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound copying missing object, got %v", err)
+	}
+}
+
+func TestLocalMediaHandlerSupportsRangesAndConditionalGets(t *testing.T) {
+	store, err := NewLocal(t.TempDir(), "http://localhost:8080", "/media")
+	if err != nil {
+		t.Fatalf("new local store: %v", err)
+	}
+	if _, err := store.Upload(context.Background(), "clips/a.bin", strings.NewReader("0123456789"), "video/mp4"); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	handler := http.StripPrefix("/media/", store.MediaHandler(nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/media/clips/a.bin", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" {
+		t.Fatalf("unexpected range response: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != "video/mp4" {
+		t.Fatalf("unexpected content type: %q", rec.Header().Get("Content-Type"))
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected etag")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/media/clips/a.bin", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching etag, got %d", rec.Code)
+	}
+}
+
+func TestLocalStoreMultipartUpload(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocal(t.TempDir(), "http://localhost:8080", "/media")
+	if err != nil {
+		t.Fatalf("new local store: %v", err)
+	}
+
+	uploadID, err := store.CreateMultipart(ctx, "big/file.bin", "application/octet-stream")
+	if err != nil {
+		t.Fatalf("create multipart: %v", err)
+	}
+	p2, err := store.UploadPart(ctx, "big/file.bin", uploadID, 2, strings.NewReader("world"), 5)
+	if err != nil {
+		t.Fatalf("upload part 2: %v", err)
+	}
+	if _, err := store.UploadPart(ctx, "big/file.bin", uploadID, 1, strings.NewReader("stale"), 5); err != nil {
+		t.Fatalf("upload part 1: %v", err)
+	}
+	// Retrying a part replaces the earlier attempt.
+	p1, err := store.UploadPart(ctx, "big/file.bin", uploadID, 1, strings.NewReader("hello "), 6)
+	if err != nil {
+		t.Fatalf("retry part 1: %v", err)
+	}
+	if _, err := store.UploadPart(ctx, "big/file.bin", uploadID, 3, strings.NewReader("short"), 10); !errors.Is(err, ErrInvalidPart) {
+		t.Fatalf("expected ErrInvalidPart for size mismatch, got %v", err)
+	}
+	if _, err := store.UploadPart(ctx, "other/key.bin", uploadID, 1, strings.NewReader("x"), 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for mismatched key, got %v", err)
+	}
+
+	if err := store.CompleteMultipart(ctx, "big/file.bin", uploadID, []Part{p1, p2}); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	obj, err := store.Open(ctx, "big/file.bin")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	body, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(body) != "hello world" {
+		t.Fatalf("unexpected assembled body %q", body)
+	}
+	if _, err := store.UploadPart(ctx, "big/file.bin", uploadID, 1, strings.NewReader("x"), 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected completed upload to be gone, got %v", err)
+	}
+
+	aborted, err := store.CreateMultipart(ctx, "big/aborted.bin", "application/octet-stream")
+	if err != nil {
+		t.Fatalf("create multipart: %v", err)
+	}
+	if err := store.AbortMultipart(ctx, "big/aborted.bin", aborted); err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+	if err := store.AbortMultipart(ctx, "big/aborted.bin", aborted); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound aborting twice, got %v", err)
+	}
+
+	if _, err := store.CreateMultipart(ctx, "big/stale.bin", "application/octet-stream"); err != nil {
+		t.Fatalf("create multipart: %v", err)
+	}
+	removed, err := store.PruneMultipart(time.Now().Add(time.Minute))
+	if err != nil || removed != 1 {
+		t.Fatalf("prune: removed=%d err=%v", removed, err)
+	}
+}
+
+func TestR2StoreAgainstFakeS3(t *testing.T) {
+	t.Parallel()
+
+	srv := r2test.NewServer(t)
+	srv.MinPartSize = 3
+	store := NewR2(srv.Client(t))
+	ctx := context.Background()
+
+	url, err := store.Upload(ctx, "docs/a.txt", strings.NewReader("hello"), "text/plain")
+	if err != nil || url != r2test.PublicBaseURL+"/docs/a.txt" {
+		t.Fatalf("unexpected upload result %q err=%v", url, err)
+	}
+	if _, err := store.Upload(ctx, "docs/secret.txt", strings.NewReader("shh"), "text/plain", WithVisibility(VisibilityPrivate)); err != nil {
+		t.Fatalf("private upload: %v", err)
+	}
+	if _, ok := srv.Object(r2test.PrivateBucket, "docs/secret.txt"); !ok {
+		t.Fatal("private object should land in the private bucket")
+	}
+
+	if err := store.Copy(ctx, "docs/a.txt", "docs/b.txt"); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	page, err := store.List(ctx, "docs/", ListOptions{})
+	if err != nil || len(page.Objects) != 2 {
+		t.Fatalf("unexpected list %+v err=%v", page, err)
+	}
+
+	id, err := store.CreateMultipart(ctx, "big.bin", "application/octet-stream")
+	if err != nil {
+		t.Fatalf("create multipart: %v", err)
+	}
+	first, err := store.UploadPart(ctx, "big.bin", id, 1, strings.NewReader("abc"), 3)
+	if err != nil {
+		t.Fatalf("upload part: %v", err)
+	}
+	second, err := store.UploadPart(ctx, "big.bin", id, 2, strings.NewReader("d"), 1)
+	if err != nil {
+		t.Fatalf("upload part: %v", err)
+	}
+	if err := store.CompleteMultipart(ctx, "big.bin", id, []Part{first, second}); err != nil {
+		t.Fatalf("complete multipart: %v", err)
+	}
+	obj, err := store.Open(ctx, "big.bin")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	data, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(data) != "abcd" {
+		t.Fatalf("unexpected assembled object %q", data)
+	}
+
+	if err := store.Delete(ctx, "docs/secret.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.Stat(ctx, "docs/secret.txt", WithVisibility(VisibilityPrivate)); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+}
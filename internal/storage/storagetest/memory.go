@@ -0,0 +1,410 @@
+// Package storagetest provides an in-memory storage.Store for tests, with
+// injectable latency and failures and a record of every call.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing/fstest"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/storage"
+)
+
+// Call is one recorded Store method invocation.
+type Call struct {
+	Method string
+	Key    string
+}
+
+type memoryObject struct {
+	data        []byte
+	contentType string
+	etag        string
+	modified    time.Time
+}
+
+type memoryUpload struct {
+	key         string
+	contentType string
+	visibility  storage.Visibility
+	parts       map[int][]byte
+}
+
+type fault struct {
+	method string
+	nth    int
+	err    error
+}
+
+// MemoryStore keeps objects in maps keyed by visibility, mirroring LocalStore
+// semantics: Upload returns "" for private objects, Delete removes a key from
+// both visibilities and missing objects report storage.ErrNotFound.
+type MemoryStore struct {
+	baseURL string
+
+	mu      sync.Mutex
+	objects map[storage.Visibility]map[string]memoryObject
+	uploads map[string]*memoryUpload
+	seq     int
+	calls   []Call
+	counts  map[string]int
+	latency time.Duration
+	faults  []fault
+}
+
+var _ storage.Store = (*MemoryStore)(nil)
+
+// NewMemory returns an empty store whose public URLs start with baseURL.
+func NewMemory(baseURL string) *MemoryStore {
+	return &MemoryStore{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		objects: map[storage.Visibility]map[string]memoryObject{
+			storage.VisibilityPublic:  {},
+			storage.VisibilityPrivate: {},
+		},
+		uploads: map[string]*memoryUpload{},
+		counts:  map[string]int{},
+	}
+}
+
+// SetLatency delays every context-taking call by d, or until the context is
+// done.
+func (m *MemoryStore) SetLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency = d
+}
+
+// FailOn makes the nth call (counting from 1) to method return err. With
+// nth 0 every call to method fails until ClearFailures.
+func (m *MemoryStore) FailOn(method string, nth int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.faults = append(m.faults, fault{method: method, nth: nth, err: err})
+}
+
+// ClearFailures drops every fault added by FailOn.
+func (m *MemoryStore) ClearFailures() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.faults = nil
+}
+
+// Calls returns every call in the order it was made, failed ones included.
+func (m *MemoryStore) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// CallCount reports how many times method was called.
+func (m *MemoryStore) CallCount(method string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[method]
+}
+
+// Bytes returns an object's content, or false when it does not exist.
+func (m *MemoryStore) Bytes(key string, visibility storage.Visibility) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[visibility][cleanKey(key)]
+	return bytes.Clone(obj.data), ok
+}
+
+// FS returns a snapshot of the objects with the given visibility as a file
+// system, so tests can use fs.WalkDir, fs.ReadFile or fstest.TestFS on it.
+func (m *MemoryStore) FS(visibility storage.Visibility) fs.FS {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := fstest.MapFS{}
+	for key, obj := range m.objects[visibility] {
+		out[key] = &fstest.MapFile{Data: bytes.Clone(obj.data), Mode: 0o644, ModTime: obj.modified}
+	}
+	return out
+}
+
+// begin records the call, applies latency and returns any injected failure.
+func (m *MemoryStore) begin(ctx context.Context, method, key string) error {
+	m.mu.Lock()
+	m.calls = append(m.calls, Call{Method: method, Key: key})
+	m.counts[method]++
+	n := m.counts[method]
+	latency := m.latency
+	var err error
+	for _, f := range m.faults {
+		if f.method == method && (f.nth == 0 || f.nth == n) {
+			err = f.err
+			break
+		}
+	}
+	m.mu.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return err
+}
+
+func (m *MemoryStore) Upload(ctx context.Context, key string, body io.Reader, contentType string, opts ...storage.ObjectOption) (string, error) {
+	if err := m.begin(ctx, "Upload", key); err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("read upload body: %w", err)
+	}
+	visibility := storage.VisibilityOf(opts...)
+	m.mu.Lock()
+	m.objects[visibility][cleanKey(key)] = newObject(data, contentType)
+	m.mu.Unlock()
+	if visibility == storage.VisibilityPrivate {
+		return "", nil
+	}
+	return m.PublicURL(key), nil
+}
+
+func (m *MemoryStore) Open(ctx context.Context, key string, opts ...storage.ObjectOption) (*storage.Object, error) {
+	if err := m.begin(ctx, "Open", key); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[storage.VisibilityOf(opts...)][cleanKey(key)]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &storage.Object{
+		ReadCloser: io.NopCloser(bytes.NewReader(obj.data)),
+		ObjectInfo: obj.info(cleanKey(key)),
+	}, nil
+}
+
+func (m *MemoryStore) Stat(ctx context.Context, key string, opts ...storage.ObjectOption) (storage.ObjectInfo, error) {
+	if err := m.begin(ctx, "Stat", key); err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[storage.VisibilityOf(opts...)][cleanKey(key)]
+	if !ok {
+		return storage.ObjectInfo{}, storage.ErrNotFound
+	}
+	return obj.info(cleanKey(key)), nil
+}
+
+func (m *MemoryStore) List(ctx context.Context, prefix string, page storage.ListOptions, opts ...storage.ObjectOption) (storage.ListPage, error) {
+	if err := m.begin(ctx, "List", prefix); err != nil {
+		return storage.ListPage{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix = strings.TrimPrefix(prefix, "/")
+	objects := m.objects[storage.VisibilityOf(opts...)]
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > page.Cursor {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	limit := page.Limit
+	if limit <= 0 || limit > 1000 {
+		limit = 1000
+	}
+	var out storage.ListPage
+	if len(keys) > limit {
+		keys = keys[:limit]
+		out.NextCursor = keys[limit-1]
+	}
+	for _, key := range keys {
+		out.Objects = append(out.Objects, objects[key].info(key))
+	}
+	return out, nil
+}
+
+func (m *MemoryStore) Copy(ctx context.Context, srcKey, dstKey string, opts ...storage.ObjectOption) error {
+	if err := m.begin(ctx, "Copy", srcKey); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	objects := m.objects[storage.VisibilityOf(opts...)]
+	src, ok := objects[cleanKey(srcKey)]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	objects[cleanKey(dstKey)] = newObject(bytes.Clone(src.data), src.contentType)
+	return nil
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, key string) error {
+	if err := m.begin(ctx, "Delete", key); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, objects := range m.objects {
+		delete(objects, cleanKey(key))
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateMultipart(ctx context.Context, key, contentType string, opts ...storage.ObjectOption) (string, error) {
+	if err := m.begin(ctx, "CreateMultipart", key); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	id := "memory-upload-" + strconv.Itoa(m.seq)
+	m.uploads[id] = &memoryUpload{key: cleanKey(key), contentType: contentType, visibility: storage.VisibilityOf(opts...), parts: map[int][]byte{}}
+	return id, nil
+}
+
+func (m *MemoryStore) UploadPart(ctx context.Context, key, uploadID string, number int, body io.Reader, size int64, opts ...storage.ObjectOption) (storage.Part, error) {
+	if err := m.begin(ctx, "UploadPart", key); err != nil {
+		return storage.Part{}, err
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return storage.Part{}, fmt.Errorf("read part body: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	up, ok := m.uploads[uploadID]
+	if !ok || up.key != cleanKey(key) {
+		return storage.Part{}, storage.ErrNotFound
+	}
+	if number < 1 || (size >= 0 && int64(len(data)) != size) {
+		return storage.Part{}, storage.ErrInvalidPart
+	}
+	up.parts[number] = data
+	return storage.Part{Number: number, ETag: etagOf(data), Size: int64(len(data))}, nil
+}
+
+func (m *MemoryStore) CompleteMultipart(ctx context.Context, key, uploadID string, parts []storage.Part, opts ...storage.ObjectOption) error {
+	if err := m.begin(ctx, "CompleteMultipart", key); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	up, ok := m.uploads[uploadID]
+	if !ok || up.key != cleanKey(key) {
+		return storage.ErrNotFound
+	}
+	if len(parts) == 0 {
+		return storage.ErrInvalidPart
+	}
+	var data []byte
+	for i, p := range parts {
+		part, ok := up.parts[p.Number]
+		if p.Number != i+1 || !ok || int64(len(part)) != p.Size || etagOf(part) != p.ETag {
+			return fmt.Errorf("%w: part %d", storage.ErrInvalidPart, p.Number)
+		}
+		data = append(data, part...)
+	}
+	m.objects[up.visibility][up.key] = newObject(data, up.contentType)
+	delete(m.uploads, uploadID)
+	return nil
+}
+
+func (m *MemoryStore) AbortMultipart(ctx context.Context, key, uploadID string, opts ...storage.ObjectOption) error {
+	if err := m.begin(ctx, "AbortMultipart", key); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	up, ok := m.uploads[uploadID]
+	if !ok || up.key != cleanKey(key) {
+		return storage.ErrNotFound
+	}
+	delete(m.uploads, uploadID)
+	return nil
+}
+
+// PendingUploads counts multipart uploads neither completed nor aborted.
+func (m *MemoryStore) PendingUploads() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.uploads)
+}
+
+func (m *MemoryStore) PublicURL(key string) string {
+	return m.baseURL + "/" + cleanKey(key)
+}
+
+// SignedURL returns a URL that only encodes its inputs; nothing serves it.
+func (m *MemoryStore) SignedURL(ctx context.Context, key string, ttl time.Duration, opts ...storage.SignOption) (string, error) {
+	if err := m.begin(ctx, "SignedURL", key); err != nil {
+		return "", err
+	}
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	return m.baseURL + "/private/" + cleanKey(key) + "?" + q.Encode(), nil
+}
+
+// PresignUpload describes a PUT to baseURL; tests that need the body stored
+// should call Upload themselves.
+func (m *MemoryStore) PresignUpload(ctx context.Context, key, contentType string, size int64, ttl time.Duration) (storage.PresignedUpload, error) {
+	if err := m.begin(ctx, "PresignUpload", key); err != nil {
+		return storage.PresignedUpload{}, err
+	}
+	expiresAt := time.Now().Add(ttl)
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	return storage.PresignedUpload{
+		URL:    m.baseURL + "/upload/" + cleanKey(key) + "?" + q.Encode(),
+		Method: "PUT",
+		Headers: map[string]string{
+			"Content-Type":   contentType,
+			"Content-Length": strconv.FormatInt(size, 10),
+		},
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (o memoryObject) info(key string) storage.ObjectInfo {
+	return storage.ObjectInfo{
+		Key:          key,
+		Size:         int64(len(o.data)),
+		ContentType:  o.contentType,
+		ETag:         o.etag,
+		LastModified: o.modified,
+	}
+}
+
+func newObject(data []byte, contentType string) memoryObject {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return memoryObject{data: data, contentType: contentType, etag: etagOf(data), modified: time.Now()}
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func cleanKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
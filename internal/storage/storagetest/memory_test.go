@@ -0,0 +1,148 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/storage"
+)
+
+func TestMemoryStoreObjects(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemory("https://cdn.example.test/")
+	ctx := context.Background()
+
+	url, err := store.Upload(ctx, "/docs/a.txt", strings.NewReader("hello"), "text/plain")
+	if err != nil || url != "https://cdn.example.test/docs/a.txt" {
+		t.Fatalf("unexpected upload result %q err=%v", url, err)
+	}
+	if url, err := store.Upload(ctx, "docs/secret.txt", strings.NewReader("shh"), "text/plain", storage.WithVisibility(storage.VisibilityPrivate)); err != nil || url != "" {
+		t.Fatalf("unexpected private upload result %q err=%v", url, err)
+	}
+	if _, err := store.Stat(ctx, "docs/secret.txt"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("private object should not be visible publicly, got %v", err)
+	}
+	if err := store.Copy(ctx, "docs/a.txt", "docs/b.txt"); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+
+	obj, err := store.Open(ctx, "docs/b.txt")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	data, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(data) != "hello" || obj.ContentType != "text/plain" {
+		t.Fatalf("unexpected copied object %q (%s)", data, obj.ContentType)
+	}
+
+	page, err := store.List(ctx, "docs/", storage.ListOptions{Limit: 1})
+	if err != nil || len(page.Objects) != 1 || page.NextCursor != "docs/a.txt" {
+		t.Fatalf("unexpected first page %+v err=%v", page, err)
+	}
+	page, err = store.List(ctx, "docs/", storage.ListOptions{Cursor: page.NextCursor, Limit: 1})
+	if err != nil || len(page.Objects) != 1 || page.Objects[0].Key != "docs/b.txt" || page.NextCursor != "" {
+		t.Fatalf("unexpected second page %+v err=%v", page, err)
+	}
+
+	if err := fstest.TestFS(store.FS(storage.VisibilityPublic), "docs/a.txt", "docs/b.txt"); err != nil {
+		t.Fatalf("public fs: %v", err)
+	}
+	if got, err := fs.ReadFile(store.FS(storage.VisibilityPrivate), "docs/secret.txt"); err != nil || string(got) != "shh" {
+		t.Fatalf("unexpected private fs content %q err=%v", got, err)
+	}
+
+	if err := store.Delete(ctx, "docs/secret.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, ok := store.Bytes("docs/secret.txt", storage.VisibilityPrivate); ok {
+		t.Fatal("expected delete to remove the private object")
+	}
+}
+
+func TestMemoryStoreMultipart(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemory("https://cdn.example.test")
+	ctx := context.Background()
+
+	id, err := store.CreateMultipart(ctx, "big.bin", "application/octet-stream")
+	if err != nil {
+		t.Fatalf("create multipart: %v", err)
+	}
+	var parts []storage.Part
+	for i, chunk := range []string{"abc", "de"} {
+		part, err := store.UploadPart(ctx, "big.bin", id, i+1, strings.NewReader(chunk), int64(len(chunk)))
+		if err != nil {
+			t.Fatalf("upload part: %v", err)
+		}
+		parts = append(parts, part)
+	}
+	if err := store.CompleteMultipart(ctx, "big.bin", id, []storage.Part{parts[1]}); !errors.Is(err, storage.ErrInvalidPart) {
+		t.Fatalf("expected ErrInvalidPart for out-of-order parts, got %v", err)
+	}
+	if err := store.CompleteMultipart(ctx, "big.bin", id, parts); err != nil {
+		t.Fatalf("complete multipart: %v", err)
+	}
+	if data, _ := store.Bytes("big.bin", storage.VisibilityPublic); string(data) != "abcde" {
+		t.Fatalf("unexpected assembled object %q", data)
+	}
+	if err := store.AbortMultipart(ctx, "big.bin", id); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for completed upload, got %v", err)
+	}
+	if store.PendingUploads() != 0 {
+		t.Fatalf("expected no pending uploads, got %d", store.PendingUploads())
+	}
+}
+
+func TestMemoryStoreFailuresAndCalls(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemory("https://cdn.example.test")
+	ctx := context.Background()
+	boom := errors.New("boom")
+	store.FailOn("Upload", 2, boom)
+
+	if _, err := store.Upload(ctx, "a", strings.NewReader("1"), "text/plain"); err != nil {
+		t.Fatalf("first upload: %v", err)
+	}
+	if _, err := store.Upload(ctx, "b", strings.NewReader("2"), "text/plain"); !errors.Is(err, boom) {
+		t.Fatalf("expected injected failure on second upload, got %v", err)
+	}
+	if _, ok := store.Bytes("b", storage.VisibilityPublic); ok {
+		t.Fatal("failed upload should not store the object")
+	}
+	if _, err := store.Upload(ctx, "c", strings.NewReader("3"), "text/plain"); err != nil {
+		t.Fatalf("third upload: %v", err)
+	}
+
+	store.FailOn("Delete", 0, boom)
+	for range 2 {
+		if err := store.Delete(ctx, "a"); !errors.Is(err, boom) {
+			t.Fatalf("expected every delete to fail, got %v", err)
+		}
+	}
+	store.ClearFailures()
+	if err := store.Delete(ctx, "a"); err != nil {
+		t.Fatalf("delete after clearing failures: %v", err)
+	}
+
+	calls := store.Calls()
+	if len(calls) != 6 || calls[1] != (Call{Method: "Upload", Key: "b"}) || store.CallCount("Delete") != 3 {
+		t.Fatalf("unexpected calls %+v", calls)
+	}
+
+	store.SetLatency(time.Second)
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := store.Stat(timeout, "c"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected latency to respect the context, got %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// maxSyncErrors caps how many per-object errors a SyncReport keeps.
+const maxSyncErrors = 20
+
+// SyncRecord is an object Sync copied and verified.
+type SyncRecord struct {
+	Key        string     `json:"key"`
+	Visibility Visibility `json:"visibility"`
+	Size       int64      `json:"size"`
+	SHA256     string     `json:"sha256"`
+}
+
+type SyncOptions struct {
+	Prefix  string
+	Workers int
+	DryRun  bool
+	// Done holds records from earlier runs, keyed by SyncDoneKey. Those
+	// objects are skipped while the destination still has them at the
+	// recorded size, which is what makes an interrupted sync resumable.
+	Done map[string]SyncRecord
+	// OnCopied is called, one at a time, after each object is copied and
+	// verified.
+	OnCopied func(SyncRecord)
+}
+
+type SyncReport struct {
+	Listed  int
+	Copied  int
+	Skipped int
+	Failed  int
+	Bytes   int64
+	// Errors holds the first per-object failures.
+	Errors []error
+}
+
+func SyncDoneKey(visibility Visibility, key string) string {
+	return string(visibility) + ":" + key
+}
+
+type syncItem struct {
+	info       ObjectInfo
+	visibility Visibility
+}
+
+// Sync copies every public and private object under opts.Prefix from src to
+// dst with opts.Workers concurrent copies. Each copy is read back from dst
+// and compared by SHA-256. Per-object failures are counted in the report
+// and do not stop the run; the returned error is for listing failures.
+func Sync(ctx context.Context, src, dst Store, opts SyncOptions) (SyncReport, error) {
+	workers := max(opts.Workers, 1)
+	items := make(chan syncItem)
+	var (
+		mu     sync.Mutex
+		report SyncReport
+		wg     sync.WaitGroup
+	)
+	record := func(fn func(*SyncReport)) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn(&report)
+	}
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range items {
+				copied, err := syncObject(ctx, src, dst, item, opts)
+				record(func(r *SyncReport) {
+					switch {
+					case err != nil:
+						r.Failed++
+						if len(r.Errors) < maxSyncErrors {
+							r.Errors = append(r.Errors, fmt.Errorf("%s %s: %w", item.visibility, item.info.Key, err))
+						}
+					case copied == nil:
+						r.Skipped++
+					default:
+						r.Copied++
+						r.Bytes += copied.Size
+						if opts.OnCopied != nil && !opts.DryRun {
+							opts.OnCopied(*copied)
+						}
+					}
+				})
+			}
+		}()
+	}
+
+	listErr := listForSync(ctx, src, opts.Prefix, items, func() { record(func(r *SyncReport) { r.Listed++ }) })
+	close(items)
+	wg.Wait()
+	return report, listErr
+}
+
+func listForSync(ctx context.Context, src Store, prefix string, items chan<- syncItem, listed func()) error {
+	for _, visibility := range []Visibility{VisibilityPublic, VisibilityPrivate} {
+		page := ListOptions{}
+		for {
+			result, err := src.List(ctx, prefix, page, WithVisibility(visibility))
+			if errors.Is(err, ErrPrivateNotConfigured) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("list %s objects: %w", visibility, err)
+			}
+			for _, info := range result.Objects {
+				listed()
+				select {
+				case items <- syncItem{info: info, visibility: visibility}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			if result.NextCursor == "" {
+				break
+			}
+			page.Cursor = result.NextCursor
+		}
+	}
+	return nil
+}
+
+// syncObject returns the record of a copied object, or nil when it was
+// skipped. In a dry run it reports what would be copied without writing.
+func syncObject(ctx context.Context, src, dst Store, item syncItem, opts SyncOptions) (*SyncRecord, error) {
+	vis := WithVisibility(item.visibility)
+	if done, ok := opts.Done[SyncDoneKey(item.visibility, item.info.Key)]; ok && done.Size == item.info.Size {
+		existing, err := dst.Stat(ctx, item.info.Key, vis)
+		if err == nil && existing.Size == done.Size {
+			return nil, nil
+		}
+	}
+	if opts.DryRun {
+		return &SyncRecord{Key: item.info.Key, Visibility: item.visibility, Size: item.info.Size}, nil
+	}
+
+	obj, err := src.Open(ctx, item.info.Key, vis)
+	if err != nil {
+		return nil, fmt.Errorf("open source: %w", err)
+	}
+	defer obj.Close()
+	hash := sha256.New()
+	counter := &countingWriter{}
+	if _, err := dst.Upload(ctx, item.info.Key, io.TeeReader(obj, io.MultiWriter(hash, counter)), obj.ContentType, vis); err != nil {
+		return nil, fmt.Errorf("upload: %w", err)
+	}
+	want := hash.Sum(nil)
+
+	got, err := hashObject(ctx, dst, item.info.Key, item.visibility)
+	if err != nil {
+		return nil, fmt.Errorf("verify: %w", err)
+	}
+	if !bytes.Equal(got, want) {
+		return nil, fmt.Errorf("checksum mismatch after copy: source %x, destination %x", want, got)
+	}
+	return &SyncRecord{Key: item.info.Key, Visibility: item.visibility, Size: counter.n, SHA256: hex.EncodeToString(want)}, nil
+}
+
+func hashObject(ctx context.Context, store Store, key string, visibility Visibility) ([]byte, error) {
+	obj, err := store.Open(ctx, key, WithVisibility(visibility))
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, obj); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// corruptingStore flips the first byte of every upload.
+type corruptingStore struct {
+	*LocalStore
+}
+
+func (s corruptingStore) Upload(ctx context.Context, key string, body io.Reader, contentType string, opts ...ObjectOption) (string, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	data[0] ^= 0xff
+	return s.LocalStore.Upload(ctx, key, strings.NewReader(string(data)), contentType, opts...)
+}
+
+func TestSyncCopiesVerifiesAndResumes(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	src, err := NewLocal(t.TempDir(), "http://127.0.0.1:8080", "/media")
+	if err != nil {
+		t.Fatalf("new source: %v", err)
+	}
+	dst, err := NewLocal(t.TempDir(), "http://127.0.0.1:8080", "/media")
+	if err != nil {
+		t.Fatalf("new destination: %v", err)
+	}
+	for _, key := range []string{"a/1.txt", "a/2.txt", "b/3.txt"} {
+		if _, err := src.Upload(ctx, key, strings.NewReader("body of "+key), "text/plain"); err != nil {
+			t.Fatalf("seed %s: %v", key, err)
+		}
+	}
+	if _, err := src.Upload(ctx, "a/secret.txt", strings.NewReader("secret"), "text/plain", WithVisibility(VisibilityPrivate)); err != nil {
+		t.Fatalf("seed private: %v", err)
+	}
+
+	report, err := Sync(ctx, src, dst, SyncOptions{Prefix: "a/", Workers: 2, DryRun: true})
+	if err != nil || report.Copied != 3 || report.Listed != 3 {
+		t.Fatalf("unexpected dry run %+v err=%v", report, err)
+	}
+	if _, err := dst.Stat(ctx, "a/1.txt"); err == nil {
+		t.Fatal("dry run must not write")
+	}
+
+	done := map[string]SyncRecord{}
+	report, err = Sync(ctx, src, dst, SyncOptions{Prefix: "a/", Workers: 2, OnCopied: func(rec SyncRecord) {
+		done[SyncDoneKey(rec.Visibility, rec.Key)] = rec
+	}})
+	if err != nil || report.Copied != 3 || report.Failed != 0 || len(done) != 3 {
+		t.Fatalf("unexpected sync %+v err=%v", report, err)
+	}
+	obj, err := dst.Open(ctx, "a/secret.txt", WithVisibility(VisibilityPrivate))
+	if err != nil {
+		t.Fatalf("private object was not copied: %v", err)
+	}
+	data, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(data) != "secret" || obj.ContentType != "text/plain" {
+		t.Fatalf("unexpected private copy %q (%s)", data, obj.ContentType)
+	}
+	if _, err := dst.Stat(ctx, "b/3.txt"); err == nil {
+		t.Fatal("objects outside the prefix must not be copied")
+	}
+
+	report, err = Sync(ctx, src, dst, SyncOptions{Prefix: "a/", Done: done})
+	if err != nil || report.Skipped != 3 || report.Copied != 0 {
+		t.Fatalf("expected resumed sync to skip everything, got %+v err=%v", report, err)
+	}
+
+	bad := corruptingStore{dst}
+	report, err = Sync(ctx, src, bad, SyncOptions{Prefix: "b/"})
+	if err != nil || report.Failed != 1 || len(report.Errors) != 1 || !strings.Contains(report.Errors[0].Error(), "checksum mismatch") {
+		t.Fatalf("expected a checksum failure, got %+v err=%v", report, err)
+	}
+}
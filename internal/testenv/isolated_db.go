@@ -0,0 +1,226 @@
+package testenv
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	dbembed "github.com/benpsk/go-starter/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// templateLockID serialises template creation and cloning across test
+// processes, since `go test ./...` runs packages concurrently.
+const templateLockID int64 = 7202600
+
+const maxDatabaseNameLen = 63
+
+var unsafeDBNameChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// MigrateFunc applies the schema to a freshly created template database.
+type MigrateFunc func(ctx context.Context, pool *pgxpool.Pool) error
+
+// IsolatedDB creates a database cloned from the migrated template and closes
+// and drops it when the test finishes. Tests using their own database can
+// safely call t.Parallel().
+func IsolatedDB(t testing.TB, migrate MigrateFunc) *pgxpool.Pool {
+	t.Helper()
+	pool, cleanup, err := OpenIsolatedDB(context.Background(), t.Name(), migrate)
+	if err != nil {
+		t.Fatalf("isolated db: %v", err)
+	}
+	t.Cleanup(cleanup)
+	return pool
+}
+
+// OpenIsolatedDB is the TestMain-friendly variant of IsolatedDB: it returns a
+// pool connected to a new database cloned from the migrated template, plus a
+// cleanup func that closes the pool and drops the database.
+//
+// DATABASE_URL (usually loaded from .env.test) is used as the admin
+// connection; the role needs CREATEDB.
+func OpenIsolatedDB(ctx context.Context, label string, migrate MigrateFunc) (*pgxpool.Pool, func(), error) {
+	if migrate == nil {
+		return nil, nil, errors.New("migrate func is required")
+	}
+	baseURL := strings.TrimSpace(os.Getenv("DATABASE_URL"))
+	if baseURL == "" {
+		return nil, nil, errors.New("DATABASE_URL is required")
+	}
+	baseConfig, err := pgxpool.ParseConfig(baseURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse DATABASE_URL: %w", err)
+	}
+
+	admin, err := pgxpool.NewWithConfig(ctx, baseConfig.Copy())
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect admin db: %w", err)
+	}
+	defer admin.Close()
+
+	unlock, err := LockIntegrationDB(ctx, admin, templateLockID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	hash, err := migrationsHash(dbembed.Migrations)
+	if err != nil {
+		return nil, nil, err
+	}
+	baseName := baseConfig.ConnConfig.Database
+	templateName := templateDatabaseName(baseName, hash)
+	if err := ensureTemplate(ctx, admin, baseConfig, templateName, migrate); err != nil {
+		return nil, nil, err
+	}
+
+	suffix, err := randomSuffix()
+	if err != nil {
+		return nil, nil, err
+	}
+	name := isolatedDatabaseName(baseName, label, suffix)
+	if _, err := admin.Exec(ctx, fmt.Sprintf(`create database %s template %s`, quoteIdent(name), quoteIdent(templateName))); err != nil {
+		return nil, nil, fmt.Errorf("create database %s: %w", name, err)
+	}
+
+	pool, err := connectDatabase(ctx, baseConfig, name)
+	if err != nil {
+		_ = dropDatabase(context.Background(), baseConfig, name)
+		return nil, nil, err
+	}
+	return pool, func() {
+		pool.Close()
+		_ = dropDatabase(context.Background(), baseConfig, name)
+	}, nil
+}
+
+func ensureTemplate(ctx context.Context, admin *pgxpool.Pool, baseConfig *pgxpool.Config, templateName string, migrate MigrateFunc) error {
+	var exists bool
+	if err := admin.QueryRow(ctx, `select exists (select 1 from pg_database where datname = $1)`, templateName).Scan(&exists); err != nil {
+		return fmt.Errorf("check template database: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	// Build under a scratch name and rename on success so a failed migration
+	// never leaves a half-migrated template behind.
+	buildName := templateName + "_build"
+	if _, err := admin.Exec(ctx, fmt.Sprintf(`drop database if exists %s with (force)`, quoteIdent(buildName))); err != nil {
+		return fmt.Errorf("drop stale template build: %w", err)
+	}
+	if _, err := admin.Exec(ctx, fmt.Sprintf(`create database %s`, quoteIdent(buildName))); err != nil {
+		return fmt.Errorf("create template database: %w", err)
+	}
+
+	pool, err := connectDatabase(ctx, baseConfig, buildName)
+	if err != nil {
+		return err
+	}
+	err = migrate(ctx, pool)
+	pool.Close()
+	if err != nil {
+		_, _ = admin.Exec(context.Background(), fmt.Sprintf(`drop database if exists %s with (force)`, quoteIdent(buildName)))
+		return fmt.Errorf("migrate template database: %w", err)
+	}
+
+	if _, err := admin.Exec(ctx, fmt.Sprintf(`alter database %s rename to %s`, quoteIdent(buildName), quoteIdent(templateName))); err != nil {
+		return fmt.Errorf("rename template database: %w", err)
+	}
+	return nil
+}
+
+func connectDatabase(ctx context.Context, baseConfig *pgxpool.Config, name string) (*pgxpool.Pool, error) {
+	cfg := baseConfig.Copy()
+	cfg.ConnConfig.Database = name
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("connect database %s: %w", name, err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("ping database %s: %w", name, err)
+	}
+	return pool, nil
+}
+
+func dropDatabase(ctx context.Context, baseConfig *pgxpool.Config, name string) error {
+	conn, err := pgx.ConnectConfig(ctx, baseConfig.ConnConfig.Copy())
+	if err != nil {
+		return fmt.Errorf("connect admin db: %w", err)
+	}
+	defer conn.Close(ctx)
+	if _, err := conn.Exec(ctx, fmt.Sprintf(`drop database if exists %s with (force)`, quoteIdent(name))); err != nil {
+		return fmt.Errorf("drop database %s: %w", name, err)
+	}
+	return nil
+}
+
+func migrationsHash(fsys fs.FS) (string, error) {
+	names, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return "", fmt.Errorf("list migrations: %w", err)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		contents, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return "", fmt.Errorf("read %s: %w", name, err)
+		}
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write(contents)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func templateDatabaseName(baseName, hash string) string {
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	return truncateDBName(sanitizeDBName(baseName)+"_tpl", maxDatabaseNameLen-len(hash)-1) + "_" + hash
+}
+
+func isolatedDatabaseName(baseName, label, suffix string) string {
+	prefix := sanitizeDBName(baseName)
+	if label = sanitizeDBName(label); label != "" {
+		prefix += "_" + label
+	}
+	return truncateDBName(prefix, maxDatabaseNameLen-len(suffix)-1) + "_" + suffix
+}
+
+func sanitizeDBName(v string) string {
+	v = unsafeDBNameChars.ReplaceAllString(strings.ToLower(strings.TrimSpace(v)), "_")
+	return strings.Trim(v, "_")
+}
+
+func truncateDBName(v string, max int) string {
+	if len(v) > max {
+		v = v[:max]
+	}
+	return strings.TrimRight(v, "_")
+}
+
+func randomSuffix() (string, error) {
+	var raw [6]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", fmt.Errorf("random db suffix: %w", err)
+	}
+	return hex.EncodeToString(raw[:]), nil
+}
+
+func quoteIdent(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
@@ -0,0 +1,28 @@
+package testenv
+
+import (
+	"context"
+	"io/fs"
+
+	dbembed "github.com/benpsk/go-starter/db"
+	"github.com/benpsk/go-starter/internal/postgres"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Migrate applies the embedded migrations with the bookkeeping tables the
+// CLI uses. It is the MigrateFunc every integration test package passes to
+// OpenIsolatedDB, so their schemas cannot drift apart.
+func Migrate(ctx context.Context, pool *pgxpool.Pool) error {
+	if err := postgres.EnsureTable(ctx, pool); err != nil {
+		return err
+	}
+	if err := postgres.EnsureSeedTable(ctx, pool); err != nil {
+		return err
+	}
+	migrationsFS, err := fs.Sub(dbembed.Migrations, "migrations")
+	if err != nil {
+		return err
+	}
+	_, err = postgres.ApplyFS(ctx, pool, migrationsFS)
+	return err
+}
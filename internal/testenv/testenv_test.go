@@ -38,3 +38,33 @@ func TestLoadFileParsesEnvLines(t *testing.T) {
 		t.Fatalf("expected SINGLE parsed, got %q", got)
 	}
 }
+
+func TestIsolatedDatabaseNameIsSanitizedAndBounded(t *testing.T) {
+	t.Parallel()
+
+	got := isolatedDatabaseName("go_starter_test", "TestAPI/Login-Flow", "a1b2c3")
+	if got != "go_starter_test_testapi_login_flow_a1b2c3" {
+		t.Fatalf("unexpected database name: %q", got)
+	}
+
+	long := isolatedDatabaseName("go_starter_test", strings.Repeat("x", 100), "a1b2c3")
+	if len(long) > maxDatabaseNameLen {
+		t.Fatalf("database name exceeds %d chars: %q", maxDatabaseNameLen, long)
+	}
+	if !strings.HasSuffix(long, "_a1b2c3") {
+		t.Fatalf("expected random suffix to survive truncation: %q", long)
+	}
+}
+
+func TestTemplateDatabaseNameTracksMigrationsHash(t *testing.T) {
+	t.Parallel()
+
+	a := templateDatabaseName("go_starter_test", "0123456789abcdef")
+	b := templateDatabaseName("go_starter_test", "fedcba9876543210")
+	if a == b {
+		t.Fatalf("expected different template names for different hashes")
+	}
+	if a != "go_starter_test_tpl_0123456789ab" {
+		t.Fatalf("unexpected template name: %q", a)
+	}
+}
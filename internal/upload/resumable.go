@@ -0,0 +1,93 @@
+package upload
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strings"
+	"time"
+)
+
+var (
+	ErrOffsetMismatch      = errors.New("upload offset mismatch")
+	ErrExpired             = errors.New("upload expired")
+	ErrInvalidMetadata     = errors.New("invalid upload metadata")
+	ErrUnsupportedChecksum = errors.New("unsupported checksum algorithm")
+)
+
+// ChecksumAlgorithms are the Upload-Checksum algorithms accepted on PATCH.
+var ChecksumAlgorithms = []string{"sha1", "sha256"}
+
+// Part is one stored multipart part of a resumable upload.
+type Part struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+// Resumable tracks an upload whose body arrives over several requests.
+// Storage holds whole PartSize parts (and the final, shorter part); bytes
+// received past the last part wait in Tail until a later request completes
+// it. Offset counts both.
+type Resumable struct {
+	Upload
+	StorageUploadID string
+	PartSize        int64
+	Offset          int64
+	Parts           []Part
+	Tail            []byte
+	ExpiresAt       time.Time
+}
+
+// Complete reports whether every byte has been received and stored as a
+// part, so the multipart upload can be assembled.
+func (r Resumable) Complete() bool {
+	return r.Offset == r.SizeBytes && len(r.Tail) == 0
+}
+
+// ParseMetadata decodes a tus Upload-Metadata header: comma-separated
+// "key base64value" pairs where the value may be omitted.
+func ParseMetadata(header string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		if key == "" {
+			return nil, ErrInvalidMetadata
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, ErrInvalidMetadata
+		}
+		out[key] = string(value)
+	}
+	return out, nil
+}
+
+// ParseChecksum decodes a tus Upload-Checksum header ("sha1 base64digest")
+// and returns a hash to feed the body through plus the expected digest.
+func ParseChecksum(header string) (hash.Hash, []byte, error) {
+	algo, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		return nil, nil, ErrUnsupportedChecksum
+	}
+	var h hash.Hash
+	switch strings.ToLower(algo) {
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return nil, nil, ErrUnsupportedChecksum
+	}
+	want, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(want) != h.Size() {
+		return nil, nil, ErrUnsupportedChecksum
+	}
+	return h, want, nil
+}
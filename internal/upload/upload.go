@@ -0,0 +1,103 @@
+package upload
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusCompleted = "completed"
+
+	maxFilenameLen = 100
+)
+
+var (
+	ErrNotFound               = errors.New("upload not found")
+	ErrContentTypeNotAllowed  = errors.New("content type is not allowed")
+	ErrTooLarge               = errors.New("upload exceeds size limit")
+	ErrInvalidSize            = errors.New("upload size must be positive")
+	ErrAlreadyCompleted       = errors.New("upload already completed")
+	unsafeFilenameChars       = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	repeatedFilenameSeparator = regexp.MustCompile(`-+(\.|-)`)
+)
+
+type Upload struct {
+	ID          int64
+	UserID      int64
+	StorageKey  string
+	Filename    string
+	ContentType string
+	SizeBytes   int64
+	Status      string
+	CreatedAt   time.Time
+	CompletedAt *time.Time
+}
+
+// Policy limits what clients may upload.
+type Policy struct {
+	MaxBytes            int64
+	AllowedContentTypes []string
+}
+
+// Validate normalizes contentType and checks it and size against the policy.
+func (p Policy) Validate(contentType string, size int64) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(contentType))
+	if err != nil {
+		return "", ErrContentTypeNotAllowed
+	}
+	mediaType = strings.ToLower(mediaType)
+	allowed := false
+	for _, t := range p.AllowedContentTypes {
+		if strings.EqualFold(strings.TrimSpace(t), mediaType) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", ErrContentTypeNotAllowed
+	}
+	if size <= 0 {
+		return "", ErrInvalidSize
+	}
+	if p.MaxBytes > 0 && size > p.MaxBytes {
+		return "", ErrTooLarge
+	}
+	return mediaType, nil
+}
+
+// NewStorageKey returns a unique, URL-safe key scoped to the user.
+func NewStorageKey(userID int64, filename string) (string, error) {
+	var raw [12]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", fmt.Errorf("random upload key: %w", err)
+	}
+	return path.Join("uploads", fmt.Sprint(userID), hex.EncodeToString(raw[:]), SafeFilename(filename)), nil
+}
+
+// SafeFilename keeps the base name of filename with only characters that
+// are safe in storage keys and URLs.
+func SafeFilename(filename string) string {
+	name := path.Base(strings.ReplaceAll(strings.TrimSpace(filename), `\`, "/"))
+	name = unsafeFilenameChars.ReplaceAllString(name, "-")
+	name = repeatedFilenameSeparator.ReplaceAllString(name, "$1")
+	name = strings.Trim(name, "-_.")
+	if len(name) > maxFilenameLen {
+		ext := path.Ext(name)
+		if len(ext) > 10 {
+			ext = ""
+		}
+		name = strings.Trim(name[:maxFilenameLen-len(ext)], "-_.") + ext
+	}
+	if name == "" {
+		return "file"
+	}
+	return name
+}
@@ -0,0 +1,116 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	t.Parallel()
+
+	policy := Policy{MaxBytes: 1024, AllowedContentTypes: []string{"image/png", "application/pdf"}}
+
+	tests := []struct {
+		name        string
+		contentType string
+		size        int64
+		want        string
+		wantErr     error
+	}{
+		{name: "allowed", contentType: "image/png", size: 10, want: "image/png"},
+		{name: "parameters and case", contentType: "Application/PDF; charset=binary", size: 1024, want: "application/pdf"},
+		{name: "disallowed type", contentType: "text/html", size: 10, wantErr: ErrContentTypeNotAllowed},
+		{name: "malformed type", contentType: "not a type", size: 10, wantErr: ErrContentTypeNotAllowed},
+		{name: "too large", contentType: "image/png", size: 1025, wantErr: ErrTooLarge},
+		{name: "empty", contentType: "image/png", size: 0, wantErr: ErrInvalidSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := policy.Validate(tt.contentType, tt.size)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Validate error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("Validate = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSafeFilename(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"report.pdf":                      "report.pdf",
+		"../../etc/passwd":                "passwd",
+		`C:\Users\me\photo 1.JPG`:         "photo-1.JPG",
+		"résumé (final).pdf":              "r-sum-final.pdf",
+		"...":                             "file",
+		strings.Repeat("a", 200) + ".png": strings.Repeat("a", 96) + ".png",
+	}
+	for in, want := range tests {
+		if got := SafeFilename(in); got != want {
+			t.Errorf("SafeFilename(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNewStorageKeyIsScopedAndUnique(t *testing.T) {
+	t.Parallel()
+
+	a, err := NewStorageKey(42, "a.png")
+	if err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	b, err := NewStorageKey(42, "a.png")
+	if err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	if a == b {
+		t.Fatalf("expected unique keys, got %q twice", a)
+	}
+	if !strings.HasPrefix(a, "uploads/42/") || !strings.HasSuffix(a, "/a.png") {
+		t.Fatalf("unexpected key shape: %q", a)
+	}
+}
+
+func TestParseMetadata(t *testing.T) {
+	t.Parallel()
+
+	got, err := ParseMetadata("filename cmVwb3J0LnBkZg==,filetype YXBwbGljYXRpb24vcGRm, is_confidential")
+	if err != nil {
+		t.Fatalf("parse metadata: %v", err)
+	}
+	if got["filename"] != "report.pdf" || got["filetype"] != "application/pdf" {
+		t.Fatalf("unexpected metadata: %v", got)
+	}
+	if v, ok := got["is_confidential"]; !ok || v != "" {
+		t.Fatalf("expected empty value for bare key, got %q (present=%v)", v, ok)
+	}
+	if _, err := ParseMetadata("filename !!!"); !errors.Is(err, ErrInvalidMetadata) {
+		t.Fatalf("expected ErrInvalidMetadata, got %v", err)
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	t.Parallel()
+
+	sum := sha1.Sum([]byte("hello"))
+	h, want, err := ParseChecksum("sha1 " + base64.StdEncoding.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatalf("parse checksum: %v", err)
+	}
+	h.Write([]byte("hello"))
+	if !bytes.Equal(h.Sum(nil), want) {
+		t.Fatal("expected digest to match")
+	}
+	for _, header := range []string{"md5 AAAA", "sha1", "sha256 " + base64.StdEncoding.EncodeToString(sum[:])} {
+		if _, _, err := ParseChecksum(header); !errors.Is(err, ErrUnsupportedChecksum) {
+			t.Fatalf("%q: expected ErrUnsupportedChecksum, got %v", header, err)
+		}
+	}
+}
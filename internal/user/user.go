@@ -10,15 +10,27 @@ var (
 	ErrNotFound         = errors.New("user not found")
 	ErrEmailConflict    = errors.New("email already exists")
 	ErrIdentityConflict = errors.New("identity already exists")
+	ErrMFAEnabled       = errors.New("two-factor authentication is already enabled")
+	ErrPasskeyExists    = errors.New("passkey is already registered")
+)
+
+// Avatar sources. Provider avatars follow the social profile on every login;
+// custom avatars were uploaded by the user and are never overwritten.
+const (
+	AvatarSourceProvider = "provider"
+	AvatarSourceCustom   = "custom"
 )
 
 type User struct {
-	ID          int64
-	Email       string
-	DisplayName string
-	AvatarURL   string
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	ID           int64
+	Email        string
+	DisplayName  string
+	AvatarURL    string
+	AvatarSource string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	// EmailVerified is set once a provider or magic link proved Email.
+	EmailVerified bool
 }
 
 type Identity struct {
@@ -61,6 +73,84 @@ type Session struct {
 	IP         string
 	UserAgent  string
 	RevokedAt  *time.Time
+	// MFAPending sessions passed the social login but not yet the second
+	// factor, so they do not sign the user in.
+	MFAPending bool
+}
+
+// MFA is a TOTP enrollment. It is pending until ConfirmedAt is set by a
+// first valid code. LastUsedStep stops a code from being used twice.
+type MFA struct {
+	UserID           int64
+	SecretCiphertext []byte
+	ConfirmedAt      *time.Time
+	LastUsedStep     int64
+	CreatedAt        time.Time
+}
+
+// ProviderPasskey is the identity provider of users who sign in with
+// passkeys. Its provider user id is the WebAuthn user handle shared by all
+// of the user's passkeys.
+const ProviderPasskey = "passkey"
+
+// Passkey is a registered WebAuthn credential. SignCount is the last
+// signature counter seen, which must grow unless the authenticator does
+// not count.
+type Passkey struct {
+	ID             int64
+	UserID         int64
+	CredentialID   []byte
+	PublicKey      []byte
+	SignCount      uint32
+	Transports     []string
+	BackupEligible bool
+	BackedUp       bool
+	Name           string
+	CreatedAt      time.Time
+	LastUsedAt     *time.Time
+}
+
+// ProviderEmail is the identity provider of users who sign in with magic
+// links. Its provider user id is the normalized email address.
+const ProviderEmail = "email"
+
+// MagicLink is a sign-in link emailed to Email. Only the token's hash is
+// stored, and UsedAt is set by the single sign-in it allows.
+type MagicLink struct {
+	ID         int64
+	Email      string
+	TokenHash  string
+	RedirectTo string
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+	UsedAt     *time.Time
+}
+
+// Device authorization statuses. A pending authorization is approved or
+// denied by a signed-in user, and an approved one is consumed when the
+// device exchanges it for tokens.
+const (
+	DeviceAuthorizationPending  = "pending"
+	DeviceAuthorizationApproved = "approved"
+	DeviceAuthorizationDenied   = "denied"
+	DeviceAuthorizationConsumed = "consumed"
+)
+
+// DeviceAuthorization is a device flow grant for a CLI client. The device
+// polls with the code whose hash is DeviceCodeHash; the user approves it by
+// entering UserCode.
+type DeviceAuthorization struct {
+	ID              int64
+	DeviceCodeHash  string
+	UserCode        string
+	ClientID        string
+	UserID          *int64
+	Status          string
+	IntervalSeconds int
+	LastPolledAt    *time.Time
+	ExpiresAt       time.Time
+	CreatedAt       time.Time
+	DecidedAt       *time.Time
 }
 
 type APIRefreshToken struct {
@@ -74,3 +164,33 @@ type APIRefreshToken struct {
 	RevokedAt         *time.Time
 	ReplacedByTokenID *int64
 }
+
+// Device is what a sign-in looks like for new-device detection. Browser and
+// OS versions are left out so updates do not look like a new device.
+type Device struct {
+	Fingerprint string
+	Browser     string
+	OS          string
+	Type        string
+	IPPrefix    string
+}
+
+// Description reads like "Firefox on Windows".
+func (d Device) Description() string {
+	return d.Browser + " on " + d.OS
+}
+
+const SecurityEventNewDevice = "new_device_sign_in"
+
+type SecurityEvent struct {
+	ID          int64
+	UserID      int64
+	Kind        string
+	Client      string
+	Fingerprint string
+	Device      string
+	IP          string
+	UserAgent   string
+	CreatedAt   time.Time
+	ReportedAt  *time.Time
+}
@@ -0,0 +1,64 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/web/components"
+	"github.com/benpsk/go-starter/internal/web/pages"
+)
+
+const schedulerPageRuns = 50
+
+// requireAdmin answers 404 to anyone not listed in ADMIN_EMAILS, so admin
+// pages do not reveal that they exist, and sends admins without two-factor
+// authentication to turn it on first.
+func (h Handler) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		currentUser := auth.CurrentUserFromRequest(r)
+		if !h.auth.IsAdmin(currentUser) {
+			h.notFoundPage(w, r)
+			return
+		}
+		mfaEnabled, err := h.auth.MFARequired(r.Context(), currentUser.ID)
+		if err != nil {
+			http.Error(w, "failed to load account", http.StatusInternalServerError)
+			return
+		}
+		if !mfaEnabled {
+			http.Redirect(w, r, "/account?mfa_error=admin_required#mfa", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h Handler) schedulerPage(w http.ResponseWriter, r *http.Request) {
+	if h.scheduler == nil {
+		h.notFoundPage(w, r)
+		return
+	}
+	tasks, err := h.scheduler.Tasks(r.Context())
+	if err != nil {
+		http.Error(w, "failed to load scheduled tasks", http.StatusInternalServerError)
+		return
+	}
+	runs, err := h.scheduler.Runs(r.Context(), "", schedulerPageRuns)
+	if err != nil {
+		http.Error(w, "failed to load scheduled task runs", http.StatusInternalServerError)
+		return
+	}
+	model := pages.SchedulerPageModel{
+		AppName:     h.appName,
+		AppURL:      h.appURL,
+		GoogleTagID: h.googleTagID,
+		Auth:        h.headerAuthData(r),
+		Tasks:       tasks,
+		Runs:        runs,
+	}
+	if auth.IsHtmx(r) {
+		h.renderPage(w, r, components.Content("Scheduled Tasks | "+h.appName, pages.SchedulerContent(model)))
+		return
+	}
+	h.renderPage(w, r, pages.SchedulerPage(model))
+}
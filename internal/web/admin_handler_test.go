@@ -0,0 +1,76 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/postgres"
+	"github.com/benpsk/go-starter/internal/user"
+)
+
+func TestSchedulerPageIsOnlyShownToAdmins(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	users := postgres.NewUserAuthStore(integrationPool)
+	admin, _, _ := insertUserAndSession(t, ctx, users)
+	cfg := testConfig()
+	cfg.Auth.AdminEmails = []string{strings.ToLower(admin.Email)}
+	store := postgres.NewSchedulerStore(integrationPool)
+	h := NewHandler(cfg, auth.NewService(integrationPool, cfg)).WithScheduler(store)
+	routes := Routes(h, auth.NewRateLimiter(10, time.Minute))
+
+	if _, err := store.EnsureTask(ctx, "reports.weekly", "0 6 * * MON", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("ensure task: %v", err)
+	}
+	id, ok, err := store.StartRun(ctx, "reports.weekly", "web-test", time.Now(), time.Now().Add(time.Hour))
+	if err != nil || !ok {
+		t.Fatalf("start run: ok=%v err=%v", ok, err)
+	}
+	if err := store.FinishRun(ctx, id, "smtp timeout"); err != nil {
+		t.Fatalf("finish run: %v", err)
+	}
+
+	get := func(u *user.User) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/scheduler", nil)
+		req = req.WithContext(auth.ContextWithCurrentUser(ctx, u))
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get(&user.User{ID: 1, Email: "someone@example.com", EmailVerified: true}); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a non-admin, got %d", rec.Code)
+	}
+	unverified := admin
+	unverified.EmailVerified = false
+	if rec := get(&unverified); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unverified admin email, got %d", rec.Code)
+	}
+	if rec := get(&admin); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/account?mfa_error=admin_required#mfa" {
+		t.Fatalf("expected an admin without two-factor to be sent to enable it, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	if err := users.PutPendingMFA(ctx, admin.ID, []byte("secret")); err != nil {
+		t.Fatalf("put mfa: %v", err)
+	}
+	if err := users.ConfirmMFA(ctx, admin.ID, 1, time.Now()); err != nil {
+		t.Fatalf("confirm mfa: %v", err)
+	}
+	rec := get(&admin)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for an admin, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"reports.weekly", "0 6 * * MON", "failed", "smtp timeout", "web-test"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected page to contain %q", want)
+		}
+	}
+}
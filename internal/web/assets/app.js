@@ -255,6 +255,132 @@ function createAnalytics() {
   };
 }
 
+function base64URLToBuffer(value) {
+  const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+  const binary = atob(base64.padEnd(base64.length + (4 - base64.length % 4) % 4, "="));
+  return Uint8Array.from(binary, (c) => c.charCodeAt(0)).buffer;
+}
+
+function bufferToBase64URL(buffer) {
+  if (!buffer) return "";
+  const bytes = new Uint8Array(buffer);
+  let binary = "";
+  for (const byte of bytes) binary += String.fromCharCode(byte);
+  return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function parseCreationOptions(options) {
+  if (typeof PublicKeyCredential.parseCreationOptionsFromJSON === "function") {
+    return PublicKeyCredential.parseCreationOptionsFromJSON(options);
+  }
+  return {
+    ...options,
+    challenge: base64URLToBuffer(options.challenge),
+    user: { ...options.user, id: base64URLToBuffer(options.user.id) },
+    excludeCredentials: (options.excludeCredentials || []).map((c) => ({ ...c, id: base64URLToBuffer(c.id) }))
+  };
+}
+
+function parseRequestOptions(options) {
+  if (typeof PublicKeyCredential.parseRequestOptionsFromJSON === "function") {
+    return PublicKeyCredential.parseRequestOptionsFromJSON(options);
+  }
+  return {
+    ...options,
+    challenge: base64URLToBuffer(options.challenge),
+    allowCredentials: (options.allowCredentials || []).map((c) => ({ ...c, id: base64URLToBuffer(c.id) }))
+  };
+}
+
+function credentialToJSON(credential) {
+  if (typeof credential.toJSON === "function") return credential.toJSON();
+  const response = credential.response;
+  const json = {
+    id: credential.id,
+    rawId: bufferToBase64URL(credential.rawId),
+    type: credential.type,
+    response: { clientDataJSON: bufferToBase64URL(response.clientDataJSON) }
+  };
+  if (response.attestationObject) {
+    json.response.attestationObject = bufferToBase64URL(response.attestationObject);
+    json.response.transports = typeof response.getTransports === "function" ? response.getTransports() : [];
+  } else {
+    json.response.authenticatorData = bufferToBase64URL(response.authenticatorData);
+    json.response.signature = bufferToBase64URL(response.signature);
+    json.response.userHandle = bufferToBase64URL(response.userHandle);
+  }
+  return json;
+}
+
+async function postPasskeyJSON(url, body) {
+  const response = await fetch(url, {
+    method: "POST",
+    credentials: "same-origin",
+    headers: { "Content-Type": "application/json", "X-CSRF-Token": currentCSRFToken() },
+    body: JSON.stringify(body || {})
+  });
+  const data = await response.json().catch(() => ({}));
+  if (!response.ok) throw new Error(data.error || "Something went wrong. Please try again.");
+  return data;
+}
+
+// initPasskeys wires the passkey buttons on the login and account pages.
+// Each ceremony fetches options, calls navigator.credentials, then posts the
+// credential back to the same endpoint without /options.
+function initPasskeys() {
+  function showError(target, message) {
+    const section = target.closest("section, [id]") || document;
+    const alert = section.querySelector("[data-passkey-error]");
+    if (!alert) return;
+    alert.textContent = message;
+    alert.classList.toggle("hidden", !message);
+  }
+
+  async function run(target, endpoint, kind, body) {
+    if (!window.PublicKeyCredential) {
+      showError(target, "This browser does not support passkeys.");
+      return;
+    }
+    showError(target, "");
+    try {
+      const next = new URLSearchParams(window.location.search).get("next");
+      const query = next ? `?next=${encodeURIComponent(next)}` : "";
+      const options = await postPasskeyJSON(`${endpoint}/options`, body);
+      const credential = kind === "get"
+        ? await navigator.credentials.get({ publicKey: parseRequestOptions(options) })
+        : await navigator.credentials.create({ publicKey: parseCreationOptions(options) });
+      if (!credential) return;
+      const result = await postPasskeyJSON(`${endpoint}${query}`, credentialToJSON(credential));
+      window.location.assign(result.redirect || "/");
+    } catch (error) {
+      if (error && error.name === "NotAllowedError") return;
+      showError(target, (error && error.message) || "Something went wrong. Please try again.");
+    }
+  }
+
+  document.addEventListener("click", (event) => {
+    const login = event.target.closest("[data-passkey-login]");
+    if (login) {
+      run(login, "/auth/passkey/login", "get");
+      return;
+    }
+    const add = event.target.closest("[data-passkey-add]");
+    if (add) {
+      // With two-factor authentication on, adding a passkey needs a code.
+      const code = add.parentElement.querySelector("[data-passkey-code]");
+      run(add, "/account/passkeys", "create", code ? { code: code.value } : undefined);
+    }
+  });
+
+  document.addEventListener("submit", (event) => {
+    const form = event.target.closest("[data-passkey-signup]");
+    if (!form) return;
+    event.preventDefault();
+    const displayName = new FormData(form).get("display_name") || "";
+    run(form, "/auth/passkey/signup", "create", { display_name: displayName });
+  });
+}
+
 document.addEventListener("DOMContentLoaded", () => {
   createNav().init();
   createAnalytics().init();
@@ -262,4 +388,5 @@ document.addEventListener("DOMContentLoaded", () => {
   initCSRFProtection();
   initDemoCharts();
   initHtmxHooks();
+  initPasskeys();
 });
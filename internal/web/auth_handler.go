@@ -1,12 +1,17 @@
 package web
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/benpsk/go-starter/internal/abuse"
 	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/postgres"
 	"github.com/benpsk/go-starter/internal/user"
 	"github.com/benpsk/go-starter/internal/web/pages"
 	"github.com/go-chi/chi/v5"
@@ -21,6 +26,23 @@ func (h Handler) loginPage(w http.ResponseWriter, r *http.Request) {
 		errMessage = "Sign in failed. Please try again."
 	case "account_conflict":
 		errMessage = "An account with the same email already exists under another provider. Linking is not supported in this starter yet."
+	case "invalid_email":
+		errMessage = "Enter a valid email address."
+	case "magic_link_failed":
+		errMessage = "Could not send a sign-in link. Please try again."
+	case "magic_link_invalid":
+		errMessage = "That sign-in link is invalid, expired or already used. Request a new one."
+	}
+	notice := ""
+	switch strings.TrimSpace(r.URL.Query().Get("notice")) {
+	case "signed_out_everywhere":
+		notice = "You have been signed out on every device. Sign in again to secure your account."
+	case "magic_link_sent":
+		notice = "Check your email for a sign-in link. It works once and expires in 15 minutes."
+	}
+	next := ""
+	if v := r.URL.Query().Get("next"); v != "" {
+		next = localRedirect(v)
 	}
 	googleCfg, _ := h.auth.ProviderConfig("google")
 	githubCfg, _ := h.auth.ProviderConfig("github")
@@ -30,8 +52,12 @@ func (h Handler) loginPage(w http.ResponseWriter, r *http.Request) {
 		GoogleTagID:   h.googleTagID,
 		Auth:          h.headerAuthData(r),
 		Error:         errMessage,
+		Notice:        notice,
 		GoogleEnabled: auth.ProviderEnabled(googleCfg),
 		GitHubEnabled: auth.ProviderEnabled(githubCfg),
+		Next:          next,
+
+		PasskeysEnabled: h.auth.PasskeysAvailable(),
 	}
 	h.renderPage(w, r, pages.LoginPage(model))
 }
@@ -42,18 +68,47 @@ func (h Handler) accountPage(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
 		return
 	}
-	identities, err := h.auth.Users().ListIdentitiesByUserID(r.Context(), currentUser.ID)
+	// The account page is where changes to it redirect, so read from the
+	// primary rather than a replica that may not have them yet.
+	ctx := postgres.WithPrimaryReads(r.Context())
+	identities, err := h.auth.Users().ListIdentitiesByUserID(ctx, currentUser.ID)
+	if err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	events, err := h.auth.SecurityEvents(ctx, currentUser.ID)
+	if err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	mfa, err := h.auth.MFAStatus(ctx, currentUser.ID)
+	if err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	passkeys, err := h.auth.Passkeys(ctx, currentUser.ID)
 	if err != nil {
 		http.Error(w, "failed to load account", http.StatusInternalServerError)
 		return
 	}
 	model := pages.AccountPageModel{
-		AppName:     h.appName,
-		AppURL:      h.appURL,
-		GoogleTagID: h.googleTagID,
-		Auth:        h.headerAuthData(r),
-		User:        *currentUser,
-		Identities:  identities,
+		AppName:        h.appName,
+		AppURL:         h.appURL,
+		GoogleTagID:    h.googleTagID,
+		Auth:           h.headerAuthData(r),
+		User:           *currentUser,
+		Identities:     identities,
+		AvatarError:    avatarErrorMessage(r.URL.Query().Get("avatar_error")),
+		SecurityEvents: events,
+
+		MFAAvailable:         h.auth.MFAAvailable(),
+		MFAEnabled:           mfa.Enabled,
+		MFARecoveryCodesLeft: mfa.RecoveryCodesLeft,
+		MFAError:             mfaErrorMessage(r.URL.Query().Get("mfa_error")),
+
+		PasskeysEnabled: h.auth.PasskeysAvailable(),
+		Passkeys:        passkeys,
+		PasskeyError:    passkeyErrorMessage(r.URL.Query().Get("passkey_error")),
 	}
 	h.renderPage(w, r, pages.AccountPage(model))
 }
@@ -69,10 +124,7 @@ func (h Handler) startSocialLogin(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/auth/login?error=provider_not_configured", http.StatusSeeOther)
 		return
 	}
-	redirectTo := strings.TrimSpace(r.FormValue("next"))
-	if redirectTo == "" || !strings.HasPrefix(redirectTo, "/") || strings.HasPrefix(redirectTo, "//") {
-		redirectTo = "/account"
-	}
+	redirectTo := localRedirect(r.FormValue("next"))
 	record, err := h.auth.CreateOAuthFlow(provider, redirectTo, time.Now())
 	if err != nil {
 		http.Redirect(w, r, "/auth/login?error=oauth_failed", http.StatusSeeOther)
@@ -98,6 +150,8 @@ func (h Handler) oauthCallback(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/auth/login?error=oauth_failed", http.StatusSeeOther)
 		return
 	}
+	// Any page can link here with a made-up state, so only failures after
+	// a flow this server started count towards an abuse ban.
 	flow, err := h.auth.ConsumeOAuthFlow(state, provider, time.Now())
 	if err != nil {
 		http.Redirect(w, r, "/auth/login?error=oauth_failed", http.StatusSeeOther)
@@ -110,10 +164,21 @@ func (h Handler) oauthCallback(w http.ResponseWriter, r *http.Request) {
 	}
 	profile, err := h.auth.ExchangeAndVerify(r.Context(), provider, code, flow.CodeVerifier, h.auth.OAuthCallbackURL(provider), cfg)
 	if err != nil {
-		http.Redirect(w, r, "/auth/login?error=oauth_failed", http.StatusSeeOther)
+		h.oauthFailed(w, r)
 		return
 	}
-	currentUser, err := h.auth.FindOrCreateSocialUser(r.Context(), profile)
+	var token string
+	var expiresAt time.Time
+	var mfaRequired bool
+	meta := auth.RequestMetaFromRequest(r)
+	err = h.auth.InTx(r.Context(), func(ctx context.Context) error {
+		currentUser, err := h.auth.FindOrCreateSocialUser(ctx, profile)
+		if err != nil {
+			return err
+		}
+		token, expiresAt, mfaRequired, err = h.createSignInSession(ctx, currentUser, meta)
+		return err
+	})
 	if err != nil {
 		if errors.Is(err, user.ErrEmailConflict) {
 			http.Redirect(w, r, "/auth/login?error=account_conflict", http.StatusSeeOther)
@@ -122,13 +187,74 @@ func (h Handler) oauthCallback(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/auth/login?error=oauth_failed", http.StatusSeeOther)
 		return
 	}
-	token, expiresAt, err := h.auth.CreateSession(r.Context(), currentUser, auth.RequestMetaFromRequest(r))
+	h.finishSignIn(w, r, token, expiresAt, mfaRequired, flow.RedirectTo)
+}
+
+// createSignInSession records a sign-in by u and creates their session, or
+// a pending one when they still have to pass two-factor authentication.
+func (h Handler) createSignInSession(ctx context.Context, u user.User, meta auth.RequestMeta) (token string, expiresAt time.Time, mfaRequired bool, err error) {
+	if err := h.auth.RecordSignIn(ctx, u, meta, auth.ClientWeb); err != nil {
+		return "", time.Time{}, false, err
+	}
+	mfaRequired, err = h.auth.MFARequired(ctx, u.ID)
 	if err != nil {
-		http.Redirect(w, r, "/auth/login?error=oauth_failed", http.StatusSeeOther)
-		return
+		return "", time.Time{}, false, err
+	}
+	if mfaRequired {
+		token, expiresAt, err = h.auth.CreateMFAPendingSession(ctx, u, meta)
+	} else {
+		token, expiresAt, err = h.auth.CreateSession(ctx, u, meta)
 	}
+	return token, expiresAt, mfaRequired, err
+}
+
+// finishSignIn sets the session cookie from createSignInSession and sends
+// the browser on to redirectTo, through /auth/mfa when required.
+func (h Handler) finishSignIn(w http.ResponseWriter, r *http.Request, token string, expiresAt time.Time, mfaRequired bool, redirectTo string) {
 	h.auth.SetSessionCookie(w, r, token, expiresAt)
-	http.Redirect(w, r, flow.RedirectTo, http.StatusSeeOther)
+	if mfaRequired {
+		http.Redirect(w, r, "/auth/mfa?next="+url.QueryEscape(redirectTo), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+}
+
+// localRedirect returns next when it is a path on this site, so it cannot
+// send the browser elsewhere after sign-in.
+func localRedirect(next string) string {
+	next = strings.TrimSpace(next)
+	if next == "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/account"
+	}
+	return next
+}
+
+// oauthFailed counts a callback whose code the provider would not verify
+// for a known flow towards an abuse ban.
+func (h Handler) oauthFailed(w http.ResponseWriter, r *http.Request) {
+	h.auth.Abuse().Report(r, abuse.OAuthFailure)
+	http.Redirect(w, r, "/auth/login?error=oauth_failed", http.StatusSeeOther)
+}
+
+// reportSignIn is the "this wasn't me" action on a security event: it signs
+// the user out everywhere, including this browser.
+func (h Handler) reportSignIn(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.CurrentUserFromRequest(r)
+	eventID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || eventID <= 0 {
+		h.NotFound(w, r)
+		return
+	}
+	if err := h.auth.ReportSignIn(r.Context(), currentUser.ID, eventID); err != nil {
+		if errors.Is(err, user.ErrNotFound) {
+			h.NotFound(w, r)
+			return
+		}
+		http.Error(w, "failed to sign out other sessions", http.StatusInternalServerError)
+		return
+	}
+	h.auth.ClearSessionCookie(w, r)
+	http.Redirect(w, r, "/auth/login?notice=signed_out_everywhere", http.StatusSeeOther)
 }
 
 func (h Handler) logout(w http.ResponseWriter, r *http.Request) {
@@ -15,6 +15,8 @@ import (
 )
 
 func TestLoadSessionAttachesCurrentUserFromCookie(t *testing.T) {
+	t.Parallel()
+
 	ctx, cleanup := withTx(t)
 	defer cleanup()
 
@@ -47,6 +49,8 @@ func TestLoadSessionAttachesCurrentUserFromCookie(t *testing.T) {
 }
 
 func TestLoadSessionExpiredOrRevokedClearsCookieAndSkipsAuthContext(t *testing.T) {
+	t.Parallel()
+
 	t.Run("expired session", func(t *testing.T) {
 		ctx, cleanup := withTx(t)
 		defer cleanup()
@@ -107,6 +111,8 @@ func TestLoadSessionExpiredOrRevokedClearsCookieAndSkipsAuthContext(t *testing.T
 }
 
 func TestRequireAuthAndRequireGuest(t *testing.T) {
+	t.Parallel()
+
 	authService := testAuthService()
 
 	t.Run("requireAuth redirects guest", func(t *testing.T) {
@@ -142,6 +148,8 @@ func TestRequireAuthAndRequireGuest(t *testing.T) {
 }
 
 func TestLogoutDeletesCurrentSessionAndClearsCookie(t *testing.T) {
+	t.Parallel()
+
 	ctx, cleanup := withTx(t)
 	defer cleanup()
 
@@ -181,6 +189,7 @@ func testConfig() config.Config {
 			SessionCookieName: "test_session",
 			SessionTTL:        30 * 24 * time.Hour,
 		},
+		Mail: config.MailConfig{From: "Go Starter <no-reply@example.com>"},
 	}
 }
 
@@ -234,3 +243,21 @@ func assertCookieCleared(t *testing.T, rec *httptest.ResponseRecorder, cookieNam
 	}
 	t.Fatalf("expected cleared cookie %q", cookieName)
 }
+
+// sessionUserFromCookie returns the user signed in by the session cookie
+// rec sets.
+func sessionUserFromCookie(t *testing.T, ctx context.Context, authService *auth.Service, rec *httptest.ResponseRecorder) user.User {
+	t.Helper()
+	for _, c := range rec.Result().Cookies() {
+		if c.Name != authService.SessionCookieName() || c.Value == "" {
+			continue
+		}
+		_, u, err := authService.Users().FindSessionAndUserByTokenHash(ctx, auth.HashToken(c.Value))
+		if err != nil {
+			t.Fatalf("find session: %v", err)
+		}
+		return u
+	}
+	t.Fatal("expected a session cookie")
+	return user.User{}
+}
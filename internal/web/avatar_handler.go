@@ -0,0 +1,132 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/avatar"
+)
+
+// MaxFormBytes bounds the body of any web form post. The avatar upload is
+// the largest: the image plus room for the multipart headers and the CSRF
+// token.
+const MaxFormBytes = avatar.MaxBytes + 64<<10
+
+func (h Handler) uploadAvatar(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.CurrentUserFromRequest(r)
+	if currentUser == nil {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+	if h.store == nil {
+		http.Redirect(w, r, "/account?avatar_error=unavailable", http.StatusSeeOther)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, MaxFormBytes)
+	file, header, err := r.FormFile("avatar")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Redirect(w, r, "/account?avatar_error=too_large", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/account?avatar_error=missing", http.StatusSeeOther)
+		return
+	}
+	defer file.Close()
+	if header.Size > avatar.MaxBytes {
+		http.Redirect(w, r, "/account?avatar_error=too_large", http.StatusSeeOther)
+		return
+	}
+
+	variants, err := avatar.Process(file)
+	if err != nil {
+		switch {
+		case errors.Is(err, avatar.ErrTooLarge), errors.Is(err, avatar.ErrTooManyPixels):
+			http.Redirect(w, r, "/account?avatar_error=too_large", http.StatusSeeOther)
+		case errors.Is(err, avatar.ErrUnsupportedFormat):
+			http.Redirect(w, r, "/account?avatar_error=unsupported", http.StatusSeeOther)
+		default:
+			http.Redirect(w, r, "/account?avatar_error=failed", http.StatusSeeOther)
+		}
+		return
+	}
+
+	prefix, err := avatar.NewKeyPrefix(currentUser.ID)
+	if err != nil {
+		http.Redirect(w, r, "/account?avatar_error=failed", http.StatusSeeOther)
+		return
+	}
+	keys := make([]string, 0, len(variants))
+	avatarURL := ""
+	for _, v := range variants {
+		key := v.Key(prefix)
+		url, err := h.store.Upload(r.Context(), key, bytes.NewReader(v.Data), v.ContentType)
+		if err != nil {
+			h.deleteStoredObjects(r.Context(), keys)
+			http.Redirect(w, r, "/account?avatar_error=failed", http.StatusSeeOther)
+			return
+		}
+		keys = append(keys, key)
+		// Sizes are ascending; the largest variant is the canonical URL.
+		avatarURL = url
+	}
+
+	previous, err := h.auth.Users().SetCustomAvatar(r.Context(), currentUser.ID, avatarURL, keys)
+	if err != nil {
+		h.deleteStoredObjects(r.Context(), keys)
+		http.Redirect(w, r, "/account?avatar_error=failed", http.StatusSeeOther)
+		return
+	}
+	h.deleteStoredObjects(r.Context(), previous)
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+func (h Handler) removeAvatar(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.CurrentUserFromRequest(r)
+	if currentUser == nil {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+	previous, err := h.auth.Users().ResetAvatar(r.Context(), currentUser.ID)
+	if err != nil {
+		http.Redirect(w, r, "/account?avatar_error=failed", http.StatusSeeOther)
+		return
+	}
+	h.deleteStoredObjects(r.Context(), previous)
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// deleteStoredObjects is best effort: an orphaned object only costs storage,
+// so failures are logged rather than surfaced to the user.
+func (h Handler) deleteStoredObjects(ctx context.Context, keys []string) {
+	if h.store == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := h.store.Delete(ctx, key); err != nil {
+			log.Printf("delete stored object %s: %v", key, err)
+		}
+	}
+}
+
+func avatarErrorMessage(code string) string {
+	switch strings.TrimSpace(code) {
+	case "missing":
+		return "Choose an image to upload."
+	case "too_large":
+		return "That image is too large. Use a file under 5 MB."
+	case "unsupported":
+		return "Avatars must be JPEG, PNG or GIF images."
+	case "unavailable":
+		return "Avatar uploads are not available right now."
+	case "failed":
+		return "Could not update your avatar. Please try again."
+	}
+	return ""
+}
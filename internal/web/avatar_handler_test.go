@@ -0,0 +1,52 @@
+package web
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/avatar"
+	"github.com/benpsk/go-starter/internal/storage"
+	"github.com/benpsk/go-starter/internal/user"
+)
+
+func TestUploadAvatarRejectsBadFiles(t *testing.T) {
+	t.Parallel()
+
+	store, err := storage.NewLocal(t.TempDir(), "http://127.0.0.1:8080", "/media")
+	if err != nil {
+		t.Fatalf("new local store: %v", err)
+	}
+	h := NewHandler(testConfig(), auth.NewService(nil, testConfig())).WithStorage(store)
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "oversized", data: make([]byte, MaxFormBytes), want: "/account?avatar_error=too_large"},
+		{name: "just over the image limit", data: make([]byte, avatar.MaxBytes+1), want: "/account?avatar_error=too_large"},
+		{name: "not an image", data: []byte("<svg onload=alert(1)>"), want: "/account?avatar_error=unsupported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			form := multipart.NewWriter(&body)
+			part, _ := form.CreateFormFile("avatar", "avatar.png")
+			_, _ = part.Write(tt.data)
+			_ = form.Close()
+
+			req := httptest.NewRequest(http.MethodPost, "/account/avatar", &body)
+			req.Header.Set("Content-Type", form.FormDataContentType())
+			req = req.WithContext(auth.ContextWithCurrentUser(req.Context(), &user.User{ID: 1}))
+			rec := httptest.NewRecorder()
+			h.uploadAvatar(rec, req)
+			if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != tt.want {
+				t.Fatalf("got %d %q, want redirect to %q", rec.Code, rec.Header().Get("Location"), tt.want)
+			}
+		})
+	}
+}
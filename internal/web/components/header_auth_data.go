@@ -4,4 +4,5 @@ type HeaderAuthData struct {
 	IsAuthenticated bool
 	DisplayName     string
 	AvatarURL       string
+	IsAdmin         bool
 }
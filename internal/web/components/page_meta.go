@@ -1,6 +1,9 @@
 package components
 
-import "strings"
+import (
+	"encoding/json"
+	"strings"
+)
 
 type PageMeta struct {
 	Title       string
@@ -55,3 +58,16 @@ func normalizePath(path string) string {
 func hasGoogleTagID(v string) bool {
 	return strings.TrimSpace(v) != ""
 }
+
+// htmxConfig tells htmx to put the CSP nonce on the request indicator
+// styles it inserts. It never runs scripts in swapped content: boosted
+// pages only need the layout's scripts, and handing them the nonce would
+// let injected markup run despite the CSP.
+func htmxConfig(nonce string) string {
+	cfg := map[string]any{"allowScriptTags": false}
+	if nonce != "" {
+		cfg["inlineStyleNonce"] = nonce
+	}
+	b, _ := json.Marshal(cfg)
+	return string(b)
+}
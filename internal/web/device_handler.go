@@ -0,0 +1,101 @@
+package web
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/abuse"
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/web/pages"
+)
+
+// devicePage is the verification URI of the device flow. It asks for the
+// code a CLI shows, then for approval once the code matches a waiting
+// device. Guests sign in first and come back with the code kept.
+func (h Handler) devicePage(w http.ResponseWriter, r *http.Request) {
+	if auth.CurrentUserFromRequest(r) == nil {
+		target := "/auth/login"
+		if auth.MFAPendingUserFromRequest(r) != nil {
+			target = "/auth/mfa"
+		}
+		http.Redirect(w, r, target+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	model := h.devicePageModel(r)
+	switch r.URL.Query().Get("result") {
+	case "approved":
+		model.Result = "Device approved. You can return to your terminal."
+		h.renderPage(w, r, pages.DevicePage(model))
+		return
+	case "denied":
+		model.Result = "Device denied. It will not be signed in."
+		h.renderPage(w, r, pages.DevicePage(model))
+		return
+	}
+	userCode := strings.TrimSpace(r.URL.Query().Get("user_code"))
+	if userCode == "" {
+		h.renderPage(w, r, pages.DevicePage(model))
+		return
+	}
+	pending, err := h.auth.PendingDeviceAuthorization(r.Context(), userCode, time.Now())
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidUserCode) {
+			h.invalidUserCode(w, r, userCode)
+			return
+		}
+		http.Error(w, "failed to load device", http.StatusInternalServerError)
+		return
+	}
+	model.UserCode = auth.FormatUserCode(pending.UserCode)
+	model.ClientID = pending.ClientID
+	h.renderPage(w, r, pages.DevicePage(model))
+}
+
+// decideDevice approves or denies the device waiting on user_code for the
+// signed-in user.
+func (h Handler) decideDevice(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.CurrentUserFromRequest(r)
+	approve := r.FormValue("decision") == "approve"
+	err := h.auth.DecideDeviceAuthorization(r.Context(), r.FormValue("user_code"), currentUser.ID, approve, time.Now())
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidUserCode) {
+			h.invalidUserCode(w, r, r.FormValue("user_code"))
+			return
+		}
+		log.Printf("device authorization: %v", err)
+		http.Error(w, "failed to update device", http.StatusInternalServerError)
+		return
+	}
+	result := "denied"
+	if approve {
+		result = "approved"
+	}
+	http.Redirect(w, r, "/device?result="+result, http.StatusSeeOther)
+}
+
+// invalidUserCode counts a wrong or expired user code towards an abuse ban,
+// since codes are short enough to guess, and asks for the code again. Links
+// from other sites are not counted: any page can send a signed-in user to
+// /device with a made-up code.
+func (h Handler) invalidUserCode(w http.ResponseWriter, r *http.Request, userCode string) {
+	if !auth.IsCrossSite(r) {
+		h.auth.Abuse().Report(r, abuse.DeviceCodeFailure)
+	}
+	model := h.devicePageModel(r)
+	model.UserCode = strings.TrimSpace(userCode)
+	model.Error = "That code is invalid or expired. Check the code shown in your terminal."
+	h.renderPageStatus(w, r, http.StatusUnprocessableEntity, pages.DevicePage(model))
+}
+
+func (h Handler) devicePageModel(r *http.Request) pages.DevicePageModel {
+	return pages.DevicePageModel{
+		AppName: h.appName,
+		AppURL:  h.appURL,
+		// No analytics here: page views would report the user code.
+		Auth: h.headerAuthData(r),
+	}
+}
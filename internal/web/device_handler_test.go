@@ -0,0 +1,77 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/auth"
+)
+
+func TestDevicePageApprovesDevice(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	cfg := testConfig()
+	cfg.Auth.API.AccessTokenSecret = "test-api-access-secret"
+	cfg.Auth.API.AccessTokenTTL = 10 * time.Minute
+	cfg.Auth.API.RefreshTokenTTL = 24 * time.Hour
+	cfg.Auth.API.DeviceClientIDs = []string{"starter-cli"}
+	authService := auth.NewService(integrationPool, cfg)
+	routes := Routes(NewHandler(cfg, authService), auth.NewRateLimiter(100, time.Minute))
+	u, sessionToken, _ := insertUserAndSession(t, ctx, authService.Users())
+	serve := func(method, target string, form url.Values, signedIn bool) *httptest.ResponseRecorder {
+		var req *http.Request
+		if form != nil {
+			req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, target, nil)
+		}
+		if signedIn {
+			req.AddCookie(&http.Cookie{Name: cfg.Auth.SessionCookieName, Value: sessionToken})
+		}
+		rec := httptest.NewRecorder()
+		authService.LoadSession(routes).ServeHTTP(rec, req.WithContext(ctx))
+		return rec
+	}
+
+	started, err := authService.StartDeviceAuthorization(ctx, "starter-cli", time.Now())
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	target := "/device?user_code=" + url.QueryEscape(started.UserCode)
+
+	rec := serve(http.MethodGet, target, nil, false)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/auth/login?next="+url.QueryEscape(target) {
+		t.Fatalf("guest: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = serve(http.MethodGet, "/device?user_code=BCDF-GHJK", nil, true)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "invalid or expired") {
+		t.Fatalf("unknown code: %d", rec.Code)
+	}
+
+	rec = serve(http.MethodGet, target, nil, true)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "starter-cli") || !strings.Contains(rec.Body.String(), `value="approve"`) {
+		t.Fatalf("confirm page: %d", rec.Code)
+	}
+
+	rec = serve(http.MethodPost, "/device", url.Values{"user_code": {started.UserCode}, "decision": {"approve"}}, true)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/device?result=approved" {
+		t.Fatalf("approve: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if _, err := authService.PendingDeviceAuthorization(ctx, started.UserCode, time.Now()); !errors.Is(err, auth.ErrInvalidUserCode) {
+		t.Fatalf("approved device still pending: %v", err)
+	}
+	signedIn, _, err := authService.ExchangeDeviceCode(ctx, started.DeviceCode, "starter-cli", auth.RequestMeta{IP: "127.0.0.1", UserAgent: "cli"}, time.Now())
+	if err != nil || signedIn.ID != u.ID {
+		t.Fatalf("exchange: %+v %v", signedIn, err)
+	}
+}
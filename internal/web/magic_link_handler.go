@@ -0,0 +1,78 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/abuse"
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/user"
+	"github.com/benpsk/go-starter/internal/web/pages"
+)
+
+// sendMagicLink emails a sign-in link. Every valid address gets the same
+// answer, so it does not reveal which ones have accounts.
+func (h Handler) sendMagicLink(w http.ResponseWriter, r *http.Request) {
+	err := h.auth.SendMagicLink(r.Context(), r.FormValue("email"), localRedirect(r.FormValue("next")), time.Now())
+	switch {
+	case errors.Is(err, auth.ErrInvalidEmail):
+		http.Redirect(w, r, "/auth/login?error=invalid_email", http.StatusSeeOther)
+	case err != nil:
+		log.Printf("magic link: %v", err)
+		http.Redirect(w, r, "/auth/login?error=magic_link_failed", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/auth/login?notice=magic_link_sent", http.StatusSeeOther)
+	}
+}
+
+// magicLinkPage asks to confirm the sign-in instead of signing in on GET,
+// so mail scanners that open links do not use them up.
+func (h Handler) magicLinkPage(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSpace(r.URL.Query().Get("token"))
+	if token == "" {
+		http.Redirect(w, r, "/auth/login?error=magic_link_invalid", http.StatusSeeOther)
+		return
+	}
+	model := pages.MagicLinkPageModel{
+		AppName: h.appName,
+		AppURL:  h.appURL,
+		// No analytics here: page views would report the token in the URL.
+		Auth:  h.headerAuthData(r),
+		Token: token,
+	}
+	h.renderPage(w, r, pages.MagicLinkPage(model))
+}
+
+func (h Handler) verifyMagicLink(w http.ResponseWriter, r *http.Request) {
+	var token, redirectTo string
+	var expiresAt time.Time
+	var mfaRequired bool
+	meta := auth.RequestMetaFromRequest(r)
+	err := h.auth.InTx(r.Context(), func(ctx context.Context) error {
+		u, next, err := h.auth.UseMagicLink(ctx, r.FormValue("token"), time.Now())
+		if err != nil {
+			return err
+		}
+		redirectTo = localRedirect(next)
+		token, expiresAt, mfaRequired, err = h.createSignInSession(ctx, u, meta)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrInvalidMagicLink):
+			h.auth.Abuse().Report(r, abuse.MagicLinkFailure)
+			http.Redirect(w, r, "/auth/login?error=magic_link_invalid", http.StatusSeeOther)
+		case errors.Is(err, user.ErrEmailConflict):
+			http.Redirect(w, r, "/auth/login?error=account_conflict", http.StatusSeeOther)
+		default:
+			log.Printf("magic link: %v", err)
+			http.Redirect(w, r, "/auth/login?error=oauth_failed", http.StatusSeeOther)
+		}
+		return
+	}
+	h.finishSignIn(w, r, token, expiresAt, mfaRequired, redirectTo)
+}
@@ -0,0 +1,128 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/postgres"
+)
+
+var magicLinkRe = regexp.MustCompile(`/auth/magic-link\?token=([A-Za-z0-9_-]+)`)
+
+func TestMagicLinkSignsInOnce(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	authService := testAuthService()
+	h := NewHandler(testConfig(), authService)
+	routes := Routes(h, auth.NewRateLimiter(100, time.Minute))
+	serve := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		var req *http.Request
+		if form != nil {
+			req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, target, nil)
+		}
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req.WithContext(ctx))
+		return rec
+	}
+
+	rec := serve(http.MethodPost, "/auth/magic-link", url.Values{"email": {"not an email"}})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/auth/login?error=invalid_email" {
+		t.Fatalf("invalid email: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	email := "magic+" + strconv.FormatInt(time.Now().UnixNano(), 10) + "@example.com"
+	rec = serve(http.MethodPost, "/auth/magic-link", url.Values{"email": {strings.ToUpper(email)}})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/auth/login?notice=magic_link_sent" {
+		t.Fatalf("send: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	token := sentMagicLinkToken(t, ctx, email)
+
+	rec = serve(http.MethodGet, "/auth/magic-link?token="+token, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `value="`+token+`"`) {
+		t.Fatalf("confirm page: %d", rec.Code)
+	}
+	rec = serve(http.MethodPost, "/auth/magic-link/verify", url.Values{"token": {token}})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/account" {
+		t.Fatalf("verify: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	created := sessionUserFromCookie(t, ctx, authService, rec)
+	if created.Email != email || created.DisplayName != strings.Split(email, "@")[0] {
+		t.Fatalf("created user = %+v", created)
+	}
+
+	rec = serve(http.MethodPost, "/auth/magic-link/verify", url.Values{"token": {token}})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/auth/login?error=magic_link_invalid" {
+		t.Fatalf("reused link: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// A second link signs in to the same account.
+	serve(http.MethodPost, "/auth/magic-link", url.Values{"email": {email}})
+	rec = serve(http.MethodPost, "/auth/magic-link/verify", url.Values{"token": {sentMagicLinkToken(t, ctx, email)}})
+	if again := sessionUserFromCookie(t, ctx, authService, rec); again.ID != created.ID {
+		t.Fatalf("second sign-in as %d, want %d", again.ID, created.ID)
+	}
+}
+
+func TestMagicLinkUsesAccountWithVerifiedEmail(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	authService := testAuthService()
+	routes := Routes(NewHandler(testConfig(), authService), auth.NewRateLimiter(100, time.Minute))
+	existing, _, _ := insertUserAndSession(t, ctx, authService.Users())
+
+	if err := authService.SendMagicLink(ctx, existing.Email, "/account", time.Now()); err != nil {
+		t.Fatalf("send magic link: %v", err)
+	}
+	form := url.Values{"token": {sentMagicLinkToken(t, ctx, existing.Email)}}
+	req := httptest.NewRequest(http.MethodPost, "/auth/magic-link/verify", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, req.WithContext(ctx))
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/account" {
+		t.Fatalf("verify: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if signedIn := sessionUserFromCookie(t, ctx, authService, rec); signedIn.ID != existing.ID {
+		t.Fatalf("signed in as %d, want existing user %d", signedIn.ID, existing.ID)
+	}
+	identities, err := authService.Users().ListIdentitiesByUserID(ctx, existing.ID)
+	if err != nil || len(identities) != 2 {
+		t.Fatalf("expected the email identity to be linked: %+v %v", identities, err)
+	}
+}
+
+func sentMagicLinkToken(t *testing.T, ctx context.Context, email string) string {
+	t.Helper()
+	var text string
+	err := postgres.DBFromContext(ctx, integrationPool).QueryRow(ctx, `
+		select text_body
+		from mail_outbox
+		where $1 = any(to_addresses)
+		order by id desc
+		limit 1
+	`, email).Scan(&text)
+	if err != nil {
+		t.Fatalf("find magic link email: %v", err)
+	}
+	m := magicLinkRe.FindStringSubmatch(text)
+	if m == nil {
+		t.Fatalf("no magic link in %q", text)
+	}
+	return m[1]
+}
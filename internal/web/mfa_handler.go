@@ -0,0 +1,163 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/abuse"
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/user"
+	"github.com/benpsk/go-starter/internal/web/pages"
+)
+
+func (h Handler) mfaPage(w http.ResponseWriter, r *http.Request) {
+	h.renderMFAChallenge(w, r, http.StatusOK, "")
+}
+
+func (h Handler) renderMFAChallenge(w http.ResponseWriter, r *http.Request, status int, errMessage string) {
+	model := pages.MFAChallengePageModel{
+		AppName:     h.appName,
+		AppURL:      h.appURL,
+		GoogleTagID: h.googleTagID,
+		Auth:        h.headerAuthData(r),
+		Next:        localRedirect(r.FormValue("next")),
+		Error:       errMessage,
+	}
+	h.renderPageStatus(w, r, status, pages.MFAChallengePage(model))
+}
+
+// verifyMFA checks the second factor of a pending session and swaps it for
+// a fully signed-in one.
+func (h Handler) verifyMFA(w http.ResponseWriter, r *http.Request) {
+	pendingUser := auth.MFAPendingUserFromRequest(r)
+	now := time.Now()
+	if err := h.auth.VerifyMFA(r.Context(), pendingUser.ID, r.FormValue("code"), now); err != nil {
+		if errors.Is(err, auth.ErrInvalidMFACode) {
+			h.auth.Abuse().Report(r, abuse.MFAFailure)
+			h.renderMFAChallenge(w, r, http.StatusUnprocessableEntity, "That code is not valid. Try again or use a recovery code.")
+			return
+		}
+		h.renderMFAChallenge(w, r, http.StatusInternalServerError, "Could not check your code. Please try again.")
+		return
+	}
+	token, expiresAt, err := h.auth.CompleteMFASession(r.Context(), h.auth.SessionTokenFromRequest(r), now)
+	if err != nil {
+		http.Redirect(w, r, "/auth/login?error=oauth_failed", http.StatusSeeOther)
+		return
+	}
+	h.auth.SetSessionCookie(w, r, token, expiresAt)
+	http.Redirect(w, r, localRedirect(r.FormValue("next")), http.StatusSeeOther)
+}
+
+func (h Handler) beginMFAEnrollment(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.CurrentUserFromRequest(r)
+	enrollment, err := h.auth.BeginMFAEnrollment(r.Context(), *currentUser)
+	if err != nil {
+		switch {
+		case errors.Is(err, user.ErrMFAEnabled):
+			http.Redirect(w, r, "/account?mfa_error=enabled", http.StatusSeeOther)
+		case errors.Is(err, auth.ErrMFAUnavailable):
+			http.Redirect(w, r, "/account?mfa_error=unavailable", http.StatusSeeOther)
+		default:
+			http.Redirect(w, r, "/account?mfa_error=failed", http.StatusSeeOther)
+		}
+		return
+	}
+	h.renderMFASetup(w, r, http.StatusOK, enrollment, "")
+}
+
+func (h Handler) renderMFASetup(w http.ResponseWriter, r *http.Request, status int, enrollment auth.MFAEnrollment, errMessage string) {
+	w.Header().Set("Cache-Control", "no-store")
+	model := pages.MFASetupPageModel{
+		AppName:     h.appName,
+		AppURL:      h.appURL,
+		GoogleTagID: h.googleTagID,
+		Auth:        h.headerAuthData(r),
+		Secret:      enrollment.Secret,
+		URI:         enrollment.URI,
+		Error:       errMessage,
+	}
+	h.renderPageStatus(w, r, status, pages.MFASetupPage(model))
+}
+
+func (h Handler) confirmMFAEnrollment(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.CurrentUserFromRequest(r)
+	codes, err := h.auth.ConfirmMFAEnrollment(r.Context(), currentUser.ID, r.FormValue("code"), time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrInvalidMFACode):
+			enrollment, err := h.auth.PendingMFAEnrollment(r.Context(), *currentUser)
+			if err != nil {
+				http.Redirect(w, r, "/account?mfa_error=failed", http.StatusSeeOther)
+				return
+			}
+			h.renderMFASetup(w, r, http.StatusUnprocessableEntity, enrollment, "That code is not valid. Check the time on your device and try again.")
+		case errors.Is(err, user.ErrMFAEnabled):
+			http.Redirect(w, r, "/account?mfa_error=enabled", http.StatusSeeOther)
+		default:
+			http.Redirect(w, r, "/account?mfa_error=failed", http.StatusSeeOther)
+		}
+		return
+	}
+	h.renderRecoveryCodes(w, r, codes)
+}
+
+func (h Handler) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.CurrentUserFromRequest(r)
+	codes, err := h.auth.RegenerateRecoveryCodes(r.Context(), currentUser.ID, r.FormValue("code"), time.Now())
+	if err != nil {
+		h.accountMFAFailed(w, r, err)
+		return
+	}
+	h.renderRecoveryCodes(w, r, codes)
+}
+
+func (h Handler) disableMFA(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.CurrentUserFromRequest(r)
+	if err := h.auth.DisableMFA(r.Context(), currentUser.ID, r.FormValue("code"), time.Now()); err != nil {
+		h.accountMFAFailed(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/account#mfa", http.StatusSeeOther)
+}
+
+func (h Handler) accountMFAFailed(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, auth.ErrInvalidMFACode) {
+		h.auth.Abuse().Report(r, abuse.MFAFailure)
+		http.Redirect(w, r, "/account?mfa_error=invalid_code#mfa", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/account?mfa_error=failed#mfa", http.StatusSeeOther)
+}
+
+// renderRecoveryCodes shows freshly generated recovery codes. They are
+// stored hashed, so this is the only time the user sees them.
+func (h Handler) renderRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string) {
+	w.Header().Set("Cache-Control", "no-store")
+	model := pages.RecoveryCodesPageModel{
+		AppName:     h.appName,
+		AppURL:      h.appURL,
+		GoogleTagID: h.googleTagID,
+		Auth:        h.headerAuthData(r),
+		Codes:       codes,
+	}
+	h.renderPage(w, r, pages.RecoveryCodesPage(model))
+}
+
+func mfaErrorMessage(code string) string {
+	switch strings.TrimSpace(code) {
+	case "invalid_code":
+		return "That code is not valid."
+	case "enabled":
+		return "Two-factor authentication is already on."
+	case "unavailable":
+		return "Two-factor authentication is not available right now."
+	case "failed":
+		return "Could not update two-factor authentication. Please try again."
+	case "admin_required":
+		return "Turn on two-factor authentication to open admin pages."
+	}
+	return ""
+}
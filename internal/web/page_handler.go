@@ -1,7 +1,10 @@
 package web
 
 import (
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/a-h/templ"
 	"github.com/benpsk/go-starter/internal/auth"
@@ -41,6 +44,21 @@ func (h Handler) methodNotAllowedPage(w http.ResponseWriter, r *http.Request) {
 	h.renderPageStatus(w, r, http.StatusMethodNotAllowed, pages.MethodNotAllowedPage(h.appName, h.appURL, h.googleTagID, h.headerAuthData(r)))
 }
 
+// Banned renders the page for clients blocked by the abuse detector. until
+// is zero for deny rules.
+func (h Handler) Banned(w http.ResponseWriter, r *http.Request, until time.Time) {
+	label := ""
+	if !until.IsZero() {
+		label = until.UTC().Format("15:04 MST on Jan 2")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+	}
+	if auth.IsHtmx(r) {
+		h.renderPageStatus(w, r, http.StatusForbidden, components.Content("Access Blocked | "+h.appName, pages.BannedContent(label)))
+		return
+	}
+	h.renderPageStatus(w, r, http.StatusForbidden, pages.BannedPage(h.appName, h.appURL, h.googleTagID, components.HeaderAuthData{}, label))
+}
+
 func (h Handler) renderPage(w http.ResponseWriter, r *http.Request, component templ.Component) {
 	h.renderPageStatus(w, r, http.StatusOK, component)
 }
@@ -66,5 +84,6 @@ func (h Handler) headerAuthData(r *http.Request) components.HeaderAuthData {
 		IsAuthenticated: true,
 		DisplayName:     name,
 		AvatarURL:       currentUser.AvatarURL,
+		IsAdmin:         h.auth.IsAdmin(currentUser),
 	}
 }
@@ -0,0 +1,42 @@
+package pages
+
+import (
+	"time"
+
+	"github.com/benpsk/go-starter/internal/scheduler"
+	"github.com/benpsk/go-starter/internal/web/components"
+)
+
+type SchedulerPageModel struct {
+	AppName     string
+	AppURL      string
+	GoogleTagID string
+	Auth        components.HeaderAuthData
+	Tasks       []scheduler.TaskStatus
+	Runs        []scheduler.Run
+}
+
+func formatRunTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05 UTC")
+}
+
+func formatRunDuration(run scheduler.Run) string {
+	if run.FinishedAt == nil {
+		return "—"
+	}
+	if run.Duration < time.Second {
+		return run.Duration.String()
+	}
+	return run.Duration.Round(100 * time.Millisecond).String()
+}
+
+func runStatusBadge(status scheduler.RunStatus) string {
+	switch status {
+	case scheduler.RunSucceeded:
+		return "badge badge-success"
+	case scheduler.RunFailed:
+		return "badge badge-error"
+	default:
+		return "badge badge-info"
+	}
+}
@@ -1,6 +1,10 @@
 package pages
 
 import (
+	"strconv"
+	"time"
+
+	"github.com/a-h/templ"
 	"github.com/benpsk/go-starter/internal/user"
 	"github.com/benpsk/go-starter/internal/web/components"
 )
@@ -11,8 +15,35 @@ type LoginPageModel struct {
 	GoogleTagID   string
 	Auth          components.HeaderAuthData
 	Error         string
+	Notice        string
 	GoogleEnabled bool
 	GitHubEnabled bool
+	// Next is where to go after signing in, kept across the sign-in forms.
+	Next string
+
+	PasskeysEnabled bool
+}
+
+// MagicLinkPageModel confirms a sign-in with the emailed link's Token.
+type MagicLinkPageModel struct {
+	AppName     string
+	AppURL      string
+	GoogleTagID string
+	Auth        components.HeaderAuthData
+	Token       string
+}
+
+// DevicePageModel approves a device flow sign-in. Without a ClientID it
+// asks for the UserCode; Result is set once the user decided.
+type DevicePageModel struct {
+	AppName     string
+	AppURL      string
+	GoogleTagID string
+	Auth        components.HeaderAuthData
+	UserCode    string
+	ClientID    string
+	Error       string
+	Result      string
 }
 
 type AccountPageModel struct {
@@ -22,4 +53,78 @@ type AccountPageModel struct {
 	Auth        components.HeaderAuthData
 	User        user.User
 	Identities  []user.Identity
+	AvatarError string
+	// SecurityEvents is the security feed, newest first.
+	SecurityEvents []user.SecurityEvent
+
+	MFAAvailable         bool
+	MFAEnabled           bool
+	MFARecoveryCodesLeft int
+	MFAError             string
+
+	PasskeysEnabled bool
+	Passkeys        []user.Passkey
+	PasskeyError    string
+}
+
+type MFAChallengePageModel struct {
+	AppName     string
+	AppURL      string
+	GoogleTagID string
+	Auth        components.HeaderAuthData
+	// Next is where to go once the code is accepted.
+	Next  string
+	Error string
+}
+
+// MFASetupPageModel shows a pending authenticator secret. URI is the
+// otpauth:// provisioning URI authenticator apps import.
+type MFASetupPageModel struct {
+	AppName     string
+	AppURL      string
+	GoogleTagID string
+	Auth        components.HeaderAuthData
+	Secret      string
+	URI         string
+	Error       string
+}
+
+type RecoveryCodesPageModel struct {
+	AppName     string
+	AppURL      string
+	GoogleTagID string
+	Auth        components.HeaderAuthData
+	Codes       []string
+}
+
+func formatEventTime(t time.Time) string {
+	return t.UTC().Format("Jan 2, 2006 15:04 UTC")
+}
+
+func reportSignInURL(eventID int64) templ.SafeURL {
+	return templ.SafeURL("/account/security/" + strconv.FormatInt(eventID, 10) + "/report")
+}
+
+func deletePasskeyURL(passkeyID int64) templ.SafeURL {
+	return templ.SafeURL("/account/passkeys/" + strconv.FormatInt(passkeyID, 10) + "/delete")
+}
+
+func passkeyLastUsed(p user.Passkey) string {
+	if p.LastUsedAt == nil {
+		return "Never used"
+	}
+	return "Last used " + formatEventTime(*p.LastUsedAt)
+}
+
+func eventClient(client string) string {
+	if client == "api" {
+		return "API sign-in"
+	}
+	return "Web sign-in"
+}
+
+// otpauthURL marks a provisioning URI built by the auth package as safe;
+// templ would otherwise replace the otpauth: scheme.
+func otpauthURL(uri string) templ.SafeURL {
+	return templ.SafeURL(uri)
 }
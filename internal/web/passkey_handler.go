@@ -0,0 +1,214 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/abuse"
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/user"
+	"github.com/benpsk/go-starter/internal/webauthn"
+	"github.com/go-chi/chi/v5"
+)
+
+// passkeyBodyLimit comfortably fits a WebAuthn response with an RSA key.
+const passkeyBodyLimit = 64 << 10
+
+const maxDisplayNameLength = 100
+
+// The passkey endpoints are called by app.js around navigator.credentials:
+// .../options returns the JSON options for create() or get(), and the
+// endpoint without /options takes the credential's toJSON() result.
+
+func (h Handler) passkeyLoginOptions(w http.ResponseWriter, r *http.Request) {
+	opts, err := h.auth.BeginPasskeyLogin(time.Now())
+	if err != nil {
+		h.passkeyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, opts)
+}
+
+func (h Handler) passkeyLogin(w http.ResponseWriter, r *http.Request) {
+	var resp webauthn.AssertionResponse
+	if !decodePasskeyJSON(w, r, &resp) {
+		return
+	}
+	currentUser, err := h.auth.FinishPasskeyLogin(r.Context(), resp, time.Now())
+	if err != nil {
+		h.passkeyFailed(w, r, err)
+		return
+	}
+	h.startPasskeySession(w, r, currentUser)
+}
+
+func (h Handler) passkeySignupOptions(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DisplayName string `json:"display_name"`
+	}
+	if !decodePasskeyJSON(w, r, &req) {
+		return
+	}
+	name := strings.TrimSpace(req.DisplayName)
+	if name == "" || len([]rune(name)) > maxDisplayNameLength {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Enter a name of up to 100 characters."})
+		return
+	}
+	opts, err := h.auth.BeginPasskeySignup(name, time.Now())
+	if err != nil {
+		h.passkeyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, opts)
+}
+
+// passkeySignup creates an account from a new passkey and signs it in.
+func (h Handler) passkeySignup(w http.ResponseWriter, r *http.Request) {
+	var resp webauthn.RegistrationResponse
+	if !decodePasskeyJSON(w, r, &resp) {
+		return
+	}
+	created, err := h.auth.FinishPasskeyRegistration(r.Context(), nil, resp, auth.RequestMetaFromRequest(r), time.Now())
+	if err != nil {
+		h.passkeyFailed(w, r, err)
+		return
+	}
+	h.startPasskeySession(w, r, created)
+}
+
+// startPasskeySession signs in u. Passkeys require user verification, so
+// they count as two factors and skip the TOTP challenge.
+func (h Handler) startPasskeySession(w http.ResponseWriter, r *http.Request, u user.User) {
+	var token string
+	var expiresAt time.Time
+	meta := auth.RequestMetaFromRequest(r)
+	err := h.auth.InTx(r.Context(), func(ctx context.Context) error {
+		if err := h.auth.RecordSignIn(ctx, u, meta, auth.ClientWeb); err != nil {
+			return err
+		}
+		var err error
+		token, expiresAt, err = h.auth.CreateSession(ctx, u, meta)
+		return err
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Could not sign you in. Please try again."})
+		return
+	}
+	h.auth.SetSessionCookie(w, r, token, expiresAt)
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": localRedirect(r.URL.Query().Get("next"))})
+}
+
+// addPasskeyOptions starts adding a passkey. With two-factor
+// authentication on the request carries a code, since the new passkey
+// could sign in without one.
+func (h Handler) addPasskeyOptions(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.CurrentUserFromRequest(r)
+	var req struct {
+		Code string `json:"code"`
+	}
+	if !decodePasskeyJSON(w, r, &req) {
+		return
+	}
+	opts, err := h.auth.BeginPasskeyRegistration(r.Context(), *currentUser, req.Code, time.Now())
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidMFACode) {
+			if strings.TrimSpace(req.Code) != "" {
+				h.auth.Abuse().Report(r, abuse.MFAFailure)
+			}
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Enter a current code from your authenticator app or a recovery code."})
+			return
+		}
+		h.passkeyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, opts)
+}
+
+func (h Handler) addPasskey(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.CurrentUserFromRequest(r)
+	var resp webauthn.RegistrationResponse
+	if !decodePasskeyJSON(w, r, &resp) {
+		return
+	}
+	if _, err := h.auth.FinishPasskeyRegistration(r.Context(), currentUser, resp, auth.RequestMetaFromRequest(r), time.Now()); err != nil {
+		h.passkeyFailed(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": "/account#passkeys"})
+}
+
+func (h Handler) deletePasskey(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.CurrentUserFromRequest(r)
+	passkeyID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || passkeyID <= 0 {
+		h.NotFound(w, r)
+		return
+	}
+	if err := h.auth.DeletePasskey(r.Context(), currentUser.ID, passkeyID); err != nil {
+		switch {
+		case errors.Is(err, user.ErrNotFound):
+			h.NotFound(w, r)
+		case errors.Is(err, auth.ErrLastSignInMethod):
+			http.Redirect(w, r, "/account?passkey_error=last#passkeys", http.StatusSeeOther)
+		default:
+			http.Redirect(w, r, "/account?passkey_error=failed#passkeys", http.StatusSeeOther)
+		}
+		return
+	}
+	http.Redirect(w, r, "/account#passkeys", http.StatusSeeOther)
+}
+
+// passkeyFailed answers a rejected create() or get() response. Responses
+// that fail verification count towards an abuse ban.
+func (h Handler) passkeyFailed(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, auth.ErrPasskeyFailed):
+		h.auth.Abuse().Report(r, abuse.PasskeyFailure)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "That passkey could not be verified. Please try again."})
+	case errors.Is(err, user.ErrPasskeyExists):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "That passkey is already registered."})
+	default:
+		h.passkeyError(w, err)
+	}
+}
+
+func (h Handler) passkeyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrPasskeyUnavailable) {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "Passkeys are not available right now."})
+		return
+	}
+	log.Printf("passkey: %v", err)
+	writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Something went wrong. Please try again."})
+}
+
+func decodePasskeyJSON(w http.ResponseWriter, r *http.Request, dst any) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, passkeyBodyLimit)
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request."})
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func passkeyErrorMessage(code string) string {
+	switch strings.TrimSpace(code) {
+	case "last":
+		return "This passkey is the only way to sign in to your account, so it cannot be removed."
+	case "failed":
+		return "Could not remove the passkey. Please try again."
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/auth"
+	"github.com/benpsk/go-starter/internal/user"
+	"github.com/benpsk/go-starter/internal/webauthn"
+	"github.com/benpsk/go-starter/internal/webauthn/webauthntest"
+)
+
+const passkeyOrigin = "http://127.0.0.1:8080"
+
+func TestPasskeySignUpSignInAndRemove(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	authService := testAuthService()
+	h := NewHandler(testConfig(), authService)
+	routes := Routes(h, auth.NewRateLimiter(100, time.Minute))
+	post := func(path string, body any, currentUser *user.User) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		reqCtx := ctx
+		if currentUser != nil {
+			reqCtx = auth.ContextWithCurrentUser(ctx, currentUser)
+		}
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data)).WithContext(reqCtx)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:128.0) Gecko/20100101 Firefox/128.0")
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+	a := webauthntest.New()
+
+	rec := post("/auth/passkey/signup/options", map[string]string{"display_name": "Ada"}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("signup options: %d %s", rec.Code, rec.Body)
+	}
+	var creation webauthn.CreationOptions
+	decodeTestJSON(t, rec, &creation)
+	if creation.RP.ID != "127.0.0.1" || creation.User.DisplayName != "Ada" {
+		t.Fatalf("creation options = %+v", creation)
+	}
+	rec = post("/auth/passkey/signup", a.Register(creation, passkeyOrigin), nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"redirect":"/"`) {
+		t.Fatalf("signup: %d %s", rec.Code, rec.Body)
+	}
+	u := sessionUserFromCookie(t, ctx, authService, rec)
+	if u.DisplayName != "Ada" {
+		t.Fatalf("signed up user = %+v", u)
+	}
+	passkeys, err := authService.Passkeys(ctx, u.ID)
+	if err != nil || len(passkeys) != 1 || passkeys[0].Name != "Firefox on Windows" {
+		t.Fatalf("passkeys after signup: %+v %v", passkeys, err)
+	}
+
+	signIn := func() *httptest.ResponseRecorder {
+		rec := post("/auth/passkey/login/options", nil, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("login options: %d %s", rec.Code, rec.Body)
+		}
+		var request webauthn.RequestOptions
+		decodeTestJSON(t, rec, &request)
+		return post("/auth/passkey/login", a.Assert(request, passkeyOrigin), nil)
+	}
+	rec = signIn()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", rec.Code, rec.Body)
+	}
+	if signedIn := sessionUserFromCookie(t, ctx, authService, rec); signedIn.ID != u.ID {
+		t.Fatalf("signed in as %d, want %d", signedIn.ID, u.ID)
+	}
+
+	// A clone of the authenticator replays a counter that was already used.
+	a.SignCount--
+	if rec = signIn(); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a reused counter to be rejected, got %d %s", rec.Code, rec.Body)
+	}
+
+	deletePath := "/account/passkeys/" + strconv.FormatInt(passkeys[0].ID, 10) + "/delete"
+	rec = post(deletePath, nil, &u)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/account?passkey_error=last#passkeys" {
+		t.Fatalf("removing the last passkey: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// With a second passkey the first can go.
+	second := webauthntest.New()
+	rec = post("/account/passkeys/options", nil, &u)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("add options: %d %s", rec.Code, rec.Body)
+	}
+	decodeTestJSON(t, rec, &creation)
+	if len(creation.ExcludeCredentials) != 1 || !bytes.Equal(creation.User.ID, a.UserHandle) {
+		t.Fatalf("add options = %+v", creation)
+	}
+	if rec = post("/account/passkeys", second.Register(creation, passkeyOrigin), &u); rec.Code != http.StatusOK {
+		t.Fatalf("add passkey: %d %s", rec.Code, rec.Body)
+	}
+	if rec = post(deletePath, nil, &u); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/account#passkeys" {
+		t.Fatalf("remove passkey: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec = signIn(); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a removed passkey to be rejected, got %d", rec.Code)
+	}
+}
+
+func decodeTestJSON(t *testing.T, rec *httptest.ResponseRecorder, dst any) {
+	t.Helper()
+	if err := json.NewDecoder(rec.Body).Decode(dst); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+}
+
+func TestAddingPasskeyNeedsMFACode(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	cfg := testConfig()
+	cfg.Auth.MFAEncryptionKey = bytes.Repeat([]byte{7}, 32)
+	authService := auth.NewService(integrationPool, cfg)
+	routes := Routes(NewHandler(cfg, authService), auth.NewRateLimiter(100, time.Minute))
+	users := authService.Users()
+	u, _, _ := insertUserAndSession(t, ctx, users)
+	if _, err := authService.BeginMFAEnrollment(ctx, u); err != nil {
+		t.Fatalf("begin mfa: %v", err)
+	}
+	if err := users.ConfirmMFA(ctx, u.ID, 1, time.Now()); err != nil {
+		t.Fatalf("confirm mfa: %v", err)
+	}
+	if err := users.ReplaceRecoveryCodes(ctx, u.ID, []string{auth.HashToken("abcd2345efgh")}); err != nil {
+		t.Fatalf("recovery codes: %v", err)
+	}
+	options := func(code string) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(map[string]string{"code": code})
+		req := httptest.NewRequest(http.MethodPost, "/account/passkeys/options", bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req.WithContext(auth.ContextWithCurrentUser(ctx, &u)))
+		return rec
+	}
+
+	for _, code := range []string{"", "000000", "wxyz2345efgh"} {
+		if rec := options(code); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("code %q: expected 401, got %d %s", code, rec.Code, rec.Body)
+		}
+	}
+	if rec := options("ABCD-2345-EFGH"); rec.Code != http.StatusOK {
+		t.Fatalf("recovery code: %d %s", rec.Code, rec.Body)
+	}
+	if rec := options("ABCD-2345-EFGH"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("a used recovery code should not work again, got %d", rec.Code)
+	}
+}
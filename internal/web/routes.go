@@ -5,11 +5,15 @@ import (
 
 	"github.com/benpsk/go-starter/internal/auth"
 	"github.com/benpsk/go-starter/internal/config"
+	"github.com/benpsk/go-starter/internal/scheduler"
+	"github.com/benpsk/go-starter/internal/storage"
 	"github.com/go-chi/chi/v5"
 )
 
 type Handler struct {
 	auth        *auth.Service
+	store       storage.Store
+	scheduler   scheduler.Store
 	appName     string
 	appURL      string
 	googleTagID string
@@ -24,15 +28,50 @@ func NewHandler(cfg config.Config, authService *auth.Service) Handler {
 	}
 }
 
+// WithStorage enables avatar uploads backed by store.
+func (h Handler) WithStorage(store storage.Store) Handler {
+	h.store = store
+	return h
+}
+
+// WithScheduler enables the scheduled task admin page.
+func (h Handler) WithScheduler(store scheduler.Store) Handler {
+	h.scheduler = store
+	return h
+}
+
 func Routes(h Handler, limiter *auth.RateLimiter) chi.Router {
 	r := chi.NewRouter()
 	r.Get("/", h.homePage)
 	r.Get("/about", h.aboutPage)
 	r.With(h.auth.RequireGuest).Get("/auth/login", h.loginPage)
-	r.With(limiter.LimitByIP("web_oauth_start"), h.auth.RequireGuest).Post("/auth/login/{provider}", h.startSocialLogin)
+	r.With(limiter.Limit("web_oauth_start"), h.auth.RequireGuest).Post("/auth/login/{provider}", h.startSocialLogin)
 	r.With(h.auth.RequireGuest).Get("/auth/callback/{provider}", h.oauthCallback)
+	r.With(limiter.Limit("web_passkey"), h.auth.RequireGuest).Post("/auth/passkey/login/options", h.passkeyLoginOptions)
+	r.With(limiter.Limit("web_passkey"), h.auth.RequireGuest).Post("/auth/passkey/login", h.passkeyLogin)
+	r.With(limiter.Limit("web_passkey"), h.auth.RequireGuest).Post("/auth/passkey/signup/options", h.passkeySignupOptions)
+	r.With(limiter.Limit("web_passkey"), h.auth.RequireGuest).Post("/auth/passkey/signup", h.passkeySignup)
+	r.With(limiter.LimitByIP("web_magic_link"), limiter.LimitByEmail("web_magic_link_email"), h.auth.RequireGuest).Post("/auth/magic-link", h.sendMagicLink)
+	r.With(h.auth.RequireGuest).Get("/auth/magic-link", h.magicLinkPage)
+	r.With(limiter.LimitByIP("web_magic_link"), h.auth.RequireGuest).Post("/auth/magic-link/verify", h.verifyMagicLink)
+	r.With(h.auth.RequireMFAPending).Get("/auth/mfa", h.mfaPage)
+	r.With(limiter.Limit("web_mfa"), h.auth.RequireMFAPending).Post("/auth/mfa", h.verifyMFA)
+	r.With(h.auth.RequireMFAPending).Post("/auth/mfa/cancel", h.logout)
 	r.With(h.auth.RequireAuth).Get("/account", h.accountPage)
+	r.With(h.auth.RequireAuth).Post("/account/avatar", h.uploadAvatar)
+	r.With(h.auth.RequireAuth).Post("/account/avatar/delete", h.removeAvatar)
+	r.With(h.auth.RequireAuth).Post("/account/security/{id}/report", h.reportSignIn)
+	r.With(limiter.Limit("web_passkey"), h.auth.RequireAuth).Post("/account/passkeys/options", h.addPasskeyOptions)
+	r.With(limiter.Limit("web_passkey"), h.auth.RequireAuth).Post("/account/passkeys", h.addPasskey)
+	r.With(h.auth.RequireAuth).Post("/account/passkeys/{id}/delete", h.deletePasskey)
+	r.With(h.auth.RequireAuth).Post("/account/mfa/enroll", h.beginMFAEnrollment)
+	r.With(limiter.Limit("web_mfa"), h.auth.RequireAuth).Post("/account/mfa/confirm", h.confirmMFAEnrollment)
+	r.With(limiter.Limit("web_mfa"), h.auth.RequireAuth).Post("/account/mfa/recovery-codes", h.regenerateRecoveryCodes)
+	r.With(limiter.Limit("web_mfa"), h.auth.RequireAuth).Post("/account/mfa/disable", h.disableMFA)
+	r.With(limiter.Limit("web_device")).Get("/device", h.devicePage)
+	r.With(limiter.Limit("web_device"), h.auth.RequireAuth).Post("/device", h.decideDevice)
 	r.With(h.auth.RequireAuth).Post("/auth/logout", h.logout)
+	r.With(h.auth.RequireAuth, h.requireAdmin).Get("/admin/scheduler", h.schedulerPage)
 	return r
 }
 
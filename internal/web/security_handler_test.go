@@ -0,0 +1,83 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpsk/go-starter/internal/auth"
+)
+
+func TestNewDeviceSignInIsShownAndCanBeReported(t *testing.T) {
+	t.Parallel()
+
+	ctx, cleanup := withTx(t)
+	defer cleanup()
+
+	authService := testAuthService()
+	h := NewHandler(testConfig(), authService)
+	routes := Routes(h, auth.NewRateLimiter(10, time.Minute))
+	u, rawToken, sessionID := insertUserAndSession(t, ctx, authService.Users())
+
+	laptop := auth.RequestMeta{IP: "203.0.113.7", UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) Gecko/20100101 Firefox/127.0"}
+	phone := auth.RequestMeta{IP: "198.51.100.23", UserAgent: "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36"}
+	for _, meta := range []auth.RequestMeta{laptop, laptop, phone} {
+		if err := authService.RecordSignIn(ctx, u, meta, auth.ClientWeb); err != nil {
+			t.Fatalf("record sign-in: %v", err)
+		}
+	}
+	events, err := authService.SecurityEvents(ctx, u.ID)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("expected one new-device event: %+v err=%v", events, err)
+	}
+	if events[0].Device != "Chrome on Android" || events[0].IP != phone.IP {
+		t.Fatalf("unexpected event %+v", events[0])
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/account", nil).WithContext(auth.ContextWithCurrentUser(ctx, &u))
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("account page: %d", rec.Code)
+	}
+	for _, want := range []string{"Security activity", "New sign-in from Chrome on Android", "198.51.100.23", "This wasn&#39;t me"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected account page to contain %q", want)
+		}
+	}
+
+	report := func(id int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/account/security/"+strconv.FormatInt(id, 10)+"/report", nil)
+		req = req.WithContext(auth.ContextWithCurrentUser(ctx, &u))
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := report(events[0].ID + 1000000); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another user's event, got %d", rec.Code)
+	}
+	rec = report(events[0].ID)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/auth/login?notice=signed_out_everywhere" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	assertCookieCleared(t, rec, authService.SessionCookieName())
+
+	sess, _, err := authService.Users().FindSessionAndUserByTokenHash(ctx, auth.HashToken(rawToken))
+	if err != nil || sess.ID != sessionID || sess.RevokedAt == nil {
+		t.Fatalf("expected the session to be revoked: %+v err=%v", sess, err)
+	}
+	events, _ = authService.SecurityEvents(ctx, u.ID)
+	if events[0].ReportedAt == nil {
+		t.Fatal("expected the event to be marked reported")
+	}
+	// The reported device is forgotten, so signing in from it is flagged again.
+	if err := authService.RecordSignIn(ctx, u, phone, auth.ClientWeb); err != nil {
+		t.Fatalf("record sign-in: %v", err)
+	}
+	if events, _ = authService.SecurityEvents(ctx, u.ID); len(events) != 2 {
+		t.Fatalf("expected a second event, got %d", len(events))
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"os"
 	"testing"
 
-	"github.com/benpsk/go-starter/internal/config"
 	"github.com/benpsk/go-starter/internal/postgres"
 	"github.com/benpsk/go-starter/internal/testenv"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -20,54 +19,16 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
-	cfg, err := config.Load()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-
 	ctx := context.Background()
-	pool, err := postgres.Connect(ctx, cfg.Database)
+	pool, cleanup, err := testenv.OpenIsolatedDB(ctx, "web", testenv.Migrate)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	unlock, err := testenv.LockIntegrationDB(ctx, pool, 7202603)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-
-	if err := postgres.EnsureTable(ctx, pool); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-	if err := postgres.EnsureSeedTable(ctx, pool); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-	if err := postgres.ResetSchema(ctx, pool); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-	if err := postgres.EnsureTable(ctx, pool); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-	if err := postgres.EnsureSeedTable(ctx, pool); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-	if _, err := postgres.Apply(ctx, pool, "../../db/migrations"); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-
 	integrationPool = pool
 	code := m.Run()
-	unlock()
-	pool.Close()
+	cleanup()
 	os.Exit(code)
 }
 
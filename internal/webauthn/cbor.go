@@ -0,0 +1,128 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var errCBOR = errors.New("webauthn: malformed cbor")
+
+// maxCBORDepth bounds nesting so a hostile attestation cannot exhaust the
+// stack. WebAuthn structures nest three levels at most.
+const maxCBORDepth = 16
+
+// decodeCBOR decodes the first CBOR item in data and returns it with the
+// bytes that follow it. It handles the subset WebAuthn uses: integers,
+// byte and text strings, arrays, maps, booleans and null, all with
+// definite lengths. Integers decode to int64, maps to map[any]any.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, errCBOR
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBOR
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data[1:], nil
+		case 21:
+			return true, data[1:], nil
+		case 22:
+			return nil, data[1:], nil
+		}
+		return nil, nil, fmt.Errorf("%w: unsupported simple value %d", errCBOR, info)
+	}
+	arg, rest, err := cborArgument(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return int64(arg), rest, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(arg), rest, nil
+	case 2, 3:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBOR
+		}
+		value := rest[:arg]
+		if major == 3 {
+			return string(value), rest[arg:], nil
+		}
+		return append([]byte(nil), value...), rest[arg:], nil
+	case 4:
+		// Every item takes at least one byte.
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBOR
+		}
+		items := make([]any, 0, arg)
+		for range arg {
+			var item any
+			item, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5:
+		if arg > uint64(len(rest))/2 {
+			return nil, nil, errCBOR
+		}
+		m := make(map[any]any, arg)
+		for range arg {
+			var key, value any
+			key, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key", errCBOR)
+			}
+			value, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			if _, dup := m[key]; dup {
+				return nil, nil, fmt.Errorf("%w: duplicate map key", errCBOR)
+			}
+			m[key] = value
+		}
+		return m, rest, nil
+	}
+	return nil, nil, fmt.Errorf("%w: unsupported major type %d", errCBOR, major)
+}
+
+func cborArgument(data []byte) (uint64, []byte, error) {
+	info := data[0] & 0x1f
+	data = data[1:]
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	}
+	return 0, nil, errCBOR
+}
@@ -0,0 +1,42 @@
+package webauthn
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	t.Parallel()
+
+	// {1: 2, 3: -7, "a": h'0102', "b": [true, null]} followed by one byte.
+	data, _ := hex.DecodeString("a4010203266161420102616282f5f6ff")
+	item, rest, err := decodeCBOR(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	m := item.(map[any]any)
+	if m[int64(1)] != int64(2) || m[int64(3)] != int64(-7) || string(m["a"].([]byte)) != "\x01\x02" {
+		t.Fatalf("decoded %#v", m)
+	}
+	if list := m["b"].([]any); len(list) != 2 || list[0] != true || list[1] != nil {
+		t.Fatalf("decoded list %#v", list)
+	}
+	if len(rest) != 1 {
+		t.Fatalf("rest = %x", rest)
+	}
+
+	for _, bad := range []string{
+		"",
+		"5a00000010",         // byte string longer than the input
+		"9bffffffffffffffff", // array claiming 2^64-1 items
+		"a20101" + "0102",    // duplicate key
+		"a1f401",             // boolean map key
+		"1f",                 // indefinite length
+		"fb3ff0000000000000", // float
+	} {
+		data, _ := hex.DecodeString(bad)
+		if _, _, err := decodeCBOR(data); err == nil {
+			t.Errorf("decoded malformed %s", bad)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// COSE algorithm identifiers this package verifies.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// SupportedAlgorithms is sent as pubKeyCredParams, most preferred first.
+var SupportedAlgorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+var ErrUnsupportedKey = errors.New("webauthn: unsupported public key")
+
+// publicKey is a credential public key parsed from its COSE_Key encoding.
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+func parsePublicKey(cose []byte) (publicKey, error) {
+	item, rest, err := decodeCBOR(cose)
+	if err != nil {
+		return publicKey{}, err
+	}
+	m, ok := item.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return publicKey{}, ErrUnsupportedKey
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == AlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return publicKey{}, ErrUnsupportedKey
+		}
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return publicKey{}, ErrUnsupportedKey
+		}
+		return publicKey{alg: alg, key: key}, nil
+	case kty == 1 && alg == AlgEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return publicKey{}, ErrUnsupportedKey
+		}
+		return publicKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+	case kty == 3 && alg == AlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return publicKey{}, ErrUnsupportedKey
+		}
+		exponent := int(new(big.Int).SetBytes(e).Int64())
+		if exponent < 3 || exponent%2 == 0 {
+			return publicKey{}, ErrUnsupportedKey
+		}
+		return publicKey{alg: alg, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}}, nil
+	}
+	return publicKey{}, ErrUnsupportedKey
+}
+
+func (k publicKey) verify(data, signature []byte) bool {
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(key, digest[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
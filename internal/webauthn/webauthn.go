@@ -0,0 +1,405 @@
+// Package webauthn verifies passkey registrations and sign-ins (WebAuthn
+// Level 2) for a single relying party. It requests no attestation, so it
+// trusts the browser for the authenticator's make and model and only checks
+// what a login needs: the challenge, origin, relying party, user
+// verification and signature.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidResponse = errors.New("webauthn: invalid response")
+	// ErrSignCount means the authenticator's signature counter went
+	// backwards, which suggests a cloned credential.
+	ErrSignCount = errors.New("webauthn: signature counter did not increase")
+)
+
+// Timeout is how long the browser waits for the user; ceremony state should
+// be kept at least this long.
+const Timeout = 5 * time.Minute
+
+// Authenticator data flags.
+const (
+	flagUserPresent    = 0x01
+	flagUserVerified   = 0x04
+	flagBackupEligible = 0x08
+	flagBackedUp       = 0x10
+	flagAttestedData   = 0x40
+)
+
+// RelyingParty is this site as WebAuthn sees it. ID is the host name that
+// credentials are scoped to and Origins the page origins allowed to use
+// them.
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+// NewRelyingParty derives the relying party from the public app URL.
+func NewRelyingParty(appURL, name string) (RelyingParty, error) {
+	u, err := url.Parse(strings.TrimSpace(appURL))
+	if err != nil || u.Hostname() == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return RelyingParty{}, fmt.Errorf("webauthn: app url %q has no host", appURL)
+	}
+	return RelyingParty{
+		ID:      u.Hostname(),
+		Name:    name,
+		Origins: []string{u.Scheme + "://" + u.Host},
+	}, nil
+}
+
+// Credential is a registered passkey.
+type Credential struct {
+	ID []byte
+	// PublicKey is the COSE_Key encoding from the authenticator.
+	PublicKey      []byte
+	SignCount      uint32
+	Transports     []string
+	BackupEligible bool
+	BackedUp       bool
+}
+
+// User is the account a new credential is created for. Handle is the
+// opaque user.id the authenticator stores and returns on sign-in; it must
+// not contain personal information.
+type User struct {
+	Handle      []byte
+	Name        string
+	DisplayName string
+}
+
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// Bytes is binary data that JSON-encodes as unpadded base64url, the way
+// browsers encode it in PublicKeyCredential.toJSON().
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	// Some clients pad or use the standard alphabet.
+	s = strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(s), "=")
+	decoded, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         Bytes    `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// CreationOptions is the JSON form of PublicKeyCredentialCreationOptions.
+type CreationOptions struct {
+	Challenge Bytes `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          Bytes  `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey        string `json:"residentKey"`
+		RequireResidentKey bool   `json:"requireResidentKey"`
+		UserVerification   string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// RequestOptions is the JSON form of PublicKeyCredentialRequestOptions.
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	UserVerification string                 `json:"userVerification"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+}
+
+// CreationOptions asks for a discoverable, user-verified credential for u
+// that is not already one of exclude.
+func (rp RelyingParty) CreationOptions(challenge []byte, u User, exclude []Credential) CreationOptions {
+	var opts CreationOptions
+	opts.Challenge = challenge
+	opts.RP.ID = rp.ID
+	opts.RP.Name = rp.Name
+	opts.User.ID = u.Handle
+	opts.User.Name = u.Name
+	opts.User.DisplayName = u.DisplayName
+	for _, alg := range SupportedAlgorithms {
+		opts.PubKeyCredParams = append(opts.PubKeyCredParams, CredentialParameter{Type: "public-key", Alg: alg})
+	}
+	opts.Timeout = Timeout.Milliseconds()
+	opts.ExcludeCredentials = []CredentialDescriptor{}
+	for _, c := range exclude {
+		opts.ExcludeCredentials = append(opts.ExcludeCredentials, CredentialDescriptor{Type: "public-key", ID: c.ID, Transports: c.Transports})
+	}
+	opts.AuthenticatorSelection.ResidentKey = "required"
+	opts.AuthenticatorSelection.RequireResidentKey = true
+	opts.AuthenticatorSelection.UserVerification = "required"
+	opts.Attestation = "none"
+	return opts
+}
+
+// RequestOptions asks for any discoverable credential for this site, so
+// the user picks an account instead of typing a name.
+func (rp RelyingParty) RequestOptions(challenge []byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          Timeout.Milliseconds(),
+		UserVerification: "required",
+		AllowCredentials: []CredentialDescriptor{},
+	}
+}
+
+// RegistrationResponse is the JSON form of a PublicKeyCredential returned
+// by navigator.credentials.create().
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes    `json:"clientDataJSON"`
+		AttestationObject Bytes    `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the JSON form of a PublicKeyCredential returned by
+// navigator.credentials.get().
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AuthenticatorData Bytes `json:"authenticatorData"`
+		Signature         Bytes `json:"signature"`
+		UserHandle        Bytes `json:"userHandle"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+func parseClientData(raw []byte) (clientData, []byte, error) {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return clientData{}, nil, fmt.Errorf("%w: client data: %v", ErrInvalidResponse, err)
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return clientData{}, nil, fmt.Errorf("%w: client data challenge", ErrInvalidResponse)
+	}
+	return cd, challenge, nil
+}
+
+// Challenge returns the challenge the browser signed, for finding the
+// ceremony the response belongs to. It is not verified yet.
+func (r RegistrationResponse) Challenge() ([]byte, error) {
+	_, challenge, err := parseClientData(r.Response.ClientDataJSON)
+	return challenge, err
+}
+
+// Challenge returns the challenge the browser signed, for finding the
+// ceremony the response belongs to. It is not verified yet.
+func (r AssertionResponse) Challenge() ([]byte, error) {
+	_, challenge, err := parseClientData(r.Response.ClientDataJSON)
+	return challenge, err
+}
+
+func (rp RelyingParty) checkClientData(raw []byte, ceremony string, challenge []byte) error {
+	cd, got, err := parseClientData(raw)
+	if err != nil {
+		return err
+	}
+	if cd.Type != ceremony {
+		return fmt.Errorf("%w: client data type %q", ErrInvalidResponse, cd.Type)
+	}
+	if subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("%w: challenge mismatch", ErrInvalidResponse)
+	}
+	if !slices.Contains(rp.Origins, cd.Origin) || cd.CrossOrigin {
+		return fmt.Errorf("%w: origin %q", ErrInvalidResponse, cd.Origin)
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, fmt.Errorf("%w: authenticator data too short", ErrInvalidResponse)
+	}
+	ad := authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authenticatorData{}, fmt.Errorf("%w: attested credential data too short", ErrInvalidResponse)
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+		return authenticatorData{}, fmt.Errorf("%w: credential id", ErrInvalidResponse)
+	}
+	ad.credentialID = rest[:idLen]
+	rest = rest[idLen:]
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("%w: credential public key: %v", ErrInvalidResponse, err)
+	}
+	ad.publicKey = rest[:len(rest)-len(after)]
+	return ad, nil
+}
+
+func (rp RelyingParty) checkAuthenticatorData(ad authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return fmt.Errorf("%w: relying party id", ErrInvalidResponse)
+	}
+	if ad.flags&flagUserPresent == 0 || ad.flags&flagUserVerified == 0 {
+		return fmt.Errorf("%w: user was not verified", ErrInvalidResponse)
+	}
+	if ad.flags&flagBackedUp != 0 && ad.flags&flagBackupEligible == 0 {
+		return fmt.Errorf("%w: backup flags", ErrInvalidResponse)
+	}
+	return nil
+}
+
+// VerifyRegistration checks a create() response against the challenge
+// issued for it and returns the new credential.
+func (rp RelyingParty) VerifyRegistration(r RegistrationResponse, challenge []byte) (Credential, error) {
+	if r.Type != "public-key" {
+		return Credential{}, fmt.Errorf("%w: credential type %q", ErrInvalidResponse, r.Type)
+	}
+	if err := rp.checkClientData(r.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return Credential{}, err
+	}
+	item, rest, err := decodeCBOR(r.Response.AttestationObject)
+	if err != nil || len(rest) != 0 {
+		return Credential{}, fmt.Errorf("%w: attestation object", ErrInvalidResponse)
+	}
+	attestation, _ := item.(map[any]any)
+	rawAuthData, _ := attestation["authData"].([]byte)
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if err := rp.checkAuthenticatorData(ad); err != nil {
+		return Credential{}, err
+	}
+	if ad.credentialID == nil {
+		return Credential{}, fmt.Errorf("%w: no attested credential", ErrInvalidResponse)
+	}
+	if len(r.RawID) > 0 && !bytes.Equal(r.RawID, ad.credentialID) {
+		return Credential{}, fmt.Errorf("%w: credential id mismatch", ErrInvalidResponse)
+	}
+	if _, err := parsePublicKey(ad.publicKey); err != nil {
+		return Credential{}, err
+	}
+	return Credential{
+		ID:             bytes.Clone(ad.credentialID),
+		PublicKey:      bytes.Clone(ad.publicKey),
+		SignCount:      ad.signCount,
+		Transports:     r.Response.Transports,
+		BackupEligible: ad.flags&flagBackupEligible != 0,
+		BackedUp:       ad.flags&flagBackedUp != 0,
+	}, nil
+}
+
+// VerifyAssertion checks a get() response made with cred against the
+// challenge issued for it. It returns cred with the new signature counter
+// and backup state, to be stored for the next sign-in.
+func (rp RelyingParty) VerifyAssertion(r AssertionResponse, challenge []byte, cred Credential) (Credential, error) {
+	if r.Type != "public-key" {
+		return Credential{}, fmt.Errorf("%w: credential type %q", ErrInvalidResponse, r.Type)
+	}
+	if !bytes.Equal(r.RawID, cred.ID) {
+		return Credential{}, fmt.Errorf("%w: credential id mismatch", ErrInvalidResponse)
+	}
+	if err := rp.checkClientData(r.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return Credential{}, err
+	}
+	ad, err := parseAuthenticatorData(r.Response.AuthenticatorData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if err := rp.checkAuthenticatorData(ad); err != nil {
+		return Credential{}, err
+	}
+	key, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return Credential{}, err
+	}
+	clientDataHash := sha256.Sum256(r.Response.ClientDataJSON)
+	signed := append(bytes.Clone(r.Response.AuthenticatorData), clientDataHash[:]...)
+	if !key.verify(signed, r.Response.Signature) {
+		return Credential{}, fmt.Errorf("%w: bad signature", ErrInvalidResponse)
+	}
+	// Authenticators that do not count, like most synced passkeys, always
+	// report zero.
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return Credential{}, ErrSignCount
+	}
+	cred.SignCount = ad.signCount
+	cred.BackedUp = ad.flags&flagBackedUp != 0
+	return cred, nil
+}
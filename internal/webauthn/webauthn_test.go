@@ -0,0 +1,158 @@
+package webauthn_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/benpsk/go-starter/internal/webauthn"
+	"github.com/benpsk/go-starter/internal/webauthn/webauthntest"
+)
+
+const origin = "https://app.example.com"
+
+func testRP(t *testing.T) webauthn.RelyingParty {
+	t.Helper()
+	rp, err := webauthn.NewRelyingParty(origin+"/", "Example")
+	if err != nil {
+		t.Fatalf("relying party: %v", err)
+	}
+	return rp
+}
+
+func register(t *testing.T, rp webauthn.RelyingParty, a *webauthntest.Authenticator) webauthn.Credential {
+	t.Helper()
+	challenge, _ := webauthn.NewChallenge()
+	opts := rp.CreationOptions(challenge, webauthn.User{Handle: []byte("handle-1"), Name: "ada", DisplayName: "Ada"}, nil)
+	cred, err := rp.VerifyRegistration(a.Register(opts, origin), challenge)
+	if err != nil {
+		t.Fatalf("verify registration: %v", err)
+	}
+	return cred
+}
+
+func TestRegisterAndSignIn(t *testing.T) {
+	t.Parallel()
+
+	rp := testRP(t)
+	if rp.ID != "app.example.com" || rp.Origins[0] != origin {
+		t.Fatalf("relying party = %+v", rp)
+	}
+	a := webauthntest.New()
+	cred := register(t, rp, a)
+	if string(cred.ID) != string(a.CredentialID) || cred.SignCount != 1 {
+		t.Fatalf("credential = %+v", cred)
+	}
+
+	for want := uint32(2); want <= 3; want++ {
+		challenge, _ := webauthn.NewChallenge()
+		resp := a.Assert(rp.RequestOptions(challenge), origin)
+		got, err := resp.Challenge()
+		if err != nil || string(got) != string(challenge) {
+			t.Fatalf("response challenge = %x, %v", got, err)
+		}
+		if string(resp.Response.UserHandle) != "handle-1" {
+			t.Fatalf("user handle = %q", resp.Response.UserHandle)
+		}
+		cred, err = rp.VerifyAssertion(resp, challenge, cred)
+		if err != nil {
+			t.Fatalf("verify assertion: %v", err)
+		}
+		if cred.SignCount != want {
+			t.Fatalf("sign count = %d, want %d", cred.SignCount, want)
+		}
+	}
+}
+
+func TestRejectsBadAssertions(t *testing.T) {
+	t.Parallel()
+
+	rp := testRP(t)
+	a := webauthntest.New()
+	cred := register(t, rp, a)
+	challenge, _ := webauthn.NewChallenge()
+	other, _ := webauthn.NewChallenge()
+
+	cases := map[string]func() (webauthn.AssertionResponse, []byte){
+		"wrong challenge": func() (webauthn.AssertionResponse, []byte) {
+			return a.Assert(rp.RequestOptions(other), origin), challenge
+		},
+		"wrong origin": func() (webauthn.AssertionResponse, []byte) {
+			return a.Assert(rp.RequestOptions(challenge), "https://evil.example.com"), challenge
+		},
+		"wrong relying party": func() (webauthn.AssertionResponse, []byte) {
+			opts := rp.RequestOptions(challenge)
+			opts.RPID = "evil.example.com"
+			return a.Assert(opts, origin), challenge
+		},
+		"user not verified": func() (webauthn.AssertionResponse, []byte) {
+			a.Flags = 0x01
+			defer func() { a.Flags = 0x05 }()
+			return a.Assert(rp.RequestOptions(challenge), origin), challenge
+		},
+		"tampered signature": func() (webauthn.AssertionResponse, []byte) {
+			resp := a.Assert(rp.RequestOptions(challenge), origin)
+			resp.Response.Signature[len(resp.Response.Signature)-1] ^= 1
+			return resp, challenge
+		},
+		"other key": func() (webauthn.AssertionResponse, []byte) {
+			impostor := webauthntest.New()
+			impostor.CredentialID = a.CredentialID
+			impostor.SignCount = 100
+			return impostor.Assert(rp.RequestOptions(challenge), origin), challenge
+		},
+	}
+	for name, build := range cases {
+		resp, want := build()
+		if _, err := rp.VerifyAssertion(resp, want, cred); !errors.Is(err, webauthn.ErrInvalidResponse) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+}
+
+func TestSignCountMustIncrease(t *testing.T) {
+	t.Parallel()
+
+	rp := testRP(t)
+	a := webauthntest.New()
+	cred := register(t, rp, a)
+	cred.SignCount = 10
+	challenge, _ := webauthn.NewChallenge()
+	if _, err := rp.VerifyAssertion(a.Assert(rp.RequestOptions(challenge), origin), challenge, cred); !errors.Is(err, webauthn.ErrSignCount) {
+		t.Fatalf("err = %v, want ErrSignCount", err)
+	}
+
+	synced := webauthntest.New()
+	synced.SignCount = 0
+	cred = register(t, rp, synced)
+	for range 2 {
+		challenge, _ := webauthn.NewChallenge()
+		var err error
+		cred, err = rp.VerifyAssertion(synced.Assert(rp.RequestOptions(challenge), origin), challenge, cred)
+		if err != nil {
+			t.Fatalf("authenticator without a counter: %v", err)
+		}
+	}
+}
+
+func TestRejectsBadRegistrations(t *testing.T) {
+	t.Parallel()
+
+	rp := testRP(t)
+	challenge, _ := webauthn.NewChallenge()
+	opts := rp.CreationOptions(challenge, webauthn.User{Handle: []byte("h"), Name: "n", DisplayName: "n"}, nil)
+
+	resp := webauthntest.New().Register(opts, "https://evil.example.com")
+	if _, err := rp.VerifyRegistration(resp, challenge); !errors.Is(err, webauthn.ErrInvalidResponse) {
+		t.Errorf("wrong origin: %v", err)
+	}
+	a := webauthntest.New()
+	a.Flags = 0x01
+	if _, err := rp.VerifyRegistration(a.Register(opts, origin), challenge); !errors.Is(err, webauthn.ErrInvalidResponse) {
+		t.Errorf("user not verified: %v", err)
+	}
+	resp = webauthntest.New().Register(opts, origin)
+	resp.Response.AttestationObject = resp.Response.AttestationObject[:len(resp.Response.AttestationObject)-3]
+	if _, err := rp.VerifyRegistration(resp, challenge); !errors.Is(err, webauthn.ErrInvalidResponse) {
+		t.Errorf("truncated attestation: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+// Package webauthntest is a software passkey authenticator for tests. It
+// produces the same JSON a browser sends after navigator.credentials.create
+// and get, with an ES256 key and "none" attestation.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+
+	"github.com/benpsk/go-starter/internal/webauthn"
+)
+
+// Authenticator holds one credential. Fields may be changed between calls
+// to simulate misbehaving authenticators.
+type Authenticator struct {
+	Key          *ecdsa.PrivateKey
+	CredentialID []byte
+	UserHandle   []byte
+	// SignCount is sent with the next assertion and then incremented, unless
+	// it is zero, like a synced passkey that does not count.
+	SignCount uint32
+	// Flags overrides the authenticator data flags; by default the user is
+	// present and verified.
+	Flags byte
+}
+
+const defaultFlags = 0x01 | 0x04
+
+// New returns an authenticator with a fresh key and credential id that
+// counts signatures from 1.
+func New() *Authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return &Authenticator{Key: key, CredentialID: id, SignCount: 1, Flags: defaultFlags}
+}
+
+// Register answers creation options the way create() would on origin.
+func (a *Authenticator) Register(opts webauthn.CreationOptions, origin string) webauthn.RegistrationResponse {
+	a.UserHandle = opts.User.ID
+	clientData := a.clientData("webauthn.create", opts.Challenge, origin)
+
+	var attested []byte
+	attested = append(attested, make([]byte, 16)...) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.CredentialID)))
+	attested = append(attested, a.CredentialID...)
+	attested = append(attested, a.publicKeyCOSE()...)
+	authData := a.authenticatorData(opts.RP.ID, a.Flags|0x40, attested)
+
+	var resp webauthn.RegistrationResponse
+	resp.ID = base64.RawURLEncoding.EncodeToString(a.CredentialID)
+	resp.RawID = a.CredentialID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = clientData
+	resp.Response.AttestationObject = encodeCBOR(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authData,
+	})
+	resp.Response.Transports = []string{"internal"}
+	return resp
+}
+
+// Assert answers request options the way get() would on origin.
+func (a *Authenticator) Assert(opts webauthn.RequestOptions, origin string) webauthn.AssertionResponse {
+	clientData := a.clientData("webauthn.get", opts.Challenge, origin)
+	authData := a.authenticatorData(opts.RPID, a.Flags, nil)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), sha256Sum(clientData)...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.Key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+
+	var resp webauthn.AssertionResponse
+	resp.ID = base64.RawURLEncoding.EncodeToString(a.CredentialID)
+	resp.RawID = a.CredentialID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = clientData
+	resp.Response.AuthenticatorData = authData
+	resp.Response.Signature = signature
+	resp.Response.UserHandle = a.UserHandle
+	return resp
+}
+
+func (a *Authenticator) clientData(typ string, challenge []byte, origin string) []byte {
+	data, err := json.Marshal(map[string]any{
+		"type":        typ,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      origin,
+		"crossOrigin": false,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func (a *Authenticator) authenticatorData(rpID string, flags byte, attested []byte) []byte {
+	data := sha256Sum([]byte(rpID))
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.SignCount)
+	if a.SignCount != 0 {
+		a.SignCount++
+	}
+	return append(data, attested...)
+}
+
+func (a *Authenticator) publicKeyCOSE() []byte {
+	point, err := a.Key.PublicKey.Bytes()
+	if err != nil {
+		panic(err)
+	}
+	return encodeCBOR(map[int64]any{
+		1:  int64(2),  // kty: EC2
+		3:  int64(-7), // alg: ES256
+		-1: int64(1),  // crv: P-256
+		-2: point[1:33],
+		-3: point[33:],
+	})
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// encodeCBOR encodes the few types the authenticator needs. Map keys are
+// sorted so output is deterministic.
+func encodeCBOR(v any) []byte {
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := cborHead(5, uint64(len(v)))
+		for _, k := range keys {
+			out = append(out, encodeCBOR(k)...)
+			out = append(out, encodeCBOR(v[k])...)
+		}
+		return out
+	case map[int64]any:
+		keys := make([]int64, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		out := cborHead(5, uint64(len(v)))
+		for _, k := range keys {
+			out = append(out, encodeCBOR(k)...)
+			out = append(out, encodeCBOR(v[k])...)
+		}
+		return out
+	}
+	panic("webauthntest: cannot encode value")
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+}